@@ -5,19 +5,23 @@ package main
 
 import (
 	"context"
-	"flag"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/grandcat/zeroconf"
 )
 
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
 // interfaceNames Returns a list of interface names given a list of
 // net.Interface objects.
 func interfaceNames(intfs []net.Interface) []string {
@@ -30,11 +34,6 @@ func interfaceNames(intfs []net.Interface) []string {
 	return intfNames
 }
 
-// compareSEKey Compares the key parts of a zeroconf.ServiceEntry.
-func compareSEKey(a *zeroconf.ServiceEntry, b *zeroconf.ServiceEntry) bool {
-	return a.ServiceInstanceName() == b.ServiceInstanceName()
-}
-
 // compareSEEntry Compares the payload of a zeroconf.ServiceEntry.
 func compareSEEntry(a *zeroconf.ServiceEntry, b *zeroconf.ServiceEntry) bool {
 	if a.HostName != b.HostName {
@@ -52,23 +51,20 @@ func compareSEEntry(a *zeroconf.ServiceEntry, b *zeroconf.ServiceEntry) bool {
 	if len(a.Text) != len(b.Text) {
 		return false
 	} else {
-		for _, aEntry := range a.Text {
-			for _, bEntry := range b.Text {
-				if aEntry != bEntry {
-					return false
-				}
+		for index := range a.Text {
+			if a.Text[index] != b.Text[index] {
+				return false
 			}
 		}
 	}
 
+	// Addresses may be answered in any order.
 	if len(a.AddrIPv4) != len(b.AddrIPv4) {
 		return false
 	} else {
 		for _, aAddr := range a.AddrIPv4 {
-			for _, bAddr := range b.AddrIPv4 {
-				if !aAddr.Equal(bAddr) {
-					return false
-				}
+			if !containsIP(b.AddrIPv4, aAddr) {
+				return false
 			}
 		}
 	}
@@ -77,10 +73,8 @@ func compareSEEntry(a *zeroconf.ServiceEntry, b *zeroconf.ServiceEntry) bool {
 		return false
 	} else {
 		for _, aAddr := range a.AddrIPv6 {
-			for _, bAddr := range b.AddrIPv6 {
-				if !aAddr.Equal(bAddr) {
-					return false
-				}
+			if !containsIP(b.AddrIPv6, aAddr) {
+				return false
 			}
 		}
 	}
@@ -88,262 +82,1116 @@ func compareSEEntry(a *zeroconf.ServiceEntry, b *zeroconf.ServiceEntry) bool {
 	return true
 }
 
+// containsIP Returns true if ip is in ips.
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, candidate := range ips {
+		if candidate.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// errWatcherStopped is passed to the result processing of a browse which was
+// cut short because the watcher is stopping.
+var errWatcherStopped = errors.New("watcher stopped")
+
+// errRescanned is passed to the result processing of a browse which was cut
+// short to start another straight away.
+var errRescanned = errors.New("rescan requested")
+
 // watchZCGroups periodically browses the zeroconf multicast group(s) and notifies
-// group change events via the updates channel.
+// group change events on the updates bus.  If baselined is set the ADDs of
+// the first browse are marked as the baseline, and it's called once they've
+// been published.  Failed browses are retried with backoff, so it only
+// returns when told to exit.  An adaptive scan period is adjusted after
+// every browse, see browseTiming.adapt, and passed to adapted if it's set.
 func watchZCGroups(done chan error,
 	exit chan bool,
-	updates chan ServiceEntryChange,
+	rescan <-chan bool,
+	updates *eventBus,
 	service string,
 	domain string,
-	periodSecs uint,
-	ipver zeroconf.IPType,
-	intfs []net.Interface) {
-	var previousEntries []zeroconf.ServiceEntry
+	timing browseTiming,
+	browse browseFunc,
+	cache *resolveCache,
+	tracker *deviceTracker,
+	modify *modifyConfig,
+	known []zeroconf.ServiceEntry,
+	baselined func(),
+	adapted func(period time.Duration)) {
+	// Start from the services which were known when we last ran, any
+	// which have since gone are reported as removed after the first browse.
+	previousEntries := newEntrySet(known)
+	baseline := baselined != nil
+	endBaseline := func() {
+		if baseline {
+			baseline = false
+			baselined()
+		}
+	}
+	defer endBaseline()
 
+	// The names of the results of each browse are collected in seen, which
+	// is reused so that browses of a quiet network don't allocate.
+	seen := make(map[string]bool)
+	current := timing
+	wait := timing.startDelay()
+	var failures uint
 	for {
 		select {
-		case <-time.After(time.Duration(1) * time.Millisecond):
+		case <-time.After(wait):
 			// Wake up and browse the multicast group(s).
 			break
+		case <-rescan:
+			// Don't wait out a backoff when asked to rescan.
+			break
 		case <-exit:
 			// Received the exit signal from the exit channel.
 			done <- nil
 			return
 		}
 
-		resolver, err := zeroconf.NewResolver(zeroconf.SelectIPTraffic(ipver),
-			zeroconf.SelectIfaces(intfs))
-
-		if err != nil {
-			log.Fatalln("Failed to initialize resolver:", err.Error())
-			done <- err
-			return
-		}
-
 		entries := make(chan *zeroconf.ServiceEntry)
+		finished := make(chan error, 1)
+		processed := make(chan bool)
+		changed := false
 		go func(results <-chan *zeroconf.ServiceEntry,
-			prev *[]zeroconf.ServiceEntry) {
-			// Look at each result, if we've not seen this service before
-			// then signal an ADD via the update channel.
-			var entries []zeroconf.ServiceEntry
-			for entry := range results {
-				new_entry := true
-				for _, old_entry := range *prev {
-					if compareSEKey(&old_entry, entry) {
-						new_entry = false
-						if !compareSEEntry(&old_entry, entry) {
-							updates <- ServiceEntryChange{MODIFY,
-								time.Now().UTC(), *entry}
-						}
+			prev *entrySet) {
+			defer close(processed)
 
-						break
+			// Look at each result, services we've not seen before are
+			// held until the end of the browse as they may turn out to be
+			// a renamed device.
+			clear(seen)
+			var added []zeroconf.ServiceEntry
+			for entry := range results {
+				// Answers without address records would look like a
+				// MODIFY, complete them from the cache (or a lookup if
+				// the cached data is stale).
+				if len(entry.AddrIPv4) == 0 && len(entry.AddrIPv6) == 0 {
+					resolved, err := cache.resolve(entry.Instance,
+						entry.Service,
+						entry.Domain)
+					if err != nil {
+						slog.Warn("failed to resolve instance",
+							"instance", entry.Instance,
+							"err", err)
+					} else if resolved != nil {
+						entry.AddrIPv4 = resolved.AddrIPv4
+						entry.AddrIPv6 = resolved.AddrIPv6
 					}
+				} else {
+					cache.put(entry)
 				}
 
-				if new_entry {
-					*prev = append(*prev, *entry)
-					updates <- ServiceEntryChange{ADD, time.Now().UTC(), *entry}
+				// Differences which are all ignored update the entry
+				// without being reported.
+				if prev.compare(entry, seen, func(old_entry *zeroconf.ServiceEntry) {
+					if modify.modified(old_entry, entry) {
+						previous := *old_entry
+						updates.publish(ServiceEntryChange{
+							ChangeType: modify.changeType(old_entry, entry),
+							Timestamp:  time.Now().UTC(),
+							Entry:      *entry,
+							Previous:   &previous})
+						changed = true
+					}
+				}) {
+					added = append(added, *entry)
 				}
+			}
 
-				entries = append(entries, *entry)
+			// A browse which failed part way through doesn't say anything
+			// about which services have gone.
+			var removed []zeroconf.ServiceEntry
+			if err := <-finished; err == nil {
+				// Any of the old services which weren't in this update
+				// have gone.
+				removed = prev.removeUnseen(seen)
 			}
 
-			// Check if any of the old services were not in this update, if
-			// a service has gone then signal a REMOVE via the update channel.
-			for index := len(*prev) - 1; index >= 0; index-- {
-				found := false
-				for _, entry := range entries {
-					if compareSEKey(&entry, &((*prev)[index])) {
-						found = true
-						break
-					}
+			// A service which went while another from the same device
+			// appeared has been renamed, anything else is an ADD or a
+			// REMOVE.
+			if len(added) != 0 || len(removed) != 0 {
+				changed = true
+			}
+
+			renames := tracker.pairRenames(removed, added)
+			renamed := make(map[int]bool)
+			for index := range added {
+				change := ServiceEntryChange{ChangeType: ADD,
+					Timestamp: time.Now().UTC(),
+					Entry:     added[index],
+					Baseline:  baseline}
+				if r, ok := renames[index]; ok {
+					renamed[r] = true
+					change.ChangeType = RENAMED
+					change.Previous = &removed[r]
 				}
 
-				if !found {
-					updates <- ServiceEntryChange{REMOVE,
-						time.Now().UTC(),
-						(*prev)[index]}
-					*prev = append((*prev)[:index], (*prev)[index+1:]...)
+				updates.publish(change)
+			}
+
+			for index := range removed {
+				if !renamed[index] {
+					updates.publish(ServiceEntryChange{ChangeType: REMOVE,
+						Timestamp: time.Now().UTC(),
+						Entry:     removed[index]})
 				}
 			}
-		}(entries, &previousEntries)
+
+			cache.expire()
+		}(entries, previousEntries)
 
 		// Browse the group(s), updates are delivered via the entries channel
 		// and thus the anonymous goroutine above will be called to process
 		// found entries.
-		ctx, cancel := context.WithTimeout(context.Background(),
-			time.Second*time.Duration(periodSecs))
-		err = resolver.Browse(ctx, service, domain, entries)
+		wait = time.Millisecond
+		length, idle := current.next()
+		ctx, cancel := context.WithTimeout(context.Background(), length)
+		cut := make(chan error, 1)
+		watched := make(chan bool)
+		go func() {
+			defer close(watched)
+			select {
+			case <-ctx.Done():
+				break
+			case <-exit:
+				cut <- errWatcherStopped
+				cancel()
+				break
+			case <-rescan:
+				cut <- errRescanned
+				cancel()
+				break
+			}
+		}()
+
+		err := browse(ctx, service, domain, entries)
 		<-ctx.Done()
 		cancel()
-		if err != nil {
-			log.Fatalln("Failed to browse:", err.Error())
-			done <- err
-			return
+		<-watched
+		select {
+		case reason := <-cut:
+			// The results so far don't say which services have gone.
+			finished <- reason
+			<-processed
+			if reason == errWatcherStopped {
+				done <- nil
+				return
+			}
+
+			slog.Info("rescanning", "service", service, "domain", domain)
+			endBaseline()
+			continue
+		default:
+			break
 		}
+
+		finished <- err
+		<-processed
+		endBaseline()
+		if err == nil {
+			failures = 0
+			wait = idle
+			if next := current.adapt(timing, changed); next.period != current.period {
+				current = next
+				slog.Debug("scan period adapted",
+					"service", service,
+					"domain", domain,
+					"changed", changed,
+					"period", current.period)
+				if adapted != nil {
+					adapted(current.period)
+				}
+			}
+			continue
+		}
+
+		failures++
+		wait = timing.retry.backoff(failures)
+		var transient *transientBrowseError
+		if errors.As(err, &transient) {
+			slog.Warn("browse incomplete, will retry",
+				"service", service,
+				"domain", domain,
+				"retryIn", wait,
+				"err", err)
+			continue
+		}
+
+		slog.Error("failed to browse, will retry",
+			"service", service,
+			"domain", domain,
+			"failures", failures,
+			"retryIn", wait,
+			"err", err)
 	}
 }
 
-func main() {
-	var (
-		ipver      zeroconf.IPType
-		intfs      []net.Interface
-		err        error
-		zcnConfig  config
-		configFile = flag.String("config",
-			"zcnotify.toml",
-			"Configuration TOML file")
-	)
-
-	flag.Parse()
-	// Decode and parse the supplied config, if no config exists use sensible
-	// defaults.
-	if _, err := toml.DecodeFile(*configFile, &zcnConfig); err != nil {
-		log.Fatalln("failed to decode config file:", err.Error())
-	} else {
-		if len(zcnConfig.Interfaces.Ip) == 0 {
-			// Default to v4 and v6 if not specified.
-			ipver = zeroconf.IPv4AndIPv6
-		} else {
-			// Which ip versions can we use on the local discovery interfaces?
-			for _, ipv := range zcnConfig.Interfaces.Ip {
-				switch ipv {
-				case "ipv4":
-					ipver |= zeroconf.IPv4
-					break
-				case "ipv6":
-					ipver |= zeroconf.IPv6
-					break
-				default:
-					log.Fatalf("unknown IP version %s in interface config", ipv)
-				}
+// watcher Runs watchZCGroups for a single browse target, the watcher can be
+// stopped and started again, e.g. with different interfaces.
+type watcher struct {
+	target  browseTarget
+	exit    chan bool
+	rescan  chan bool
+	stopped chan bool
+	status  watcherStatus
+	timing  browseTiming
+}
+
+// start Starts watching, an ERROR event is raised when its browses start
+// failing.  known is the list
+// of services which are already known, the target's own are picked out.  If
+// baselined is set the ADDs of the first browse are the baseline, see
+// watchZCGroups.
+func (w *watcher) start(updates *eventBus,
+	browse browseFunc,
+	cache *resolveCache,
+	tracker *deviceTracker,
+	modify *modifyConfig,
+	known []zeroconf.ServiceEntry,
+	baselined func()) {
+	var targetKnown []zeroconf.ServiceEntry
+	for _, entry := range known {
+		if w.target.matches(&entry) {
+			targetKnown = append(targetKnown, entry)
+		}
+	}
+
+	slog.Info("watching",
+		"service", w.target.Service,
+		"domain", w.target.Domain,
+		"unicast", w.target.unicast(),
+		"periodSeconds", w.target.ScanPeriodSeconds)
+
+	// Record each browse for the health endpoints, and report failures.
+	w.status.starting()
+	adapted := func(period time.Duration) {
+		w.status.adapted(period)
+		scanPeriodMetric.With("service", w.target.Service,
+			"domain", w.target.Domain).Set(int64(period.Seconds()))
+	}
+	adapted(w.timing.period)
+	reporter := &errorReporter{service: w.target.Service, domain: w.target.Domain}
+	recorded := func(ctx context.Context,
+		service string,
+		domain string,
+		entries chan<- *zeroconf.ServiceEntry) error {
+		err := browse(ctx, service, domain, entries)
+		w.status.browsed(err)
+		reporter.browsed(err)
+		return err
+	}
+
+	done := make(chan error, 1)
+	w.exit = make(chan bool)
+	w.rescan = make(chan bool, 1)
+	w.stopped = make(chan bool)
+	go watchZCGroups(done,
+		w.exit,
+		w.rescan,
+		updates,
+		w.target.Service,
+		w.target.Domain,
+		w.timing,
+		recorded,
+		cache,
+		tracker,
+		modify,
+		targetKnown,
+		baselined,
+		adapted)
+
+	go func(stopped chan bool) {
+		<-done
+		close(stopped)
+	}(w.stopped)
+}
+
+// requestRescan Has a running watcher start a new browse straight away,
+// rather than at the end of its scan period.  Returns false if it isn't
+// running.
+func (w *watcher) requestRescan() bool {
+	if w.exit == nil {
+		return false
+	}
+
+	select {
+	case w.rescan <- true:
+		break
+	default:
+		// A rescan is already pending.
+		break
+	}
+
+	return true
+}
+
+// rescanWatchers Has the watchers of service, or every watcher if it's
+// empty, start a new browse straight away.
+func rescanWatchers(watchers []*watcher, service string) error {
+	rescanned := 0
+	for _, w := range watchers {
+		if service == "" || strings.EqualFold(w.target.Service, service) {
+			if w.requestRescan() {
+				rescanned++
 			}
 		}
 	}
 
-	if len(zcnConfig.Interfaces.Use) == 0 {
-		// No interfaces specified, use all.
-		intfs, err = net.Interfaces()
+	if rescanned == 0 && service != "" {
+		return fmt.Errorf("service %q isn't being watched", service)
+	}
+
+	return nil
+}
+
+// stopWatchers Stops every running watcher and waits for them to finish.
+func stopWatchers(watchers []*watcher) {
+	for _, w := range watchers {
+		if w.exit != nil {
+			close(w.exit)
+		}
+	}
+
+	for _, w := range watchers {
+		if w.stopped != nil {
+			<-w.stopped
+			w.exit = nil
+			w.stopped = nil
+			w.status.stopping()
+		}
+	}
+}
+
+// ipVersions Returns the IP versions which discovery should use, as
+// described by the [interfaces] section of the config file.
+func ipVersions(intfConf interfaceConfig) (zeroconf.IPType, error) {
+	if len(intfConf.Ip) == 0 {
+		// Default to v4 and v6 if not specified.
+		return zeroconf.IPv4AndIPv6, nil
+	}
+
+	// Which ip versions can we use on the local discovery interfaces?
+	var ipver zeroconf.IPType
+	for _, ipv := range intfConf.Ip {
+		switch ipv {
+		case "ipv4":
+			ipver |= zeroconf.IPv4
+			break
+		case "ipv6":
+			ipver |= zeroconf.IPv6
+			break
+		default:
+			return 0, fmt.Errorf("unknown IP version %q in interface config", ipv)
+		}
+	}
+
+	return ipver, nil
+}
+
+// currentInterfaces Returns the interfaces which discovery should use right
+// now, which may be none.
+func currentInterfaces(intfConf interfaceConfig) ([]net.Interface, error) {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("cannot retrieve system interfaces: %s",
+			err.Error())
+	}
+
+	return selectInterfaces(intfConf, all), nil
+}
+
+// discoveryInterfaces Returns the IP versions and interfaces which discovery
+// should use, as described by the [interfaces] section of the config file.
+func discoveryInterfaces(intfConf interfaceConfig) (zeroconf.IPType,
+	[]net.Interface,
+	error) {
+	ipver, err := ipVersions(intfConf)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	intfs, err := currentInterfaces(intfConf)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(intfs) == 0 {
+		return 0, nil, errors.New("no usable multicast interfaces found")
+	}
+
+	slog.Info("final interface list", "interfaces", interfaceNames(intfs))
+	return ipver, intfs, nil
+}
+
+// run Watches the configured service and delivers notifications until an
+// interrupt is received or stop is signalled.  reload loads the config again
+// when an admin asks for it.
+func run(zcnConfig *config,
+	reload func() (*config, error),
+	ipver zeroconf.IPType,
+	intfs []net.Interface,
+	stop <-chan bool) {
+	queues, err := newDeliveryQueues(zcnConfig, false)
+	if err != nil {
+		fatal("failed to create notifiers", "err", err)
+	}
+
+	// The shadow pipeline receives a copy of every event, so that a new
+	// configuration can be tried out against live traffic.
+	var shadowQueues []*deliveryQueue
+	if zcnConfig.Shadow.Config != "" {
+		shadowConfig, err := loadConfig(zcnConfig.Shadow.Config, "", nil)
 		if err != nil {
-			log.Fatalln("cannot retrieve system interfaces:", err.Error())
+			fatal("failed to load shadow config file", "err", err)
 		}
-		log.Println("no interfaces specified, assuming all:",
-			interfaceNames(intfs))
-	} else {
-		for _, intfName := range zcnConfig.Interfaces.Use {
-			intf, err := net.InterfaceByName(intfName)
-			if err != nil {
-				log.Fatalf("no such interface %q", intfName)
-			} else {
-				intfs = append(intfs, *intf)
-			}
+
+		shadowQueues, err = newDeliveryQueues(shadowConfig, true)
+		if err != nil {
+			fatal("failed to create shadow notifiers", "err", err)
 		}
 
-		log.Println("using specific interfaces", interfaceNames(intfs))
+		slog.Info("shadow pipeline enabled",
+			"config", zcnConfig.Shadow.Config,
+			"backends", len(shadowQueues))
 	}
 
-	if len(zcnConfig.Interfaces.Exclude) > 0 {
-		log.Printf("excluding interfaces %s", zcnConfig.Interfaces.Exclude)
-		for _, excludeIntfName := range zcnConfig.Interfaces.Exclude {
-			_, err := net.InterfaceByName(excludeIntfName)
-			if err != nil {
-				log.Fatalf("no such interface %q", excludeIntfName)
+	if zcnConfig.Metrics.Listen != "" || activatedListener("metrics") != nil {
+		go serveMetrics(zcnConfig.Metrics.Listen, &zcnConfig.Server)
+	}
+
+	state, known, saved, err := openStateStore(zcnConfig.State, zcnConfig.Migrate)
+	if err != nil {
+		fatal("failed to open state store", "err", err)
+	}
+
+	var traces *traceStore
+	if zcnConfig.Trace.Enabled {
+		traces = newTraceStore(zcnConfig.Trace.History)
+	}
+
+	registry := newServiceRegistry()
+	registry.seed(known)
+	for _, queue := range queues {
+		if s, ok := queue.backend.(seeder); ok {
+			s.seed(known)
+		}
+		if f, ok := queue.backend.(follower); ok {
+			f.follow(registry)
+		}
+	}
+	presence := newPresenceTracker(zcnConfig.State, saved, known)
+	go state.run(func() ([]zeroconf.ServiceEntry, []servicePresence) {
+		return registry.snapshot(), presence.snapshot()
+	})
+	if zcnConfig.Metrics.TextfileDir != "" {
+		go runTextfile(zcnConfig.Metrics, registry)
+	}
+	historyConf := zcnConfig.History
+	if zcnConfig.LowPower && historyConf.File != "" {
+		slog.Info("low power mode, not recording history", "file", historyConf.File)
+		historyConf = historyConfig{}
+	}
+	history := newHistoryWriter(historyConf)
+	go history.run()
+	pipe := newEventPipe(zcnConfig.Output, os.Stdout)
+
+	enrichment, err := newEnricher(zcnConfig.Enrich)
+	if err != nil {
+		fatal("invalid enrichment configuration", "err", err)
+	}
+
+	sites, err := newSiteTagger(zcnConfig.Site)
+	if err != nil {
+		fatal("invalid site configuration", "err", err)
+	}
+
+	identities, err := newIdentityResolvers(zcnConfig.Identity)
+	if err != nil {
+		fatal("invalid identity configuration", "err", err)
+	}
+
+	dedupe := newDeduplicator(zcnConfig.Dedupe)
+	correlate := newCorrelator(zcnConfig.Correlate)
+	probes := newProber(zcnConfig.Probe)
+	capture := newPacketCapture(zcnConfig.Capture)
+	aggregated := newAggregator(zcnConfig.Aggregator)
+	go aggregated.serve()
+	silences := newSilenceStore()
+	acks := newAckStore(zcnConfig.Ack)
+	expected := newExpectMonitor(zcnConfig.Expect, registry)
+	go expected.run()
+	updates := newEventBus(zcnConfig.Bus)
+	initial := newBaseline(zcnConfig)
+
+	// The discovery interfaces are replaced by the main loop below.
+	var discovery atomic.Pointer[[]net.Interface]
+	discoveryIntfs := intfs
+	discovery.Store(&discoveryIntfs)
+
+	// A reload replaces the pipeline's config and delivery queues, which
+	// are only touched by its goroutine once it has started, tasks are run
+	// by it to do so.
+	pipelineConfig := zcnConfig
+	tasks := make(chan func())
+	// stopping asks the pipeline to raise the STOPPED event and stop, the
+	// channel it carries is closed once the event has been delivered.
+	stopping := make(chan chan bool)
+
+	// Process newly discovered or removed services.
+	go func() {
+		deliver := func(change *ServiceEntryChange) {
+			pipelineEventsMetric.With().Inc()
+			dropped := pipelineConfig.runScripts(change)
+			history.append(change)
+			pipe.write(change)
+			if dropped != nil {
+				change.Trace.add("script", "", TRACE_SUPPRESSED, "dropped by script "+dropped.Name)
+				scriptDroppedMetric.With("script", dropped.Name).Inc()
+				slog.Info("change dropped", changeAttrs(change), "script", dropped.Name)
+				return
+			}
+
+			if initial.hold(change) {
+				return
+			}
+
+			if ack := acks.acknowledged(change); ack != nil {
+				change.Trace.add("ack", "", TRACE_SUPPRESSED,
+					"event "+ack.EventID+" was acknowledged")
+				acknowledgedMetric.With().Inc()
+				slog.Info("change acknowledged", changeAttrs(change), "event", ack.EventID)
+				return
+			}
+
+			if s := silences.silenced(change); s != nil {
+				change.Trace.add("silence", "", TRACE_SUPPRESSED, s.description())
+				silencedMetric.With().Inc()
+				slog.Info("change silenced", changeAttrs(change), "silence", s.ID)
+				return
+			}
+
+			if window := pipelineConfig.maintenance(change); window != nil {
+				change.Trace.add("maintenance", "", TRACE_SUPPRESSED,
+					"maintenance window "+window.Name)
+				maintenanceMetric.With("window", window.Name).Inc()
+				slog.Info("change in maintenance window", changeAttrs(change),
+					"window", window.Name)
+				return
+			}
+
+			acks.link(change)
+			for _, queue := range queues {
+				queue.Enqueue(*change)
+			}
+
+			shadowChange := *change
+			shadowChange.Shadow = true
+			// The routes name the live backends.
+			shadowChange.Routes = nil
+			for _, queue := range shadowQueues {
+				queue.Enqueue(shadowChange)
+			}
+		}
+
+		// deliverOps Delivers one of zcnotify's own events, unless [ops]
+		// leaves it out.  They aren't services, so they're kept out of the
+		// registry, and errors are raised to critical if the [[severity]]
+		// rules leave them at info.  Returns false if it was left out.
+		deliverOps := func(change *ServiceEntryChange) bool {
+			if !pipelineConfig.Ops.raises(change.ChangeType) {
+				return false
+			}
+
+			change.ID = newEventID()
+			sites.tag(change)
+			traces.start(change)
+			pipelineConfig.assignSeverity(change)
+			if change.Error != "" {
+				if change.Severity == SEVERITY_INFO {
+					change.Severity = SEVERITY_CRITICAL
+				}
+				slog.Error("zcnotify error", changeAttrs(change), "err", change.Error)
 			} else {
-				for index := len(intfs) - 1; index >= 0; index-- {
-					if excludeIntfName == intfs[index].Name {
-						intfs = append(intfs[:index], intfs[index+1:]...)
+				slog.Info("zcnotify event", changeAttrs(change))
+			}
+			deliver(change)
+			return true
+		}
+
+		// finish Classifies a change once it has been probed, records it
+		// and delivers it.
+		finish := func(change *ServiceEntryChange) {
+			pipelineConfig.KnownDevices.classify(change)
+			pipelineConfig.assignSeverity(change)
+			if change.UnknownDevice {
+				slog.Warn("unknown device", changeAttrs(change))
+			}
+			slog.Info("service change", changeAttrs(change))
+			registry.apply(change)
+			presence.apply(change)
+			state.saveLater()
+			deliver(change)
+		}
+
+		// process Tags the changes found by the watchers and passes them
+		// on to be probed and delivered.
+		process := func(changes []ServiceEntryChange) {
+			for _, change := range changes {
+				change.ID = newEventID()
+				change.Interface = entryInterface(&change.Entry)
+				change.Zones = linkLocalZones(&change.Entry,
+					change.Interface,
+					*discovery.Load())
+				change.Connect = connectStrings(&change.Entry, change.Zones)
+				pipelineConfig.Networks.tag(&change)
+				change.URL = pipelineConfig.Urls.url(&change)
+				change.Category = pipelineConfig.category(&change.Entry)
+				sites.tag(&change)
+				if change.Interface == "" {
+					// A device with only link-local addresses is on the
+					// interface they're reachable on.
+					for _, zone := range change.Zones {
+						change.Interface = zone
+						break
 					}
 				}
+				traces.start(&change)
+				if duplicate, reason := dedupe.duplicate(&change); duplicate {
+					// Keep the registry up to date without notifying.
+					change.Trace.add("dedupe", "", TRACE_SUPPRESSED, reason)
+					slog.Debug("change suppressed",
+						changeAttrs(&change),
+						"reason", reason)
+					registry.apply(&change)
+					state.saveLater()
+					continue
+				}
+
+				presence.stamp(&change)
+				capture.attach(&change)
+				enrichment.enrich(&change)
+				identities.resolve(&change)
+				probes.check(change, tasks, finish)
 			}
 		}
-	}
 
-	log.Println("final interface list", interfaceNames(intfs))
+		for {
+			var changes []ServiceEntryChange
+			select {
+			case change := <-updates.events():
+				changes = correlate.correlate(change)
+				break
+			case change := <-correlate.expired:
+				changes = []ServiceEntryChange{change}
+				break
+			case change := <-aggregated.received():
+				// Agents forward events which were enriched and classified
+				// at their site, so they're only recorded and delivered.
+				traces.start(&change)
+				aggregated.apply(&change)
+				slog.Info("service change", changeAttrs(&change))
+				deliver(&change)
+				continue
+			case change := <-expected.events():
+				sites.tag(&change)
+				traces.start(&change)
+				pipelineConfig.assignSeverity(&change)
+				slog.Info("service change", changeAttrs(&change))
+				deliver(&change)
+				continue
+			case change := <-opsEvents:
+				deliverOps(&change)
+				continue
+			case drained := <-stopping:
+				// Deliver what's being held back rather than lose it.
+				held := correlate.flush()
+				process(held)
+				flushed := initial.stop(queues) || len(held) != 0
+				change := newOpsEvent(STOPPED, nil)
+				raised := deliverOps(&change) && len(pipelineConfig.Ops.Notify) != 0
+				if !raised && !flushed {
+					close(drained)
+					return
+				}
 
-	if zcnConfig.Zeroconf.Service == "" {
-		zcnConfig.Zeroconf.Service = DEFAULT_SERVICE
-	} else if zcnConfig.Zeroconf.Service != DEFAULT_SERVICE {
-		log.Fatalln("unknown zeroconf service:", zcnConfig.Zeroconf.Service)
+				for _, queue := range queues {
+					queue.retire(nil)
+				}
+				go func(queues []*deliveryQueue) {
+					for _, queue := range queues {
+						queue.wait()
+					}
+					close(drained)
+				}(queues)
+				return
+			case task := <-tasks:
+				task()
+				continue
+			}
+
+			process(changes)
+		}
+	}()
+
+	go probes.run(registry, updates)
+
+	var reporter *inventoryReporter
+	startReporter := func(zcnConfig *config, queues []*deliveryQueue) {
+		reporter = nil
+		if len(zcnConfig.InventoryReport.At) != 0 {
+			reporter = newInventoryReporter(zcnConfig, registry, queues)
+			go reporter.run()
+		}
 	}
+	startReporter(zcnConfig, queues)
 
-	if zcnConfig.Zeroconf.Domain == "" {
-		zcnConfig.Zeroconf.Domain = DEFAULT_DOMAIN
-	} else if zcnConfig.Zeroconf.Domain != DEFAULT_DOMAIN {
-		log.Fatalln("unknown zeroconf domain:", zcnConfig.Zeroconf.Domain)
+	// Watch for changes to each service/domain pair by browsing
+	// periodically.  Multicast watchers are restarted with the new
+	// interfaces whenever the discovery interfaces change, unicast watchers
+	// don't depend on them.
+	var multicast, unicast []*watcher
+	for _, target := range zcnConfig.browseTargets() {
+		w := &watcher{target: target,
+			timing: newBrowseTiming(target.ScanPeriodSeconds, zcnConfig)}
+		if target.unicast() {
+			unicast = append(unicast, w)
+		} else {
+			multicast = append(multicast, w)
+		}
 	}
 
-	if zcnConfig.ScanPeriodSeconds == 0 {
-		zcnConfig.ScanPeriodSeconds = DEFAULT_SCAN_PERIOD
+	health := &healthMonitor{started: time.Now().UTC(),
+		watchers: append(append([]*watcher(nil), multicast...), unicast...),
+		queues:   append(append([]*deliveryQueue(nil), queues...), shadowQueues...)}
+	admin := make(chan adminRequest)
+	if zcnConfig.Api.Listen != "" || activatedListener("api") != nil {
+		var sampler *statsSampler
+		if zcnConfig.Debug.Diagnostics {
+			sampler = newStatsSampler()
+			go sampler.run()
+		}
+
+		go serveAPI(zcnConfig.Api.Listen, &zcnConfig.Server, &apiServer{registry: registry,
+			presence:   presence,
+			history:    history,
+			traces:     traces,
+			health:     health,
+			aggregator: aggregated,
+			silences:   silences,
+			acks:       acks,
+			server:     &zcnConfig.Server,
+			admin:      admin,
+			sampler:    sampler})
 	}
 
-	log.Printf("will browse every %d seconds", zcnConfig.ScanPeriodSeconds)
+	tracker := newDeviceTracker(zcnConfig.Enrich)
+	startWatchers := func(watchers []*watcher,
+		intfs []net.Interface,
+		known []zeroconf.ServiceEntry,
+		sniffer *passiveSniffer) {
+		cache := newResolveCache(zcnConfig.Zeroconf.Resolver, ipver, intfs)
+		if sniffer != nil {
+			cache = newPassiveResolveCache()
+			sniffer.seed(known)
+		}
+
+		for _, w := range watchers {
+			target := w.target
+			create := func() (browseFunc, error) {
+				return newBrowseFunc(target,
+					zcnConfig.Zeroconf,
+					ipver,
+					intfs,
+					sniffer)
+			}
+			browse, err := create()
+			if err != nil {
+				// The watcher keeps trying to create it, backing off.
+				slog.Error("failed to create browser, will retry",
+					"service", w.target.Service,
+					"domain", w.target.Domain,
+					"err", err)
+				browse = retryingBrowser(create)
+			}
 
-	if len(zcnConfig.NotifyTypes) == 0 {
-		log.Fatalln("no notification types found in config file")
+			w.start(updates,
+				browse,
+				cache,
+				tracker,
+				&zcnConfig.Modify,
+				known,
+				initial.watch())
+		}
 	}
 
-	for _, notifyType := range zcnConfig.NotifyTypes {
-		notifyTypeLower := strings.ToLower(notifyType)
-		switch notifyTypeLower {
-		case "email":
-			if err := ValidEmailConfig(zcnConfig.Email); err != nil {
-				log.Fatalln("invalid email configuration settings:",
-					err.Error())
+	// In passive mode, or with the shared resolver, the multicast watchers
+	// share a sniffer, which is replaced along with them when the
+	// interfaces change.
+	advertise := newAdvertiser(zcnConfig.Advertise)
+	var sniffer *passiveSniffer
+	startMulticast := func(intfs []net.Interface, known []zeroconf.ServiceEntry) {
+		if zcnConfig.Zeroconf.Passive {
+			var err error
+			if sniffer, err = newPassiveSniffer(ipver, intfs); err != nil {
+				fatal("failed to start passive mode", "err", err)
 			}
-			break
-		default:
-			log.Fatalf("unknown notification type %q", notifyTypeLower)
+			slog.Info("passive mode, listening without querying")
+		} else if zcnConfig.Zeroconf.SharedResolver {
+			var err error
+			if sniffer, err = newSharedResolver(ipver,
+				intfs,
+				zcnConfig.Zeroconf); err != nil {
+				fatal("failed to start shared resolver", "err", err)
+			}
+			slog.Info("browsing with the shared resolver",
+				"maxConcurrentBrowses", zcnConfig.Zeroconf.MaxConcurrentBrowses,
+				"unicastResponse", zcnConfig.Zeroconf.UnicastResponse,
+				"queryRepeats", zcnConfig.Zeroconf.QueryRepeats)
 		}
+
+		startWatchers(multicast, intfs, known, sniffer)
+		advertise.start(intfs)
+		capture.start(ipver, intfs)
 	}
 
-	// Done parsing the config file.
-	done := make(chan error, 1)
-	exit := make(chan bool, 1)
-	updates := make(chan ServiceEntryChange, 1)
+	stopMulticast := func() {
+		stopWatchers(multicast)
+		advertise.stop()
+		capture.stop()
+		if sniffer != nil {
+			sniffer.stop()
+			sniffer = nil
+		}
+	}
 
-	// Process newly discovered or removed services.
-	go func(updates chan ServiceEntryChange, zConfig *config) {
-		for {
-			change := <-updates
-			for _, notifyType := range zConfig.NotifyTypes {
-				switch notifyType {
-				case "email":
-					go SendEmail(zcnConfig.Email, &change)
-					break
-				default:
-					panic(fmt.Sprintf("unknown notification type %q", notifyType))
+	startWatchers(unicast, intfs, known, nil)
+	slog.Info("final interface list", "interfaces", interfaceNames(intfs))
+	if len(intfs) == 0 {
+		slog.Warn("no usable multicast interfaces, waiting for one to appear")
+	} else {
+		startMulticast(intfs, known)
+	}
+
+	// Watchers started from now on, e.g. when an interface appears, aren't
+	// part of the baseline.
+	initial.started()
+	raiseOpsEvent(newOpsEvent(STARTED, configSummary(zcnConfig, queues, intfs)))
+	go initial.wait(updates, tasks, func() {
+		initial.close(queues)
+	})
+
+	// reloadPipeline Replaces the backends, and the settings used by the
+	// pipeline, with those of the reloaded config.  The rest only changes
+	// on a restart.
+	reloadPipeline := func() error {
+		next, err := reload()
+		if err != nil {
+			return err
+		}
+
+		nextQueues, err := newDeliveryQueues(next, false)
+		if err != nil {
+			return err
+		}
+
+		current := make(chan []*deliveryQueue, 1)
+		tasks <- func() { current <- queues }
+		previous := <-current
+
+		known := registry.snapshot()
+		for _, queue := range nextQueues {
+			if s, ok := queue.backend.(seeder); ok {
+				s.seed(known)
+			}
+			if f, ok := queue.backend.(follower); ok {
+				f.follow(registry)
+			}
+			if i, ok := queue.backend.(inheritor); ok {
+				for _, prev := range previous {
+					if prev.route == queue.route && prev.backend.Name() == queue.backend.Name() {
+						i.inherit(prev.backend)
+						break
+					}
 				}
 			}
 		}
-	}(updates, &zcnConfig)
 
-	// Watch for changes to the multicast groups by browsing periodically.
-	go watchZCGroups(done,
-		exit,
-		updates,
-		zcnConfig.Zeroconf.Service,
-		zcnConfig.Zeroconf.Domain,
-		zcnConfig.ScanPeriodSeconds,
-		ipver,
-		intfs)
-
-	// Handle interrupt signals, on receiving one deliver a notification
-	// to the watchZCGroups goroutine so it terminates.
+		tasks <- func() {
+			for _, queue := range queues {
+				queue.retire(nextQueues)
+			}
+			queues = nextQueues
+			pipelineConfig = next
+		}
+
+		reporter.stop()
+		startReporter(next, nextQueues)
+		health.setQueues(append(append([]*deliveryQueue(nil), nextQueues...),
+			shadowQueues...))
+		slog.Info("config reloaded", "backends", len(nextQueues))
+		raiseOpsEvent(newOpsEvent(RELOADED, configSummary(next, nextQueues, intfs)))
+		if changed := restartSections(zcnConfig, next); len(changed) != 0 {
+			slog.Warn("config changes which need a restart to take effect",
+				"changed", changed)
+		}
+
+		return nil
+	}
+
+	// clearState Forgets the known services, the watchers are restarted
+	// so that those still present are reported as new.
+	clearState := func() error {
+		stopMulticast()
+		stopWatchers(unicast)
+
+		saved := make(chan error, 1)
+		tasks <- func() {
+			registry.clear()
+			presence.clear()
+			saved <- state.save(nil, nil)
+		}
+		err := <-saved
+
+		startWatchers(unicast, intfs, nil, nil)
+		if len(intfs) != 0 {
+			startMulticast(intfs, nil)
+		}
+
+		slog.Info("state cleared")
+		return err
+	}
+
+	// stopPipeline Delivers the REMOVEs and baseline summary being held,
+	// raises the STOPPED event, and waits for the backends to deliver them,
+	// and what else they have queued, for at most OPS_STOP_TIMEOUT.
+	stopPipeline := func() {
+		drained := make(chan bool)
+		stopping <- drained
+		select {
+		case <-drained:
+			break
+		case <-time.After(OPS_STOP_TIMEOUT):
+			slog.Warn("timed out delivering the last events")
+			break
+		}
+	}
+
+	// dumpState Takes a snapshot of the internal state, on the pipeline as
+	// that owns the config and queues.
+	dumpState := func() *stateDump {
+		dumped := make(chan *stateDump, 1)
+		tasks <- func() {
+			dumped <- newStateDump(pipelineConfig, registry, health, silences)
+		}
+		return <-dumped
+	}
+
+	intfChanges := make(chan []net.Interface, 1)
+	go monitorInterfaces(zcnConfig.Interfaces, intfs, intfChanges)
+
+	// Handle interrupt signals, on receiving one stop every watcher.
 	sigchan := make(chan os.Signal, 1)
-	go func() {
-		<-sigchan
-		log.Println("interrupt received")
-		exit <- true
-	}()
+	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM)
+	rescanSignals := make(chan os.Signal, 1)
+	if rescanSignal != nil {
+		signal.Notify(rescanSignals, rescanSignal)
+	}
+	dumpSignals := make(chan os.Signal, 1)
+	if dumpSignal != nil {
+		signal.Notify(dumpSignals, dumpSignal)
+	}
 
-	signal.Notify(sigchan, os.Interrupt)
+	// Under systemd say that startup has finished, and keep the watchdog
+	// fed from this loop so that systemd restarts zcnotify if it hangs.
+	sdNotify("READY=1")
+	var watchdog <-chan time.Time
+	if interval := sdWatchdogInterval(); interval != 0 {
+		slog.Info("systemd watchdog enabled", "interval", interval)
+		watchdog = time.Tick(interval / 2)
+	}
 
-	// Wait till the watchZCGroups goroutine exits, either via an error or
-	// via an interrupt signal.
-	watchZCGroupsErr := <-done
-	if watchZCGroupsErr != nil {
-		log.Fatalln("exited:", watchZCGroupsErr.Error())
-	} else {
-		log.Println("exited")
+	for {
+		select {
+		case intfs = <-intfChanges:
+			discoveryIntfs := intfs
+			discovery.Store(&discoveryIntfs)
+			slog.Info("discovery interfaces changed, restarting watchers",
+				"interfaces", interfaceNames(intfs))
+			stopMulticast()
+			if len(intfs) == 0 {
+				slog.Warn("no usable multicast interfaces, waiting for one to appear")
+			} else {
+				startMulticast(intfs, registry.snapshot())
+			}
+			break
+		case <-watchdog:
+			sdNotify("WATCHDOG=1")
+			break
+		case request := <-admin:
+			slog.Info("admin request",
+				"action", request.action,
+				"service", request.service)
+			switch request.action {
+			case ADMIN_RELOAD:
+				err := reloadPipeline()
+				if err != nil {
+					slog.Error("reload failed, keeping the running config", "err", err)
+				}
+				request.done <- err
+				break
+			case ADMIN_CLEAR_STATE:
+				request.done <- clearState()
+				break
+			case ADMIN_RESCAN:
+				request.done <- rescanWatchers(append(append([]*watcher(nil),
+					multicast...), unicast...), request.service)
+				break
+			case ADMIN_DUMP:
+				request.dumped <- dumpState()
+				request.done <- nil
+				break
+			default:
+				request.done <- fmt.Errorf("unknown action %q", request.action)
+				break
+			}
+			break
+		case <-rescanSignals:
+			slog.Info("rescan signal received")
+			rescanWatchers(append(append([]*watcher(nil), multicast...), unicast...), "")
+			break
+		case <-dumpSignals:
+			slog.Info("dump signal received", "file", zcnConfig.Debug.DumpFile)
+			if err := writeStateDump(zcnConfig.Debug, dumpState()); err != nil {
+				slog.Error("failed to write state dump", "err", err)
+			}
+			break
+		case <-sigchan:
+			slog.Info("interrupt received")
+			sdNotify("STOPPING=1")
+			stopMulticast()
+			stopWatchers(unicast)
+			stopPipeline()
+			state.stop()
+			slog.Info("exited")
+			return
+		case <-stop:
+			slog.Info("stop requested")
+			stopMulticast()
+			stopWatchers(unicast)
+			stopPipeline()
+			state.stop()
+			slog.Info("exited")
+			return
+		}
 	}
 }
+
+func main() {
+	os.Exit(dispatch(os.Args[1:]))
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Days for which acknowledgement links work by default.
+const DEFAULT_ACK_LINK_DAYS uint = 7
+
+var acknowledgedMetric = metrics.newCounter("zcnotify_events_acknowledged_total",
+	"Events recorded but not notified because their service's last event was acknowledged.")
+
+// ackConfig adds acknowledgement links, served by the API, to
+// notifications.
+type ackConfig struct {
+	// URL the API is reached at from where notifications are read, e.g.
+	// "https://zcnotify.example.com:9466".
+	URL string
+	// Secret signs the links, it may reference ${ENV_VAR}s or be read from
+	// SecretFile.
+	Secret     string
+	SecretFile string
+	// Days for which a link works.
+	LinkDays uint
+}
+
+// setupAck Checks the [ack] section and fills in its defaults.
+func (zcnConfig *config) setupAck() error {
+	if zcnConfig.Ack.URL == "" {
+		return nil
+	}
+
+	if zcnConfig.Ack.Secret == "" {
+		return fmt.Errorf("ack: a Secret or SecretFile is needed to sign the links")
+	}
+
+	if parsed, err := url.Parse(zcnConfig.Ack.URL); err != nil ||
+		(parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("ack: URL %q isn't an http or https URL", zcnConfig.Ack.URL)
+	}
+	zcnConfig.Ack.URL = strings.TrimSuffix(zcnConfig.Ack.URL, "/")
+
+	if zcnConfig.Api.Listen == "" && activatedListener("api") == nil {
+		return fmt.Errorf("ack: the links are served by the API, which isn't enabled")
+	}
+
+	if zcnConfig.Ack.LinkDays == 0 {
+		zcnConfig.Ack.LinkDays = DEFAULT_ACK_LINK_DAYS
+	}
+
+	return nil
+}
+
+// acknowledgement is an event someone has acknowledged.
+type acknowledgement struct {
+	EventID    string            `json:"eventId"`
+	Name       string            `json:"name"`
+	ChangeType ServiceChangeType `json:"changeType"`
+	At         time.Time         `json:"at"`
+}
+
+// ackStore Signs the acknowledgement links of events and keeps the
+// acknowledged ones.  Acknowledging an event holds back the notifications
+// of later events of the same type for its service, until one of another
+// type shows that its state has changed again.  Acknowledgements are
+// forgotten when zcnotify restarts.
+type ackStore struct {
+	conf  ackConfig
+	mutex sync.Mutex
+	acks  map[string]acknowledgement
+}
+
+// newAckStore Returns the store, nil if acknowledgement links are disabled.
+func newAckStore(conf ackConfig) *ackStore {
+	if conf.URL == "" {
+		return nil
+	}
+
+	return &ackStore{conf: conf, acks: make(map[string]acknowledgement)}
+}
+
+// signature Returns the signature of an acknowledgement link.
+func (store *ackStore) signature(id string,
+	name string,
+	changeType string,
+	expires string) string {
+	mac := hmac.New(sha256.New, []byte(store.conf.Secret))
+	mac.Write([]byte(id + "\n" + name + "\n" + changeType + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// link Sets the acknowledgement link of change.
+func (store *ackStore) link(change *ServiceEntryChange) {
+	if store == nil || change.ID == "" {
+		return
+	}
+
+	name := change.Entry.ServiceInstanceName()
+	expires := strconv.FormatInt(time.Now().Add(time.Duration(store.conf.LinkDays)*24*time.Hour).Unix(), 10)
+	query := url.Values{"event": {change.ID},
+		"name":    {name},
+		"type":    {change.ChangeType.String()},
+		"expires": {expires},
+		"sig":     {store.signature(change.ID, name, change.ChangeType.String(), expires)}}
+	change.AckURL = store.conf.URL + "/ack?" + query.Encode()
+}
+
+// acknowledged Returns the acknowledgement which holds back change, nil if
+// there's none.  A change of another type than the acknowledged event ends
+// the acknowledgement.
+func (store *ackStore) acknowledged(change *ServiceEntryChange) *acknowledgement {
+	if store == nil {
+		return nil
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	name := change.Entry.ServiceInstanceName()
+	ack, ok := store.acks[name]
+	if !ok {
+		return nil
+	} else if ack.ChangeType != change.ChangeType {
+		delete(store.acks, name)
+		return nil
+	}
+
+	return &ack
+}
+
+// acknowledge Records the acknowledgement of the event in a request's form,
+// an error is returned if the link isn't valid.
+func (store *ackStore) acknowledge(form url.Values, now time.Time) (*acknowledgement, error) {
+	id, name, changeType := form.Get("event"), form.Get("name"), form.Get("type")
+	expires := form.Get("expires")
+	expected := store.signature(id, name, changeType, expires)
+	if !hmac.Equal([]byte(expected), []byte(form.Get("sig"))) {
+		return nil, fmt.Errorf("invalid acknowledgement link")
+	}
+
+	if seconds, err := strconv.ParseInt(expires, 10, 64); err != nil ||
+		now.After(time.Unix(seconds, 0)) {
+		return nil, fmt.Errorf("acknowledgement link has expired")
+	}
+
+	parsed, err := parseServiceChangeType(changeType)
+	if err != nil {
+		return nil, err
+	}
+
+	ack := acknowledgement{EventID: id, Name: name, ChangeType: parsed, At: now.UTC()}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.acks[name] = ack
+	return &ack, nil
+}
+
+// ackPage is shown by the acknowledgement endpoints.  Following a link only
+// asks for confirmation, so that mail scanners which fetch every link don't
+// acknowledge events.
+var ackPage = template.Must(template.New("ack").Parse(`<!DOCTYPE html>
+<html><head><title>zcnotify</title></head><body>
+{{if .Done}}<p>Acknowledged {{.Type}} of {{.Name}}, its notifications are held back until it changes again.</p>
+{{else if .Error}}<p>{{.Error}}</p>
+{{else}}<form method="post">
+<p>Acknowledge {{.Type}} of {{.Name}}?</p>
+{{range $key, $values := .Form}}{{range $values}}<input type="hidden" name="{{$key}}" value="{{.}}">
+{{end}}{{end}}<button type="submit">Acknowledge</button>
+</form>
+{{end}}</body></html>
+`))
+
+// ackPageData is given to ackPage.
+type ackPageData struct {
+	Name  string
+	Type  string
+	Form  url.Values
+	Done  bool
+	Error string
+}
+
+// confirmAck Asks whoever followed an acknowledgement link to confirm it.
+func (as *apiServer) confirmAck(w http.ResponseWriter, r *http.Request) {
+	if as.acks == nil {
+		http.Error(w, "acknowledgements aren't enabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	ackPage.Execute(w, ackPageData{Name: query.Get("name"),
+		Type: query.Get("type"),
+		Form: query})
+}
+
+// acknowledge Acknowledges the event of a confirmed link.
+func (as *apiServer) acknowledge(w http.ResponseWriter, r *http.Request) {
+	if as.acks == nil {
+		http.Error(w, "acknowledgements aren't enabled", http.StatusNotFound)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data := ackPageData{Name: r.Form.Get("name"), Type: r.Form.Get("type")}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	ack, err := as.acks.acknowledge(r.Form, time.Now())
+	if err != nil {
+		data.Error = err.Error()
+		w.WriteHeader(http.StatusForbidden)
+		ackPage.Execute(w, data)
+		return
+	}
+
+	slog.Info("event acknowledged",
+		"event", ack.EventID,
+		"name", ack.Name,
+		"changeType", ack.ChangeType.String(),
+		"remote", r.RemoteAddr)
+	data.Done = true
+	ackPage.Execute(w, data)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+)
+
+// Actions of the admin endpoints, which are carried out by the main loop.
+const (
+	// Re-read the config file and replace the notification pipeline.
+	ADMIN_RELOAD string = "reload"
+	// Forget the known services and their availability history.
+	ADMIN_CLEAR_STATE string = "clear-state"
+	// Start a new browse straight away.
+	ADMIN_RESCAN string = "rescan"
+	// Take a snapshot of the internal state.
+	ADMIN_DUMP string = "dump"
+)
+
+// adminRequest Asks the main loop to carry out an action, the result is
+// sent on done.
+type adminRequest struct {
+	action string
+	// service is the service type the action applies to, every one if
+	// it's empty.
+	service string
+	done    chan error
+	// dumped carries the snapshot taken by ADMIN_DUMP.
+	dumped chan *stateDump
+}
+
+// adminResult is the response of the admin endpoints.
+type adminResult struct {
+	Action string `json:"action"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// perform Asks the main loop to carry out action and writes the result.
+// The service query parameter selects a service type.
+func (as *apiServer) perform(w http.ResponseWriter, r *http.Request, action string) {
+	request := adminRequest{action: action,
+		service: r.URL.Query().Get("service"),
+		done:    make(chan error, 1)}
+	select {
+	case as.admin <- request:
+		break
+	case <-r.Context().Done():
+		return
+	}
+
+	select {
+	case err := <-request.done:
+		if err != nil {
+			writeJSONStatus(w, http.StatusInternalServerError,
+				adminResult{Action: action, Status: "failed", Error: err.Error()})
+			return
+		}
+
+		writeJSON(w, adminResult{Action: action, Status: "ok"})
+		break
+	case <-r.Context().Done():
+		break
+	}
+}
+
+// reload Re-reads the config file.
+func (as *apiServer) reload(w http.ResponseWriter, r *http.Request) {
+	as.perform(w, r, ADMIN_RELOAD)
+}
+
+// clearState Forgets the known services.
+func (as *apiServer) clearState(w http.ResponseWriter, r *http.Request) {
+	as.perform(w, r, ADMIN_CLEAR_STATE)
+}
+
+// rescan Starts a new browse of the service query parameter's type, or of
+// every one.
+func (as *apiServer) rescan(w http.ResponseWriter, r *http.Request) {
+	as.perform(w, r, ADMIN_RESCAN)
+}
+
+// restartSections Returns the parts of the config which differ between
+// current and next but which a reload doesn't apply, they only take effect
+// when zcnotify is restarted.
+func restartSections(current *config, next *config) []string {
+	sections := []struct {
+		name    string
+		current any
+		next    any
+	}{
+		{"watched services", current.browseTargets(), next.browseTargets()},
+		{"Output", current.Output, next.Output},
+		{"LowPower", current.LowPower, next.LowPower},
+		{"AdaptiveScan",
+			[]any{current.AdaptiveScan, current.MinScanPeriodSeconds, current.MaxScanPeriodSeconds},
+			[]any{next.AdaptiveScan, next.MinScanPeriodSeconds, next.MaxScanPeriodSeconds}},
+		{"BrowseTimeoutSeconds", current.BrowseTimeoutSeconds, next.BrowseTimeoutSeconds},
+		{"[zeroconf]", current.Zeroconf, next.Zeroconf},
+		{"[interfaces]", current.Interfaces, next.Interfaces},
+		{"[metrics]", current.Metrics, next.Metrics},
+		{"[api]", current.Api, next.Api},
+		{"[server]", current.Server, next.Server},
+		{"[ack]", current.Ack, next.Ack},
+		{"[history]", current.History, next.History},
+		{"[enrich]", current.Enrich, next.Enrich},
+		{"[site]", current.Site, next.Site},
+		{"[dedupe]", current.Dedupe, next.Dedupe},
+		{"[correlate]", current.Correlate, next.Correlate},
+		{"[bus]", current.Bus, next.Bus},
+		{"[modify]", current.Modify, next.Modify},
+		{"[probe]", current.Probe, next.Probe},
+		{"[[identity]]", current.Identity, next.Identity},
+		{"[[expect]]", current.Expect, next.Expect},
+		{"[state]", current.State, next.State},
+		{"[shadow]", current.Shadow, next.Shadow},
+		{"[trace]", current.Trace, next.Trace},
+		{"[[advertise]]", current.Advertise, next.Advertise},
+		{"[capture]", current.Capture, next.Capture},
+		{"[aggregator]", current.Aggregator, next.Aggregator},
+		{"[debug]", current.Debug, next.Debug},
+	}
+
+	var changed []string
+	for _, section := range sections {
+		if !reflect.DeepEqual(section.current, section.next) {
+			changed = append(changed, section.name)
+		}
+	}
+
+	return changed
+}
+
+// adminCommand Asks a running instance to carry out an admin action.
+func adminCommand(name string, args []string) int {
+	fs := newFlagSet(name,
+		ADMIN_RELOAD+"|"+ADMIN_CLEAR_STATE+"|"+ADMIN_RESCAN+" [service type]")
+	common := addCommonFlags(fs)
+	addr := fs.String("api", "",
+		"Address of the instance's API, defaults to the configured API listener")
+	token := fs.String("token", "",
+		"Bearer token for the API, defaults to the first [server] admin token")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || (fs.NArg() > 1 && fs.Arg(0) != ADMIN_RESCAN) || fs.NArg() > 2 {
+		fs.Usage()
+		return 2
+	}
+
+	var method, path string
+	switch fs.Arg(0) {
+	case ADMIN_RELOAD:
+		method, path = http.MethodPost, "/reload"
+		break
+	case ADMIN_CLEAR_STATE:
+		method, path = http.MethodDelete, "/state"
+		break
+	case ADMIN_RESCAN:
+		method, path = http.MethodPost, "/rescan"
+		if fs.NArg() == 2 {
+			path += "?service=" + url.QueryEscape(fs.Arg(1))
+		}
+		break
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	client := newCommandAPIClient(common, *addr, *token, ROLE_ADMIN)
+	resp, err := client.do(method, path, nil)
+	if err != nil {
+		fatal("failed to query API", "err", err)
+	}
+	defer resp.Body.Close()
+
+	var result adminResult
+	body, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(body, &result); err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %s %s\n", fs.Arg(0), resp.Status, body)
+		return 1
+	}
+
+	if result.Status != "ok" {
+		fmt.Fprintf(os.Stderr, "%s failed: %s\n", result.Action, result.Error)
+		return 1
+	}
+
+	fmt.Printf("%s: ok\n", result.Action)
+	return 0
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// advertiseConfig is a single [[advertise]] block, a service zcnotify
+// registers itself while it runs.
+type advertiseConfig struct {
+	// Instance name, the host name if not given.
+	Instance string
+	Service  string
+	// Port of the service, the [api] Listen port if 0.
+	Port int
+	// TXT records, e.g. ["path=/services"].
+	Text []string
+}
+
+// setupAdvertise Validates the [[advertise]] blocks and fills in their
+// defaults.
+func (zcnConfig *config) setupAdvertise() error {
+	for i := range zcnConfig.Advertise {
+		advertise := &zcnConfig.Advertise[i]
+		if err := validService(advertise.Service); err != nil {
+			return fmt.Errorf("advertise: %s", err.Error())
+		}
+
+		if subtype, _ := splitSubtype(advertise.Service); subtype != "" {
+			return fmt.Errorf("advertise %s: subtypes can't be advertised",
+				advertise.Service)
+		}
+
+		if advertise.Instance == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return fmt.Errorf("advertise %s: no Instance and %s",
+					advertise.Service, err.Error())
+			}
+			advertise.Instance = hostname
+		}
+
+		if advertise.Port == 0 {
+			_, port, err := net.SplitHostPort(zcnConfig.Api.Listen)
+			if err != nil {
+				return fmt.Errorf("advertise %s: no Port and no [api] Listen port to use",
+					advertise.Service)
+			}
+			advertise.Port, _ = strconv.Atoi(port)
+		}
+
+		if advertise.Port < 1 || advertise.Port > 65535 {
+			return fmt.Errorf("advertise %s: invalid Port %d",
+				advertise.Service, advertise.Port)
+		}
+	}
+
+	return nil
+}
+
+// advertiser Registers the [[advertise]] services on the discovery
+// interfaces, they're registered again whenever the interfaces change.
+type advertiser struct {
+	services []advertiseConfig
+	servers  []*zeroconf.Server
+}
+
+// newAdvertiser Creates the advertiser, the config has already been
+// validated by loadConfig.
+func newAdvertiser(services []advertiseConfig) *advertiser {
+	return &advertiser{services: services}
+}
+
+// start Registers every service on intfs.  A service which can't be
+// registered is logged rather than being fatal, as advertising is secondary
+// to watching.
+func (a *advertiser) start(intfs []net.Interface) {
+	for _, service := range a.services {
+		server, err := zeroconf.Register(service.Instance,
+			service.Service,
+			DEFAULT_DOMAIN,
+			service.Port,
+			service.Text,
+			intfs)
+		if err != nil {
+			slog.Error("failed to advertise service",
+				"instance", service.Instance,
+				"service", service.Service,
+				"err", err)
+			continue
+		}
+
+		slog.Info("advertising service",
+			"instance", service.Instance,
+			"service", service.Service,
+			"port", service.Port)
+		a.servers = append(a.servers, server)
+	}
+}
+
+// stop Withdraws every registered service, announcing that it's gone.
+func (a *advertiser) stop() {
+	for _, server := range a.servers {
+		server.Shutdown()
+	}
+
+	a.servers = nil
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// Events from agents waiting for the pipeline, requests block once it's
+// full.
+const DEFAULT_AGGREGATOR_BACKLOG = 64
+
+var aggregatorEventsMetric = metrics.newCounter("zcnotify_aggregator_events_total",
+	"Events received from agents.")
+
+// aggregatorConfig is the [aggregator] section of the config file, which
+// makes this instance accept the events of agents at other sites and notify
+// on their behalf.
+type aggregatorConfig struct {
+	// Address agents connect to, e.g. ":9467".
+	Listen string
+	// Server certificate and key, agents connect with HTTPS.
+	CertFile string
+	KeyFile  string
+	// CA which signs the agents' client certificates, agents without one
+	// are refused.  Each agent's certificate names its site, as its common
+	// name or one of its DNS names.
+	ClientCAFile string
+}
+
+// setupAggregator Checks the [aggregator] section's certificates.
+func (zcnConfig *config) setupAggregator() error {
+	if zcnConfig.Aggregator.Listen == "" {
+		return nil
+	}
+
+	if zcnConfig.Aggregator.CertFile == "" ||
+		zcnConfig.Aggregator.KeyFile == "" ||
+		zcnConfig.Aggregator.ClientCAFile == "" {
+		return errors.New("aggregator: CertFile, KeyFile and ClientCAFile are required")
+	}
+
+	if _, err := zcnConfig.Aggregator.tlsConfig(); err != nil {
+		return fmt.Errorf("aggregator: %s", err.Error())
+	}
+
+	return nil
+}
+
+// tlsConfig Returns the TLS settings of the listener, which requires a
+// client certificate signed by ClientCAFile.
+func (ac *aggregatorConfig) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(ac.CertFile, ac.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("server certificate: %s", err.Error())
+	}
+
+	clientCAs, err := loadCertPool(ac.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert},
+		ClientCAs:  clientCAs,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		MinVersion: tls.VersionTLS12}, nil
+}
+
+// loadCertPool Returns the CA certificates in a PEM file.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("CA file: %s", err.Error())
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("CA file: no certificates in %q", file)
+	}
+
+	return pool, nil
+}
+
+// aggregatedSite is the inventory of a single agent's site.
+type aggregatedSite struct {
+	registry *serviceRegistry
+	lastSeen time.Time
+}
+
+// siteSummary describes a site in the API.
+type siteSummary struct {
+	Site     string    `json:"site"`
+	Services int       `json:"services"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// aggregator Accepts events and inventories from agents, keeping the
+// inventory of every site.  The events are passed to the pipeline through
+// received, to be recorded and delivered like local ones.
+type aggregator struct {
+	conf    aggregatorConfig
+	changes chan ServiceEntryChange
+	mutex   sync.Mutex
+	sites   map[string]*aggregatedSite
+}
+
+// newAggregator Creates the aggregator, or returns nil if this instance
+// isn't one.
+func newAggregator(conf aggregatorConfig) *aggregator {
+	if conf.Listen == "" {
+		return nil
+	}
+
+	return &aggregator{conf: conf,
+		changes: make(chan ServiceEntryChange, DEFAULT_AGGREGATOR_BACKLOG),
+		sites:   make(map[string]*aggregatedSite)}
+}
+
+// received Returns the channel of events from agents, nil if this instance
+// isn't an aggregator so that it's never ready.
+func (ag *aggregator) received() <-chan ServiceEntryChange {
+	if ag == nil {
+		return nil
+	}
+
+	return ag.changes
+}
+
+// site Returns the named site, adding it if it's new, and records that it
+// was heard from.  The mutex must be held.
+func (ag *aggregator) site(name string) *aggregatedSite {
+	site, ok := ag.sites[name]
+	if !ok {
+		site = &aggregatedSite{registry: newServiceRegistry()}
+		ag.sites[name] = site
+		slog.Info("new aggregated site", "site", name)
+	}
+
+	site.lastSeen = time.Now().UTC()
+	return site
+}
+
+// apply Updates the inventory of the change's site.
+func (ag *aggregator) apply(change *ServiceEntryChange) {
+	ag.mutex.Lock()
+	defer ag.mutex.Unlock()
+
+	ag.site(change.Site).registry.apply(change)
+}
+
+// summaries Returns every site, sorted by name.
+func (ag *aggregator) summaries() []siteSummary {
+	ag.mutex.Lock()
+	defer ag.mutex.Unlock()
+
+	summaries := make([]siteSummary, 0, len(ag.sites))
+	for name, site := range ag.sites {
+		summaries = append(summaries, siteSummary{Site: name,
+			Services: len(site.registry.snapshot()),
+			LastSeen: site.lastSeen})
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Site < summaries[j].Site
+	})
+
+	return summaries
+}
+
+// services Returns the services present at a site, false if there's no
+// such site.
+func (ag *aggregator) services(name string) ([]zeroconf.ServiceEntry, bool) {
+	ag.mutex.Lock()
+	defer ag.mutex.Unlock()
+
+	site, ok := ag.sites[name]
+	if !ok {
+		return nil, false
+	}
+
+	return site.registry.snapshot(), true
+}
+
+// handler Returns the routes agents use.
+func (ag *aggregator) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /events", ag.postEvent)
+	mux.HandleFunc("POST /events/batch", ag.postEvents)
+	mux.HandleFunc("PUT /sites/{site}/inventory", ag.putInventory)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{"status": "ok"})
+	})
+	return mux
+}
+
+// postEvent Passes an agent's event on to the pipeline.
+func (ag *aggregator) postEvent(w http.ResponseWriter, r *http.Request) {
+	var change ServiceEntryChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !agentSite(w, r, change.Site) {
+		return
+	}
+
+	if ag.accept(r, &change) {
+		writeJSON(w, map[string]string{"id": change.ID})
+	}
+}
+
+// postEvents Passes a batch of an agent's events on to the pipeline, in
+// order.
+func (ag *aggregator) postEvents(w http.ResponseWriter, r *http.Request) {
+	var changes []ServiceEntryChange
+	if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for i := range changes {
+		if !agentSite(w, r, changes[i].Site) {
+			return
+		}
+	}
+
+	ids := make([]string, 0, len(changes))
+	for i := range changes {
+		if !ag.accept(r, &changes[i]) {
+			return
+		}
+		ids = append(ids, changes[i].ID)
+	}
+
+	writeJSON(w, map[string][]string{"ids": ids})
+}
+
+// agentSite Checks that the agent making a request may speak for site: the
+// site must be named by its client certificate, as the common name or one of
+// the DNS names, and mustn't contain control characters, as it ends up in
+// email headers and log lines.  Otherwise the request is refused and false
+// returned.
+func agentSite(w http.ResponseWriter, r *http.Request, site string) bool {
+	if site == "" {
+		http.Error(w, "event has no site", http.StatusBadRequest)
+		return false
+	}
+
+	if strings.IndexFunc(site, unicode.IsControl) >= 0 {
+		http.Error(w, fmt.Sprintf("invalid site %q", site), http.StatusBadRequest)
+		return false
+	}
+
+	if r.TLS != nil && len(r.TLS.PeerCertificates) != 0 {
+		cert := r.TLS.PeerCertificates[0]
+		if strings.EqualFold(cert.Subject.CommonName, site) {
+			return true
+		}
+
+		for _, name := range cert.DNSNames {
+			if strings.EqualFold(name, site) {
+				return true
+			}
+		}
+	}
+
+	http.Error(w, fmt.Sprintf("certificate doesn't name site %q", site), http.StatusForbidden)
+	return false
+}
+
+// accept Passes an event on to the pipeline, giving it an ID if it has
+// none.  Returns false if the request was cancelled first.
+func (ag *aggregator) accept(r *http.Request, change *ServiceEntryChange) bool {
+	if change.ID == "" {
+		change.ID = newEventID()
+	}
+
+	select {
+	case ag.changes <- *change:
+		aggregatorEventsMetric.With("site", change.Site).Inc()
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// putInventory Replaces the inventory of a site with the one its agent
+// sent, without notifying.
+func (ag *aggregator) putInventory(w http.ResponseWriter, r *http.Request) {
+	site := r.PathValue("site")
+	if !agentSite(w, r, site) {
+		return
+	}
+
+	var jsonEntries []serviceEntryJSON
+	if err := json.NewDecoder(r.Body).Decode(&jsonEntries); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries := make([]zeroconf.ServiceEntry, 0, len(jsonEntries))
+	for i := range jsonEntries {
+		entries = append(entries, jsonEntries[i].serviceEntry())
+	}
+
+	registry := newServiceRegistry()
+	registry.seed(entries)
+
+	ag.mutex.Lock()
+	ag.site(site).registry = registry
+	ag.mutex.Unlock()
+
+	writeJSON(w, map[string]int{"services": len(entries)})
+}
+
+// serve Accepts agents on the [aggregator] Listen address, or the
+// "aggregator" socket from systemd, until the process exits.
+func (ag *aggregator) serve() {
+	if ag == nil {
+		return
+	}
+
+	// The certificates have been checked by setupAggregator.
+	tlsConf, _ := ag.conf.tlsConfig()
+	listener, err := listen("aggregator", ag.conf.Listen)
+	if err != nil {
+		slog.Error("aggregator listener failed", "err", err)
+		return
+	}
+
+	slog.Info("accepting agents", "listen", listener.Addr().String())
+	server := &http.Server{Handler: ag.handler(), TLSConfig: tlsConf}
+	if err := server.ServeTLS(listener, "", ""); err != nil {
+		slog.Error("aggregator listener failed", "err", err)
+	}
+}
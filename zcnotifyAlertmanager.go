@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	DEFAULT_ALERTMANAGER_TIMEOUT uint = 10
+	// Minutes after which alerts about changes, rather than a service being
+	// gone, resolve themselves.
+	DEFAULT_ALERTMANAGER_RESOLVE uint = 60
+	// Alertmanager resolves alerts which aren't repeated, so firing alerts
+	// are sent again at this interval.
+	ALERTMANAGER_RESEND_INTERVAL time.Duration = time.Minute
+)
+
+// alertmanagerConfig describes a single [alertmanager.<name>] block.
+type alertmanagerConfig struct {
+	serviceFilter
+	scheduleConfig
+	// Template sets the description annotation of the alerts.
+	templateConfig
+	// Base URL of Alertmanager, e.g. "http://alertmanager:9093".
+	URL string
+	// Bearer token, may reference ${ENV_VAR}s or be read from TokenFile.
+	Token     string
+	TokenFile string
+	// Labels added to every alert, e.g. { team = "network" }.
+	Labels map[string]string
+	// Minutes after which change alerts resolve themselves.
+	ResolveMinutes uint
+	TimeoutSeconds uint
+}
+
+// alert is an alert in the format of Alertmanager's v2 API.
+type alert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       *time.Time        `json:"endsAt,omitempty"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// validAlertmanagerConfig Checks every [alertmanager.<name>] block and fills
+// in the defaults.
+func validAlertmanagerConfig(amConfs map[string]alertmanagerConfig) error {
+	if len(amConfs) == 0 {
+		return errors.New("no [alertmanager.<name>] blocks")
+	}
+
+	for name, amConf := range amConfs {
+		parsed, err := url.Parse(amConf.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return fmt.Errorf("alertmanager config: %q invalid URL %q", name, amConf.URL)
+		}
+
+		if amConf.ResolveMinutes == 0 {
+			amConf.ResolveMinutes = DEFAULT_ALERTMANAGER_RESOLVE
+		}
+
+		if amConf.TimeoutSeconds == 0 {
+			amConf.TimeoutSeconds = DEFAULT_ALERTMANAGER_TIMEOUT
+		}
+
+		if err := amConf.setup(fmt.Sprintf("alertmanager config: %q", name)); err != nil {
+			return err
+		}
+
+		amConfs[name] = amConf
+	}
+
+	return nil
+}
+
+// alertmanagerNotifier Sends events to the Alertmanager of a single
+// [alertmanager.<name>] block.  A service going away or becoming unreachable
+// fires an alert which is resolved when the service returns, other changes
+// are alerts which resolve themselves after ResolveMinutes.
+type alertmanagerNotifier struct {
+	name     string
+	conf     alertmanagerConfig
+	template *template.Template
+	client   *http.Client
+	firing   *firingAlerts
+	resender sync.Once
+	exit     chan struct{}
+}
+
+// firingAlerts holds the alerts waiting for their service to return, by
+// service instance name and alert name.  They outlive a reload, the notifier
+// which replaces a block's takes them over.
+type firingAlerts struct {
+	mutex  sync.Mutex
+	alerts map[string]map[string]alert
+}
+
+// newAlertmanagerNotifier Creates a notifier for the alertmanager block
+// called name.
+func newAlertmanagerNotifier(name string, conf alertmanagerConfig) *alertmanagerNotifier {
+	return &alertmanagerNotifier{name: "alertmanager." + name,
+		conf:     conf,
+		template: parseTemplate("alertmanager."+name, conf.Template),
+		client:   &http.Client{Timeout: time.Duration(conf.TimeoutSeconds) * time.Second},
+		firing:   &firingAlerts{alerts: make(map[string]map[string]alert)},
+		exit:     make(chan struct{})}
+}
+
+// inherit Implements inheritor, the alerts of the notifier a reload replaced
+// keep firing, and those it's still delivering update them.  They're resent
+// from now on as the previous notifier stops resending them once closed.
+func (an *alertmanagerNotifier) inherit(previous notifier) {
+	prev, ok := previous.(*alertmanagerNotifier)
+	if !ok {
+		return
+	}
+
+	an.firing = prev.firing
+	an.firing.mutex.Lock()
+	firing := len(an.firing.alerts) != 0
+	an.firing.mutex.Unlock()
+	if firing {
+		an.resender.Do(func() { go an.resend() })
+	}
+}
+
+// close Implements closer, the firing alerts are resent by the notifier
+// which replaced this one.
+func (an *alertmanagerNotifier) close() {
+	close(an.exit)
+}
+
+func (an *alertmanagerNotifier) Name() string {
+	return an.name
+}
+
+func (an *alertmanagerNotifier) Allows(change *ServiceEntryChange) (bool, string) {
+	return an.conf.allowsChange(change)
+}
+
+// alertName Returns the alertname label for a change type.
+func alertName(changeType ServiceChangeType) string {
+	switch changeType {
+	case REMOVE:
+		return "ZeroconfServiceGone"
+	case UNREACHABLE:
+		return "ZeroconfServiceUnreachable"
+	case MISSING:
+		return "ZeroconfServiceMissing"
+	case ERROR:
+		return "ZcnotifyError"
+	case BACKEND_FAILED:
+		return "ZcnotifyBackendFailed"
+	case STARTED, STOPPED, RELOADED:
+		return "ZcnotifyLifecycle"
+	default:
+		return "ZeroconfServiceChanged"
+	}
+}
+
+// firingChange Returns true for the change types which fire an alert until
+// the service returns.
+func firingChange(changeType ServiceChangeType) bool {
+	return changeType == REMOVE || changeType == UNREACHABLE || changeType == MISSING
+}
+
+// labels Returns the labels of the alert for a change.
+func (an *alertmanagerNotifier) labels(change *ServiceEntryChange) map[string]string {
+	labels := map[string]string{"alertname": alertName(change.ChangeType),
+		"instance":   change.Entry.Instance,
+		"service":    change.Entry.Service,
+		"domain":     strings.TrimSuffix(change.Entry.Domain, "."),
+		"changetype": change.ChangeType.String(),
+		"severity":   change.Severity.String()}
+	if change.Shadow {
+		labels["shadow"] = "true"
+	}
+
+	for name, value := range an.conf.Labels {
+		labels[name] = value
+	}
+
+	return labels
+}
+
+// alerts Returns the alerts to send for changes: the alert for each change
+// itself, and the resolution of any alerts about the service going away
+// if it has returned.  The firing alerts aren't changed, the firing alerts
+// of each service after the changes are returned instead, nil for a service
+// whose alerts are resolved, for commit to record once the alerts are sent.
+func (an *alertmanagerNotifier) alerts(changes ...*ServiceEntryChange) ([]alert, map[string]map[string]alert) {
+	an.firing.mutex.Lock()
+	defer an.firing.mutex.Unlock()
+
+	var alerts []alert
+	updates := make(map[string]map[string]alert)
+	for _, change := range changes {
+		name := change.Entry.ServiceInstanceName()
+		if (change.ChangeType == RENAMED || change.ChangeType == RECOVERED) &&
+			change.Previous != nil {
+			name = change.Previous.ServiceInstanceName()
+		}
+
+		firing, updated := updates[name]
+		if !updated {
+			firing = an.firing.alerts[name]
+		}
+
+		if !firingChange(change.ChangeType) {
+			for _, resolved := range firing {
+				ended := change.Timestamp
+				resolved.EndsAt = &ended
+				resolved.Annotations = map[string]string{"summary": fmt.Sprintf("%q is back (%s)",
+					change.Entry.Instance, change.ChangeType.String())}
+				alerts = append(alerts, resolved)
+			}
+			if firing != nil {
+				updates[name] = nil
+			}
+		}
+
+		details, _ := json.Marshal(change.toJSON(false))
+		current := alert{Labels: an.labels(change),
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("%s %q (%s)",
+					change.ChangeType.String(),
+					change.Entry.Instance,
+					change.Entry.Service),
+				"host":  change.Entry.HostName,
+				"event": string(details)},
+			StartsAt:     change.Timestamp,
+			GeneratorURL: change.URL}
+		if description := applyTemplate(an.template, change, ""); description != "" {
+			current.Annotations["description"] = description
+		}
+		if firingChange(change.ChangeType) {
+			// A retried notification replaces the alert rather than adding
+			// another.
+			next := make(map[string]alert, len(firing)+1)
+			for alertname, a := range firing {
+				next[alertname] = a
+			}
+			next[current.Labels["alertname"]] = current
+			updates[name] = next
+		} else {
+			expires := change.Timestamp.Add(time.Duration(an.conf.ResolveMinutes) * time.Minute)
+			current.EndsAt = &expires
+		}
+
+		alerts = append(alerts, current)
+	}
+
+	return alerts, updates
+}
+
+// commit Records the firing alerts returned by alerts once they've been
+// sent.
+func (an *alertmanagerNotifier) commit(updates map[string]map[string]alert) {
+	an.firing.mutex.Lock()
+	defer an.firing.mutex.Unlock()
+
+	for name, firing := range updates {
+		if firing == nil {
+			delete(an.firing.alerts, name)
+		} else {
+			an.firing.alerts[name] = firing
+		}
+	}
+}
+
+// post Sends alerts to Alertmanager.
+func (an *alertmanagerNotifier) post(alerts []alert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return fmt.Errorf("marshal error: %s", err.Error())
+	}
+
+	req, err := http.NewRequest(http.MethodPost,
+		strings.TrimSuffix(an.conf.URL, "/")+"/api/v2/alerts",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if an.conf.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+an.conf.Token)
+	}
+
+	resp, err := an.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("alertmanager request failed: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// render Returns the alerts as they would be posted.
+func (an *alertmanagerNotifier) render(alerts []alert) (string, error) {
+	body, err := json.MarshalIndent(alerts, "", "    ")
+	if err != nil {
+		return "", fmt.Errorf("marshal error: %s", err.Error())
+	}
+
+	return "POST " + strings.TrimSuffix(an.conf.URL, "/") + "/api/v2/alerts\n\n" +
+		string(body), nil
+}
+
+// Render Returns the alerts which would be sent for a change, without
+// changing the alerts which are firing.
+func (an *alertmanagerNotifier) Render(change *ServiceEntryChange) (string, error) {
+	alerts, _ := an.alerts(change)
+	return an.render(alerts)
+}
+
+// resend Sends the firing alerts again periodically so that Alertmanager
+// doesn't resolve them, until the notifier is closed.
+func (an *alertmanagerNotifier) resend() {
+	ticker := time.NewTicker(ALERTMANAGER_RESEND_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			break
+		case <-an.exit:
+			return
+		}
+
+		an.firing.mutex.Lock()
+		var alerts []alert
+		for _, firing := range an.firing.alerts {
+			for _, a := range firing {
+				alerts = append(alerts, a)
+			}
+		}
+		an.firing.mutex.Unlock()
+
+		if len(alerts) == 0 {
+			continue
+		}
+
+		if err := an.post(alerts); err != nil {
+			slog.Warn("failed to resend firing alerts",
+				"backend", an.name,
+				"alerts", len(alerts),
+				"err", err)
+		}
+	}
+}
+
+// Notify Sends the alerts for a change.  The firing alerts only change once
+// Alertmanager has accepted them, so a failed notification which is retried
+// still resolves the alerts of a returning service.
+func (an *alertmanagerNotifier) Notify(change *ServiceEntryChange) error {
+	an.resender.Do(func() { go an.resend() })
+	alerts, updates := an.alerts(change)
+	if err := an.post(alerts); err != nil {
+		return err
+	}
+
+	an.commit(updates)
+	return nil
+}
+
+// digestChanges Returns pointers to the changes of a digest.
+func digestChanges(changes []ServiceEntryChange) []*ServiceEntryChange {
+	pointers := make([]*ServiceEntryChange, len(changes))
+	for i := range changes {
+		pointers[i] = &changes[i]
+	}
+
+	return pointers
+}
+
+// RenderDigest Returns the alerts which would be sent for a digest.
+func (an *alertmanagerNotifier) RenderDigest(changes []ServiceEntryChange) (string, error) {
+	alerts, _ := an.alerts(digestChanges(changes)...)
+	return an.render(alerts)
+}
+
+// NotifyDigest Sends the alerts for every change held back during quiet
+// hours in a single request.
+func (an *alertmanagerNotifier) NotifyDigest(changes []ServiceEntryChange) error {
+	an.resender.Do(func() { go an.resend() })
+	alerts, updates := an.alerts(digestChanges(changes)...)
+	if err := an.post(alerts); err != nil {
+		return err
+	}
+
+	an.commit(updates)
+	return nil
+}
+
+// Check Asks Alertmanager for its status.
+func (an *alertmanagerNotifier) Check() error {
+	req, err := http.NewRequest(http.MethodGet,
+		strings.TrimSuffix(an.conf.URL, "/")+"/api/v2/status",
+		nil)
+	if err != nil {
+		return err
+	}
+
+	if an.conf.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+an.conf.Token)
+	}
+
+	resp, err := an.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("alertmanager status request failed: %s", resp.Status)
+	}
+
+	return nil
+}
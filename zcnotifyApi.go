@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	// Time allowed for API requests made by the command line client.
+	DEFAULT_API_CLIENT_TIMEOUT time.Duration = 5 * time.Second
+	// Period covered by availability reports if none is given.
+	DEFAULT_REPORT_PERIOD string = "7d"
+)
+
+// apiConfig controls the HTTP API listener.
+type apiConfig struct {
+	Listen string
+}
+
+// apiServer Serves the HTTP API of a running instance.
+type apiServer struct {
+	registry *serviceRegistry
+	presence *presenceTracker
+	history  *historyWriter
+	traces   *traceStore
+	health   *healthMonitor
+	// aggregator is set if this instance is one.
+	aggregator *aggregator
+	silences   *silenceStore
+	acks       *ackStore
+	// server decides who may use the admin endpoints, whose requests are
+	// carried out by the main loop.
+	server *serverConfig
+	admin  chan<- adminRequest
+	// sampler is set if the diagnostics endpoints are enabled.
+	sampler *statsSampler
+}
+
+// handler Returns the routes served by the API.
+func (as *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /services", as.services)
+	mux.HandleFunc("GET /services/{instance}/timeline", as.timeline)
+	mux.HandleFunc("GET /availability", as.availability)
+	mux.HandleFunc("GET /traces", as.recentTraces)
+	mux.HandleFunc("GET /traces/{id}", as.trace)
+	mux.HandleFunc("GET /healthz", as.healthz)
+	mux.HandleFunc("GET /readyz", as.readyz)
+	mux.HandleFunc("GET /sites", as.sites)
+	mux.HandleFunc("GET /sites/{site}/services", as.siteServices)
+	mux.HandleFunc("POST /reload", as.server.admin(as.reload))
+	mux.HandleFunc("DELETE /state", as.server.admin(as.clearState))
+	mux.HandleFunc("POST /rescan", as.server.admin(as.rescan))
+	mux.HandleFunc("GET /dump", as.server.admin(as.dump))
+	mux.HandleFunc("GET /silences", as.listSilences)
+	mux.HandleFunc("POST /silences", as.server.admin(as.addSilence))
+	mux.HandleFunc("DELETE /silences/{id}", as.server.admin(as.expireSilence))
+	mux.HandleFunc("GET /ack", as.confirmAck)
+	mux.HandleFunc("POST /ack", as.acknowledge)
+	if as.sampler != nil {
+		as.handleDiagnostics(mux)
+	}
+	return mux
+}
+
+// registryEntryJSON is a service listed by the API, with when it was first
+// and last seen.
+type registryEntryJSON struct {
+	serviceEntryJSON
+	FirstSeen *time.Time `json:"firstSeen,omitempty"`
+	LastSeen  *time.Time `json:"lastSeen,omitempty"`
+}
+
+// services Returns every service currently present on the network.
+func (as *apiServer) services(w http.ResponseWriter, r *http.Request) {
+	entries := as.registry.snapshot()
+	now := time.Now().UTC()
+	jsonEntries := make([]registryEntryJSON, 0, len(entries))
+	for i := range entries {
+		jsonEntry := registryEntryJSON{serviceEntryJSON: newServiceEntryJSON(&entries[i])}
+		jsonEntry.FirstSeen, jsonEntry.LastSeen = as.presence.seen(entries[i].ServiceInstanceName(), now)
+		jsonEntries = append(jsonEntries, jsonEntry)
+	}
+
+	writeJSON(w, jsonEntries)
+}
+
+// sites Returns the sites of the agents an aggregator has heard from.
+func (as *apiServer) sites(w http.ResponseWriter, r *http.Request) {
+	if as.aggregator == nil {
+		http.Error(w, "not an aggregator", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, as.aggregator.summaries())
+}
+
+// siteServices Returns every service present at an agent's site.
+func (as *apiServer) siteServices(w http.ResponseWriter, r *http.Request) {
+	if as.aggregator == nil {
+		http.Error(w, "not an aggregator", http.StatusNotFound)
+		return
+	}
+
+	entries, ok := as.aggregator.services(r.PathValue("site"))
+	if !ok {
+		http.Error(w, "no such site", http.StatusNotFound)
+		return
+	}
+
+	jsonEntries := make([]serviceEntryJSON, 0, len(entries))
+	for i := range entries {
+		jsonEntries = append(jsonEntries, newServiceEntryJSON(&entries[i]))
+	}
+
+	writeJSON(w, jsonEntries)
+}
+
+// availability Returns the availability report for the period given by the
+// "period" parameter, 7 days by default.
+func (as *apiServer) availability(w http.ResponseWriter, r *http.Request) {
+	period := DEFAULT_REPORT_PERIOD
+	if r.URL.Query().Has("period") {
+		period = r.URL.Query().Get("period")
+	}
+
+	duration, err := parsePeriod(period)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, availabilityReport(as.presence.snapshot(), duration, time.Now().UTC()))
+}
+
+// timeline Returns when the services of an instance appeared and
+// disappeared, from the history.  The "since" parameter, an RFC 3339 time, a
+// date or a period before now, leaves out the intervals which ended before
+// it.
+func (as *apiServer) timeline(w http.ResponseWriter, r *http.Request) {
+	if as.history == nil || as.history.path == "" {
+		http.Error(w, "no history file configured", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now().UTC()
+	var since time.Time
+	if r.URL.Query().Has("since") {
+		var err error
+		if since, err = parseHistoryTime(r.URL.Query().Get("since"), now); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	changes, err := as.history.read()
+	if err != nil {
+		http.Error(w, "failed to read history", http.StatusInternalServerError)
+		slog.Error("failed to read history", "err", err)
+		return
+	}
+
+	timeline := presenceTimeline(changes, r.PathValue("instance"), now)
+	if len(timeline) == 0 {
+		http.Error(w, "no history of this instance", http.StatusNotFound)
+		return
+	}
+
+	intervals := make([]presenceInterval, 0, len(timeline))
+	for _, interval := range timeline {
+		if interval.Disappeared == nil || !interval.Disappeared.Before(since) {
+			intervals = append(intervals, interval)
+		}
+	}
+
+	writeJSON(w, intervals)
+}
+
+// recentTraces Returns the decision traces of the most recent events.
+func (as *apiServer) recentTraces(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, as.traces.recent())
+}
+
+// trace Returns the decision trace of a single event.
+func (as *apiServer) trace(w http.ResponseWriter, r *http.Request) {
+	event, ok := as.traces.find(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "no trace for event", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, event)
+}
+
+// writeJSON Writes v as the JSON body of a response.
+func writeJSON(w http.ResponseWriter, v any) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+// writeJSONStatus Writes v as the JSON body of a response with the given
+// status code.
+func writeJSONStatus(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("failed to write API response", "err", err)
+	}
+}
+
+// listen Returns the socket passed by systemd with FileDescriptorName=name
+// if there is one, otherwise it listens on address.
+func listen(name string, address string) (net.Listener, error) {
+	if listener := activatedListener(name); listener != nil {
+		return listener, nil
+	}
+
+	return net.Listen("tcp", address)
+}
+
+// serveAPI Serves the API on the given address, or the "api" socket from
+// systemd, until the process exits.  The health checks don't need
+// authenticating, so probes can reach them.
+func serveAPI(address string, server *serverConfig, as *apiServer) {
+	handler := server.protect(as.handler(), "/healthz", "/readyz", "/ack")
+	if err := server.serveHTTP("api", address, handler); err != nil {
+		slog.Error("API listener failed", "err", err)
+	}
+}
+
+// fetchServices Asks the instance serving the API for the services it
+// currently knows about.
+func fetchServices(client *apiClient) ([]zeroconf.ServiceEntry, error) {
+	resp, err := client.get("/services")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API request failed: %s", resp.Status)
+	}
+
+	var jsonEntries []serviceEntryJSON
+	if err := json.NewDecoder(resp.Body).Decode(&jsonEntries); err != nil {
+		return nil, err
+	}
+
+	entries := make([]zeroconf.ServiceEntry, 0, len(jsonEntries))
+	for i := range jsonEntries {
+		entries = append(entries, jsonEntries[i].serviceEntry())
+	}
+
+	return entries, nil
+}
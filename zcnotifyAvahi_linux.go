@@ -0,0 +1,250 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/grandcat/zeroconf"
+	"github.com/holoplot/go-avahi"
+)
+
+// Avahi doesn't pass on record TTLs, so entries have the TTL RFC 6762
+// recommends for SRV and address records.
+const DEFAULT_AVAHI_TTL uint32 = 120
+
+// avahiResolver Implements mdnsResolver by asking avahi-daemon over D-Bus,
+// so zcnotify doesn't need port 5353 on hosts where Avahi already has it.
+type avahiResolver struct {
+	protocol int32
+	// Interface indexes to report services on, Avahi browses them all.
+	intfs map[int32]bool
+}
+
+// newAvahiResolver Returns a resolver using Avahi with the given IP versions
+// on intfs.
+func newAvahiResolver(ipver zeroconf.IPType,
+	intfs []net.Interface) (mdnsResolver, error) {
+	ar := &avahiResolver{protocol: avahi.ProtoUnspec, intfs: make(map[int32]bool)}
+	switch ipver {
+	case zeroconf.IPv4:
+		ar.protocol = avahi.ProtoInet
+		break
+	case zeroconf.IPv6:
+		ar.protocol = avahi.ProtoInet6
+		break
+	}
+
+	for _, intf := range intfs {
+		ar.intfs[int32(intf.Index)] = true
+	}
+
+	return ar, nil
+}
+
+// connect Opens a private connection to avahi-daemon, closed along with the
+// server.
+func (ar *avahiResolver) connect() (*avahi.Server, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := avahi.ServerNew(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return server, nil
+}
+
+// avahiRunning Returns true if avahi-daemon answers on the system bus.
+func avahiRunning() bool {
+	server, err := (&avahiResolver{}).connect()
+	if err != nil {
+		return false
+	}
+
+	server.Close()
+	return true
+}
+
+// resolve Returns the entry of a single service found on an interface
+// and protocol.
+func (ar *avahiResolver) resolve(server *avahi.Server,
+	found avahi.Service) (*zeroconf.ServiceEntry, error) {
+	resolved, err := server.ResolveService(found.Interface,
+		found.Protocol,
+		found.Name,
+		found.Type,
+		found.Domain,
+		ar.protocol,
+		0)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := zeroconf.NewServiceEntry(resolved.Name, resolved.Type, resolved.Domain)
+	entry.HostName = strings.TrimSuffix(resolved.Host, ".") + "."
+	entry.Port = int(resolved.Port)
+	entry.TTL = DEFAULT_AVAHI_TTL
+	for _, txt := range resolved.Txt {
+		entry.Text = append(entry.Text, string(txt))
+	}
+
+	ip := net.ParseIP(strings.Split(resolved.Address, "%")[0])
+	if ip.To4() != nil {
+		entry.AddrIPv4 = []net.IP{ip}
+	} else if ip != nil {
+		entry.AddrIPv6 = []net.IP{ip}
+	}
+
+	return entry, nil
+}
+
+// Browse Browses with an Avahi ServiceBrowser until ctx is done.  Avahi
+// reports each instance once for every interface and protocol it's on,
+// these are merged and the entries sent once ctx is done.
+func (ar *avahiResolver) Browse(ctx context.Context,
+	service string,
+	domain string,
+	entries chan<- *zeroconf.ServiceEntry) error {
+	// avahi-daemon may be restarting, so failing to reach it is retried
+	// next period.
+	server, err := ar.connect()
+	if err != nil {
+		close(entries)
+		return &transientBrowseError{err}
+	}
+
+	browser, err := server.ServiceBrowserNew(avahi.InterfaceUnspec,
+		ar.protocol,
+		service,
+		domain,
+		0)
+	if err != nil {
+		server.Close()
+		close(entries)
+		return &transientBrowseError{err}
+	}
+
+	go func() {
+		defer close(entries)
+
+		var names []string
+		merged := make(map[string]*zeroconf.ServiceEntry)
+		for done := false; !done; {
+			select {
+			case found := <-browser.AddChannel:
+				if !ar.intfs[found.Interface] {
+					break
+				}
+
+				entry, err := ar.resolve(server, found)
+				if err != nil {
+					slog.Debug("avahi failed to resolve service",
+						"instance", found.Name,
+						"err", err)
+					break
+				}
+
+				if existing, ok := merged[found.Name]; ok {
+					mergeAddresses(existing, entry)
+				} else {
+					merged[found.Name] = entry
+					names = append(names, found.Name)
+				}
+				break
+			case <-browser.RemoveChannel:
+				break
+			case <-ctx.Done():
+				done = true
+				break
+			}
+		}
+
+		closeAvahi(server, browser)
+		for _, name := range names {
+			entries <- merged[name]
+		}
+	}()
+
+	return nil
+}
+
+// Lookup Resolves a single instance on any of the interfaces.
+func (ar *avahiResolver) Lookup(ctx context.Context,
+	instance string,
+	service string,
+	domain string,
+	entries chan<- *zeroconf.ServiceEntry) error {
+	server, err := ar.connect()
+	if err != nil {
+		close(entries)
+		return err
+	}
+
+	go func() {
+		defer close(entries)
+		defer server.Close()
+
+		var result *zeroconf.ServiceEntry
+		for index := range ar.intfs {
+			entry, err := ar.resolve(server, avahi.Service{Interface: index,
+				Protocol: ar.protocol,
+				Name:     instance,
+				Type:     service,
+				Domain:   domain})
+			if err != nil {
+				continue
+			}
+
+			if result == nil {
+				result = entry
+			} else {
+				mergeAddresses(result, entry)
+			}
+		}
+
+		if result != nil {
+			select {
+			case entries <- result:
+				break
+			case <-ctx.Done():
+				break
+			}
+		}
+	}()
+
+	return nil
+}
+
+// closeAvahi Frees the browser and closes the server.  The server's signal
+// dispatcher blocks until the browser's signals are read, so they're drained
+// meanwhile.
+func closeAvahi(server *avahi.Server, browser *avahi.ServiceBrowser) {
+	closed := make(chan bool)
+	go func() {
+		for {
+			select {
+			case _, ok := <-browser.AddChannel:
+				if !ok {
+					return
+				}
+				break
+			case <-browser.RemoveChannel:
+				break
+			case <-closed:
+				return
+			}
+		}
+	}()
+
+	server.Close()
+	close(closed)
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// newAvahiResolver Returns an error, Avahi is only supported on Linux.
+func newAvahiResolver(ipver zeroconf.IPType,
+	intfs []net.Interface) (mdnsResolver, error) {
+	return nil, errors.New("the avahi resolver is only supported on Linux")
+}
+
+// avahiRunning Returns false, there's no Avahi here.
+func avahiRunning() bool {
+	return false
+}
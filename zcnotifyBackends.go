@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// backendBlock is implemented by the config of every backend block, through
+// the serviceFilter and scheduleConfig which they embed.
+type backendBlock interface {
+	blockFilter() serviceFilter
+	blockSchedule() scheduleConfig
+}
+
+// blockFilter Returns the service filter of a backend block.
+func (sf serviceFilter) blockFilter() serviceFilter {
+	return sf
+}
+
+// blockSchedule Returns the quiet hours of a backend block.
+func (sc scheduleConfig) blockSchedule() scheduleConfig {
+	return sc
+}
+
+// backendType is a notification type, e.g. "email", which NotifyTypes can
+// name.  Everything which handles each type's blocks alike goes through it,
+// so adding a type is a matter of adding it to backendTypes.
+type backendType struct {
+	name string
+	// validate Checks the type's blocks and fills in their defaults.
+	validate func(zcnConfig *config) error
+	// names Returns the names of the type's blocks, sorted.
+	names func(zcnConfig *config) []string
+	// create Creates the notifier of the block called name.
+	create   func(zcnConfig *config, name string) notifier
+	filter   func(zcnConfig *config, name string) serviceFilter
+	schedule func(zcnConfig *config, name string) scheduleConfig
+	// expandSecrets Resolves environment references and secret files in
+	// every block.
+	expandSecrets func(zcnConfig *config) error
+	// merge Adds the type's blocks of a profile, see mergeBlocks.
+	merge func(zcnConfig *config, profileName string, profile *profileConfig) ([]string, error)
+}
+
+// newBackendType Describes the notification type called name whose blocks
+// are found by blocks and profileBlocks.  secrets resolves the secrets of a
+// single block, it's nil if the type has none.
+func newBackendType[T backendBlock](name string,
+	validate func(zcnConfig *config) error,
+	blocks func(zcnConfig *config) *map[string]T,
+	profileBlocks func(profile *profileConfig) map[string]T,
+	create func(name string, conf T) notifier,
+	secrets func(prefix string, conf *T) error) backendType {
+	return backendType{name: name,
+		validate: validate,
+		names: func(zcnConfig *config) []string {
+			return blockNames(*blocks(zcnConfig))
+		},
+		create: func(zcnConfig *config, block string) notifier {
+			return create(block, (*blocks(zcnConfig))[block])
+		},
+		filter: func(zcnConfig *config, block string) serviceFilter {
+			return (*blocks(zcnConfig))[block].blockFilter()
+		},
+		schedule: func(zcnConfig *config, block string) scheduleConfig {
+			return (*blocks(zcnConfig))[block].blockSchedule()
+		},
+		expandSecrets: func(zcnConfig *config) error {
+			if secrets == nil {
+				return nil
+			}
+
+			confs := *blocks(zcnConfig)
+			for block, conf := range confs {
+				if err := secrets(fmt.Sprintf("%s config: %q", name, block), &conf); err != nil {
+					return err
+				}
+				confs[block] = conf
+			}
+
+			return nil
+		},
+		merge: func(zcnConfig *config, profileName string, profile *profileConfig) ([]string, error) {
+			return mergeBlocks(zcnConfig, profileName, name, blocks(zcnConfig), profileBlocks(profile))
+		},
+	}
+}
+
+// backendTypes Every notification type, in the order their blocks are
+// merged from profiles.
+var backendTypes = []backendType{
+	newBackendType("email",
+		func(zcnConfig *config) error { return ValidEmailConfig(zcnConfig.Email) },
+		func(zcnConfig *config) *map[string]emailConfig { return &zcnConfig.Email },
+		func(profile *profileConfig) map[string]emailConfig { return profile.Email },
+		func(name string, conf emailConfig) notifier { return newEmailNotifier(name, conf) },
+		expandEmailSecrets),
+	newBackendType("alertmanager",
+		func(zcnConfig *config) error { return validAlertmanagerConfig(zcnConfig.Alertmanager) },
+		func(zcnConfig *config) *map[string]alertmanagerConfig { return &zcnConfig.Alertmanager },
+		func(profile *profileConfig) map[string]alertmanagerConfig { return profile.Alertmanager },
+		func(name string, conf alertmanagerConfig) notifier { return newAlertmanagerNotifier(name, conf) },
+		expandAlertmanagerSecrets),
+	newBackendType("mqtt",
+		func(zcnConfig *config) error { return validMqttConfig(zcnConfig.Mqtt) },
+		func(zcnConfig *config) *map[string]mqttConfig { return &zcnConfig.Mqtt },
+		func(profile *profileConfig) map[string]mqttConfig { return profile.Mqtt },
+		func(name string, conf mqttConfig) notifier { return newMqttNotifier(name, conf) },
+		expandMqttSecrets),
+	newBackendType("snmptrap",
+		func(zcnConfig *config) error { return validSnmpTrapConfig(zcnConfig.SnmpTrap) },
+		func(zcnConfig *config) *map[string]snmpTrapConfig { return &zcnConfig.SnmpTrap },
+		func(profile *profileConfig) map[string]snmpTrapConfig { return profile.SnmpTrap },
+		func(name string, conf snmpTrapConfig) notifier { return newSnmpTrapNotifier(name, conf) },
+		expandSnmpTrapSecrets),
+	newBackendType("journald",
+		validJournaldConfig,
+		func(zcnConfig *config) *map[string]journaldConfig { return &zcnConfig.Journald },
+		func(profile *profileConfig) map[string]journaldConfig { return profile.Journald },
+		func(name string, conf journaldConfig) notifier { return newJournaldNotifier(name, conf) },
+		nil),
+	newBackendType("console",
+		validConsoleConfig,
+		func(zcnConfig *config) *map[string]consoleConfig { return &zcnConfig.Console },
+		func(profile *profileConfig) map[string]consoleConfig { return profile.Console },
+		func(name string, conf consoleConfig) notifier { return newConsoleNotifier(name, conf) },
+		nil),
+	newBackendType("eventlog",
+		validEventLogConfig,
+		func(zcnConfig *config) *map[string]eventLogConfig { return &zcnConfig.EventLog },
+		func(profile *profileConfig) map[string]eventLogConfig { return profile.EventLog },
+		func(name string, conf eventLogConfig) notifier { return newEventLogNotifier(name, conf) },
+		nil),
+	newBackendType("forward",
+		func(zcnConfig *config) error {
+			return validForwardConfig(zcnConfig.Forward, zcnConfig.Site.Name)
+		},
+		func(zcnConfig *config) *map[string]forwardConfig { return &zcnConfig.Forward },
+		func(profile *profileConfig) map[string]forwardConfig { return profile.Forward },
+		func(name string, conf forwardConfig) notifier { return newForwardNotifier(name, conf) },
+		expandForwardSecrets),
+	newBackendType("sms",
+		func(zcnConfig *config) error { return validSmsConfig(zcnConfig.Sms) },
+		func(zcnConfig *config) *map[string]smsConfig { return &zcnConfig.Sms },
+		func(profile *profileConfig) map[string]smsConfig { return profile.Sms },
+		func(name string, conf smsConfig) notifier { return newSmsNotifier(name, conf) },
+		expandSmsSecrets),
+	newBackendType(CHAT_TEAMS,
+		func(zcnConfig *config) error { return validChatConfig(CHAT_TEAMS, zcnConfig.Teams) },
+		func(zcnConfig *config) *map[string]chatConfig { return &zcnConfig.Teams },
+		func(profile *profileConfig) map[string]chatConfig { return profile.Teams },
+		func(name string, conf chatConfig) notifier { return newChatNotifier(CHAT_TEAMS, name, conf) },
+		expandChatSecrets),
+	newBackendType(CHAT_GOOGLE_CHAT,
+		func(zcnConfig *config) error { return validChatConfig(CHAT_GOOGLE_CHAT, zcnConfig.GoogleChat) },
+		func(zcnConfig *config) *map[string]chatConfig { return &zcnConfig.GoogleChat },
+		func(profile *profileConfig) map[string]chatConfig { return profile.GoogleChat },
+		func(name string, conf chatConfig) notifier { return newChatNotifier(CHAT_GOOGLE_CHAT, name, conf) },
+		expandChatSecrets),
+	newBackendType("plugin",
+		func(zcnConfig *config) error { return validPluginConfig(zcnConfig.Plugin) },
+		func(zcnConfig *config) *map[string]pluginConfig { return &zcnConfig.Plugin },
+		func(profile *profileConfig) map[string]pluginConfig { return profile.Plugin },
+		func(name string, conf pluginConfig) notifier { return newPluginNotifier(name, conf) },
+		expandPluginSecrets),
+}
+
+// lookupBackendType Returns the notification type called name, which is
+// case insensitive.
+func lookupBackendType(name string) (*backendType, error) {
+	for i := range backendTypes {
+		if strings.EqualFold(backendTypes[i].name, name) {
+			return &backendTypes[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown notification type %q", name)
+}
+
+// blockNames Returns the names of the blocks of a backend type, sorted so
+// that notifiers are created in a stable order.
+func blockNames[T any](blocks map[string]T) []string {
+	names := make([]string, 0, len(blocks))
+	for name := range blocks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// backendFilter Returns the filter of the backend block called route, e.g.
+// "email.pdmorrow".
+func (zcnConfig *config) backendFilter(route string) serviceFilter {
+	notifyType, name, _ := strings.Cut(route, ".")
+	bt, err := lookupBackendType(notifyType)
+	if err != nil {
+		return serviceFilter{}
+	}
+
+	return bt.filter(zcnConfig, name)
+}
+
+// backendSchedule Returns the quiet hours of the backend block called route,
+// e.g. "email.pdmorrow".
+func (zcnConfig *config) backendSchedule(route string) scheduleConfig {
+	notifyType, name, _ := strings.Cut(route, ".")
+	bt, err := lookupBackendType(notifyType)
+	if err != nil {
+		return scheduleConfig{}
+	}
+
+	return bt.schedule(zcnConfig, name)
+}
+
+// setupBackends Checks the blocks of every configured notification type.
+func (zcnConfig *config) setupBackends() error {
+	for _, notifyType := range zcnConfig.NotifyTypes {
+		bt, err := lookupBackendType(notifyType)
+		if err != nil {
+			return err
+		}
+
+		if err := bt.validate(zcnConfig); err != nil {
+			return fmt.Errorf("invalid %s configuration settings: %s", bt.name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// setupFilters Checks the change types of every backend block.
+func (zcnConfig *config) setupFilters() error {
+	for _, bt := range backendTypes {
+		for _, name := range bt.names(zcnConfig) {
+			filter := bt.filter(zcnConfig, name)
+			if err := filter.validate(); err != nil {
+				return fmt.Errorf("%s.%s: %s", bt.name, name, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// setupSchedules Validates the quiet hours of every backend block.
+func (zcnConfig *config) setupSchedules() error {
+	for _, bt := range backendTypes {
+		for _, name := range bt.names(zcnConfig) {
+			if _, err := newSchedule(bt.schedule(zcnConfig, name)); err != nil {
+				return fmt.Errorf("%s.%s: %s", bt.name, name, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
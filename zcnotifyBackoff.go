@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	DEFAULT_BROWSE_INITIAL_BACKOFF uint = 5
+	DEFAULT_BROWSE_MAX_BACKOFF     uint = 300
+	MAX_JITTER_PERCENT             uint = 50
+	// In low power mode the scan period doubles after each browse which
+	// finds no changes, up to this many times the configured period.
+	LOW_POWER_PERIOD_FACTOR uint = 8
+	// Bounds of an adaptive scan period if none are configured.
+	DEFAULT_MIN_SCAN_PERIOD uint = 2
+	DEFAULT_MAX_SCAN_PERIOD uint = 120
+)
+
+var scanPeriodMetric = metrics.newGauge("zcnotify_scan_period_seconds",
+	"Scan period in effect for each watched service and domain.")
+
+// browseTiming spreads a watcher's browses out in time.  A browse starts
+// every scan period give or take up to JitterPercent of it, the first after
+// up to that much, so that a fleet started together doesn't query in step,
+// and browses which fail are retried with exponential backoff.  A browse
+// lasts the whole period unless a shorter timeout is set.
+type browseTiming struct {
+	period time.Duration
+	jitter time.Duration
+	// timeout is the length of a browse, the whole period if it's zero.
+	timeout time.Duration
+	// The period adapts to the network between minPeriod and maxPeriod,
+	// both of which are the period if it's fixed.
+	minPeriod time.Duration
+	maxPeriod time.Duration
+	retry     retryConfig
+}
+
+// newBrowseTiming Returns the timing of a watcher with the given scan period.
+// With AdaptiveScan the period shortens while changes are found, down to
+// MinScanPeriodSeconds, and lengthens while the network is quiet, up to
+// MaxScanPeriodSeconds.  In low power mode it lengthens up to
+// LOW_POWER_PERIOD_FACTOR times the scan period.
+func newBrowseTiming(periodSecs uint, zcnConfig *config) browseTiming {
+	period := time.Duration(periodSecs) * time.Second
+	zcConf := zcnConfig.Zeroconf
+	timing := browseTiming{period: period,
+		jitter:    period * time.Duration(zcConf.JitterPercent) / 100,
+		timeout:   time.Duration(zcnConfig.BrowseTimeoutSeconds) * time.Second,
+		minPeriod: period,
+		maxPeriod: period,
+		retry: retryConfig{InitialBackoffSeconds: zcConf.InitialBackoffSeconds,
+			MaxBackoffSeconds: zcConf.MaxBackoffSeconds}}
+	if zcnConfig.AdaptiveScan {
+		timing.minPeriod = min(period, time.Duration(zcnConfig.MinScanPeriodSeconds)*time.Second)
+		timing.maxPeriod = max(period, time.Duration(zcnConfig.MaxScanPeriodSeconds)*time.Second)
+	}
+
+	if zcnConfig.LowPower {
+		timing.maxPeriod = max(timing.maxPeriod,
+			period*time.Duration(LOW_POWER_PERIOD_FACTOR))
+	}
+
+	return timing
+}
+
+// withPeriod Returns the timing with the given period, the jitter scaled to
+// match.
+func (bt browseTiming) withPeriod(period time.Duration) browseTiming {
+	next := bt
+	next.period = period
+	next.jitter = bt.jitter * period / bt.period
+	return next
+}
+
+// adapt Returns the timing of the browse following one which found changes,
+// or didn't.  base is the configured timing.  A quiet network doubles the
+// period up to maxPeriod.  A change after a quiet spell goes straight back
+// to the configured period, and changes in a row halve it down to
+// minPeriod.
+func (bt browseTiming) adapt(base browseTiming, changed bool) browseTiming {
+	switch {
+	case bt.maxPeriod <= bt.minPeriod:
+		// The period is fixed.
+		return bt
+	case !changed:
+		return bt.withPeriod(min(2*bt.period, bt.maxPeriod))
+	case bt.period > base.period:
+		return base
+	default:
+		return bt.withPeriod(max((bt.period / 2).Round(time.Second), bt.minPeriod))
+	}
+}
+
+// duration Returns the time between the start of the next browse and the
+// one after.
+func (bt browseTiming) duration() time.Duration {
+	if bt.jitter <= 0 {
+		return bt.period
+	}
+
+	return bt.period - bt.jitter + time.Duration(rand.Int63n(int64(2*bt.jitter)))
+}
+
+// next Returns the length of the next browse, and how long to wait after it
+// before the one after so that they start a scan period apart.
+func (bt browseTiming) next() (time.Duration, time.Duration) {
+	interval := bt.duration()
+	if bt.timeout <= 0 || bt.timeout >= interval {
+		return interval, time.Millisecond
+	}
+
+	return bt.timeout, interval - bt.timeout
+}
+
+// startDelay Returns how long to wait before the first browse.
+func (bt browseTiming) startDelay() time.Duration {
+	if bt.jitter <= 0 {
+		return time.Millisecond
+	}
+
+	return time.Duration(rand.Int63n(int64(bt.jitter)))
+}
+
+// retryingBrowser Returns a browseFunc which tries to create the browser
+// again on every browse, for a browser which couldn't be created at start up,
+// e.g. as the DNS server was unreachable.  Until it's created each browse
+// fails, and so is retried with the watcher's backoff.
+func retryingBrowser(create func() (browseFunc, error)) browseFunc {
+	var browse browseFunc
+	return func(ctx context.Context,
+		service string,
+		domain string,
+		entries chan<- *zeroconf.ServiceEntry) error {
+		if browse == nil {
+			created, err := create()
+			if err != nil {
+				close(entries)
+				return err
+			}
+			browse = created
+		}
+
+		return browse(ctx, service, domain, entries)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// How often the event bus is checked for the baseline's changes once the
+// watchers have published them.
+const BASELINE_POLL_INTERVAL time.Duration = time.Second
+
+// baseline Holds the ADDs of each watcher's first browse when
+// SuppressInitialAdds is set, so that starting without a state file doesn't
+// notify every service on the network.  They're recorded as usual, and sent
+// as a single summary if InitialAddsSummary is set.  Other than the
+// watchers the pipeline goroutine is the only one to use it.
+type baseline struct {
+	summary bool
+	// watchers are those started with zcnotify, which have yet to complete
+	// their first browse.
+	watchers   sync.WaitGroup
+	allStarted bool
+	held       int
+	changes    []ServiceEntryChange
+	// Set once the baseline's changes have been through the pipeline, ADDs
+	// which arrive later are notified as usual.
+	closed bool
+}
+
+// newBaseline Returns the baseline of zcnConfig, nil if SuppressInitialAdds
+// isn't set.
+func newBaseline(zcnConfig *config) *baseline {
+	if !zcnConfig.SuppressInitialAdds {
+		return nil
+	}
+
+	return &baseline{summary: zcnConfig.InitialAddsSummary}
+}
+
+// watch Returns the function a watcher calls once its first browse has been
+// published, nil if there's no baseline or the watcher started after
+// zcnotify did.
+func (b *baseline) watch() func() {
+	if b == nil || b.allStarted {
+		return nil
+	}
+
+	b.watchers.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(b.watchers.Done)
+	}
+}
+
+// started Records that the watchers started with zcnotify have been.
+func (b *baseline) started() {
+	if b != nil {
+		b.allStarted = true
+	}
+}
+
+// hold Returns true if change is part of the baseline, which is kept for the
+// summary rather than notified.
+func (b *baseline) hold(change *ServiceEntryChange) bool {
+	if b == nil || b.closed || !change.Baseline {
+		return false
+	}
+
+	change.Trace.add("baseline", "", TRACE_SUPPRESSED, "found by the first browse")
+	b.held++
+	if b.summary {
+		b.changes = append(b.changes, *change)
+	}
+	return true
+}
+
+// wait Runs flush as a pipeline task once every watcher has published its
+// first browse and the pipeline has taken every change off the bus.
+func (b *baseline) wait(updates *eventBus, tasks chan<- func(), flush func()) {
+	if b == nil {
+		return
+	}
+
+	b.watchers.Wait()
+	for {
+		flushed := make(chan bool)
+		tasks <- func() {
+			if updates.pending() != 0 {
+				flushed <- false
+				return
+			}
+
+			flush()
+			flushed <- true
+		}
+
+		if <-flushed {
+			return
+		}
+		time.Sleep(BASELINE_POLL_INTERVAL)
+	}
+}
+
+// close Ends the baseline and sends the summary of the services it found to
+// every backend which they're routed to, as their watches, profiles and
+// filters say.
+func (b *baseline) close(queues []*deliveryQueue) {
+	b.closed = true
+	slog.Info("baseline recorded", "services", b.held, "summary", b.summary)
+	if len(b.changes) == 0 {
+		return
+	}
+
+	for _, queue := range queues {
+		var allowed []ServiceEntryChange
+		for _, change := range b.changes {
+			if queue.routes(&change) {
+				allowed = append(allowed, change)
+			}
+		}
+
+		if len(allowed) != 0 {
+			queue.EnqueueDigest(allowed, nil)
+		}
+	}
+	b.changes = nil
+}
+
+// stop Ends the baseline if zcnotify stops before the first browses have
+// completed, sending the summary of the services found so far.  Returns true
+// if there was a summary to send.
+func (b *baseline) stop(queues []*deliveryQueue) bool {
+	if b == nil || b.closed {
+		return false
+	}
+
+	summary := len(b.changes) != 0
+	b.close(queues)
+	return summary
+}
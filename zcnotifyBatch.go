@@ -0,0 +1,62 @@
+package main
+
+import (
+	"time"
+)
+
+// Milliseconds the first event of a batch waits for others by default.
+const DEFAULT_BATCH_LATENCY uint = 1000
+
+// batchConfig is embedded in the blocks of backends which can send several
+// events in a single message, so that a storm of events, such as a switch
+// rebooting, doesn't become a storm of requests.
+type batchConfig struct {
+	// Most events sent in one message, 0 or 1 sends each on its own.
+	BatchSize uint
+	// Milliseconds the first event of a batch waits for others before the
+	// batch is sent anyway.
+	BatchLatencyMilliseconds uint
+}
+
+// setup Fills in the default latency.
+func (bc *batchConfig) setup() {
+	if bc.BatchLatencyMilliseconds == 0 {
+		bc.BatchLatencyMilliseconds = DEFAULT_BATCH_LATENCY
+	}
+}
+
+// latency Returns how long the first event of a batch waits for others.
+func (bc *batchConfig) latency() time.Duration {
+	return time.Duration(bc.BatchLatencyMilliseconds) * time.Millisecond
+}
+
+// collect Returns first along with the changes which arrive on changes
+// within the latency, up to BatchSize in all.  Once exit is closed only the
+// changes already queued are taken.
+func (bc *batchConfig) collect(first ServiceEntryChange,
+	changes <-chan ServiceEntryChange,
+	exit <-chan bool) []ServiceEntryChange {
+	batch := []ServiceEntryChange{first}
+	timer := time.NewTimer(bc.latency())
+	defer timer.Stop()
+
+	for uint(len(batch)) < bc.BatchSize {
+		select {
+		case change := <-changes:
+			batch = append(batch, change)
+			break
+		case <-timer.C:
+			return batch
+		case <-exit:
+			select {
+			case change := <-changes:
+				batch = append(batch, change)
+				break
+			default:
+				return batch
+			}
+		}
+	}
+
+	return batch
+}
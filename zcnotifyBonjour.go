@@ -0,0 +1,404 @@
+//go:build (darwin && cgo) || windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	// mDNSResponder doesn't pass on SRV record TTLs, so entries have the TTL
+	// of their addresses, or failing that the one RFC 6762 recommends.
+	DEFAULT_BONJOUR_TTL uint32 = 120
+
+	// How long a single instance may take to resolve.
+	DEFAULT_BONJOUR_RESOLVE_TIMEOUT = 2 * time.Second
+
+	// How often operations check whether they've been cancelled.
+	dnssdPollInterval = 100 * time.Millisecond
+
+	// DNSServiceFlags from dns_sd.h.
+	dnssdFlagMoreComing uint32 = 0x1
+	dnssdFlagAdd        uint32 = 0x2
+
+	// DNSServiceProtocol values from dns_sd.h.
+	dnssdProtocolIPv4 uint32 = 0x1
+	dnssdProtocolIPv6 uint32 = 0x2
+
+	// DNSServiceErrorType values from dns_sd.h.
+	dnssdErrUnknown           dnssdError = -65537
+	dnssdErrBadParam          dnssdError = -65540
+	dnssdErrServiceNotRunning dnssdError = -65563
+	dnssdErrTimeout           dnssdError = -65568
+)
+
+// dnssdReply is a single callback from the DNS-SD API, the fields set depend
+// on the operation.
+type dnssdReply struct {
+	flags   uint32
+	ifIndex uint32
+	err     int32
+	// The instance name of a browse reply.
+	name string
+	// The target host, port and TXT record of a resolve reply.
+	host string
+	port int
+	text []byte
+	// The address and its TTL of an address reply.
+	ip  net.IP
+	ttl uint32
+}
+
+// dnssdHandler Receives the replies to an operation.
+type dnssdHandler func(reply *dnssdReply)
+
+// dnssdHandlers Holds the handler of each outstanding operation, the C
+// callbacks are given its key as their context.
+var dnssdHandlers = struct {
+	mutex    sync.Mutex
+	next     uintptr
+	handlers map[uintptr]dnssdHandler
+}{handlers: make(map[uintptr]dnssdHandler)}
+
+// registerDNSSD Returns the key of a newly registered handler.
+func registerDNSSD(handler dnssdHandler) uintptr {
+	dnssdHandlers.mutex.Lock()
+	defer dnssdHandlers.mutex.Unlock()
+
+	dnssdHandlers.next++
+	dnssdHandlers.handlers[dnssdHandlers.next] = handler
+	return dnssdHandlers.next
+}
+
+// unregisterDNSSD Removes a handler once its operation is deallocated.
+func unregisterDNSSD(key uintptr) {
+	dnssdHandlers.mutex.Lock()
+	defer dnssdHandlers.mutex.Unlock()
+
+	delete(dnssdHandlers.handlers, key)
+}
+
+// dispatchDNSSD Passes a reply from the C callbacks on to its handler.
+func dispatchDNSSD(key uintptr, reply *dnssdReply) {
+	dnssdHandlers.mutex.Lock()
+	handler := dnssdHandlers.handlers[key]
+	dnssdHandlers.mutex.Unlock()
+
+	if handler != nil {
+		handler(reply)
+	}
+}
+
+// dnssdError is a DNSServiceErrorType.
+type dnssdError int32
+
+func (de dnssdError) Error() string {
+	switch de {
+	case dnssdErrUnknown:
+		return "dnssd: unknown error"
+	case dnssdErrBadParam:
+		return "dnssd: bad parameter"
+	case dnssdErrServiceNotRunning:
+		return "dnssd: the mDNSResponder service isn't running"
+	case dnssdErrTimeout:
+		return "dnssd: timed out"
+	}
+
+	return fmt.Sprintf("dnssd: error %d", int32(de))
+}
+
+// dnssdOp is an outstanding DNS-SD operation.  Its replies are only
+// delivered while poll is called, on the calling goroutine.
+type dnssdOp struct {
+	ref dnssdRef
+	key uintptr
+}
+
+// poll Waits up to timeout for replies, passing them on to the handler.
+func (op *dnssdOp) poll(timeout time.Duration) error {
+	ready, err := dnssdWait(op.ref, timeout)
+	if err != nil || !ready {
+		return err
+	}
+
+	if code := dnssdProcessResult(op.ref); code != 0 {
+		return dnssdError(code)
+	}
+
+	return nil
+}
+
+// close Ends the operation.
+func (op *dnssdOp) close() {
+	dnssdDeallocate(op.ref)
+	unregisterDNSSD(op.key)
+}
+
+// startDNSSD Starts an operation with start, whose replies go to handler.
+func startDNSSD(handler dnssdHandler,
+	start func(key uintptr) (dnssdRef, int32)) (*dnssdOp, error) {
+	key := registerDNSSD(handler)
+	ref, code := start(key)
+	if code != 0 {
+		unregisterDNSSD(key)
+		return nil, dnssdError(code)
+	}
+
+	return &dnssdOp{ref: ref, key: key}, nil
+}
+
+// bonjourResolver Implements mdnsResolver with the DNS-SD API of Bonjour's
+// mDNSResponder, which owns port 5353 on macOS and on Windows hosts with
+// Bonjour installed.
+type bonjourResolver struct {
+	protocol uint32
+	// Interface indexes to report services on, Bonjour browses them all.
+	intfs map[uint32]bool
+}
+
+// newBonjourResolver Returns a resolver using Bonjour with the given IP
+// versions on intfs.
+func newBonjourResolver(ipver zeroconf.IPType,
+	intfs []net.Interface) (mdnsResolver, error) {
+	if err := dnssdLoad(); err != nil {
+		return nil, err
+	}
+
+	br := &bonjourResolver{protocol: dnssdProtocolIPv4 | dnssdProtocolIPv6,
+		intfs: make(map[uint32]bool)}
+	switch ipver {
+	case zeroconf.IPv4:
+		br.protocol = dnssdProtocolIPv4
+		break
+	case zeroconf.IPv6:
+		br.protocol = dnssdProtocolIPv6
+		break
+	}
+
+	for _, intf := range intfs {
+		br.intfs[uint32(intf.Index)] = true
+	}
+
+	return br, nil
+}
+
+// bonjourRunning Returns true if mDNSResponder answers.
+func bonjourRunning() bool {
+	if dnssdLoad() != nil {
+		return false
+	}
+
+	ref, code := dnssdCreateConnection()
+	if code != 0 {
+		return false
+	}
+
+	dnssdDeallocate(ref)
+	return true
+}
+
+// Browse Browses until ctx is done, resolving instances as they're found.
+// Bonjour reports each instance once for every interface it's on, these are
+// merged and the entries sent once ctx is done.
+func (br *bonjourResolver) Browse(ctx context.Context,
+	service string,
+	domain string,
+	entries chan<- *zeroconf.ServiceEntry) error {
+	type found struct {
+		name    string
+		ifIndex uint32
+	}
+
+	var pending []found
+	op, err := startDNSSD(func(reply *dnssdReply) {
+		if reply.err == 0 &&
+			reply.flags&dnssdFlagAdd != 0 &&
+			br.intfs[reply.ifIndex] {
+			pending = append(pending, found{name: reply.name, ifIndex: reply.ifIndex})
+		}
+	}, func(key uintptr) (dnssdRef, int32) {
+		return dnssdBrowse(key, service, domain)
+	})
+	if err != nil {
+		// mDNSResponder may be restarting, so it's retried next period.
+		close(entries)
+		return &transientBrowseError{err}
+	}
+
+	go func() {
+		defer close(entries)
+
+		var names []string
+		merged := make(map[string]*zeroconf.ServiceEntry)
+		for ctx.Err() == nil {
+			if err := op.poll(dnssdPollInterval); err != nil {
+				slog.Warn("bonjour browse failed", "service", service, "err", err)
+				break
+			}
+
+			for _, instance := range pending {
+				entry, err := br.resolve(ctx, instance.ifIndex, instance.name, service, domain)
+				if err != nil {
+					slog.Debug("bonjour failed to resolve service",
+						"instance", instance.name,
+						"err", err)
+					continue
+				}
+
+				if existing, ok := merged[instance.name]; ok {
+					mergeAddresses(existing, entry)
+				} else {
+					merged[instance.name] = entry
+					names = append(names, instance.name)
+				}
+			}
+			pending = nil
+		}
+
+		op.close()
+		for _, name := range names {
+			entries <- merged[name]
+		}
+	}()
+
+	return nil
+}
+
+// Lookup Resolves a single instance on any of the interfaces.
+func (br *bonjourResolver) Lookup(ctx context.Context,
+	instance string,
+	service string,
+	domain string,
+	entries chan<- *zeroconf.ServiceEntry) error {
+	go func() {
+		defer close(entries)
+
+		var result *zeroconf.ServiceEntry
+		for index := range br.intfs {
+			entry, err := br.resolve(ctx, index, instance, service, domain)
+			if err != nil {
+				continue
+			}
+
+			if result == nil {
+				result = entry
+			} else {
+				mergeAddresses(result, entry)
+			}
+		}
+
+		if result != nil {
+			select {
+			case entries <- result:
+				break
+			case <-ctx.Done():
+				break
+			}
+		}
+	}()
+
+	return nil
+}
+
+// resolve Returns the entry of a single instance on an interface, which
+// takes a DNSServiceResolve for its host, port and TXT record then a
+// DNSServiceGetAddrInfo for the host's addresses.
+func (br *bonjourResolver) resolve(ctx context.Context,
+	ifIndex uint32,
+	instance string,
+	service string,
+	domain string) (*zeroconf.ServiceEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, DEFAULT_BONJOUR_RESOLVE_TIMEOUT)
+	defer cancel()
+
+	var entry *zeroconf.ServiceEntry
+	var replyErr error
+	op, err := startDNSSD(func(reply *dnssdReply) {
+		if reply.err != 0 {
+			replyErr = dnssdError(reply.err)
+			return
+		}
+
+		entry = zeroconf.NewServiceEntry(instance, service, domain)
+		entry.HostName = reply.host
+		entry.Port = reply.port
+		entry.Text = parseTXTRecord(reply.text)
+		entry.TTL = DEFAULT_BONJOUR_TTL
+	}, func(key uintptr) (dnssdRef, int32) {
+		return dnssdResolve(key, ifIndex, instance, service, domain)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for entry == nil && replyErr == nil && ctx.Err() == nil && err == nil {
+		err = op.poll(dnssdPollInterval)
+	}
+	op.close()
+
+	switch {
+	case err != nil:
+		return nil, err
+	case replyErr != nil:
+		return nil, replyErr
+	case entry == nil:
+		return nil, ctx.Err()
+	}
+
+	// The addresses are all reported straight away, done once a reply isn't
+	// followed by more.
+	done := false
+	op, err = startDNSSD(func(reply *dnssdReply) {
+		if reply.err == 0 && reply.flags&dnssdFlagAdd != 0 && reply.ip != nil {
+			if ip4 := reply.ip.To4(); ip4 != nil {
+				entry.AddrIPv4 = append(entry.AddrIPv4, ip4)
+			} else {
+				entry.AddrIPv6 = append(entry.AddrIPv6, reply.ip)
+			}
+
+			if reply.ttl != 0 {
+				entry.TTL = reply.ttl
+			}
+		}
+
+		done = reply.flags&dnssdFlagMoreComing == 0
+	}, func(key uintptr) (dnssdRef, int32) {
+		return dnssdGetAddrInfo(key, ifIndex, br.protocol, entry.HostName)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for !done && ctx.Err() == nil && err == nil {
+		err = op.poll(dnssdPollInterval)
+	}
+	op.close()
+
+	return entry, err
+}
+
+// parseTXTRecord Splits a TXT record's rdata into its strings, each of which
+// is preceded by its length.
+func parseTXTRecord(record []byte) []string {
+	var text []string
+	for len(record) > 0 {
+		length := int(record[0])
+		if length+1 > len(record) {
+			break
+		}
+
+		if length > 0 {
+			text = append(text, string(record[1:length+1]))
+		}
+		record = record[length+1:]
+	}
+
+	return text
+}
@@ -0,0 +1,212 @@
+//go:build darwin && cgo
+
+package main
+
+/*
+#include <dns_sd.h>
+#include <netinet/in.h>
+#include <poll.h>
+#include <stdint.h>
+#include <stdlib.h>
+#include <sys/socket.h>
+
+extern void dnssdBrowseReply(uint32_t flags, uint32_t ifIndex, int32_t code, char *name, uintptr_t key);
+extern void dnssdResolveReply(uint32_t flags, uint32_t ifIndex, int32_t code, char *host, uint16_t port, uint16_t txtLen, unsigned char *txt, uintptr_t key);
+extern void dnssdAddrReply(uint32_t flags, uint32_t ifIndex, int32_t code, void *ip, int ipLen, uint32_t ttl, uintptr_t key);
+
+static void dnssd_browse_callback(DNSServiceRef ref, DNSServiceFlags flags, uint32_t ifIndex, DNSServiceErrorType code, const char *name, const char *type, const char *domain, void *context) {
+	dnssdBrowseReply(flags, ifIndex, code, (char *)name, (uintptr_t)context);
+}
+
+static void dnssd_resolve_callback(DNSServiceRef ref, DNSServiceFlags flags, uint32_t ifIndex, DNSServiceErrorType code, const char *fullname, const char *host, uint16_t port, uint16_t txtLen, const unsigned char *txt, void *context) {
+	dnssdResolveReply(flags, ifIndex, code, (char *)host, ntohs(port), txtLen, (unsigned char *)txt, (uintptr_t)context);
+}
+
+static void dnssd_addr_callback(DNSServiceRef ref, DNSServiceFlags flags, uint32_t ifIndex, DNSServiceErrorType code, const char *host, const struct sockaddr *addr, uint32_t ttl, void *context) {
+	void *ip = NULL;
+	int ipLen = 0;
+	if (addr != NULL && addr->sa_family == AF_INET) {
+		ip = &((struct sockaddr_in *)addr)->sin_addr;
+		ipLen = 4;
+	} else if (addr != NULL && addr->sa_family == AF_INET6) {
+		ip = &((struct sockaddr_in6 *)addr)->sin6_addr;
+		ipLen = 16;
+	}
+	dnssdAddrReply(flags, ifIndex, code, ip, ipLen, ttl, (uintptr_t)context);
+}
+
+static DNSServiceErrorType dnssd_browse(DNSServiceRef *ref, const char *type, const char *domain, uintptr_t key) {
+	return DNSServiceBrowse(ref, 0, kDNSServiceInterfaceIndexAny, type, domain, dnssd_browse_callback, (void *)key);
+}
+
+static DNSServiceErrorType dnssd_resolve(DNSServiceRef *ref, uint32_t ifIndex, const char *name, const char *type, const char *domain, uintptr_t key) {
+	return DNSServiceResolve(ref, 0, ifIndex, name, type, domain, dnssd_resolve_callback, (void *)key);
+}
+
+static DNSServiceErrorType dnssd_get_addr_info(DNSServiceRef *ref, uint32_t ifIndex, uint32_t protocol, const char *host, uintptr_t key) {
+	return DNSServiceGetAddrInfo(ref, 0, ifIndex, protocol, host, dnssd_addr_callback, (void *)key);
+}
+
+static int dnssd_wait(DNSServiceRef ref, int timeout) {
+	struct pollfd fd = { DNSServiceRefSockFD(ref), POLLIN, 0 };
+	return poll(&fd, 1, timeout);
+}
+*/
+import "C"
+
+import (
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// dnssdRef is a DNSServiceRef.
+type dnssdRef = C.DNSServiceRef
+
+// dnssdLoad Returns nil, the DNS-SD API is part of libSystem on macOS.
+func dnssdLoad() error {
+	return nil
+}
+
+// dnssdCreateConnection Connects to mDNSResponder.
+func dnssdCreateConnection() (dnssdRef, int32) {
+	var ref C.DNSServiceRef
+	code := C.DNSServiceCreateConnection(&ref)
+	return ref, int32(code)
+}
+
+// dnssdBrowse Starts a DNSServiceBrowse on every interface.
+func dnssdBrowse(key uintptr, service string, domain string) (dnssdRef, int32) {
+	cService := C.CString(service)
+	defer C.free(unsafe.Pointer(cService))
+	cDomain := C.CString(domain)
+	defer C.free(unsafe.Pointer(cDomain))
+
+	var ref C.DNSServiceRef
+	code := C.dnssd_browse(&ref, cService, cDomain, C.uintptr_t(key))
+	return ref, int32(code)
+}
+
+// dnssdResolve Starts a DNSServiceResolve of an instance on an interface.
+func dnssdResolve(key uintptr,
+	ifIndex uint32,
+	instance string,
+	service string,
+	domain string) (dnssdRef, int32) {
+	cInstance := C.CString(instance)
+	defer C.free(unsafe.Pointer(cInstance))
+	cService := C.CString(service)
+	defer C.free(unsafe.Pointer(cService))
+	cDomain := C.CString(domain)
+	defer C.free(unsafe.Pointer(cDomain))
+
+	var ref C.DNSServiceRef
+	code := C.dnssd_resolve(&ref,
+		C.uint32_t(ifIndex),
+		cInstance,
+		cService,
+		cDomain,
+		C.uintptr_t(key))
+	return ref, int32(code)
+}
+
+// dnssdGetAddrInfo Starts a DNSServiceGetAddrInfo of a host on an
+// interface.
+func dnssdGetAddrInfo(key uintptr,
+	ifIndex uint32,
+	protocol uint32,
+	host string) (dnssdRef, int32) {
+	cHost := C.CString(host)
+	defer C.free(unsafe.Pointer(cHost))
+
+	var ref C.DNSServiceRef
+	code := C.dnssd_get_addr_info(&ref,
+		C.uint32_t(ifIndex),
+		C.uint32_t(protocol),
+		cHost,
+		C.uintptr_t(key))
+	return ref, int32(code)
+}
+
+// dnssdWait Returns true once the operation has replies to process, or false
+// if there are none within timeout.
+func dnssdWait(ref dnssdRef, timeout time.Duration) (bool, error) {
+	ready, err := C.dnssd_wait(ref, C.int(timeout.Milliseconds()))
+	if ready < 0 {
+		if err == syscall.EINTR {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return ready > 0, nil
+}
+
+// dnssdProcessResult Calls the callbacks of the operation's replies.
+func dnssdProcessResult(ref dnssdRef) int32 {
+	return int32(C.DNSServiceProcessResult(ref))
+}
+
+// dnssdDeallocate Ends the operation.
+func dnssdDeallocate(ref dnssdRef) {
+	C.DNSServiceRefDeallocate(ref)
+}
+
+//export dnssdBrowseReply
+func dnssdBrowseReply(flags C.uint32_t,
+	ifIndex C.uint32_t,
+	code C.int32_t,
+	name *C.char,
+	key C.uintptr_t) {
+	reply := &dnssdReply{flags: uint32(flags), ifIndex: uint32(ifIndex), err: int32(code)}
+	if name != nil {
+		reply.name = C.GoString(name)
+	}
+
+	dispatchDNSSD(uintptr(key), reply)
+}
+
+//export dnssdResolveReply
+func dnssdResolveReply(flags C.uint32_t,
+	ifIndex C.uint32_t,
+	code C.int32_t,
+	host *C.char,
+	port C.uint16_t,
+	txtLen C.uint16_t,
+	txt *C.uchar,
+	key C.uintptr_t) {
+	reply := &dnssdReply{flags: uint32(flags),
+		ifIndex: uint32(ifIndex),
+		err:     int32(code),
+		port:    int(port)}
+	if host != nil {
+		reply.host = C.GoString(host)
+	}
+
+	if txt != nil {
+		reply.text = C.GoBytes(unsafe.Pointer(txt), C.int(txtLen))
+	}
+
+	dispatchDNSSD(uintptr(key), reply)
+}
+
+//export dnssdAddrReply
+func dnssdAddrReply(flags C.uint32_t,
+	ifIndex C.uint32_t,
+	code C.int32_t,
+	ip unsafe.Pointer,
+	ipLen C.int,
+	ttl C.uint32_t,
+	key C.uintptr_t) {
+	reply := &dnssdReply{flags: uint32(flags),
+		ifIndex: uint32(ifIndex),
+		err:     int32(code),
+		ttl:     uint32(ttl)}
+	if ip != nil && ipLen > 0 {
+		reply.ip = net.IP(C.GoBytes(ip, ipLen))
+	}
+
+	dispatchDNSSD(uintptr(key), reply)
+}
@@ -0,0 +1,22 @@
+//go:build !windows && !(darwin && cgo)
+
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// newBonjourResolver Returns an error, Bonjour is only supported on macOS,
+// built with cgo, and Windows.
+func newBonjourResolver(ipver zeroconf.IPType,
+	intfs []net.Interface) (mdnsResolver, error) {
+	return nil, errors.New("the bonjour resolver is only supported on macOS, built with cgo, and Windows")
+}
+
+// bonjourRunning Returns false, there's no Bonjour here.
+func bonjourRunning() bool {
+	return false
+}
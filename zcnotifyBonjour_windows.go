@@ -0,0 +1,245 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Socket address families of the addresses DNSServiceGetAddrInfo reports.
+const (
+	dnssdAFInet  = 2
+	dnssdAFInet6 = 23
+)
+
+// dnssdRef is a DNSServiceRef.
+type dnssdRef = uintptr
+
+// dnssd.dll is installed in the system directory along with Bonjour, e.g. by
+// iTunes or the Bonjour Print Services.
+var (
+	dnssdDLL = windows.NewLazySystemDLL("dnssd.dll")
+	ws2DLL   = windows.NewLazySystemDLL("ws2_32.dll")
+
+	dnssdProcCreateConnection = dnssdDLL.NewProc("DNSServiceCreateConnection")
+	dnssdProcBrowse           = dnssdDLL.NewProc("DNSServiceBrowse")
+	dnssdProcResolve          = dnssdDLL.NewProc("DNSServiceResolve")
+	dnssdProcGetAddrInfo      = dnssdDLL.NewProc("DNSServiceGetAddrInfo")
+	dnssdProcSockFD           = dnssdDLL.NewProc("DNSServiceRefSockFD")
+	dnssdProcProcessResult    = dnssdDLL.NewProc("DNSServiceProcessResult")
+	dnssdProcDeallocate       = dnssdDLL.NewProc("DNSServiceRefDeallocate")
+	ws2ProcSelect             = ws2DLL.NewProc("select")
+
+	dnssdLoadOnce sync.Once
+	dnssdLoadErr  error
+
+	dnssdBrowseCallback  uintptr
+	dnssdResolveCallback uintptr
+	dnssdAddrCallback    uintptr
+)
+
+// dnssdLoad Loads dnssd.dll and creates the callbacks, once.
+func dnssdLoad() error {
+	dnssdLoadOnce.Do(func() {
+		if err := dnssdDLL.Load(); err != nil {
+			dnssdLoadErr = errors.New("unable to load dnssd.dll, is Bonjour installed?")
+			return
+		}
+
+		dnssdBrowseCallback = windows.NewCallback(func(ref uintptr,
+			flags uint32,
+			ifIndex uint32,
+			code int32,
+			name *byte,
+			service *byte,
+			domain *byte,
+			key uintptr) uintptr {
+			dispatchDNSSD(key, &dnssdReply{flags: flags,
+				ifIndex: ifIndex,
+				err:     code,
+				name:    windows.BytePtrToString(name)})
+			return 0
+		})
+
+		dnssdResolveCallback = windows.NewCallback(func(ref uintptr,
+			flags uint32,
+			ifIndex uint32,
+			code int32,
+			fullname *byte,
+			host *byte,
+			port uint16,
+			txtLen uint16,
+			txt *byte,
+			key uintptr) uintptr {
+			reply := &dnssdReply{flags: flags,
+				ifIndex: ifIndex,
+				err:     code,
+				host:    windows.BytePtrToString(host),
+				port:    int(port>>8 | port<<8)}
+			if txt != nil {
+				reply.text = append([]byte(nil), unsafe.Slice(txt, txtLen)...)
+			}
+
+			dispatchDNSSD(key, reply)
+			return 0
+		})
+
+		dnssdAddrCallback = windows.NewCallback(func(ref uintptr,
+			flags uint32,
+			ifIndex uint32,
+			code int32,
+			host *byte,
+			addr *byte,
+			ttl uint32,
+			key uintptr) uintptr {
+			reply := &dnssdReply{flags: flags, ifIndex: ifIndex, err: code, ttl: ttl}
+			if addr != nil {
+				sockaddr := unsafe.Slice(addr, 24)
+				switch uint16(sockaddr[0]) | uint16(sockaddr[1])<<8 {
+				case dnssdAFInet:
+					reply.ip = net.IP(append([]byte(nil), sockaddr[4:8]...))
+					break
+				case dnssdAFInet6:
+					reply.ip = net.IP(append([]byte(nil), sockaddr[8:24]...))
+					break
+				}
+			}
+
+			dispatchDNSSD(key, reply)
+			return 0
+		})
+	})
+
+	return dnssdLoadErr
+}
+
+// dnssdCreateConnection Connects to mDNSResponder.
+func dnssdCreateConnection() (dnssdRef, int32) {
+	var ref uintptr
+	code, _, _ := dnssdProcCreateConnection.Call(uintptr(unsafe.Pointer(&ref)))
+	return ref, int32(code)
+}
+
+// dnssdBrowse Starts a DNSServiceBrowse on every interface.
+func dnssdBrowse(key uintptr, service string, domain string) (dnssdRef, int32) {
+	cService, err := windows.BytePtrFromString(service)
+	if err != nil {
+		return 0, int32(dnssdErrBadParam)
+	}
+
+	cDomain, err := windows.BytePtrFromString(domain)
+	if err != nil {
+		return 0, int32(dnssdErrBadParam)
+	}
+
+	var ref uintptr
+	code, _, _ := dnssdProcBrowse.Call(uintptr(unsafe.Pointer(&ref)),
+		0,
+		0,
+		uintptr(unsafe.Pointer(cService)),
+		uintptr(unsafe.Pointer(cDomain)),
+		dnssdBrowseCallback,
+		key)
+	return ref, int32(code)
+}
+
+// dnssdResolve Starts a DNSServiceResolve of an instance on an interface.
+func dnssdResolve(key uintptr,
+	ifIndex uint32,
+	instance string,
+	service string,
+	domain string) (dnssdRef, int32) {
+	cInstance, err := windows.BytePtrFromString(instance)
+	if err != nil {
+		return 0, int32(dnssdErrBadParam)
+	}
+
+	cService, err := windows.BytePtrFromString(service)
+	if err != nil {
+		return 0, int32(dnssdErrBadParam)
+	}
+
+	cDomain, err := windows.BytePtrFromString(domain)
+	if err != nil {
+		return 0, int32(dnssdErrBadParam)
+	}
+
+	var ref uintptr
+	code, _, _ := dnssdProcResolve.Call(uintptr(unsafe.Pointer(&ref)),
+		0,
+		uintptr(ifIndex),
+		uintptr(unsafe.Pointer(cInstance)),
+		uintptr(unsafe.Pointer(cService)),
+		uintptr(unsafe.Pointer(cDomain)),
+		dnssdResolveCallback,
+		key)
+	return ref, int32(code)
+}
+
+// dnssdGetAddrInfo Starts a DNSServiceGetAddrInfo of a host on an
+// interface.
+func dnssdGetAddrInfo(key uintptr,
+	ifIndex uint32,
+	protocol uint32,
+	host string) (dnssdRef, int32) {
+	cHost, err := windows.BytePtrFromString(host)
+	if err != nil {
+		return 0, int32(dnssdErrBadParam)
+	}
+
+	var ref uintptr
+	code, _, _ := dnssdProcGetAddrInfo.Call(uintptr(unsafe.Pointer(&ref)),
+		0,
+		uintptr(ifIndex),
+		uintptr(protocol),
+		uintptr(unsafe.Pointer(cHost)),
+		dnssdAddrCallback,
+		key)
+	return ref, int32(code)
+}
+
+// dnssdWait Returns true once the operation has replies to process, or false
+// if there are none within timeout.
+func dnssdWait(ref dnssdRef, timeout time.Duration) (bool, error) {
+	sock, _, _ := dnssdProcSockFD.Call(ref)
+
+	// An fd_set and timeval as winsock declares them.
+	readable := struct {
+		count   uint32
+		sockets [64]uintptr
+	}{count: 1}
+	readable.sockets[0] = sock
+	wait := struct {
+		sec  int32
+		usec int32
+	}{sec: int32(timeout / time.Second),
+		usec: int32(timeout % time.Second / time.Microsecond)}
+
+	ready, _, err := ws2ProcSelect.Call(0,
+		uintptr(unsafe.Pointer(&readable)),
+		0,
+		0,
+		uintptr(unsafe.Pointer(&wait)))
+	if int32(ready) < 0 {
+		return false, err
+	}
+
+	return int32(ready) > 0, nil
+}
+
+// dnssdProcessResult Calls the callbacks of the operation's replies.
+func dnssdProcessResult(ref dnssdRef) int32 {
+	code, _, _ := dnssdProcProcessResult.Call(ref)
+	return int32(code)
+}
+
+// dnssdDeallocate Ends the operation.
+func dnssdDeallocate(ref dnssdRef) {
+	dnssdProcDeallocate.Call(ref)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+const (
+	// Changes the event bus holds while the pipeline is busy.
+	DEFAULT_BUS_LENGTH uint = 1024
+	// A full bus drops its oldest modification...
+	BUS_OVERFLOW_DROP_OLDEST string = "drop-oldest"
+	// ...or merges the new change into one of the same service.
+	BUS_OVERFLOW_COALESCE string = "coalesce"
+)
+
+var (
+	busLengthMetric = metrics.newGauge("zcnotify_bus_length",
+		"Number of changes waiting for the pipeline on the event bus.")
+	busCapacityMetric = metrics.newGauge("zcnotify_bus_capacity",
+		"Maximum number of changes the event bus can hold.")
+	busPublishedMetric = metrics.newCounter("zcnotify_bus_published_total",
+		"Changes published on the event bus by the watchers and probes.")
+	busDroppedMetric = metrics.newCounter("zcnotify_bus_dropped_total",
+		"Changes lost because the event bus was full, by overflow policy.")
+)
+
+// busConfig sizes the event bus between the watchers and the pipeline.
+type busConfig struct {
+	// Changes held while the pipeline is busy, e.g. with slow identity
+	// lookups.
+	Length uint
+	// What a full bus does with a new change, drop-oldest or coalesce.
+	Overflow string
+}
+
+// setupBus Fills in the defaults of the [bus] section.
+func (zcnConfig *config) setupBus() error {
+	if zcnConfig.Bus.Length == 0 {
+		zcnConfig.Bus.Length = DEFAULT_BUS_LENGTH
+	}
+
+	switch strings.ToLower(zcnConfig.Bus.Overflow) {
+	case "":
+		zcnConfig.Bus.Overflow = BUS_OVERFLOW_DROP_OLDEST
+		break
+	case BUS_OVERFLOW_DROP_OLDEST, BUS_OVERFLOW_COALESCE:
+		zcnConfig.Bus.Overflow = strings.ToLower(zcnConfig.Bus.Overflow)
+		break
+	default:
+		return fmt.Errorf("bus: unknown Overflow %q, expected %s or %s",
+			zcnConfig.Bus.Overflow,
+			BUS_OVERFLOW_DROP_OLDEST,
+			BUS_OVERFLOW_COALESCE)
+	}
+
+	return nil
+}
+
+// eventBus Passes the changes found by the watchers and probes to the
+// pipeline.  Publishing never blocks, so a slow pipeline can't hold up
+// discovery; once the bus is full changes are lost according to the
+// overflow policy, and counted.  ADDs, REMOVEs and RENAMEDs are never lost,
+// the registry would otherwise disagree with the watchers for good, so they
+// are held beyond the bus's length.
+type eventBus struct {
+	mutex    sync.Mutex
+	changes  []ServiceEntryChange
+	length   uint
+	overflow string
+	// dropped counts the changes lost since the bus last overflowed.
+	dropped uint
+	// Set while a change taken off the bus is being passed on.
+	passing bool
+	// ready is signalled when a change is published.
+	ready chan struct{}
+	out   chan ServiceEntryChange
+	exit  chan struct{}
+	once  sync.Once
+}
+
+// newEventBus Creates an event bus and starts passing its changes on.
+func newEventBus(conf busConfig) *eventBus {
+	eb := &eventBus{length: conf.Length,
+		overflow: conf.Overflow,
+		ready:    make(chan struct{}, 1),
+		out:      make(chan ServiceEntryChange),
+		exit:     make(chan struct{})}
+	busCapacityMetric.With().Set(int64(conf.Length))
+	go eb.run()
+	return eb
+}
+
+// events Returns the channel the pipeline reads the changes from.
+func (eb *eventBus) events() <-chan ServiceEntryChange {
+	return eb.out
+}
+
+// stop Stops passing changes on, those still waiting are discarded.
+func (eb *eventBus) stop() {
+	eb.once.Do(func() {
+		close(eb.exit)
+	})
+}
+
+// pending Returns the number of changes the pipeline has yet to receive.
+func (eb *eventBus) pending() int {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+
+	if eb.passing {
+		return len(eb.changes) + 1
+	}
+	return len(eb.changes)
+}
+
+// publish Adds a change to the bus, making room for it if the bus is full.
+func (eb *eventBus) publish(change ServiceEntryChange) {
+	eb.mutex.Lock()
+	busPublishedMetric.With().Inc()
+	if uint(len(eb.changes)) >= eb.length {
+		if eb.dropped == 0 {
+			slog.Warn("event bus full, the pipeline isn't keeping up",
+				"length", eb.length,
+				"overflow", eb.overflow)
+		}
+
+		if eb.overflow != BUS_OVERFLOW_COALESCE || !eb.coalesce(change) {
+			eb.dropOldest(change)
+		}
+	} else {
+		eb.changes = append(eb.changes, change)
+	}
+	busLengthMetric.With().Set(int64(len(eb.changes)))
+	eb.mutex.Unlock()
+
+	select {
+	case eb.ready <- struct{}{}:
+		break
+	default:
+		// The bus is already being emptied.
+		break
+	}
+}
+
+// dropOldest Makes room for change by dropping the oldest waiting
+// modification, or change itself if it's the only one, the mutex is held.
+// A membership change is added regardless, beyond the bus's length if there's
+// no modification to drop.
+func (eb *eventBus) dropOldest(change ServiceEntryChange) {
+	for index := range eb.changes {
+		if membership(eb.changes[index].ChangeType) {
+			continue
+		}
+
+		busDroppedMetric.With("policy", BUS_OVERFLOW_DROP_OLDEST).Inc()
+		slog.Debug("change dropped from event bus", changeAttrs(&eb.changes[index]))
+		eb.changes = append(eb.changes[:index], eb.changes[index+1:]...)
+		eb.changes = append(eb.changes, change)
+		eb.dropped++
+		return
+	}
+
+	if membership(change.ChangeType) {
+		eb.changes = append(eb.changes, change)
+		return
+	}
+
+	busDroppedMetric.With("policy", BUS_OVERFLOW_DROP_OLDEST).Inc()
+	slog.Debug("change dropped from event bus", changeAttrs(&change))
+	eb.dropped++
+}
+
+// membership Returns true if a change of type sct adds a service to or
+// removes one from the registry.
+func membership(sct ServiceChangeType) bool {
+	switch sct {
+	case ADD, REMOVE, RENAMED:
+		return true
+	default:
+		return false
+	}
+}
+
+// coalesce Merges change into the latest waiting change of the same service,
+// the mutex is held.  Returns false if there's none it can be merged with.
+func (eb *eventBus) coalesce(change ServiceEntryChange) bool {
+	name := change.Entry.ServiceInstanceName()
+	for index := len(eb.changes) - 1; index >= 0; index-- {
+		waiting := &eb.changes[index]
+		if waiting.Entry.ServiceInstanceName() != name {
+			continue
+		}
+
+		merged, keep, ok := coalesceChanges(*waiting, change)
+		if !ok {
+			return false
+		}
+
+		busDroppedMetric.With("policy", BUS_OVERFLOW_COALESCE).Inc()
+		slog.Debug("change coalesced on event bus", changeAttrs(&change))
+		eb.dropped++
+		if keep {
+			*waiting = merged
+		} else {
+			// Added and removed again while waiting, there's
+			// nothing to report.
+			eb.changes = append(eb.changes[:index], eb.changes[index+1:]...)
+		}
+		return true
+	}
+
+	return false
+}
+
+// coalesceChanges Returns the change which reports both older and newer, of
+// the same service, as one.  keep is false if they cancel out, ok is false
+// if they can't be merged, e.g. a REMOVE followed by an ADD, which may be a
+// move.
+func coalesceChanges(older ServiceEntryChange,
+	newer ServiceEntryChange) (ServiceEntryChange, bool, bool) {
+	switch {
+	case older.ChangeType == ADD && newer.ChangeType == REMOVE:
+		return newer, false, true
+	case older.ChangeType == ADD && newer.ChangeType.modification():
+		newer.ChangeType = ADD
+		newer.Previous = nil
+		return newer, true, true
+	case older.ChangeType == RENAMED && newer.ChangeType.modification():
+		newer.ChangeType = RENAMED
+		newer.Previous = older.Previous
+		return newer, true, true
+	case older.ChangeType.modification() && newer.ChangeType == REMOVE:
+		return newer, true, true
+	case older.ChangeType.modification() && newer.ChangeType.modification():
+		if older.ChangeType != newer.ChangeType {
+			newer.ChangeType = MODIFY
+		}
+		newer.Previous = older.Previous
+		return newer, true, true
+	}
+
+	return newer, false, false
+}
+
+// run Passes the changes on to the pipeline in the order they were
+// published, until the bus is stopped.
+func (eb *eventBus) run() {
+	for {
+		eb.mutex.Lock()
+		if len(eb.changes) == 0 {
+			if eb.dropped != 0 {
+				slog.Info("event bus caught up", "lost", eb.dropped)
+				eb.dropped = 0
+			}
+			eb.mutex.Unlock()
+			select {
+			case <-eb.ready:
+				break
+			case <-eb.exit:
+				return
+			}
+			continue
+		}
+
+		change := eb.changes[0]
+		eb.changes = eb.changes[1:]
+		eb.passing = true
+		busLengthMetric.With().Set(int64(len(eb.changes)))
+		eb.mutex.Unlock()
+
+		select {
+		case eb.out <- change:
+			break
+		case <-eb.exit:
+			return
+		}
+		eb.mutex.Lock()
+		eb.passing = false
+		eb.mutex.Unlock()
+	}
+}
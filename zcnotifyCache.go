@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	// Time allowed for a single instance lookup on a cache miss.
+	DEFAULT_LOOKUP_TIMEOUT time.Duration = 2 * time.Second
+)
+
+var (
+	cacheLookupsMetric = metrics.newCounter("zcnotify_cache_lookups_total",
+		"Instance resolutions by result, a miss queries the network.")
+)
+
+// cachedEntry is a resolved service instance along with the time at which
+// its records expire.
+type cachedEntry struct {
+	entry   zeroconf.ServiceEntry
+	expires time.Time
+}
+
+// resolveCache Holds the most recently resolved SRV/TXT/A/AAAA data of each
+// service instance for as long as the record TTL says it is valid, so that
+// data which is still fresh isn't queried for again.
+type resolveCache struct {
+	mutex    sync.Mutex
+	entries  map[string]cachedEntry
+	resolver string
+	ipver    zeroconf.IPType
+	intfs    []net.Interface
+	// Set in passive mode, a cache miss isn't looked up.
+	passive bool
+}
+
+// newResolveCache Creates an empty cache, network lookups on a cache miss
+// use the named resolver with the given IP versions and interfaces.
+func newResolveCache(resolver string,
+	ipver zeroconf.IPType,
+	intfs []net.Interface) *resolveCache {
+	return &resolveCache{entries: make(map[string]cachedEntry),
+		resolver: selectResolver(resolver),
+		ipver:    ipver,
+		intfs:    intfs}
+}
+
+// newPassiveResolveCache Creates an empty cache which never queries the
+// network, for passive mode.
+func newPassiveResolveCache() *resolveCache {
+	return &resolveCache{entries: make(map[string]cachedEntry), passive: true}
+}
+
+// put Caches entry until its TTL expires.  A TTL of zero is a goodbye
+// announcement, so any cached data for the instance is dropped.
+func (rc *resolveCache) put(entry *zeroconf.ServiceEntry) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if entry.TTL == 0 {
+		delete(rc.entries, entry.ServiceInstanceName())
+		return
+	}
+
+	rc.entries[entry.ServiceInstanceName()] = cachedEntry{entry: *entry,
+		expires: time.Now().Add(time.Duration(entry.TTL) * time.Second)}
+}
+
+// get Returns the cached entry for instanceName if it hasn't expired.
+func (rc *resolveCache) get(instanceName string) (*zeroconf.ServiceEntry, bool) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	cached, ok := rc.entries[instanceName]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(cached.expires) {
+		delete(rc.entries, instanceName)
+		return nil, false
+	}
+
+	entry := cached.entry
+	return &entry, true
+}
+
+// expire Removes every entry whose TTL has passed.
+func (rc *resolveCache) expire() {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	now := time.Now()
+	for name, cached := range rc.entries {
+		if now.After(cached.expires) {
+			delete(rc.entries, name)
+		}
+	}
+}
+
+// resolve Returns the records of a single service instance, from the cache if
+// they are still fresh, otherwise by querying the network.
+func (rc *resolveCache) resolve(instance string,
+	service string,
+	domain string) (*zeroconf.ServiceEntry, error) {
+	name := zeroconf.NewServiceEntry(instance, service, domain).ServiceInstanceName()
+	if entry, ok := rc.get(name); ok {
+		cacheLookupsMetric.With("result", "hit").Inc()
+		return entry, nil
+	}
+
+	cacheLookupsMetric.With("result", "miss").Inc()
+	if rc.passive {
+		return nil, nil
+	}
+
+	resolver, err := newMDNSResolver(rc.resolver, rc.ipver, rc.intfs)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		DEFAULT_LOOKUP_TIMEOUT)
+	defer cancel()
+
+	// The instances of a subtype are looked up by their service type.
+	_, serviceType := splitSubtype(service)
+	results := make(chan *zeroconf.ServiceEntry)
+	if err := resolver.Lookup(ctx, instance, serviceType, domain, results); err != nil {
+		return nil, err
+	}
+
+	for {
+		select {
+		case entry, ok := <-results:
+			if !ok {
+				return nil, nil
+			}
+
+			if entry.ServiceInstanceName() == name {
+				rc.put(entry)
+				return entry, nil
+			}
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
+}
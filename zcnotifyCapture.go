@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
+)
+
+const (
+	CAPTURE_HEX    string = "hex"
+	CAPTURE_BASE64 string = "base64"
+
+	DEFAULT_PCAP_MAX_MB uint = 10
+	// Most responses remembered for Raw, beyond which those heard longest
+	// ago are forgotten.  Those not heard again for DEFAULT_PASSIVE_TTL are
+	// forgotten too, the instance is gone by then.
+	CAPTURE_MAX_PACKETS int = 4096
+
+	pcapFileMode  = 0644
+	pcapFileFlags = os.O_APPEND | os.O_CREATE | os.O_WRONLY
+	// pcap link type of packets which start with their IP header.
+	pcapLinkTypeRaw uint32 = 101
+)
+
+// captureConfig is the [capture] section of the config file, which keeps
+// the mDNS traffic behind events for debugging devices which advertise
+// malformed records.
+type captureConfig struct {
+	// Attach the DNS response which last described the service to each
+	// event, "hex" or "base64", nothing if empty.
+	Raw string
+	// Write every mDNS packet to this pcap file, it's moved to PcapFile.1
+	// once it reaches PcapMaxMB.
+	PcapFile  string
+	PcapMaxMB uint
+}
+
+// setupCapture Validates the [capture] section and fills in its defaults.
+func (zcnConfig *config) setupCapture() error {
+	switch zcnConfig.Capture.Raw {
+	case "", CAPTURE_HEX, CAPTURE_BASE64:
+		break
+	default:
+		return fmt.Errorf("capture: unknown Raw encoding %q, expected hex or base64",
+			zcnConfig.Capture.Raw)
+	}
+
+	if zcnConfig.Capture.PcapMaxMB == 0 {
+		zcnConfig.Capture.PcapMaxMB = DEFAULT_PCAP_MAX_MB
+	}
+
+	return nil
+}
+
+// enabled Returns true if anything is to be captured.
+func (cc *captureConfig) enabled() bool {
+	return cc.Raw != "" || cc.PcapFile != ""
+}
+
+// packetCapture Listens to the mDNS traffic alongside the multicast
+// watchers, remembering the last response which described each service
+// instance and writing the traffic to the pcap file.
+type packetCapture struct {
+	mutex    sync.Mutex
+	encoding string
+	conns    []*net.UDPConn
+	// The last response naming each instance, by instanceKey.
+	packets map[string]capturedPacket
+	swept   time.Time
+	pcap    *pcapWriter
+}
+
+// capturedPacket is a response remembered for Raw and when it was heard.
+type capturedPacket struct {
+	data  []byte
+	heard time.Time
+}
+
+// newPacketCapture Creates the capture, or returns nil if capturing isn't
+// enabled.
+func newPacketCapture(conf captureConfig) *packetCapture {
+	if !conf.enabled() {
+		return nil
+	}
+
+	pc := &packetCapture{encoding: conf.Raw, packets: make(map[string]capturedPacket)}
+	if conf.PcapFile != "" {
+		pc.pcap = &pcapWriter{path: conf.PcapFile,
+			maxBytes: int64(conf.PcapMaxMB) * 1024 * 1024}
+	}
+
+	return pc
+}
+
+// start Starts capturing on intfs, like the watchers it's restarted when
+// the interfaces change.
+func (pc *packetCapture) start(ipver zeroconf.IPType, intfs []net.Interface) {
+	if pc == nil {
+		return
+	}
+
+	conns, err := listenMDNS(ipver, intfs, pc.handle)
+	if err != nil {
+		slog.Error("failed to start capturing", "err", err)
+		return
+	}
+
+	pc.mutex.Lock()
+	pc.conns = conns
+	pc.mutex.Unlock()
+}
+
+// stop Stops capturing.
+func (pc *packetCapture) stop() {
+	if pc == nil {
+		return
+	}
+
+	pc.mutex.Lock()
+	for _, conn := range pc.conns {
+		conn.Close()
+	}
+	pc.conns = nil
+	pc.mutex.Unlock()
+
+	pc.pcap.close()
+}
+
+// handle Implements mdnsHandler.
+func (pc *packetCapture) handle(packet []byte, from *net.UDPAddr, group *net.UDPAddr) {
+	pc.pcap.write(packet, from, group)
+	if pc.encoding == "" {
+		return
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(packet); err != nil || !msg.Response {
+		return
+	}
+
+	now := time.Now()
+	saved := capturedPacket{data: append([]byte(nil), packet...), heard: now}
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	if now.Sub(pc.swept) >= PASSIVE_SWEEP_INTERVAL {
+		pc.sweep(now)
+	}
+
+	for _, rr := range append(msg.Answer, msg.Extra...) {
+		switch record := rr.(type) {
+		case *dns.PTR:
+			pc.save(instanceKey(record.Ptr), saved)
+			break
+		case *dns.SRV, *dns.TXT:
+			pc.save(instanceKey(record.Header().Name), saved)
+			break
+		}
+	}
+}
+
+// save Remembers the response which last described the instance key,
+// making room for it if need be.  The mutex is held.
+func (pc *packetCapture) save(key string, saved capturedPacket) {
+	if _, ok := pc.packets[key]; !ok && len(pc.packets) >= CAPTURE_MAX_PACKETS {
+		pc.sweep(saved.heard)
+		if len(pc.packets) >= CAPTURE_MAX_PACKETS {
+			evictOldest(pc.packets, func(cp capturedPacket) time.Time {
+				return cp.heard
+			})
+		}
+	}
+
+	pc.packets[key] = saved
+}
+
+// sweep Forgets the responses not heard again for DEFAULT_PASSIVE_TTL.  The
+// mutex is held.
+func (pc *packetCapture) sweep(now time.Time) {
+	pc.swept = now
+	stale := now.Add(-time.Duration(DEFAULT_PASSIVE_TTL) * time.Second)
+	for key, cp := range pc.packets {
+		if cp.heard.Before(stale) {
+			delete(pc.packets, key)
+		}
+	}
+}
+
+// attach Sets the change's Raw field to the last response which described
+// its instance.
+func (pc *packetCapture) attach(change *ServiceEntryChange) {
+	if pc == nil || pc.encoding == "" {
+		return
+	}
+
+	pc.mutex.Lock()
+	cp, ok := pc.packets[instanceKey(change.Entry.ServiceInstanceName())]
+	if change.ChangeType == REMOVE {
+		delete(pc.packets, instanceKey(change.Entry.ServiceInstanceName()))
+	}
+	pc.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	if pc.encoding == CAPTURE_HEX {
+		change.Raw = hex.EncodeToString(cp.data)
+	} else {
+		change.Raw = base64.StdEncoding.EncodeToString(cp.data)
+	}
+}
+
+// pcapWriter Writes packets to a pcap file with made up IP and UDP headers,
+// as only the UDP payload is received.  The file is rotated once it reaches
+// maxBytes.
+type pcapWriter struct {
+	mutex    sync.Mutex
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64
+}
+
+// open Opens the pcap file, writing the file header if it's new.
+func (pw *pcapWriter) open() error {
+	f, err := os.OpenFile(pw.path, pcapFileFlags, pcapFileMode)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	pw.file = f
+	pw.size = info.Size()
+	if pw.size != 0 {
+		return nil
+	}
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], uint32(mdnsMaxPacket+48))
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeRaw)
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		pw.file = nil
+		return err
+	}
+
+	pw.size = int64(len(header))
+	return nil
+}
+
+// close Closes the pcap file.
+func (pw *pcapWriter) close() {
+	if pw == nil {
+		return
+	}
+
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+
+	if pw.file != nil {
+		pw.file.Close()
+		pw.file = nil
+	}
+}
+
+// write Appends a single packet.  Failures are logged, capturing is only a
+// debugging aid.
+func (pw *pcapWriter) write(payload []byte, from *net.UDPAddr, to *net.UDPAddr) {
+	if pw == nil {
+		return
+	}
+
+	packet := ipPacket(payload, from, to)
+	now := time.Now()
+	record := make([]byte, 16, 16+len(packet))
+	binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	record = append(record, packet...)
+
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+
+	if pw.file != nil && pw.size+int64(len(record)) > pw.maxBytes {
+		pw.file.Close()
+		pw.file = nil
+		if err := os.Rename(pw.path, pw.path+".1"); err != nil {
+			slog.Error("failed to rotate pcap file", "err", err)
+		}
+	}
+
+	if pw.file == nil {
+		if err := pw.open(); err != nil {
+			slog.Error("failed to open pcap file", "err", err)
+			return
+		}
+	}
+
+	n, err := pw.file.Write(record)
+	pw.size += int64(n)
+	if err != nil {
+		slog.Error("failed to write pcap file", "err", err)
+	}
+}
+
+// ipPacket Returns payload with the IPv4 or IPv6 and UDP headers it would
+// have been received with.
+func ipPacket(payload []byte, from *net.UDPAddr, to *net.UDPAddr) []byte {
+	udp := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:], uint16(from.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(to.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	udp = append(udp, payload...)
+
+	if src, dst := from.IP.To4(), to.IP.To4(); src != nil && dst != nil {
+		// The UDP checksum is optional over IPv4.
+		ip := make([]byte, 20, 20+len(udp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[8] = 255
+		ip[9] = 17
+		copy(ip[12:], src)
+		copy(ip[16:], dst)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+		return append(ip, udp...)
+	}
+
+	ip := make([]byte, 40, 40+len(udp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+	ip[6] = 17
+	ip[7] = 255
+	copy(ip[8:], from.IP.To16())
+	copy(ip[24:], to.IP.To16())
+
+	// The UDP checksum covers a pseudo header of the addresses, length and
+	// protocol.
+	pseudo := append(append([]byte(nil), ip[8:40]...), 0, 0, ip[4], ip[5], 0, 0, 0, 17)
+	var sum uint32
+	for i := 0; i < len(pseudo); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pseudo[i:]))
+	}
+	binary.BigEndian.PutUint16(udp[6:], checksum(udp, sum))
+	return append(ip, udp...)
+}
+
+// checksum Returns the internet checksum of data, starting from sum.
+func checksum(data []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+
+	if sum == 0xffff {
+		return 0xffff
+	}
+
+	return ^uint16(sum)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// Categories of the built-in rules.
+const (
+	CATEGORY_APPLE_TV     string = "Apple TV"
+	CATEGORY_CAMERA       string = "camera"
+	CATEGORY_COMPUTER     string = "computer"
+	CATEGORY_ESPHOME      string = "ESPHome device"
+	CATEGORY_MEDIA_PLAYER string = "media player"
+	CATEGORY_NAS          string = "NAS"
+	CATEGORY_PRINTER      string = "printer"
+	CATEGORY_SMART_HOME   string = "smart home"
+	CATEGORY_SPEAKER      string = "speaker"
+)
+
+// categoryRule is a single [[category]] block, or a built-in rule.  A rule
+// matches an entry if its service type is in Services, any if empty, and
+// every TXT hint matches.
+type categoryRule struct {
+	// Name is the category, e.g. "printer".
+	Name     string
+	Services []string
+	// Txt maps TXT record keys to glob patterns of their values, matched
+	// without regard to case, e.g. { model = "AppleTV*" }.
+	Txt map[string]string
+}
+
+// builtinCategories classify the common devices, the first rule which
+// matches wins so the more specific rules come first.  AirPlay and RAOP
+// receivers give their model in "model" and "am" respectively, HomeKit
+// accessories their category in "ci" and Chromecasts their model in "md".
+var builtinCategories = []categoryRule{
+	{Name: CATEGORY_APPLE_TV, Services: []string{"_airplay._tcp"}, Txt: map[string]string{"model": "AppleTV*"}},
+	{Name: CATEGORY_APPLE_TV, Services: []string{"_raop._tcp"}, Txt: map[string]string{"am": "AppleTV*"}},
+	{Name: CATEGORY_APPLE_TV, Services: []string{"_companion-link._tcp"}, Txt: map[string]string{"rpmd": "AppleTV*"}},
+	{Name: CATEGORY_APPLE_TV, Services: []string{"_mediaremotetv._tcp", "_touch-able._tcp"}},
+	{Name: CATEGORY_SPEAKER, Services: []string{"_airplay._tcp"}, Txt: map[string]string{"model": "AudioAccessory*"}},
+	{Name: CATEGORY_SPEAKER, Services: []string{"_raop._tcp"}, Txt: map[string]string{"am": "AudioAccessory*"}},
+	{Name: CATEGORY_COMPUTER, Services: []string{"_airplay._tcp"}, Txt: map[string]string{"model": "Mac*"}},
+	{Name: CATEGORY_COMPUTER, Services: []string{"_raop._tcp"}, Txt: map[string]string{"am": "Mac*"}},
+	{Name: CATEGORY_SPEAKER, Services: []string{"_airplay._tcp", "_raop._tcp", "_spotify-connect._tcp", "_sonos._tcp"}},
+	{Name: CATEGORY_ESPHOME, Services: []string{"_esphomelib._tcp"}},
+	{Name: CATEGORY_PRINTER, Services: []string{"_ipp._tcp", "_ipps._tcp", "_printer._tcp", "_pdl-datastream._tcp"}},
+	{Name: CATEGORY_CAMERA, Services: []string{"_rtsp._tcp", "_axis-video._tcp"}},
+	{Name: CATEGORY_CAMERA, Services: []string{"_hap._tcp", "_hap._udp"}, Txt: map[string]string{"ci": "17"}},
+	{Name: CATEGORY_CAMERA, Services: []string{"_hap._tcp", "_hap._udp"}, Txt: map[string]string{"ci": "18"}},
+	{Name: CATEGORY_SPEAKER, Services: []string{"_hap._tcp", "_hap._udp"}, Txt: map[string]string{"ci": "26"}},
+	{Name: CATEGORY_SPEAKER, Services: []string{"_googlecast._tcp"}, Txt: map[string]string{"md": "*Home*"}},
+	{Name: CATEGORY_SPEAKER, Services: []string{"_googlecast._tcp"}, Txt: map[string]string{"md": "*Nest*"}},
+	{Name: CATEGORY_MEDIA_PLAYER, Services: []string{"_googlecast._tcp"}},
+	{Name: CATEGORY_NAS, Services: []string{"_adisk._tcp", "_nfs._tcp", "_qdiscover._tcp"}},
+	{Name: CATEGORY_NAS, Txt: map[string]string{"vendor": "Synology"}},
+	{Name: CATEGORY_NAS, Txt: map[string]string{"vendor": "QNAP"}},
+	{Name: CATEGORY_NAS, Services: []string{"_device-info._tcp"}, Txt: map[string]string{"model": "TimeCapsule*"}},
+	{Name: CATEGORY_SMART_HOME, Services: []string{"_hap._tcp", "_hap._udp", "_hue._tcp", "_home-assistant._tcp", "_matter._tcp"}},
+	{Name: CATEGORY_COMPUTER, Services: []string{"_workstation._tcp", "_rfb._tcp", "_rdp._tcp"}},
+}
+
+// matches Returns true if the rule matches entry.
+func (cr *categoryRule) matches(entry *zeroconf.ServiceEntry) bool {
+	if len(cr.Services) != 0 {
+		filter := serviceFilter{Services: cr.Services}
+		if allowed, _ := filter.allows(entry.Service); !allowed {
+			return false
+		}
+	}
+
+	for key, pattern := range cr.Txt {
+		if !matchInstance([]string{pattern}, txtValue(entry, key)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// setupCategories Checks the [[category]] blocks.
+func (zcnConfig *config) setupCategories() error {
+	for i, rule := range zcnConfig.Category {
+		if rule.Name == "" {
+			return fmt.Errorf("category %d: no Name", i+1)
+		}
+
+		if len(rule.Services) == 0 && len(rule.Txt) == 0 {
+			return fmt.Errorf("category %q: no Services or Txt to match", rule.Name)
+		}
+
+		for _, service := range rule.Services {
+			if err := validService(service); err != nil {
+				return fmt.Errorf("category %q: %s", rule.Name, err.Error())
+			}
+		}
+
+		for key, pattern := range rule.Txt {
+			if key == "" {
+				return fmt.Errorf("category %q: empty Txt key", rule.Name)
+			}
+
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("category %q: Txt pattern %q: %s",
+					rule.Name, pattern, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// category Returns the category of entry, set by the first [[category]]
+// block and then the first built-in rule which matches, empty if none does.
+func (zcnConfig *config) category(entry *zeroconf.ServiceEntry) string {
+	for _, rules := range [][]categoryRule{zcnConfig.Category, builtinCategories} {
+		for i := range rules {
+			if rules[i].matches(entry) {
+				return rules[i].Name
+			}
+		}
+	}
+
+	return ""
+}
+
+// matchCategory Returns true if category is one of categories, ignoring
+// case.
+func matchCategory(categories []string, category string) bool {
+	for _, c := range categories {
+		if strings.EqualFold(c, category) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	CHAT_TEAMS       string = "teams"
+	CHAT_GOOGLE_CHAT string = "googlechat"
+	// Seconds to wait for the chat service to accept a message.
+	DEFAULT_CHAT_TIMEOUT uint = 10
+	// Cards list at most this many changes of a digest.
+	CHAT_DIGEST_MAX int = 50
+)
+
+// chatConfig describes a single [teams.<name>] or [googlechat.<name>] block,
+// an incoming webhook of a channel or space.
+type chatConfig struct {
+	serviceFilter
+	scheduleConfig
+	// Template replaces the text at the top of the card.
+	templateConfig
+	// Webhook URL, which may reference ${ENV_VAR}s or be read from URLFile
+	// as it's a secret.
+	URL     string
+	URLFile string
+	// Only send events of at least this severity, see [[severity]].
+	MinSeverity    string
+	TimeoutSeconds uint
+}
+
+// validChatConfig Checks every block of the teams or googlechat notify type
+// and fills in the defaults.
+func validChatConfig(kind string, chatConfs map[string]chatConfig) error {
+	if len(chatConfs) == 0 {
+		return fmt.Errorf("no [%s.<name>] blocks", kind)
+	}
+
+	for name, chatConf := range chatConfs {
+		prefix := fmt.Sprintf("%s config: %q", kind, name)
+		parsed, err := url.Parse(chatConf.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return fmt.Errorf("%s invalid URL", prefix)
+		}
+
+		if chatConf.MinSeverity != "" {
+			if _, err := parseSeverity(chatConf.MinSeverity); err != nil {
+				return fmt.Errorf("%s MinSeverity: %s", prefix, err.Error())
+			}
+		}
+
+		if chatConf.TimeoutSeconds == 0 {
+			chatConf.TimeoutSeconds = DEFAULT_CHAT_TIMEOUT
+		}
+
+		if err := chatConf.setup(prefix); err != nil {
+			return err
+		}
+
+		chatConfs[name] = chatConf
+	}
+
+	return nil
+}
+
+// chatFact is a labelled detail of an event shown on a card.
+type chatFact struct {
+	Title string
+	Value string
+}
+
+// chatFacts Returns the details of a change shown on its card.
+func chatFacts(change *ServiceEntryChange) []chatFact {
+	facts := []chatFact{{"Service", change.Entry.Service},
+		{"Host", strings.TrimSuffix(change.Entry.HostName, ".")},
+		{"Port", strconv.Itoa(change.Entry.Port)}}
+	var addresses []string
+	for _, ip := range entryIPs(&change.Entry) {
+		addresses = append(addresses, ip.String())
+	}
+	if len(addresses) != 0 {
+		facts = append(facts, chatFact{"Addresses", strings.Join(addresses, ", ")})
+	}
+
+	if change.Category != "" {
+		facts = append(facts, chatFact{"Category", change.Category})
+	}
+
+	if change.Error != "" {
+		facts = append(facts, chatFact{"Error", change.Error})
+	}
+
+	var details []string
+	for key := range change.Details {
+		details = append(details, key)
+	}
+	sort.Strings(details)
+	for _, key := range details {
+		facts = append(facts, chatFact{key, change.Details[key]})
+	}
+
+	facts = append(facts, chatFact{"Severity", change.Severity.String()})
+	if change.Site != "" {
+		facts = append(facts, chatFact{"Site", change.Site})
+	}
+
+	if change.Location != "" {
+		facts = append(facts, chatFact{"Location", change.Location})
+	}
+
+	if change.Geo != nil {
+		place := strings.TrimPrefix(change.Geo.City+", "+change.Geo.Country, ", ")
+		facts = append(facts, chatFact{"GeoIP", place})
+	}
+
+	if change.Previous != nil {
+		for _, diff := range entryDiff(change.Previous, &change.Entry) {
+			facts = append(facts, chatFact{"Changed " + diff.Field,
+				fmt.Sprintf("%q → %q", diff.Previous, diff.Current)})
+		}
+	}
+
+	if ago := lastSeenAgo(change); ago != "" {
+		facts = append(facts, chatFact{"Last seen", ago + " ago"})
+	}
+
+	facts = append(facts, chatFact{"Time", change.Timestamp.Format(time.RFC3339)})
+	return facts
+}
+
+// chatButton is a link shown as a button on a card.
+type chatButton struct {
+	Title string
+	URL   string
+}
+
+// chatButtons Returns the buttons of a change's card, which open its service
+// and acknowledge it.
+func chatButtons(change *ServiceEntryChange) []chatButton {
+	var buttons []chatButton
+	if change.URL != "" {
+		buttons = append(buttons, chatButton{"Open", change.URL})
+	}
+
+	if change.AckURL != "" {
+		buttons = append(buttons, chatButton{"Acknowledge", change.AckURL})
+	}
+
+	return buttons
+}
+
+// chatTitle Returns the text at the top of the card for a change.
+func chatTitle(change *ServiceEntryChange) string {
+	title := fmt.Sprintf("%s %q", change.ChangeType.String(), change.Entry.Instance)
+	if change.ChangeType == RENAMED && change.Previous != nil {
+		title += fmt.Sprintf(" (was %q)", change.Previous.Instance)
+	}
+
+	if change.Shadow {
+		title = "[SHADOW] " + title
+	}
+
+	return title
+}
+
+// digestFacts Returns a fact for each change of a digest, up to
+// CHAT_DIGEST_MAX.
+func digestFacts(changes []ServiceEntryChange) []chatFact {
+	var facts []chatFact
+	for i := range changes {
+		if i == CHAT_DIGEST_MAX {
+			facts = append(facts, chatFact{"…",
+				fmt.Sprintf("and %d more", len(changes)-CHAT_DIGEST_MAX)})
+			break
+		}
+
+		facts = append(facts, chatFact{changes[i].ChangeType.String(),
+			fmt.Sprintf("%q (%s) %s", changes[i].Entry.Instance,
+				changes[i].Entry.Service,
+				changes[i].Severity.String())})
+	}
+
+	return facts
+}
+
+// chatNotifier Posts cards to the webhook of a single [teams.<name>] or
+// [googlechat.<name>] block.
+type chatNotifier struct {
+	name     string
+	kind     string
+	conf     chatConfig
+	template *template.Template
+	client   *http.Client
+}
+
+// newChatNotifier Creates a notifier for the teams or googlechat block
+// called name.
+func newChatNotifier(kind string, name string, conf chatConfig) *chatNotifier {
+	return &chatNotifier{name: kind + "." + name,
+		kind:     kind,
+		conf:     conf,
+		template: parseTemplate(kind+"."+name, conf.Template),
+		client:   &http.Client{Timeout: time.Duration(conf.TimeoutSeconds) * time.Second}}
+}
+
+func (cn *chatNotifier) Name() string {
+	return cn.name
+}
+
+func (cn *chatNotifier) Allows(change *ServiceEntryChange) (bool, string) {
+	if change.Severity < minSeverity(cn.conf.MinSeverity) {
+		return false, "severity below MinSeverity"
+	}
+
+	return cn.conf.allowsChange(change)
+}
+
+// card Returns the message posted to the webhook, a card with title,
+// subtitle, facts and buttons in the format of the chat service.
+func (cn *chatNotifier) card(id string,
+	title string,
+	subtitle string,
+	severity Severity,
+	facts []chatFact,
+	buttons []chatButton) any {
+	if cn.kind == CHAT_TEAMS {
+		return teamsCard(title, subtitle, severity, facts, buttons)
+	}
+
+	return googleChatCard(id, title, subtitle, facts, buttons)
+}
+
+// teamsCard Returns an Adaptive Card message, which both the Teams incoming
+// webhooks and Workflows accept.
+func teamsCard(title string,
+	subtitle string,
+	severity Severity,
+	facts []chatFact,
+	buttons []chatButton) any {
+	color := "Default"
+	switch severity {
+	case SEVERITY_WARNING:
+		color = "Warning"
+		break
+	case SEVERITY_CRITICAL:
+		color = "Attention"
+		break
+	}
+
+	factSet := make([]map[string]string, 0, len(facts))
+	for _, fact := range facts {
+		factSet = append(factSet, map[string]string{"title": fact.Title, "value": fact.Value})
+	}
+
+	content := map[string]any{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body": []map[string]any{
+			{"type": "TextBlock",
+				"text":   title,
+				"weight": "Bolder",
+				"size":   "Medium",
+				"color":  color,
+				"wrap":   true},
+			{"type": "TextBlock",
+				"text":     subtitle,
+				"isSubtle": true,
+				"spacing":  "None",
+				"wrap":     true},
+			{"type": "FactSet", "facts": factSet}}}
+	if len(buttons) != 0 {
+		actions := make([]map[string]string, 0, len(buttons))
+		for _, button := range buttons {
+			actions = append(actions, map[string]string{"type": "Action.OpenUrl",
+				"title": button.Title,
+				"url":   button.URL})
+		}
+		content["actions"] = actions
+	}
+
+	return map[string]any{"type": "message",
+		"attachments": []map[string]any{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content":     content}}}
+}
+
+// googleChatCard Returns a message with a card in the cardsV2 format of
+// Google Chat, the text is shown in notifications.
+func googleChatCard(id string,
+	title string,
+	subtitle string,
+	facts []chatFact,
+	buttons []chatButton) any {
+	widgets := make([]map[string]any, 0, len(facts)+1)
+	for _, fact := range facts {
+		widgets = append(widgets, map[string]any{
+			"decoratedText": map[string]any{"topLabel": fact.Title,
+				"text":     fact.Value,
+				"wrapText": true}})
+	}
+
+	if len(buttons) != 0 {
+		list := make([]map[string]any, 0, len(buttons))
+		for _, button := range buttons {
+			list = append(list, map[string]any{"text": button.Title,
+				"onClick": map[string]any{"openLink": map[string]string{"url": button.URL}}})
+		}
+		widgets = append(widgets, map[string]any{
+			"buttonList": map[string]any{"buttons": list}})
+	}
+
+	return map[string]any{"text": title,
+		"cardsV2": []map[string]any{{
+			"cardId": id,
+			"card": map[string]any{
+				"header":   map[string]string{"title": title, "subtitle": subtitle},
+				"sections": []map[string]any{{"widgets": widgets}}}}}}
+}
+
+// message Returns the card for a change.
+func (cn *chatNotifier) message(change *ServiceEntryChange) any {
+	subtitle := change.Entry.ServiceInstanceName()
+	if change.UnknownDevice {
+		subtitle += " (unknown device)"
+	}
+
+	return cn.card(change.ID,
+		applyTemplate(cn.template, change, chatTitle(change)),
+		subtitle,
+		change.Severity,
+		chatFacts(change),
+		chatButtons(change))
+}
+
+// digestMessage Returns the card for a digest, its colour is that of the
+// most severe change.
+func (cn *chatNotifier) digestMessage(changes []ServiceEntryChange) any {
+	severity := SEVERITY_INFO
+	for i := range changes {
+		severity = max(severity, changes[i].Severity)
+	}
+
+	title := fmt.Sprintf("Digest of %d changes", len(changes))
+	if len(changes) != 0 && changes[0].Report {
+		title = fmt.Sprintf("Inventory report of %d changes", len(changes))
+	}
+	if len(changes) != 0 && changes[0].Shadow {
+		title = "[SHADOW] " + title
+	}
+
+	return cn.card(newEventID(), title, "zcnotify", severity, digestFacts(changes), nil)
+}
+
+// post Sends a message to the webhook.
+func (cn *chatNotifier) post(message any) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("marshal error: %s", err.Error())
+	}
+
+	resp, err := cn.client.Post(cn.conf.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The error includes the URL, which is a secret.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Teams Workflows accept messages with 202.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("%s webhook request failed: %s", cn.kind, resp.Status)
+	}
+
+	return nil
+}
+
+// render Returns a message as it would be posted, without the secret URL.
+func (cn *chatNotifier) render(message any) (string, error) {
+	body, err := json.MarshalIndent(message, "", "    ")
+	if err != nil {
+		return "", fmt.Errorf("marshal error: %s", err.Error())
+	}
+
+	parsed, _ := url.Parse(cn.conf.URL)
+	return "POST " + parsed.Scheme + "://" + parsed.Host + "/...\n\n" + string(body), nil
+}
+
+func (cn *chatNotifier) Render(change *ServiceEntryChange) (string, error) {
+	return cn.render(cn.message(change))
+}
+
+// Notify Posts the card for a change.
+func (cn *chatNotifier) Notify(change *ServiceEntryChange) error {
+	return cn.post(cn.message(change))
+}
+
+func (cn *chatNotifier) RenderDigest(changes []ServiceEntryChange) (string, error) {
+	return cn.render(cn.digestMessage(changes))
+}
+
+// NotifyDigest Posts the changes held back during quiet hours as a single
+// card.
+func (cn *chatNotifier) NotifyDigest(changes []ServiceEntryChange) error {
+	return cn.post(cn.digestMessage(changes))
+}
+
+// Check Connects to the webhook's host, posting anything would be seen in
+// the channel.
+func (cn *chatNotifier) Check() error {
+	parsed, err := url.Parse(cn.conf.URL)
+	if err != nil {
+		return err
+	}
+
+	port := parsed.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	conn, err := net.DialTimeout("tcp",
+		net.JoinHostPort(parsed.Hostname(), port),
+		time.Duration(cn.conf.TimeoutSeconds)*time.Second)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// Events are written in zcnotify's own JSON form, see
+	// serviceEntryChangeJSON.
+	FORMAT_NATIVE string = "native"
+	// Events are written as CloudEvents 1.0 in structured JSON mode, with
+	// the native form as their data.
+	FORMAT_CLOUDEVENTS string = "cloudevents"
+	// Prefix of the CloudEvents type attribute, e.g.
+	// "net.zcnotify.service.added".
+	CLOUDEVENTS_TYPE_PREFIX string = "net.zcnotify.service."
+)
+
+// eventFormatConfig is embedded in backend blocks which write events as
+// JSON, to choose the form they're written in.
+type eventFormatConfig struct {
+	// native or cloudevents.
+	Format string
+	// CloudEvents source attribute, "zcnotify://<host name>" if not set.
+	Source string
+}
+
+// setup Checks the format and fills in the default source.
+func (ef *eventFormatConfig) setup(name string) error {
+	switch strings.ToLower(ef.Format) {
+	case "", FORMAT_NATIVE:
+		ef.Format = FORMAT_NATIVE
+		break
+	case FORMAT_CLOUDEVENTS:
+		ef.Format = FORMAT_CLOUDEVENTS
+		break
+	default:
+		return fmt.Errorf("%s: unknown Format %q, expected %s or %s",
+			name, ef.Format, FORMAT_NATIVE, FORMAT_CLOUDEVENTS)
+	}
+
+	if ef.Format == FORMAT_CLOUDEVENTS && ef.Source == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("%s: no Source and %s", name, err.Error())
+		}
+		ef.Source = "zcnotify://" + hostname
+	}
+
+	return nil
+}
+
+// cloudEvent is a CloudEvents 1.0 event in structured JSON mode.  The
+// severity is an extension attribute so that it can be routed on without
+// looking at the data.
+type cloudEvent struct {
+	SpecVersion     string                 `json:"specversion"`
+	ID              string                 `json:"id"`
+	Source          string                 `json:"source"`
+	Type            string                 `json:"type"`
+	Subject         string                 `json:"subject"`
+	Time            time.Time              `json:"time"`
+	DataContentType string                 `json:"datacontenttype"`
+	Severity        string                 `json:"severity"`
+	Data            serviceEntryChangeJSON `json:"data"`
+}
+
+// cloudEventType Returns the CloudEvents type of a change type.
+func cloudEventType(changeType ServiceChangeType) string {
+	var suffix string
+	switch changeType {
+	case ADD:
+		suffix = "added"
+		break
+	case REMOVE:
+		suffix = "removed"
+		break
+	case MODIFY:
+		suffix = "modified"
+		break
+	default:
+		// RENAMED is "renamed", TXT_CHANGED is "txt.changed" and so on.
+		suffix = strings.ReplaceAll(strings.ToLower(changeType.String()), "_", ".")
+		break
+	}
+
+	return CLOUDEVENTS_TYPE_PREFIX + suffix
+}
+
+// encode Returns the value to marshal for a change in the configured
+// format.
+func (ef *eventFormatConfig) encode(change *ServiceEntryChange, includeTrace bool) any {
+	event := change.toJSON(includeTrace)
+	if ef.Format != FORMAT_CLOUDEVENTS {
+		return event
+	}
+
+	return cloudEvent{SpecVersion: "1.0",
+		ID:              change.ID,
+		Source:          ef.Source,
+		Type:            cloudEventType(change.ChangeType),
+		Subject:         change.Entry.ServiceInstanceName(),
+		Time:            change.Timestamp,
+		DataContentType: "application/json",
+		Severity:        change.Severity.String(),
+		Data:            event}
+}
@@ -0,0 +1,894 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// command is a single zcnotify subcommand.
+type command struct {
+	name        string
+	description string
+	// run Parses the command's arguments and executes it, returning the
+	// process exit code.
+	run func(name string, args []string) int
+}
+
+var commands []command
+
+func init() {
+	// Assigned in init as the help command refers to the command table.
+	commands = []command{
+		{"run", "watch for service changes and send notifications", runCommand},
+		{"scan", "browse once and print the services found", scanCommand},
+		{"watch", "print service changes as they happen, or show them live with -tui", watchCommand},
+		{"check-config", "validate the config file and backend connectivity", checkConfigCommand},
+		{"init-config", "write a commented example config file", initConfigCommand},
+		{"list", "list the services known to a running instance", listCommand},
+		{"health", "check the health of a running instance", healthCommand},
+		{"export", "write the known services to a file", exportCommand},
+		{"import", "replace the known services with those from a file", importCommand},
+		{"history", "print or export the recorded event history", historyCommand},
+		{"replay", "send recorded events again through selected backends", replayCommand},
+		{"report", "print the availability of each service over a period", reportCommand},
+		{"selftest", "check that discovery works on this host", selftestCommand},
+		{"test-notify", "send a synthetic event through the configured backends", testNotifyCommand},
+		{"admin", "reload, rescan or clear the state of a running instance", adminCommand},
+		{"dump", "print a snapshot of the internal state of a running instance", dumpCommand},
+		{"silence", "hold back the notifications of a running instance for a while", silenceCommand},
+		{"service", "install, uninstall, start or stop the Windows service", serviceCommand},
+		{"help", "show this help", helpCommand},
+	}
+}
+
+// commonFlags are accepted by every command which reads the config file.
+type commonFlags struct {
+	fs           *flag.FlagSet
+	configFile   *string
+	configFormat *string
+	overrides    []configOverride
+	logLevel     *string
+	logFormat    *string
+	logOutput    *string
+}
+
+// addCommonFlags Registers the common flags on fs.
+func addCommonFlags(fs *flag.FlagSet) *commonFlags {
+	cf := &commonFlags{
+		fs: fs,
+		configFile: fs.String("config",
+			DEFAULT_CONFIG_FILE,
+			"Configuration file (TOML, YAML or JSON)"),
+		configFormat: fs.String("config-format",
+			"",
+			"Config file format (toml, yaml, json), defaults to the file's extension"),
+		logLevel: fs.String("log-level",
+			"",
+			"Log level (debug, info, warn, error), overrides the config file"),
+		logFormat: fs.String("log-format",
+			"",
+			"Log format (text, json), overrides the config file"),
+		logOutput: fs.String("log-output",
+			"",
+			"Log destination (stderr, stdout or a file), overrides the config file"),
+	}
+	addOverrideFlags(fs, &cf.overrides)
+
+	return cf
+}
+
+// file Returns the config file to load.  Without -config a missing
+// zcnotify.toml isn't an error, the config then comes from ZCNOTIFY_*
+// environment variables and flags alone and the file is empty.
+func (cf *commonFlags) file() string {
+	explicit := false
+	cf.fs.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			explicit = true
+		}
+	})
+
+	if _, err := os.Stat(*cf.configFile); !explicit && errors.Is(err, os.ErrNotExist) {
+		return ""
+	}
+
+	return *cf.configFile
+}
+
+// setup Loads the config file and configures logging, command line flags
+// take precedence over the config file.
+func (cf *commonFlags) setup() (*config, error) {
+	zcnConfig, err := loadConfig(cf.file(), *cf.configFormat, cf.overrides)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config file: %s", err.Error())
+	}
+
+	if *cf.logLevel != "" {
+		zcnConfig.Log.Level = *cf.logLevel
+	}
+
+	if *cf.logFormat != "" {
+		zcnConfig.Log.Format = *cf.logFormat
+	}
+
+	if *cf.logOutput != "" {
+		zcnConfig.Log.Output = *cf.logOutput
+	}
+
+	if err := setupLogging(zcnConfig.Log); err != nil {
+		return nil, fmt.Errorf("invalid log configuration: %s", err.Error())
+	}
+
+	return zcnConfig, nil
+}
+
+// newFlagSet Creates the flag set for a command.
+func newFlagSet(name string, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags] %s\n",
+			os.Args[0], name, args)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+func runCommand(name string, args []string) int {
+	return runUntil(name, args, nil)
+}
+
+// runUntil Runs zcnotify with the run command's arguments until it's
+// interrupted or told to on stop, e.g. by the Windows service manager.
+func runUntil(name string, args []string, stop <-chan bool) int {
+	fs := newFlagSet(name, "")
+	common := addCommonFlags(fs)
+	once := fs.Bool("once", false, "Browse once, print the results and exit (same as scan)")
+	format := fs.String("format", OUTPUT_TABLE,
+		"Output format with -once (table, json, yaml, csv)")
+	dryRun := fs.Bool("dry-run", false,
+		"Log rendered notifications instead of sending them")
+	shadow := fs.String("shadow-config", "",
+		"Also deliver every event to the backends of this config file, marked as shadow")
+	migrate := fs.Bool("migrate", false,
+		"Rewrite a state file written by a newer zcnotify in this version's schema")
+	baseline := fs.Bool("baseline", false,
+		"Record the services found by the first browse without notifying them")
+	output := fs.String("output", "",
+		"Write every event to stdout as ndjson, a JSON object per line, and log to stderr")
+	fs.Parse(args)
+
+	if *once {
+		return scan(common, *format, 0)
+	}
+
+	// The config is loaded again by a reload.
+	load := func() (*config, error) {
+		zcnConfig, err := common.setup()
+		if err != nil {
+			return nil, err
+		}
+
+		if *dryRun {
+			zcnConfig.DryRun = true
+		}
+
+		if *migrate {
+			zcnConfig.Migrate = true
+		}
+
+		if *baseline {
+			zcnConfig.SuppressInitialAdds = true
+		}
+
+		if *shadow != "" {
+			zcnConfig.Shadow.Config = *shadow
+		}
+
+		if *output != "" {
+			zcnConfig.Output = *output
+		}
+
+		if err := zcnConfig.checkOutput(); err != nil {
+			return nil, err
+		}
+
+		return zcnConfig, nil
+	}
+
+	zcnConfig, err := load()
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	// Interfaces may come and go while running, so having none to start
+	// with isn't fatal.
+	ipver, err := ipVersions(zcnConfig.Interfaces)
+	if err != nil {
+		fatal("invalid interface configuration", "err", err)
+	}
+
+	intfs, err := currentInterfaces(zcnConfig.Interfaces)
+	if err != nil {
+		fatal("invalid interface configuration", "err", err)
+	}
+
+	run(zcnConfig, load, ipver, intfs, stop)
+	return 0
+}
+
+func scanCommand(name string, args []string) int {
+	fs := newFlagSet(name, "")
+	common := addCommonFlags(fs)
+	format := fs.String("format", OUTPUT_TABLE,
+		"Output format (table, json, yaml, csv)")
+	timeout := fs.Uint("timeout", 0,
+		"Seconds to browse for, defaults to the configured scan period")
+	fs.Parse(args)
+
+	return scan(common, *format, *timeout)
+}
+
+// scan Browses once and prints the services found, the exit code is non-zero
+// if no services were found so that scripts can act on it.
+func scan(common *commonFlags, format string, timeout uint) int {
+	zcnConfig, err := common.setup()
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	ipver, intfs, err := discoveryInterfaces(zcnConfig.Interfaces)
+	if err != nil {
+		fatal("invalid interface configuration", "err", err)
+	}
+
+	if timeout == 0 {
+		timeout = zcnConfig.ScanPeriodSeconds
+		if zcnConfig.BrowseTimeoutSeconds != 0 {
+			timeout = min(timeout, zcnConfig.BrowseTimeoutSeconds)
+		}
+	}
+
+	entries, err := browseTargetsOnce(zcnConfig,
+		time.Duration(timeout)*time.Second,
+		ipver,
+		intfs)
+	if err != nil {
+		fatal("failed to browse", "err", err)
+	}
+
+	if err := writeEntries(os.Stdout, entries, format); err != nil {
+		fatal("failed to write results", "err", err)
+	}
+
+	if len(entries) == 0 {
+		return 1
+	}
+
+	return 0
+}
+
+func checkConfigCommand(name string, args []string) int {
+	fs := newFlagSet(name, "")
+	common := addCommonFlags(fs)
+	noConnect := fs.Bool("no-connect", false,
+		"Only validate the config file, don't contact notification backends")
+	fs.Parse(args)
+
+	// Every problem with the file is listed before it's loaded, which
+	// stops at the first.
+	if configFile := common.file(); configFile != "" {
+		problems, err := lintConfig(configFile, *common.configFormat)
+		if err != nil {
+			fmt.Println("FAIL:", err.Error())
+			return 1
+		}
+
+		failed := false
+		for _, problem := range problems {
+			if problem.warning {
+				fmt.Printf("WARN: %s: %s\n", configFile, problem)
+			} else {
+				fmt.Printf("FAIL: %s: %s\n", configFile, problem)
+				failed = true
+			}
+		}
+
+		if failed {
+			return 1
+		}
+	}
+
+	zcnConfig, err := common.setup()
+	if err != nil {
+		fmt.Println("FAIL:", err.Error())
+		return 1
+	}
+
+	fmt.Println("OK: config file", *common.configFile)
+	if _, _, err := discoveryInterfaces(zcnConfig.Interfaces); err != nil {
+		fmt.Println("FAIL: interfaces:", err.Error())
+		return 1
+	}
+
+	fmt.Println("OK: interfaces")
+	notifiers, err := buildNotifiers(zcnConfig)
+	if err != nil {
+		fmt.Println("FAIL: notifiers:", err.Error())
+		return 1
+	}
+
+	if *noConnect {
+		return 0
+	}
+
+	status := 0
+	for _, n := range notifiers {
+		if err := n.Check(); err != nil {
+			fmt.Printf("FAIL: %s: %s\n", n.Name(), err.Error())
+			status = 1
+		} else {
+			fmt.Printf("OK: %s\n", n.Name())
+		}
+	}
+
+	return status
+}
+
+// initConfigCommand Writes the example config, which documents every
+// section, in TOML or YAML.  JSON has no comments so isn't offered.
+func initConfigCommand(name string, args []string) int {
+	fs := newFlagSet(name, "")
+	format := fs.String("format", "",
+		"Config format (toml, yaml), defaults to the extension of -o or toml")
+	output := fs.String("o", "", "File to write, defaults to stdout")
+	force := fs.Bool("force", false, "Overwrite the file if it exists")
+	fs.Parse(args)
+
+	configFormat, err := configFormat(*output, *format)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	example := exampleTOML
+	switch configFormat {
+	case CONFIG_YAML:
+		example = exampleYAML
+		break
+	case CONFIG_JSON:
+		fatal("JSON can't hold the example's comments, use toml or yaml")
+	}
+
+	if *output == "" {
+		fmt.Print(example)
+		return 0
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if !*force {
+		flags |= os.O_EXCL
+	}
+
+	f, err := os.OpenFile(*output, flags, 0644)
+	if errors.Is(err, os.ErrExist) {
+		fatal("file already exists, use -force to overwrite it", "file", *output)
+	} else if err != nil {
+		fatal("failed to create file", "err", err)
+	}
+
+	if _, err := io.WriteString(f, example); err != nil {
+		f.Close()
+		fatal("failed to write file", "err", err)
+	}
+
+	if err := f.Close(); err != nil {
+		fatal("failed to write file", "err", err)
+	}
+
+	fmt.Printf("wrote %s, check it with \"%s check-config -config %s\"\n",
+		*output, os.Args[0], *output)
+	return 0
+}
+
+// newCommandAPIClient Returns a client of the API at addr, or of the
+// configured API listener with the config's [server] settings if addr is
+// empty.  role picks the configured token presented.
+func newCommandAPIClient(common *commonFlags,
+	addr string,
+	token string,
+	role apiRole) *apiClient {
+	var server serverConfig
+	if addr == "" {
+		zcnConfig, err := common.setup()
+		if err != nil {
+			fatal(err.Error())
+		}
+
+		if zcnConfig.Api.Listen == "" {
+			fatal("no API address given and none configured")
+		}
+
+		addr = zcnConfig.Api.Listen
+		server = zcnConfig.Server
+	}
+
+	client, err := newAPIClient(addr, server, token, role)
+	if err != nil {
+		fatal("failed to create API client", "err", err)
+	}
+
+	return client
+}
+
+func listCommand(name string, args []string) int {
+	fs := newFlagSet(name, "")
+	common := addCommonFlags(fs)
+	format := fs.String("format", OUTPUT_TABLE,
+		"Output format (table, json, yaml, csv)")
+	addr := fs.String("api", "",
+		"Address of the instance's API, defaults to the configured API listener")
+	token := fs.String("token", "",
+		"Bearer token for the API, defaults to the first [server] token")
+	fs.Parse(args)
+
+	entries, err := fetchServices(newCommandAPIClient(common, *addr, *token, ROLE_READ))
+	if err != nil {
+		fatal("failed to query API", "err", err)
+	}
+
+	if err := writeEntries(os.Stdout, entries, *format); err != nil {
+		fatal("failed to write results", "err", err)
+	}
+
+	return 0
+}
+
+// healthCommand Exits 0 if a running instance is healthy (or ready with
+// -ready) and 1 if not, for container health checks where there's no curl.
+func healthCommand(name string, args []string) int {
+	fs := newFlagSet(name, "")
+	common := addCommonFlags(fs)
+	ready := fs.Bool("ready", false, "Check readiness rather than liveness")
+	addr := fs.String("api", "",
+		"Address of the instance's API, defaults to the configured API listener")
+	token := fs.String("token", "",
+		"Bearer token for the API, defaults to the first [server] token")
+	fs.Parse(args)
+
+	report, ok, err := fetchHealth(newCommandAPIClient(common, *addr, *token, ROLE_READ), *ready)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "health check failed: %s\n", err.Error())
+		return 1
+	}
+
+	fmt.Printf("status: %s, ready: %t\n", report.Status, report.Ready)
+	for _, wh := range report.Watchers {
+		if !wh.Healthy || !wh.Ready {
+			fmt.Printf("watcher %s %s: healthy %t, ready %t, last error %q\n",
+				wh.Service, wh.Domain, wh.Healthy, wh.Ready, wh.LastError)
+		}
+	}
+	for _, bh := range report.Backends {
+		if !bh.Healthy {
+			fmt.Printf("backend %s: %d consecutive failures, queue %d/%d, last error %q\n",
+				bh.Backend, bh.ConsecutiveFailures, bh.QueueLength, bh.QueueCapacity,
+				bh.LastError)
+		}
+	}
+
+	if !ok {
+		return 1
+	}
+
+	return 0
+}
+
+// exportCommand Writes the services known to a running instance, or those
+// in the state file, in a format which import can read back.
+func exportCommand(name string, args []string) int {
+	fs := newFlagSet(name, "")
+	common := addCommonFlags(fs)
+	format := fs.String("format", OUTPUT_JSON, "Output format (json, yaml, csv)")
+	output := fs.String("o", "", "File to write, defaults to stdout")
+	addr := fs.String("api", "",
+		"Address of a running instance's API, the state file is read if not given")
+	token := fs.String("token", "", "Bearer token for the API")
+	fs.Parse(args)
+
+	if *format == OUTPUT_TABLE {
+		fatal("the table format can't be imported, use json, yaml or csv")
+	}
+
+	var entries []zeroconf.ServiceEntry
+	if *addr != "" {
+		var err error
+		if entries, err = fetchServices(newCommandAPIClient(common, *addr, *token, ROLE_READ)); err != nil {
+			fatal("failed to query API", "err", err)
+		}
+	} else {
+		zcnConfig, err := common.setup()
+		if err != nil {
+			fatal(err.Error())
+		}
+
+		if zcnConfig.State.File == "" {
+			fatal("no state file configured")
+		}
+
+		state, _, err := readStateFile(zcnConfig.State.File)
+		if err != nil {
+			fatal("failed to read state", "err", err)
+		}
+
+		if state != nil {
+			for i := range state.Services {
+				entries = append(entries, state.Services[i].serviceEntry())
+			}
+		}
+	}
+
+	w := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fatal("failed to create file", "err", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := writeEntries(w, entries, *format); err != nil {
+		fatal("failed to write services", "err", err)
+	}
+
+	return 0
+}
+
+// importCommand Replaces (or with -merge, adds to) the services in the state
+// file with those read from a file written by export or scan, the presence
+// history is kept.  Services in the file which aren't on the network are
+// reported as removed by the next run, and those on the network but not in
+// the file as added.
+func importCommand(name string, args []string) int {
+	fs := newFlagSet(name, "<file>")
+	common := addCommonFlags(fs)
+	format := fs.String("format", "",
+		"Input format (json, yaml, csv), defaults to the file's extension")
+	merge := fs.Bool("merge", false,
+		"Add to the known services rather than replacing them")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	file := fs.Arg(0)
+	if *format == "" {
+		*format = strings.ToLower(strings.TrimPrefix(filepath.Ext(file), "."))
+		if *format == "yml" {
+			*format = OUTPUT_YAML
+		}
+	}
+
+	zcnConfig, err := common.setup()
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	if zcnConfig.State.File == "" {
+		fatal("no state file configured")
+	}
+
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			fatal("failed to open file", "err", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	imported, err := readEntries(r, *format)
+	if err != nil {
+		fatal("failed to read services", "file", file, "err", err)
+	}
+
+	for i := range imported {
+		if imported[i].Instance == "" || imported[i].Service == "" {
+			fatal("every service needs an instance and service name", "file", file)
+		}
+
+		// Discovered entries have fully qualified domains.
+		if imported[i].Domain == "" {
+			imported[i].Domain = DEFAULT_DOMAIN
+		}
+		if !strings.HasSuffix(imported[i].Domain, ".") {
+			imported[i].Domain += "."
+		}
+	}
+
+	// Newer state files are refused, as they would be by run.
+	zcnConfig.State.OnNewerSchema = STATE_NEWER_REFUSE
+	state, known, presence, err := openStateStore(zcnConfig.State, false)
+	if err != nil {
+		fatal("failed to open state store", "err", err)
+	}
+
+	registry := newServiceRegistry()
+	if *merge {
+		registry.seed(known)
+	}
+	registry.seed(imported)
+
+	entries := registry.snapshot()
+	if err := state.save(entries, presence); err != nil {
+		fatal("failed to save state", "err", err)
+	}
+
+	fmt.Printf("imported %d services, %d known\n", len(imported), len(entries))
+	return 0
+}
+
+func historyCommand(name string, args []string) int {
+	if len(args) != 0 && args[0] == "export" {
+		return historyExportCommand(name+" export", args[1:])
+	}
+
+	if len(args) != 0 && args[0] == "prune" {
+		return historyPruneCommand(name+" prune", args[1:])
+	}
+
+	fs := newFlagSet(name, "[export|prune]")
+	common := addCommonFlags(fs)
+	format := fs.String("format", OUTPUT_TABLE, "Output format (table, json)")
+	last := fs.Uint("n", 0, "Only print the last n events")
+	fs.Parse(args)
+
+	zcnConfig, err := common.setup()
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	if zcnConfig.History.File == "" {
+		fatal("no history file configured")
+	}
+
+	changes, err := readHistory(zcnConfig.History.File)
+	if err != nil {
+		fatal("failed to read history", "err", err)
+	}
+
+	if *last > 0 && uint(len(changes)) > *last {
+		changes = changes[uint(len(changes))-*last:]
+	}
+
+	if err := writeChanges(os.Stdout, changes, *format); err != nil {
+		fatal("failed to write history", "err", err)
+	}
+
+	return 0
+}
+
+// historyPruneCommand Prunes the history file to the [history] limits, or to
+// those given on the command line.
+func historyPruneCommand(name string, args []string) int {
+	fs := newFlagSet(name, "")
+	common := addCommonFlags(fs)
+	maxAge := fs.String("max-age", "",
+		"Prune the events older than this period, such as 30d, defaults to MaxAgeDays")
+	maxEvents := fs.Int("max-events", -1, "Most events to keep, defaults to MaxEvents")
+	maxSize := fs.Int("max-size-mb", -1, "Largest size of the history in megabytes, defaults to MaxSizeMB")
+	fs.Parse(args)
+
+	zcnConfig, err := common.setup()
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	if zcnConfig.History.File == "" {
+		fatal("no history file configured")
+	}
+
+	now := time.Now()
+	limits := zcnConfig.History.limits(now, 100)
+	if *maxAge != "" {
+		period, err := parsePeriod(*maxAge)
+		if err != nil {
+			fatal("invalid max-age", "err", err)
+		}
+		limits.cutoff = now.Add(-period)
+	}
+
+	if *maxEvents >= 0 {
+		limits.maxEvents = *maxEvents
+	}
+
+	if *maxSize >= 0 {
+		limits.maxBytes = int64(*maxSize) * 1024 * 1024
+	}
+
+	if limits.cutoff.IsZero() && limits.maxEvents == 0 && limits.maxBytes == 0 {
+		fatal("no limits to prune to, set them in [history] or give -max-age, -max-events or -max-size-mb")
+	}
+
+	kept, removed, skipped, err := newHistoryWriter(zcnConfig.History).prune(limits)
+	if err != nil {
+		fatal("failed to prune history", "err", err)
+	}
+
+	fmt.Printf("pruned %d events, %d kept\n", removed, kept)
+	if skipped != 0 {
+		fmt.Printf("removed %d unreadable lines\n", skipped)
+	}
+	return 0
+}
+
+func reportCommand(name string, args []string) int {
+	fs := newFlagSet(name, "")
+	common := addCommonFlags(fs)
+	format := fs.String("format", OUTPUT_TABLE, "Output format (table, json)")
+	period := fs.String("period", DEFAULT_REPORT_PERIOD,
+		"Period to report on, e.g. 24h or 30d")
+	fs.Parse(args)
+
+	duration, err := parsePeriod(*period)
+	if err != nil {
+		fatal("invalid period", "err", err)
+	}
+
+	zcnConfig, err := common.setup()
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	if zcnConfig.State.File == "" {
+		fatal("no state file configured")
+	}
+
+	state, _, err := readStateFile(zcnConfig.State.File)
+	if err != nil {
+		fatal("failed to read state", "err", err)
+	}
+
+	var presence []servicePresence
+	if state != nil {
+		presence = state.Presence
+	}
+
+	report := availabilityReport(presence, duration, time.Now().UTC())
+	if err := writeAvailability(os.Stdout, report, *format); err != nil {
+		fatal("failed to write report", "err", err)
+	}
+
+	return 0
+}
+
+func selftestCommand(name string, args []string) int {
+	fs := newFlagSet(name, "")
+	common := addCommonFlags(fs)
+	fs.Parse(args)
+
+	zcnConfig, err := common.setup()
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	ipver, intfs, err := discoveryInterfaces(zcnConfig.Interfaces)
+	if err != nil {
+		fatal("invalid interface configuration", "err", err)
+	}
+
+	if !selftest(zcnConfig.Zeroconf.Resolver, ipver, intfs) {
+		fmt.Println("selftest failed, check that multicast DNS (UDP port 5353) is allowed by the firewall")
+		return 1
+	}
+
+	fmt.Println("selftest passed")
+	return 0
+}
+
+func testNotifyCommand(name string, args []string) int {
+	fs := newFlagSet(name, "[backend...]")
+	common := addCommonFlags(fs)
+	changeType := fs.String("type", "ADD", "Change type of the synthetic event")
+	fs.Parse(args)
+
+	zcnConfig, err := common.setup()
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	sct, err := parseServiceChangeType(*changeType)
+	if err != nil {
+		fatal("invalid change type", "err", err)
+	}
+
+	notifiers, err := buildNotifiers(zcnConfig)
+	if err != nil {
+		fatal("failed to create notifiers", "err", err)
+	}
+
+	change := testChange(sct, zcnConfig)
+	status := 0
+	sent := 0
+	for _, n := range notifiers {
+		if !selectedBackend(n.Name(), fs.Args()) {
+			continue
+		}
+
+		sent++
+		if err := n.Notify(&change); err != nil {
+			fmt.Printf("FAIL: %s: %s\n", n.Name(), err.Error())
+			status = 1
+		} else {
+			fmt.Printf("OK: %s\n", n.Name())
+		}
+	}
+
+	if sent == 0 {
+		fmt.Println("FAIL: no backends matched", fs.Args())
+		return 1
+	}
+
+	return status
+}
+
+// selectedBackend Returns true if the backend called name is selected by
+// the command line, either by its full name ("email.pdmorrow") or its type
+// ("email").  No selection means every backend.
+func selectedBackend(name string, selection []string) bool {
+	if len(selection) == 0 {
+		return true
+	}
+
+	for _, selected := range selection {
+		if strings.EqualFold(selected, name) ||
+			strings.EqualFold(selected, strings.SplitN(name, ".", 2)[0]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func helpCommand(name string, args []string) int {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n",
+		os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "    %-14s %s\n", cmd.name, cmd.description)
+	}
+
+	fmt.Fprintf(os.Stderr,
+		"\nWithout a command zcnotify behaves as \"run\". Use \"%s <command> -h\" for a command's flags.\n",
+		os.Args[0])
+	return 0
+}
+
+// dispatch Runs the command named by the first argument, if the first
+// argument is a flag (or there are no arguments) the run command is used so
+// that existing invocations keep working.
+func dispatch(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runCommand("run", args)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(cmd.name, args[1:])
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+	helpCommand("help", nil)
+	return 2
+}
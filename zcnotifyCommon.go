@@ -1,8 +1,14 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/grandcat/zeroconf"
+	"net"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -12,8 +18,70 @@ const (
 	ADD    ServiceChangeType = iota
 	REMOVE                   = iota
 	MODIFY                   = iota
+	// The same device under a new instance name.
+	RENAMED = iota
+	// The same instance with only its addresses changed, which was
+	// READDRESSED before the other changes were split out of MODIFY.
+	ADDRESS_CHANGED = iota
+	// An advertised service which can't be connected to.
+	UNREACHABLE = iota
+	// A service which went and came back with different addresses.
+	MOVED = iota
+	// An [[expect]] service which has been absent for its grace period.
+	MISSING = iota
+	// A MISSING service which has returned.
+	RECOVERED = iota
+	// The same instance with only its port changed.
+	PORT_CHANGED = iota
+	// The same instance with only its TXT records changed.
+	TXT_CHANGED = iota
+	// The same instance with only its TTL changed.
+	TTL_CHANGED = iota
+	// An error of zcnotify itself, such as a watcher whose browses fail.
+	ERROR = iota
+	// zcnotify started, stopped or reloaded its config.
+	STARTED  = iota
+	STOPPED  = iota
+	RELOADED = iota
+	// A backend which gave up on a notification.
+	BACKEND_FAILED = iota
 )
 
+// ops Returns true for the events zcnotify raises about itself, see [ops].
+func (sct ServiceChangeType) ops() bool {
+	switch sct {
+	case ERROR, STARTED, STOPPED, RELOADED, BACKEND_FAILED:
+		return true
+	default:
+		return false
+	}
+}
+
+// modification Returns true for MODIFY and the change types which say what
+// a modification changed.
+func (sct ServiceChangeType) modification() bool {
+	switch sct {
+	case MODIFY, ADDRESS_CHANGED, PORT_CHANGED, TXT_CHANGED, TTL_CHANGED:
+		return true
+	default:
+		return false
+	}
+}
+
+// matchChangeType Returns true if sct is one of the named change types.
+// MODIFY matches every modification, so filters written before they were
+// split out still match them.
+func matchChangeType(names []string, sct ServiceChangeType) bool {
+	for _, name := range names {
+		parsed, err := parseServiceChangeType(name)
+		if err == nil && (parsed == sct || (parsed == MODIFY && sct.modification())) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (sct ServiceChangeType) MarshalJSON() ([]byte, error) {
 	var bytes []byte
 	switch sct {
@@ -26,13 +94,113 @@ func (sct ServiceChangeType) MarshalJSON() ([]byte, error) {
 	case MODIFY:
 		bytes = []byte(`"MODIFY"`)
 		break
+	case RENAMED:
+		bytes = []byte(`"RENAMED"`)
+		break
+	case ADDRESS_CHANGED:
+		bytes = []byte(`"ADDRESS_CHANGED"`)
+		break
+	case UNREACHABLE:
+		bytes = []byte(`"UNREACHABLE"`)
+		break
+	case MOVED:
+		bytes = []byte(`"MOVED"`)
+		break
+	case MISSING:
+		bytes = []byte(`"MISSING"`)
+		break
+	case RECOVERED:
+		bytes = []byte(`"RECOVERED"`)
+		break
+	case PORT_CHANGED:
+		bytes = []byte(`"PORT_CHANGED"`)
+		break
+	case TXT_CHANGED:
+		bytes = []byte(`"TXT_CHANGED"`)
+		break
+	case TTL_CHANGED:
+		bytes = []byte(`"TTL_CHANGED"`)
+		break
+	case ERROR:
+		bytes = []byte(`"ERROR"`)
+		break
+	case STARTED:
+		bytes = []byte(`"STARTED"`)
+		break
+	case STOPPED:
+		bytes = []byte(`"STOPPED"`)
+		break
+	case RELOADED:
+		bytes = []byte(`"RELOADED"`)
+		break
+	case BACKEND_FAILED:
+		bytes = []byte(`"BACKEND_FAILED"`)
+		break
 	default:
-		panic(fmt.Sprintf("unknown service change type %s", sct))
+		panic(fmt.Sprintf("unknown service change type %d", int(sct)))
 	}
 
 	return bytes, nil
 }
 
+func (sct *ServiceChangeType) UnmarshalJSON(bytes []byte) error {
+	var sctStr string
+	if err := json.Unmarshal(bytes, &sctStr); err != nil {
+		return err
+	}
+
+	parsed, err := parseServiceChangeType(sctStr)
+	if err != nil {
+		return err
+	}
+
+	*sct = parsed
+	return nil
+}
+
+// parseServiceChangeType Converts the name of a change type, as returned by
+// String(), back into a ServiceChangeType.
+func parseServiceChangeType(sctStr string) (ServiceChangeType, error) {
+	switch strings.ToUpper(sctStr) {
+	case "ADD":
+		return ADD, nil
+	case "REMOVE":
+		return REMOVE, nil
+	case "MODIFY":
+		return MODIFY, nil
+	case "RENAMED":
+		return RENAMED, nil
+	case "ADDRESS_CHANGED", "READDRESSED":
+		return ADDRESS_CHANGED, nil
+	case "UNREACHABLE":
+		return UNREACHABLE, nil
+	case "MOVED":
+		return MOVED, nil
+	case "MISSING":
+		return MISSING, nil
+	case "RECOVERED":
+		return RECOVERED, nil
+	case "PORT_CHANGED":
+		return PORT_CHANGED, nil
+	case "TXT_CHANGED":
+		return TXT_CHANGED, nil
+	case "TTL_CHANGED":
+		return TTL_CHANGED, nil
+	case "ERROR":
+		return ERROR, nil
+	case "STARTED":
+		return STARTED, nil
+	case "STOPPED":
+		return STOPPED, nil
+	case "RELOADED":
+		return RELOADED, nil
+	case "BACKEND_FAILED":
+		return BACKEND_FAILED, nil
+	default:
+		return ADD, fmt.Errorf("unknown service change type %q", sctStr)
+	}
+}
+
 func (sct ServiceChangeType) String() string {
 	var sctStr string
 	switch sct {
@@ -45,8 +213,50 @@ func (sct ServiceChangeType) String() string {
 	case MODIFY:
 		sctStr = "MODIFY"
 		break
+	case RENAMED:
+		sctStr = "RENAMED"
+		break
+	case ADDRESS_CHANGED:
+		sctStr = "ADDRESS_CHANGED"
+		break
+	case UNREACHABLE:
+		sctStr = "UNREACHABLE"
+		break
+	case MOVED:
+		sctStr = "MOVED"
+		break
+	case MISSING:
+		sctStr = "MISSING"
+		break
+	case RECOVERED:
+		sctStr = "RECOVERED"
+		break
+	case PORT_CHANGED:
+		sctStr = "PORT_CHANGED"
+		break
+	case TXT_CHANGED:
+		sctStr = "TXT_CHANGED"
+		break
+	case TTL_CHANGED:
+		sctStr = "TTL_CHANGED"
+		break
+	case ERROR:
+		sctStr = "ERROR"
+		break
+	case STARTED:
+		sctStr = "STARTED"
+		break
+	case STOPPED:
+		sctStr = "STOPPED"
+		break
+	case RELOADED:
+		sctStr = "RELOADED"
+		break
+	case BACKEND_FAILED:
+		sctStr = "BACKEND_FAILED"
+		break
 	default:
-		panic(fmt.Sprintf("unknown service change type %s", sct))
+		panic(fmt.Sprintf("unknown service change type %d", int(sct)))
 	}
 
 	return sctStr
@@ -56,18 +266,288 @@ func (sct ServiceChangeType) String() string {
 // member along with the type of change and the time at which the event occured
 // on the network.
 type ServiceEntryChange struct {
+	ID         string                `json:"id"`
 	ChangeType ServiceChangeType     `json:"changeType"`
 	Timestamp  time.Time             `json:"timestamp"`
 	Entry      zeroconf.ServiceEntry `json:"entry"`
+	// Previous is the entry before a modification, RENAMED or MOVED change,
+	// or the entry reported MISSING before a RECOVERED one.
+	Previous *zeroconf.ServiceEntry `json:"previous,omitempty"`
+	// Interface is the local interface on whose network the entry's
+	// addresses are, empty if there isn't one.
+	Interface string `json:"interface,omitempty"`
+	// Zones is the interface of each of the entry's IPv6 link-local
+	// addresses, and Connect is a host:port for each usable address with
+	// the zone on link-local ones, e.g. "[fe80::1%eth0]:80".
+	Zones   map[string]string `json:"zones,omitempty"`
+	Connect []string          `json:"connect,omitempty"`
+	// URL links to the service, if its type has a scheme, see [urls].
+	URL string `json:"url,omitempty"`
+	// Category is the kind of device, e.g. "printer", see [[category]].
+	Category string `json:"category,omitempty"`
+	// Networks are the labels of the [networks] the entry's addresses are
+	// on.
+	Networks []string `json:"networks,omitempty"`
+	// Site is the agent's site of events forwarded to an aggregator, or
+	// the [site] Name, with its Location and Tags.
+	Site     string   `json:"site,omitempty"`
+	Location string   `json:"location,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	// Geo is the GeoIP location of the entry's public address.
+	Geo        *geoLocation      `json:"geo,omitempty"`
+	Enrichment *deviceEnrichment `json:"enrichment,omitempty"`
+	Identity   *deviceIdentity   `json:"identity,omitempty"`
+	// Probe is the result of connecting to the service, if it was probed.
+	Probe *probeResult `json:"probe,omitempty"`
+	// Severity is set by the [[severity]] rules.
+	Severity Severity `json:"severity"`
+	// UnknownDevice is set if the device isn't in the [knownDevices] list.
+	UnknownDevice bool `json:"unknownDevice,omitempty"`
+	// Shadow is set on copies of the event delivered to the shadow pipeline.
+	Shadow bool `json:"shadow,omitempty"`
+	// Report is set on changes found by the scheduled inventory report
+	// rather than as they happened.
+	Report bool `json:"report,omitempty"`
+	// Replay is set on events sent again from the history by the replay
+	// command.
+	Replay bool `json:"replay,omitempty"`
+	// Baseline is set on the ADDs of a watcher's first browse, which are
+	// recorded without being notified if SuppressInitialAdds is set.
+	Baseline bool `json:"baseline,omitempty"`
+	// FirstSeen is when the service was first seen, LastSeen when it was
+	// last seen before going away, set on the change which reports its
+	// return.
+	FirstSeen *time.Time `json:"firstSeen,omitempty"`
+	LastSeen  *time.Time `json:"lastSeen,omitempty"`
+	// AckURL is the link which acknowledges the event, if [ack] is set up.
+	AckURL string `json:"ackUrl,omitempty"`
+	// Raw is the DNS response which last described the service, hex or
+	// base64 encoded as [capture] Raw says.
+	Raw string `json:"raw,omitempty"`
+	// Labels are added by the [[script]] blocks.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Error describes what went wrong, for ERROR and BACKEND_FAILED
+	// events, and Details describe ops events, e.g. the config zcnotify
+	// STARTED with.
+	Error   string            `json:"error,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+	// Routes are the backends a [[script]] block limited the event to, all
+	// of them if empty.
+	Routes []string `json:"-"`
+	// Trace records the decisions taken for the event, if tracing is on.
+	Trace *decisionTrace `json:"-"`
+}
+
+// serviceEntryJSON is the JSON form of a zeroconf.ServiceEntry, which on its
+// own leaves out the addresses.  Changes also record the interface.
+type serviceEntryJSON struct {
+	zeroconf.ServiceEntry
+	AddrIPv4  []net.IP `json:"addrIPv4"`
+	AddrIPv6  []net.IP `json:"addrIPv6"`
+	Interface string   `json:"interface,omitempty"`
+}
+
+func newServiceEntryJSON(entry *zeroconf.ServiceEntry) serviceEntryJSON {
+	return serviceEntryJSON{ServiceEntry: *entry,
+		AddrIPv4: entry.AddrIPv4,
+		AddrIPv6: entry.AddrIPv6}
+}
+
+func (sej *serviceEntryJSON) serviceEntry() zeroconf.ServiceEntry {
+	entry := sej.ServiceEntry
+	entry.AddrIPv4 = sej.AddrIPv4
+	entry.AddrIPv6 = sej.AddrIPv6
+	return entry
+}
+
+// Version of the JSON form of events, which is only increased when a field
+// is removed or changes meaning.  Fields may be added without a new version,
+// so consumers should ignore those they don't know.
+const EVENT_SCHEMA_VERSION = 1
+
+// serviceEntryChangeJSON mirrors ServiceEntryChange with an entry which
+// includes the addresses.
+type serviceEntryChangeJSON struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	ID            string            `json:"id,omitempty"`
+	ChangeType    ServiceChangeType `json:"changeType"`
+	Timestamp     time.Time         `json:"timestamp"`
+	Entry         serviceEntryJSON  `json:"entry"`
+	Previous      *serviceEntryJSON `json:"previous,omitempty"`
+	Zones         map[string]string `json:"zones,omitempty"`
+	Connect       []string          `json:"connect,omitempty"`
+	URL           string            `json:"url,omitempty"`
+	Category      string            `json:"category,omitempty"`
+	Networks      []string          `json:"networks,omitempty"`
+	Site          string            `json:"site,omitempty"`
+	Location      string            `json:"location,omitempty"`
+	Tags          []string          `json:"tags,omitempty"`
+	Geo           *geoLocation      `json:"geo,omitempty"`
+	Enrichment    *deviceEnrichment `json:"enrichment,omitempty"`
+	Identity      *deviceIdentity   `json:"identity,omitempty"`
+	Probe         *probeResult      `json:"probe,omitempty"`
+	Severity      Severity          `json:"severity"`
+	UnknownDevice bool              `json:"unknownDevice,omitempty"`
+	Shadow        bool              `json:"shadow,omitempty"`
+	Report        bool              `json:"report,omitempty"`
+	Replay        bool              `json:"replay,omitempty"`
+	Baseline      bool              `json:"baseline,omitempty"`
+	FirstSeen     *time.Time        `json:"firstSeen,omitempty"`
+	LastSeen      *time.Time        `json:"lastSeen,omitempty"`
+	AckURL        string            `json:"ackUrl,omitempty"`
+	Raw           string            `json:"raw,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Error         string            `json:"error,omitempty"`
+	Details       map[string]string `json:"details,omitempty"`
+	Trace         *decisionTrace    `json:"trace,omitempty"`
+}
+
+// toJSON Returns the JSON form of the change, the decision trace is only
+// included if asked for.
+func (sec *ServiceEntryChange) toJSON(includeTrace bool) serviceEntryChangeJSON {
+	secJSON := serviceEntryChangeJSON{SchemaVersion: EVENT_SCHEMA_VERSION,
+		ID:            sec.ID,
+		ChangeType:    sec.ChangeType,
+		Timestamp:     sec.Timestamp,
+		Entry:         newServiceEntryJSON(&sec.Entry),
+		Zones:         sec.Zones,
+		Connect:       sec.Connect,
+		URL:           sec.URL,
+		Category:      sec.Category,
+		Networks:      sec.Networks,
+		Site:          sec.Site,
+		Location:      sec.Location,
+		Tags:          sec.Tags,
+		Geo:           sec.Geo,
+		Enrichment:    sec.Enrichment,
+		Identity:      sec.Identity,
+		Probe:         sec.Probe,
+		Severity:      sec.Severity,
+		UnknownDevice: sec.UnknownDevice,
+		Shadow:        sec.Shadow,
+		Report:        sec.Report,
+		Replay:        sec.Replay,
+		Baseline:      sec.Baseline,
+		FirstSeen:     sec.FirstSeen,
+		LastSeen:      sec.LastSeen,
+		AckURL:        sec.AckURL,
+		Raw:           sec.Raw,
+		Labels:        sec.Labels,
+		Error:         sec.Error,
+		Details:       sec.Details}
+	secJSON.Entry.Interface = sec.Interface
+	if sec.Previous != nil {
+		previous := newServiceEntryJSON(sec.Previous)
+		secJSON.Previous = &previous
+	}
+	if includeTrace {
+		secJSON.Trace = sec.Trace
+	}
+
+	return secJSON
+}
+
+func (sec ServiceEntryChange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(sec.toJSON(false))
+}
+
+func (sec *ServiceEntryChange) UnmarshalJSON(bytes []byte) error {
+	var secJSON serviceEntryChangeJSON
+	if err := json.Unmarshal(bytes, &secJSON); err != nil {
+		return err
+	}
+
+	sec.ID = secJSON.ID
+	sec.ChangeType = secJSON.ChangeType
+	sec.Timestamp = secJSON.Timestamp
+	sec.Entry = secJSON.Entry.serviceEntry()
+	sec.Interface = secJSON.Entry.Interface
+	if secJSON.Previous != nil {
+		previous := secJSON.Previous.serviceEntry()
+		sec.Previous = &previous
+	}
+	sec.Zones = secJSON.Zones
+	sec.Connect = secJSON.Connect
+	sec.URL = secJSON.URL
+	sec.Category = secJSON.Category
+	sec.Networks = secJSON.Networks
+	sec.Site = secJSON.Site
+	sec.Location = secJSON.Location
+	sec.Tags = secJSON.Tags
+	sec.Geo = secJSON.Geo
+	sec.Enrichment = secJSON.Enrichment
+	sec.Identity = secJSON.Identity
+	sec.Probe = secJSON.Probe
+	sec.Severity = secJSON.Severity
+	sec.UnknownDevice = secJSON.UnknownDevice
+	sec.Shadow = secJSON.Shadow
+	sec.Report = secJSON.Report
+	sec.Replay = secJSON.Replay
+	sec.Baseline = secJSON.Baseline
+	sec.FirstSeen = secJSON.FirstSeen
+	sec.LastSeen = secJSON.LastSeen
+	sec.AckURL = secJSON.AckURL
+	sec.Raw = secJSON.Raw
+	sec.Labels = secJSON.Labels
+	sec.Error = secJSON.Error
+	sec.Details = secJSON.Details
+	return nil
+}
+
+// newEventID Returns a random identifier for a new event.
+func newEventID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Sprintf("unable to generate event ID: %s", err.Error()))
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// opsDetails Returns the details and error of an ops event, sorted and
+// separated by "; ".
+func (sec *ServiceEntryChange) opsDetails() string {
+	var details []string
+	for key, value := range sec.Details {
+		details = append(details, key+": "+value)
+	}
+	sort.Strings(details)
+	if sec.Error != "" {
+		details = append(details, "error: "+sec.Error)
+	}
+
+	return strings.Join(details, "; ")
 }
 
 func (sec ServiceEntryChange) String() string {
-	return fmt.Sprintf("Service %s %q @ %s: (h: %s, 4: %s, 6: %s, ttl: %d)",
+	switch {
+	case sec.ChangeType == ERROR:
+		return fmt.Sprintf("zcnotify ERROR @ %s: browsing %s in %s on %s: %s",
+			sec.Timestamp.Format(time.RFC3339),
+			sec.Entry.Service,
+			sec.Entry.Domain,
+			sec.Entry.HostName,
+			sec.Error)
+	case sec.ChangeType.ops():
+		summary := fmt.Sprintf("zcnotify %s @ %s on %s",
+			sec.ChangeType.String(),
+			sec.Timestamp.Format(time.RFC3339),
+			sec.Entry.HostName)
+		details := sec.opsDetails()
+		if details == "" {
+			return summary
+		}
+
+		return summary + ": " + details
+	}
+
+	return fmt.Sprintf("Service %s %q @ %s: (h: %s, 4: %s, 6: %s, ttl: %d, if: %s)",
 		sec.ChangeType.String(),
 		sec.Entry.Instance,
 		sec.Timestamp.Format(time.RFC3339),
 		sec.Entry.HostName,
 		sec.Entry.AddrIPv4,
 		sec.Entry.AddrIPv6,
-		sec.Entry.TTL)
+		sec.Entry.TTL,
+		sec.Interface)
 }
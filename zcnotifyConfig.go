@@ -4,23 +4,143 @@ import (
 	"errors"
 	"fmt"
 	"github.com/badoux/checkmail"
+	"net/textproto"
+	"os"
+	"strings"
 )
 
+// serviceFilter restricts a backend block to a subset of service types,
+// change types and device categories.  If Services is empty every service
+// type is allowed, ExcludeServices is applied afterwards, and likewise for
+// ChangeTypes and Categories.
+type serviceFilter struct {
+	Services        []string
+	ExcludeServices []string
+	// Change types such as "ADD" or "TXT_CHANGED", "MODIFY" stands for
+	// every modification.
+	ChangeTypes        []string
+	ExcludeChangeTypes []string
+	// Categories such as "printer", see [[category]].
+	Categories        []string
+	ExcludeCategories []string
+}
+
+// validate Checks the change types.
+func (sf *serviceFilter) validate() error {
+	for _, changeType := range append(append([]string(nil), sf.ChangeTypes...),
+		sf.ExcludeChangeTypes...) {
+		if _, err := parseServiceChangeType(changeType); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// allowsChange Returns true if notifications of change should be delivered,
+// going by its change type, its category and then its service type, along
+// with the reason for the decision.
+func (sf *serviceFilter) allowsChange(change *ServiceEntryChange) (bool, string) {
+	if len(sf.ChangeTypes) != 0 && !matchChangeType(sf.ChangeTypes, change.ChangeType) {
+		return false, "change type not in ChangeTypes"
+	}
+
+	if matchChangeType(sf.ExcludeChangeTypes, change.ChangeType) {
+		return false, "change type in ExcludeChangeTypes"
+	}
+
+	if len(sf.Categories) != 0 && !matchCategory(sf.Categories, change.Category) {
+		return false, "category not in Categories"
+	}
+
+	if matchCategory(sf.ExcludeCategories, change.Category) {
+		return false, "category in ExcludeCategories"
+	}
+
+	return sf.allows(change.Entry.Service)
+}
+
+// allows Returns true if notifications for service should be delivered,
+// along with the reason for the decision.
+func (sf *serviceFilter) allows(service string) (bool, string) {
+	allowed := len(sf.Services) == 0
+	reason := "no Services filter"
+	for _, s := range sf.Services {
+		if strings.EqualFold(s, service) {
+			allowed = true
+			reason = "service type in Services"
+			break
+		}
+	}
+
+	if !allowed {
+		return false, "service type not in Services"
+	}
+
+	for _, s := range sf.ExcludeServices {
+		if strings.EqualFold(s, service) {
+			return false, "service type in ExcludeServices"
+		}
+	}
+
+	return true, reason
+}
+
 type emailConfig struct {
-	From     string
-	To       string
-	Ssl      bool
-	Server   string
-	Password string
+	serviceFilter
+	scheduleConfig
+	// Template replaces the JSON body of the email.
+	templateConfig
+	eventFormatConfig
+	// SubjectTemplate replaces the subject, or is read from
+	// SubjectTemplateFile.
+	SubjectTemplate     string
+	SubjectTemplateFile string
+	// SubjectPrefix starts the default subject, "[ZCNOTIFY]" if not set.
+	SubjectPrefix string
+	// Include the decision trace of each event in the email body.
+	IncludeTrace bool
+	// Only send unknown device alerts, see [knownDevices].
+	UnknownOnly bool
+	// Only send events of at least this severity, see [[severity]].
+	MinSeverity string
+	From        string
+	To          string
+	Ssl         bool
+	Server      string
+	// Password may reference ${ENV_VAR}s, or be read from PasswordFile.
+	Password     string
+	PasswordFile string
+	// Sendmail is a sendmail compatible program, e.g. msmtp, which the
+	// email is piped to instead of being sent to Server, with SendmailArgs
+	// before the recipient.
+	Sendmail     string
+	SendmailArgs []string
+	// Seconds the connection to Server is kept open after an email, for
+	// the next one.
+	SmtpIdleSeconds uint
+	// Headers are added to every email, e.g. List-Id, replacing the
+	// Importance and X-Priority of urgent ones if they're given.
+	Headers map[string]string
+	// Emails are signed with DkimKey, or DkimKeyFile, for DkimSelector of
+	// DkimDomain, the domain of From if not set.
+	DkimSelector string
+	DkimDomain   string
+	DkimKey      string
+	DkimKeyFile  string
 }
 
 type interfaceConfig struct {
 	Use     []string
 	Exclude []string
 	Ip      []string
+	// Seconds between checks for interface changes on platforms without
+	// change notifications.
+	RescanSeconds uint
 }
 
 const (
+	DEFAULT_CONFIG_FILE string = "zcnotify.toml"
 	DEFAULT_SERVICE     string = "_workstation._tcp"
 	DEFAULT_DOMAIN      string = "local"
 	DEFAULT_SCAN_PERIOD uint   = 10
@@ -28,15 +148,171 @@ const (
 
 type zeroconfConfig struct {
 	Service string
+	// Domains to browse, "local" for multicast DNS and unicast DNS-SD
+	// domains such as "office.example.com".  Domain is the single domain
+	// accepted by earlier versions and is added to Domains.
+	Domains []string
 	Domain  string
+	// DNS server queried for unicast DNS-SD domains, as host or host:port,
+	// the first nameserver in /etc/resolv.conf is used if this is empty.
+	UnicastServer string
+	// Build the inventory only from the mDNS traffic other hosts send,
+	// without querying.  Unicast DNS-SD domains are still queried.
+	Passive bool
+	// Multicast DNS client library, "zeroconf" or "mdns".
+	Resolver string
+	// Browse every multicast service over a single set of sockets rather
+	// than a resolver each, querying for at most MaxConcurrentBrowses
+	// at once.
+	SharedResolver       bool
+	MaxConcurrentBrowses uint
+	// The shared resolver's queries ask for unicast responses (the QU bit)
+	// in the first query of each browse, don't ask the same question more
+	// than once every MinQueryIntervalSeconds, and number at most
+	// QueryRepeats per browse.
+	UnicastResponse         bool
+	MinQueryIntervalSeconds uint
+	QueryRepeats            uint
+
+	// Vary each browse by up to this percentage of the scan period, so
+	// that hosts started together don't query together.
+	JitterPercent uint
+	// Browses which fail, or browsers which can't be created, are retried
+	// after InitialBackoffSeconds, doubling up to MaxBackoffSeconds.
+	InitialBackoffSeconds uint
+	MaxBackoffSeconds     uint
+}
+
+// normalizeDomains Lower cases domains, removing trailing dots and
+// duplicates.
+func normalizeDomains(domains []string) ([]string, error) {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if domain == "" {
+			return nil, errors.New("empty zeroconf domain")
+		}
+
+		if !seen[domain] {
+			seen[domain] = true
+			normalized = append(normalized, domain)
+		}
+	}
+
+	return normalized, nil
+}
+
+// retryConfig controls how failed notifications are retried before they are
+// written to the dead-letter file.
+type retryConfig struct {
+	MaxAttempts           uint
+	InitialBackoffSeconds uint
+	MaxBackoffSeconds     uint
+	DeadLetterFile        string
+}
+
+// queueConfig sizes the delivery queue and worker pool of every backend.
+type queueConfig struct {
+	Workers uint
+	Length  uint
+}
+
+// metricsConfig controls the Prometheus metrics listener, and the textfile
+// written for node_exporter instead or as well.
+type metricsConfig struct {
+	Listen          string
+	TextfileDir     string
+	TextfileSeconds uint
+}
+
+// shadowConfig names a second config file whose backends receive a copy of
+// every event.
+type shadowConfig struct {
+	Config string
 }
 
 type config struct {
 	ScanPeriodSeconds uint
+	DryRun            bool
+	Migrate           bool
+	// LowPower suits Raspberry Pi Zero class hosts: scans lengthen while
+	// the network is quiet and no history is recorded.
+	LowPower bool
+	// Adapt the scan period to the network's churn, between
+	// MinScanPeriodSeconds and MaxScanPeriodSeconds.
+	AdaptiveScan         bool
+	MinScanPeriodSeconds uint
+	MaxScanPeriodSeconds uint
+	// Browse for only this long every scan period, rather than for all of
+	// it, to send fewer queries.
+	BrowseTimeoutSeconds uint
+
+	// Output is "ndjson" to write every event to stdout, and nothing else.
+	Output string
+
+	// Record the services found by the first browse without notifying
+	// them, other than in a single summary if InitialAddsSummary is set.
+	SuppressInitialAdds bool
+	InitialAddsSummary  bool
+
 	NotifyTypes       []string
 	Zeroconf          zeroconfConfig
 	Interfaces        interfaceConfig
+	Queue             queueConfig
+	Bus               busConfig
+	Retry             retryConfig
+	Metrics           metricsConfig
+	Log               logConfig
+	Api               apiConfig
+	Server            serverConfig
+	Ack               ackConfig
+	History           historyConfig
+	Enrich            enrichConfig
+	KnownDevices      knownDevicesConfig
+	Severity          []severityRule
+	Category          []categoryRule
+	MaintenanceWindow []maintenanceWindowConfig
+	Expect            []expectConfig
+	Script            []scriptConfig
+	Dedupe            dedupeConfig
+	Correlate         correlateConfig
+	InventoryReport   inventoryReportConfig
+	Modify            modifyConfig
+	Probe             probeConfig
+	Identity          []identityConfig
+	State             stateConfig
+	Shadow            shadowConfig
+	Trace             traceConfig
+	Watch             []watchConfig
+	Advertise         []advertiseConfig
+	Capture           captureConfig
+	Site              siteConfig
+	Networks          networksConfig
+	Urls              urlsConfig
+	Aggregator        aggregatorConfig
+	Ops               opsConfig
+	Debug             debugConfig
 	Email             map[string]emailConfig
+	Alertmanager      map[string]alertmanagerConfig
+	Mqtt              map[string]mqttConfig
+	SnmpTrap          map[string]snmpTrapConfig
+	Journald          map[string]journaldConfig
+	Console           map[string]consoleConfig
+	EventLog          map[string]eventLogConfig
+	Forward           map[string]forwardConfig
+	Sms               map[string]smsConfig
+	Teams             map[string]chatConfig
+	GoogleChat        map[string]chatConfig
+	Plugin            map[string]pluginConfig
+
+	// Profiles add the watches and backends of other teams, from
+	// [profile.<name>] blocks and the files in ProfileDir.
+	ProfileDir string
+	Profile    map[string]profileConfig
+
+	// backendProfiles maps the backends of profiles to their profile.
+	backendProfiles map[string]string
 }
 
 func ValidEmailConfig(emailConfs map[string]emailConfig) error {
@@ -51,10 +327,353 @@ func ValidEmailConfig(emailConfs map[string]emailConfig) error {
 				cfgName, emailConf.To, err.Error()))
 		}
 
-		if emailConf.Server == "" {
-			return errors.New(fmt.Sprintf("email config: %q no server specified", cfgName))
+		if emailConf.Server == "" && emailConf.Sendmail == "" {
+			return errors.New(fmt.Sprintf("email config: %q no server or sendmail specified", cfgName))
+		} else if emailConf.Server != "" && emailConf.Sendmail != "" {
+			return errors.New(fmt.Sprintf("email config: %q only one of server and sendmail may be specified", cfgName))
 		}
+
+		prefix := fmt.Sprintf("email config: %q", cfgName)
+		if err := emailConf.templateConfig.setup(prefix); err != nil {
+			return err
+		}
+
+		if err := emailConf.eventFormatConfig.setup(prefix); err != nil {
+			return err
+		}
+
+		subject, err := loadTemplate(prefix+" subject template",
+			emailConf.SubjectTemplate,
+			emailConf.SubjectTemplateFile)
+		if err != nil {
+			return err
+		}
+		emailConf.SubjectTemplate = subject
+		emailConf.SubjectTemplateFile = ""
+
+		if emailConf.SubjectPrefix == "" {
+			emailConf.SubjectPrefix = DEFAULT_SUBJECT_PREFIX
+		}
+
+		if emailConf.SmtpIdleSeconds == 0 {
+			emailConf.SmtpIdleSeconds = DEFAULT_SMTP_IDLE_SECONDS
+		}
+
+		headers := make(map[string]string, len(emailConf.Headers))
+		for name, value := range emailConf.Headers {
+			canonical := textproto.CanonicalMIMEHeaderKey(name)
+			switch {
+			case name == "" || strings.ContainsAny(name, ": \t\r\n"):
+				return fmt.Errorf("%s: invalid header name %q", prefix, name)
+			case strings.ContainsAny(value, "\r\n"):
+				return fmt.Errorf("%s: header %s has more than one line", prefix, name)
+			case canonical == "From" || canonical == "To" || canonical == "Subject" ||
+				canonical == "Date" || canonical == "Dkim-Signature":
+				return fmt.Errorf("%s: header %s is set by zcnotify", prefix, name)
+			}
+			headers[canonical] = value
+		}
+		emailConf.Headers = headers
+
+		if emailConf.DkimKey != "" || emailConf.DkimSelector != "" {
+			if emailConf.DkimKey == "" || emailConf.DkimSelector == "" {
+				return fmt.Errorf("%s: DKIM signing needs both a key and a selector", prefix)
+			}
+
+			if emailConf.DkimDomain == "" {
+				emailConf.DkimDomain = emailDomain(emailConf.From)
+			}
+
+			if _, err := newDkimSigner(emailConf.DkimDomain,
+				emailConf.DkimSelector,
+				emailConf.DkimKey); err != nil {
+				return fmt.Errorf("%s: DKIM key: %s", prefix, err.Error())
+			}
+		}
+
+		emailConfs[cfgName] = emailConf
 	}
 
 	return nil
 }
+
+// loadConfig Decodes the config file, in the given format or that named by
+// its extension, fills in defaults for anything which isn't specified and
+// validates the result.  ZCNOTIFY_* environment variables are overridden by
+// the config file, which is overridden by overrides.  An empty configFile
+// takes the config from the environment and overrides alone.
+func loadConfig(configFile string,
+	format string,
+	overrides []configOverride) (*config, error) {
+	var zcnConfig config
+
+	if err := applyOverrides(&zcnConfig, envOverrides(os.Environ()), true); err != nil {
+		return nil, fmt.Errorf("environment: %s", err.Error())
+	}
+
+	if configFile != "" {
+		if err := decodeConfig(configFile, format, &zcnConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyOverrides(&zcnConfig, overrides, false); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupProfiles(); err != nil {
+		return nil, err
+	}
+
+	if err := expandSecrets(&zcnConfig); err != nil {
+		return nil, err
+	}
+
+	if zcnConfig.Log.Level == "" {
+		zcnConfig.Log.Level = DEFAULT_LOG_LEVEL
+	}
+
+	if zcnConfig.Log.Format == "" {
+		zcnConfig.Log.Format = DEFAULT_LOG_FORMAT
+	}
+
+	if zcnConfig.Log.Output == "" {
+		zcnConfig.Log.Output = DEFAULT_LOG_OUTPUT
+	}
+
+	if zcnConfig.Zeroconf.Service == "" {
+		zcnConfig.Zeroconf.Service = DEFAULT_SERVICE
+	}
+
+	if zcnConfig.Zeroconf.Domain != "" {
+		zcnConfig.Zeroconf.Domains = append([]string{zcnConfig.Zeroconf.Domain},
+			zcnConfig.Zeroconf.Domains...)
+	}
+
+	if len(zcnConfig.Zeroconf.Domains) == 0 {
+		zcnConfig.Zeroconf.Domains = []string{DEFAULT_DOMAIN}
+	}
+
+	domains, err := normalizeDomains(zcnConfig.Zeroconf.Domains)
+	if err != nil {
+		return nil, err
+	}
+	zcnConfig.Zeroconf.Domains = domains
+
+	if zcnConfig.Zeroconf.Resolver == "" {
+		zcnConfig.Zeroconf.Resolver = RESOLVER_ZEROCONF
+	} else if err := validResolver(zcnConfig.Zeroconf.Resolver); err != nil {
+		return nil, err
+	}
+
+	if zcnConfig.Zeroconf.SharedResolver && zcnConfig.Zeroconf.Passive {
+		return nil, errors.New("zeroconf: SharedResolver sends queries, which Passive doesn't")
+	}
+
+	if zcnConfig.Zeroconf.MaxConcurrentBrowses == 0 {
+		zcnConfig.Zeroconf.MaxConcurrentBrowses = DEFAULT_MAX_CONCURRENT_BROWSES
+	}
+
+	if zcnConfig.Zeroconf.MinQueryIntervalSeconds == 0 {
+		zcnConfig.Zeroconf.MinQueryIntervalSeconds = DEFAULT_MIN_QUERY_INTERVAL
+	}
+
+	if zcnConfig.Zeroconf.QueryRepeats == 0 {
+		zcnConfig.Zeroconf.QueryRepeats = DEFAULT_QUERY_REPEATS
+	}
+
+	if zcnConfig.Zeroconf.JitterPercent > MAX_JITTER_PERCENT {
+		return nil, fmt.Errorf("zeroconf: JitterPercent %d is more than %d",
+			zcnConfig.Zeroconf.JitterPercent, MAX_JITTER_PERCENT)
+	}
+
+	if zcnConfig.Zeroconf.InitialBackoffSeconds == 0 {
+		zcnConfig.Zeroconf.InitialBackoffSeconds = DEFAULT_BROWSE_INITIAL_BACKOFF
+	}
+
+	if zcnConfig.Zeroconf.MaxBackoffSeconds == 0 {
+		zcnConfig.Zeroconf.MaxBackoffSeconds = DEFAULT_BROWSE_MAX_BACKOFF
+	}
+
+	if zcnConfig.Zeroconf.MaxBackoffSeconds < zcnConfig.Zeroconf.InitialBackoffSeconds {
+		return nil, errors.New("zeroconf: MaxBackoffSeconds is less than InitialBackoffSeconds")
+	}
+
+	if zcnConfig.Interfaces.RescanSeconds == 0 {
+		zcnConfig.Interfaces.RescanSeconds = DEFAULT_INTERFACE_RESCAN
+	}
+
+	if zcnConfig.ScanPeriodSeconds == 0 {
+		zcnConfig.ScanPeriodSeconds = DEFAULT_SCAN_PERIOD
+	}
+
+	if zcnConfig.MinScanPeriodSeconds == 0 {
+		zcnConfig.MinScanPeriodSeconds = DEFAULT_MIN_SCAN_PERIOD
+	}
+
+	if zcnConfig.MaxScanPeriodSeconds == 0 {
+		zcnConfig.MaxScanPeriodSeconds = DEFAULT_MAX_SCAN_PERIOD
+	}
+
+	if zcnConfig.MaxScanPeriodSeconds < zcnConfig.MinScanPeriodSeconds {
+		return nil, errors.New("MaxScanPeriodSeconds is less than MinScanPeriodSeconds")
+	}
+
+	if len(zcnConfig.NotifyTypes) == 0 {
+		return nil, errors.New("no notification types configured")
+	}
+
+	if err := zcnConfig.setupBackends(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupWatches(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupKnownDevices(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupSeverity(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupCategories(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupSchedules(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupFilters(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupScripts(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupMaintenanceWindows(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupExpect(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupModify(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupInventoryReport(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupOps(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupAdvertise(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupCapture(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupNetworks(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupUrls(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupSite(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupAggregator(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupServer(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupBus(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupTextfile(); err != nil {
+		return nil, err
+	}
+
+	if err := zcnConfig.setupAck(); err != nil {
+		return nil, err
+	}
+
+	if zcnConfig.Queue.Workers == 0 {
+		zcnConfig.Queue.Workers = DEFAULT_QUEUE_WORKERS
+	}
+
+	if zcnConfig.Queue.Length == 0 {
+		zcnConfig.Queue.Length = DEFAULT_QUEUE_LENGTH
+	}
+
+	if zcnConfig.Retry.MaxAttempts == 0 {
+		zcnConfig.Retry.MaxAttempts = DEFAULT_RETRY_MAX_ATTEMPTS
+	}
+
+	if zcnConfig.Retry.InitialBackoffSeconds == 0 {
+		zcnConfig.Retry.InitialBackoffSeconds = DEFAULT_RETRY_INITIAL_BACKOFF
+	}
+
+	if zcnConfig.Retry.MaxBackoffSeconds == 0 {
+		zcnConfig.Retry.MaxBackoffSeconds = DEFAULT_RETRY_MAX_BACKOFF
+	}
+
+	switch strings.ToLower(zcnConfig.State.OnNewerSchema) {
+	case "":
+		zcnConfig.State.OnNewerSchema = STATE_NEWER_REFUSE
+	case STATE_NEWER_REFUSE, STATE_NEWER_READONLY:
+		break
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown state OnNewerSchema %q",
+			zcnConfig.State.OnNewerSchema))
+	}
+
+	if zcnConfig.Trace.History == 0 {
+		zcnConfig.Trace.History = DEFAULT_TRACE_HISTORY
+	}
+
+	if zcnConfig.Probe.TimeoutSeconds == 0 {
+		zcnConfig.Probe.TimeoutSeconds = DEFAULT_PROBE_TIMEOUT
+	}
+
+	if zcnConfig.Probe.IntervalSeconds == 0 {
+		zcnConfig.Probe.IntervalSeconds = DEFAULT_PROBE_INTERVAL
+	}
+
+	if zcnConfig.State.PresenceDays == 0 {
+		zcnConfig.State.PresenceDays = DEFAULT_PRESENCE_DAYS
+	}
+
+	if zcnConfig.Enrich.TimeoutSeconds == 0 {
+		zcnConfig.Enrich.TimeoutSeconds = DEFAULT_ENRICH_TIMEOUT
+	}
+
+	for i := range zcnConfig.Identity {
+		if zcnConfig.Identity[i].TimeoutSeconds == 0 {
+			zcnConfig.Identity[i].TimeoutSeconds = DEFAULT_IDENTITY_TIMEOUT
+		}
+
+		if zcnConfig.Identity[i].CacheSeconds == 0 {
+			zcnConfig.Identity[i].CacheSeconds = DEFAULT_IDENTITY_CACHE_SECONDS
+		}
+	}
+
+	return &zcnConfig, nil
+}
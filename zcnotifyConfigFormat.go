@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// The example config files, written by "zcnotify init-config".
+var (
+	//go:embed zcnotify.toml
+	exampleTOML string
+	//go:embed zcnotify.yaml
+	exampleYAML string
+)
+
+const (
+	CONFIG_TOML string = "toml"
+	CONFIG_YAML string = "yaml"
+	CONFIG_JSON string = "json"
+)
+
+// configFormat Returns the format of configFile, format if one is given,
+// otherwise that named by the file's extension.  Files without a YAML or JSON
+// extension are taken to be TOML.
+func configFormat(configFile string, format string) (string, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(configFile)) {
+		case ".yaml", ".yml":
+			return CONFIG_YAML, nil
+		case ".json":
+			return CONFIG_JSON, nil
+		}
+
+		return CONFIG_TOML, nil
+	}
+
+	switch strings.ToLower(format) {
+	case CONFIG_TOML:
+		return CONFIG_TOML, nil
+	case CONFIG_YAML, "yml":
+		return CONFIG_YAML, nil
+	case CONFIG_JSON:
+		return CONFIG_JSON, nil
+	}
+
+	return "", fmt.Errorf("unknown config format %q, expected toml, yaml or json", format)
+}
+
+// decodeConfig Decodes configFile into zcnConfig, or into a profile.  Every
+// format uses the TOML key names, matched without regard to case, so a YAML
+// or JSON config is the TOML one written in another syntax.
+func decodeConfig(configFile string, format string, zcnConfig any) error {
+	format, err := configFormat(configFile, format)
+	if err != nil {
+		return err
+	}
+
+	if format == CONFIG_TOML {
+		_, err := toml.DecodeFile(configFile, zcnConfig)
+		return err
+	}
+
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	if format == CONFIG_YAML {
+		// YAML is converted to JSON, whose decoder matches keys to field
+		// names without regard to case as the TOML one does.
+		var document any
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return err
+		}
+
+		if document == nil {
+			return nil
+		}
+
+		if data, err = json.Marshal(jsonCompatible(document)); err != nil {
+			return err
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(zcnConfig); err != nil {
+		return fmt.Errorf("%s: %s", configFile, err.Error())
+	}
+
+	return nil
+}
+
+// jsonCompatible Returns a decoded YAML document with any mappings whose keys
+// aren't all strings, e.g. "1: x", converted so they can be encoded as JSON.
+func jsonCompatible(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			v[key] = jsonCompatible(item)
+		}
+		return v
+	case map[any]any:
+		converted := make(map[string]any, len(v))
+		for key, item := range v {
+			converted[fmt.Sprint(key)] = jsonCompatible(item)
+		}
+		return converted
+	case []any:
+		for i, item := range v {
+			v[i] = jsonCompatible(item)
+		}
+		return v
+	}
+
+	return value
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	CONSOLE_FORMAT_TEXT string = "text"
+	CONSOLE_FORMAT_JSON string = "json"
+
+	CONSOLE_COLOR_AUTO   string = "auto"
+	CONSOLE_COLOR_ALWAYS string = "always"
+	CONSOLE_COLOR_NEVER  string = "never"
+
+	ansiReset   string = "\x1b[0m"
+	ansiBold    string = "\x1b[1m"
+	ansiRed     string = "\x1b[31m"
+	ansiGreen   string = "\x1b[32m"
+	ansiYellow  string = "\x1b[33m"
+	ansiMagenta string = "\x1b[35m"
+)
+
+// consoleColumns are the columns of the console's text format, with their
+// widths.  Longer values push the rest of the line along rather than being
+// cut short.
+var consoleColumns = []struct {
+	name  string
+	width int
+}{{"TIME", 8},
+	{"CHANGE", 15},
+	{"SEVERITY", 8},
+	{"INSTANCE", 28},
+	{"SERVICE", 20},
+	{"HOST", 24},
+	{"ADDRESS", 15},
+	{"PORT", 5},
+	{"INTERFACE", 9},
+	{"DETAILS", 0}}
+
+// consoleConfig describes a single [console.<name>] block.
+type consoleConfig struct {
+	serviceFilter
+	scheduleConfig
+	// Template replaces the columns of the text format.
+	templateConfig
+	// Format is "text", aligned columns, or "json", an object per line.
+	Format string
+	// Color is "auto", colouring the text format if stdout is a terminal
+	// and NO_COLOR isn't set, "always" or "never".
+	Color string
+}
+
+// validConsoleConfig Fills in the defaults of every [console.<name>] block, a
+// block called "default" is used if there are none.
+func validConsoleConfig(zcnConfig *config) error {
+	if len(zcnConfig.Console) == 0 {
+		zcnConfig.Console = map[string]consoleConfig{"default": {}}
+	}
+
+	for name, consoleConf := range zcnConfig.Console {
+		consoleConf.Format = strings.ToLower(consoleConf.Format)
+		switch consoleConf.Format {
+		case "":
+			consoleConf.Format = CONSOLE_FORMAT_TEXT
+		case CONSOLE_FORMAT_TEXT, CONSOLE_FORMAT_JSON:
+			break
+		default:
+			return fmt.Errorf("console config: %q unknown Format %q, expected text or json",
+				name, consoleConf.Format)
+		}
+
+		consoleConf.Color = strings.ToLower(consoleConf.Color)
+		switch consoleConf.Color {
+		case "":
+			consoleConf.Color = CONSOLE_COLOR_AUTO
+		case CONSOLE_COLOR_AUTO, CONSOLE_COLOR_ALWAYS, CONSOLE_COLOR_NEVER:
+			break
+		default:
+			return fmt.Errorf("console config: %q unknown Color %q, expected auto, always or never",
+				name, consoleConf.Color)
+		}
+
+		if err := consoleConf.setup(fmt.Sprintf("console config: %q", name)); err != nil {
+			return err
+		}
+
+		zcnConfig.Console[name] = consoleConf
+	}
+
+	return nil
+}
+
+// consoleNotifier Prints every event to stdout, as colourised columns or as
+// JSON, for running zcnotify interactively or piping it into other tools.
+type consoleNotifier struct {
+	name     string
+	conf     consoleConfig
+	template *template.Template
+	color    bool
+	mutex    sync.Mutex
+	out      io.Writer
+	// Set once the column headings have been printed.
+	headed bool
+}
+
+// newConsoleNotifier Creates a notifier for the console block called name.
+func newConsoleNotifier(name string, conf consoleConfig) *consoleNotifier {
+	color := conf.Color == CONSOLE_COLOR_ALWAYS
+	if conf.Color == CONSOLE_COLOR_AUTO {
+		color = os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout)
+	}
+
+	return &consoleNotifier{name: "console." + name,
+		conf:     conf,
+		template: parseTemplate("console."+name, conf.Template),
+		color:    color,
+		out:      os.Stdout}
+}
+
+// isTerminal Returns true if f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func (cn *consoleNotifier) Name() string {
+	return cn.name
+}
+
+func (cn *consoleNotifier) Allows(change *ServiceEntryChange) (bool, string) {
+	return cn.conf.allowsChange(change)
+}
+
+// changeColor Returns the colour of a change's line: green for services
+// which appear, red for those which go, magenta for zcnotify's own events
+// and yellow for the rest.  Critical events are bold.
+func changeColor(change *ServiceEntryChange) string {
+	color := ansiYellow
+	switch {
+	case change.ChangeType.ops():
+		color = ansiMagenta
+		break
+	case change.ChangeType == ADD || change.ChangeType == RECOVERED:
+		color = ansiGreen
+		break
+	case change.ChangeType == REMOVE || change.ChangeType == MISSING:
+		color = ansiRed
+		break
+	}
+
+	if change.Severity == SEVERITY_CRITICAL {
+		color = ansiBold + color
+	}
+	return color
+}
+
+// consoleDetails Returns the last column of a change: its previous name,
+// or what went wrong and the details of an ops event.
+func consoleDetails(change *ServiceEntryChange) string {
+	var details []string
+	if change.Previous != nil && change.Previous.Instance != change.Entry.Instance {
+		details = append(details, "was "+change.Previous.Instance)
+	}
+	if change.ChangeType.ops() {
+		details = append(details, change.opsDetails())
+	} else if change.Error != "" {
+		details = append(details, change.Error)
+	}
+	if change.Replay {
+		details = append(details, "replayed")
+	}
+
+	return strings.Join(details, "; ")
+}
+
+// columns Returns the aligned columns of the text format for a change, or
+// the headings if change is nil.
+func columns(change *ServiceEntryChange) string {
+	var values []string
+	if change == nil {
+		for _, column := range consoleColumns {
+			values = append(values, column.name)
+		}
+	} else {
+		address := ""
+		if addresses := scopedAddresses(&change.Entry, change.Zones); len(addresses) != 0 {
+			address = addresses[0]
+		}
+
+		values = []string{change.Timestamp.Local().Format(time.TimeOnly),
+			change.ChangeType.String(),
+			change.Severity.String(),
+			change.Entry.Instance,
+			change.Entry.Service,
+			strings.TrimSuffix(change.Entry.HostName, "."),
+			address,
+			fmt.Sprint(change.Entry.Port),
+			change.Interface,
+			consoleDetails(change)}
+	}
+
+	var line strings.Builder
+	for i, value := range values {
+		if value == "" {
+			value = "-"
+		}
+		fmt.Fprintf(&line, "%-*s", consoleColumns[i].width, value)
+		if i+1 < len(values) {
+			line.WriteString("  ")
+		}
+	}
+
+	return strings.TrimRight(line.String(), " ")
+}
+
+func (cn *consoleNotifier) Render(change *ServiceEntryChange) (string, error) {
+	if cn.conf.Format == CONSOLE_FORMAT_JSON {
+		line, err := json.Marshal(change)
+		return string(line), err
+	}
+
+	return applyTemplate(cn.template, change, columns(change)), nil
+}
+
+// Notify Prints a change, in the text format the column headings are
+// printed before the first.
+func (cn *consoleNotifier) Notify(change *ServiceEntryChange) error {
+	line, err := cn.Render(change)
+	if err != nil {
+		return err
+	}
+
+	cn.mutex.Lock()
+	defer cn.mutex.Unlock()
+
+	if cn.conf.Format == CONSOLE_FORMAT_TEXT && cn.template == nil && !cn.headed {
+		cn.headed = true
+		headings := columns(nil)
+		if cn.color {
+			headings = ansiBold + headings + ansiReset
+		}
+		if _, err := fmt.Fprintln(cn.out, headings); err != nil {
+			return err
+		}
+	}
+
+	if cn.color && cn.conf.Format == CONSOLE_FORMAT_TEXT {
+		line = changeColor(change) + line + ansiReset
+	}
+
+	_, err = fmt.Fprintln(cn.out, line)
+	return err
+}
+
+func (cn *consoleNotifier) RenderDigest(changes []ServiceEntryChange) (string, error) {
+	var rendered strings.Builder
+	for i := range changes {
+		line, err := cn.Render(&changes[i])
+		if err != nil {
+			return "", err
+		}
+		rendered.WriteString(line + "\n")
+	}
+
+	return rendered.String(), nil
+}
+
+// NotifyDigest Prints every change held back during quiet hours.
+func (cn *consoleNotifier) NotifyDigest(changes []ServiceEntryChange) error {
+	for i := range changes {
+		if err := cn.Notify(&changes[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Check Has nothing to check, stdout is always there.
+func (cn *consoleNotifier) Check() error {
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// correlateConfig controls the pairing of related changes into a single
+// event.
+type correlateConfig struct {
+	// Seconds a REMOVE is held for in case the service comes back with
+	// different addresses, which is reported as MOVED.  0 reports every
+	// REMOVE straight away.
+	MoveWindowSeconds uint
+}
+
+var movesMetric = metrics.newCounter("zcnotify_moves_total",
+	"REMOVE and ADD changes paired into MOVED events.")
+
+// heldRemove is a REMOVE waiting to see whether its service comes back.
+type heldRemove struct {
+	change ServiceEntryChange
+	timer  *time.Timer
+}
+
+// correlator Holds REMOVE changes for the move window.  A service which
+// comes back with different addresses within the window, e.g. after a DHCP
+// renewal or roaming to another access point, is reported as MOVED rather
+// than as a REMOVE and an ADD.  REMOVEs whose window ends are delivered on
+// expired.
+type correlator struct {
+	window  time.Duration
+	mutex   sync.Mutex
+	held    map[string]*heldRemove
+	expired chan ServiceEntryChange
+}
+
+// newCorrelator Creates the correlation stage.
+func newCorrelator(conf correlateConfig) *correlator {
+	return &correlator{window: time.Duration(conf.MoveWindowSeconds) * time.Second,
+		held:    make(map[string]*heldRemove),
+		expired: make(chan ServiceEntryChange, 1)}
+}
+
+// correlate Returns the changes to report for change, which is none if it's
+// a REMOVE being held.  An ADD of a held service is reported as MOVED if its
+// addresses changed, otherwise as the REMOVE and ADD it was.
+func (c *correlator) correlate(change ServiceEntryChange) []ServiceEntryChange {
+	if c.window == 0 {
+		return []ServiceEntryChange{change}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	name := change.Entry.ServiceInstanceName()
+	switch change.ChangeType {
+	case REMOVE:
+		if _, ok := c.held[name]; ok {
+			// Already waiting for this service.
+			return nil
+		}
+
+		held := &heldRemove{change: change}
+		held.timer = time.AfterFunc(c.window, func() {
+			c.expire(name, held)
+		})
+		c.held[name] = held
+		return nil
+	case ADD:
+		held, ok := c.held[name]
+		if !ok {
+			break
+		}
+
+		held.timer.Stop()
+		delete(c.held, name)
+		if sameAddresses(&held.change.Entry, &change.Entry) {
+			return []ServiceEntryChange{held.change, change}
+		}
+
+		movesMetric.With().Inc()
+		previous := held.change.Entry
+		change.ChangeType = MOVED
+		change.Previous = &previous
+		break
+	}
+
+	return []ServiceEntryChange{change}
+}
+
+// expire Delivers a held REMOVE whose window has ended, unless the service
+// has come back in the meantime.
+func (c *correlator) expire(name string, held *heldRemove) {
+	c.mutex.Lock()
+	if c.held[name] != held {
+		c.mutex.Unlock()
+		return
+	}
+	delete(c.held, name)
+	c.mutex.Unlock()
+
+	c.expired <- held.change
+}
+
+// flush Returns the REMOVEs being held, in the order they were removed, so
+// that they're delivered before zcnotify stops.
+func (c *correlator) flush() []ServiceEntryChange {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var changes []ServiceEntryChange
+	for name, held := range c.held {
+		held.timer.Stop()
+		delete(c.held, name)
+		changes = append(changes, held.change)
+	}
+
+	// Along with one whose window has just ended.
+	select {
+	case change := <-c.expired:
+		changes = append(changes, change)
+		break
+	default:
+		break
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Timestamp.Before(changes[j].Timestamp)
+	})
+
+	return changes
+}
+
+// sameAddresses Returns true if a and b have the same IPv4 and IPv6
+// addresses, in any order.
+func sameAddresses(a *zeroconf.ServiceEntry, b *zeroconf.ServiceEntry) bool {
+	aAddresses := *b
+	aAddresses.AddrIPv4, aAddresses.AddrIPv6 = a.AddrIPv4, a.AddrIPv6
+	return compareSEEntry(&aAddresses, b)
+}
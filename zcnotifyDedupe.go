@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// dedupeConfig controls the suppression of repeated changes, such as a
+// device whose answers flip between two sets of records.
+type dedupeConfig struct {
+	// Seconds during which a repeat of the same change is suppressed, 0 to
+	// report every repeat.
+	WindowSeconds uint
+	// Don't report changes to the TTL alone.
+	IgnoreTTL bool
+}
+
+var duplicatesMetric = metrics.newCounter("zcnotify_duplicates_suppressed_total",
+	"Changes suppressed as repeats or as TTL only changes.")
+
+// deduplicator Remembers the changes reported within the window.  It's only
+// used by the dispatcher so needs no locking.
+type deduplicator struct {
+	conf dedupeConfig
+	seen map[string]time.Time
+}
+
+// newDeduplicator Creates the deduplication stage.
+func newDeduplicator(conf dedupeConfig) *deduplicator {
+	return &deduplicator{conf: conf, seen: make(map[string]time.Time)}
+}
+
+// ttlOnly Returns true if the only difference between a and b is their TTL.
+func ttlOnly(a *zeroconf.ServiceEntry, b *zeroconf.ServiceEntry) bool {
+	aCopy := *a
+	aCopy.TTL = b.TTL
+	return compareSEEntry(&aCopy, b)
+}
+
+// changeHash Returns a hash of what a change altered, repeats of the same
+// change have the same hash.
+func changeHash(change *ServiceEntryChange) string {
+	diff := struct {
+		ChangeType ServiceChangeType
+		Previous   serviceEntryJSON
+		Entry      serviceEntryJSON
+	}{ChangeType: change.ChangeType,
+		Previous: newServiceEntryJSON(change.Previous),
+		Entry:    newServiceEntryJSON(&change.Entry)}
+	encoded, _ := json.Marshal(diff)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// duplicate Returns true if change shouldn't be reported, along with the
+// reason.  Only modifications are checked as a device which comes and goes
+// should still be reported every time.
+func (d *deduplicator) duplicate(change *ServiceEntryChange) (bool, string) {
+	if !change.ChangeType.modification() || change.Previous == nil {
+		return false, ""
+	}
+
+	if d.conf.IgnoreTTL && ttlOnly(change.Previous, &change.Entry) {
+		duplicatesMetric.With("reason", "ttl").Inc()
+		return true, "only the TTL changed and IgnoreTTL is set"
+	}
+
+	if d.conf.WindowSeconds == 0 {
+		return false, ""
+	}
+
+	now := time.Now()
+	for hash, expires := range d.seen {
+		if now.After(expires) {
+			delete(d.seen, hash)
+		}
+	}
+
+	hash := changeHash(change)
+	if _, ok := d.seen[hash]; ok {
+		duplicatesMetric.With("reason", "repeat").Inc()
+		return true, fmt.Sprintf("same change reported within the last %d seconds",
+			d.conf.WindowSeconds)
+	}
+
+	d.seen[hash] = now.Add(time.Duration(d.conf.WindowSeconds) * time.Second)
+	return false, ""
+}
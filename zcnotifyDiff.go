@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	// FNV-1a parameters, used to hash entry payloads.
+	FNV_OFFSET_64 uint64 = 14695981039346656037
+	FNV_PRIME_64  uint64 = 1099511628211
+)
+
+// entrySet is the services found by a watcher's browses, indexed by their
+// instance name and with a hash of their payload, so that each browse's
+// results are compared with it in linear time, however many responders
+// the network has.
+type entrySet struct {
+	entries []zeroconf.ServiceEntry
+	// names and hashes are the instance name and payloadHash of each
+	// entry.
+	names  []string
+	hashes []uint64
+	// index is the position of each entry by its instance name.
+	index map[string]int
+}
+
+// newEntrySet Returns a set holding a copy of entries.
+func newEntrySet(entries []zeroconf.ServiceEntry) *entrySet {
+	es := &entrySet{index: make(map[string]int, len(entries))}
+	for i := range entries {
+		es.add(entries[i].ServiceInstanceName(), &entries[i], payloadHash(&entries[i]))
+	}
+
+	return es
+}
+
+// add Adds a copy of entry, called name and whose payload hashes to hash.
+func (es *entrySet) add(name string, entry *zeroconf.ServiceEntry, hash uint64) {
+	es.index[name] = len(es.entries)
+	es.entries = append(es.entries, *entry)
+	es.names = append(es.names, name)
+	es.hashes = append(es.hashes, hash)
+}
+
+// update Replaces the entry at position i, whose payload hashes to hash.
+func (es *entrySet) update(i int, entry *zeroconf.ServiceEntry, hash uint64) {
+	es.entries[i] = *entry
+	es.hashes[i] = hash
+}
+
+// compare Compares an entry found by a browse with the set, adding it to
+// seen.  A new entry is added and true is returned, otherwise an entry whose
+// payload differs is passed to changed along with the one it replaces,
+// before it's stored in its place.
+func (es *entrySet) compare(entry *zeroconf.ServiceEntry,
+	seen map[string]bool,
+	changed func(old *zeroconf.ServiceEntry)) bool {
+	name := entry.ServiceInstanceName()
+	hash := payloadHash(entry)
+	seen[name] = true
+	index, ok := es.index[name]
+	if !ok {
+		es.add(name, entry, hash)
+		return true
+	}
+
+	// An unchanged payload needs no closer look.
+	if es.hashes[index] == hash {
+		return false
+	}
+
+	changed(&es.entries[index])
+	es.update(index, entry, hash)
+	return false
+}
+
+// removeUnseen Removes the entries whose names aren't in seen, and returns
+// them, last first.
+func (es *entrySet) removeUnseen(seen map[string]bool) []zeroconf.ServiceEntry {
+	var removed []zeroconf.ServiceEntry
+	for i := len(es.entries) - 1; i >= 0; i-- {
+		if !seen[es.names[i]] {
+			removed = append(removed, es.entries[i])
+			delete(es.index, es.names[i])
+		}
+	}
+
+	if len(removed) == 0 {
+		return nil
+	}
+
+	kept := 0
+	for i := range es.entries {
+		if !seen[es.names[i]] {
+			continue
+		}
+
+		es.entries[kept] = es.entries[i]
+		es.names[kept] = es.names[i]
+		es.hashes[kept] = es.hashes[i]
+		es.index[es.names[kept]] = kept
+		kept++
+	}
+
+	clear(es.entries[kept:])
+	clear(es.names[kept:])
+	es.entries = es.entries[:kept]
+	es.names = es.names[:kept]
+	es.hashes = es.hashes[:kept]
+	return removed
+}
+
+// payloadHash Returns a hash of what compareSEEntry compares, entries whose
+// hashes are the same are taken to be unchanged.  Addresses may be answered
+// in any order, so their hashes are summed.
+func payloadHash(entry *zeroconf.ServiceEntry) uint64 {
+	h := fnvString(FNV_OFFSET_64, entry.HostName)
+	h = fnvUint(h, uint64(entry.Port))
+	h = fnvUint(h, uint64(entry.TTL))
+	h = fnvUint(h, uint64(len(entry.Text)))
+	for _, text := range entry.Text {
+		h = fnvString(h, text)
+		h = fnvUint(h, 0)
+	}
+
+	h = fnvUint(h, uint64(len(entry.AddrIPv4)))
+	h = fnvUint(h, addressesHash(entry.AddrIPv4))
+	h = fnvUint(h, uint64(len(entry.AddrIPv6)))
+	return fnvUint(h, addressesHash(entry.AddrIPv6))
+}
+
+// addressesHash Returns the sum of the hashes of addrs, which doesn't
+// depend on their order.
+func addressesHash(addrs []net.IP) uint64 {
+	var sum uint64
+	for _, addr := range addrs {
+		h := FNV_OFFSET_64
+		for _, b := range addr.To16() {
+			h = (h ^ uint64(b)) * FNV_PRIME_64
+		}
+		sum += h
+	}
+
+	return sum
+}
+
+// fnvString Adds s to the FNV-1a hash h.
+func fnvString(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h = (h ^ uint64(s[i])) * FNV_PRIME_64
+	}
+
+	return h
+}
+
+// fnvUint Adds the 8 bytes of v to the FNV-1a hash h.
+func fnvUint(h uint64, v uint64) uint64 {
+	for i := 0; i < 8; i++ {
+		h = (h ^ (v & 0xff)) * FNV_PRIME_64
+		v >>= 8
+	}
+
+	return h
+}
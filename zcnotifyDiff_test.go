@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// testEntries Returns n entries of distinct devices, the first of them
+// called prefix-0.
+func testEntries(prefix string, n int) []zeroconf.ServiceEntry {
+	entries := make([]zeroconf.ServiceEntry, 0, n)
+	for i := 0; i < n; i++ {
+		entry := zeroconf.NewServiceEntry(fmt.Sprintf("%s-%d", prefix, i), "_http._tcp", "local.")
+		entry.HostName = fmt.Sprintf("%s-%d.local.", prefix, i)
+		entry.Port = 80
+		entry.TTL = 120
+		entry.Text = []string{"path=/"}
+		entry.AddrIPv4 = []net.IP{net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))}
+		entries = append(entries, *entry)
+	}
+
+	return entries
+}
+
+// testBrowse Returns the results of a browse of a network which had
+// previous on it: one in a hundred of them has gone, one in a hundred has a
+// new port and as many new devices have appeared.
+func testBrowse(previous []zeroconf.ServiceEntry) []*zeroconf.ServiceEntry {
+	var results []*zeroconf.ServiceEntry
+	for i := range previous {
+		if i%100 == 1 {
+			continue
+		}
+
+		entry := previous[i]
+		if i%100 == 2 {
+			entry.Port = 8080
+		}
+		results = append(results, &entry)
+	}
+
+	for _, entry := range testEntries("new", len(previous)/100) {
+		results = append(results, &entry)
+	}
+
+	return results
+}
+
+// nestedDiff Compares the results of a browse with prev as watchZCGroups did
+// before entrySet, with a nested loop over both, returning the number of
+// entries added, modified and removed.
+func nestedDiff(prev *[]zeroconf.ServiceEntry, results []*zeroconf.ServiceEntry) (int, int, int) {
+	added, modified, removed := 0, 0, 0
+	var seen []*zeroconf.ServiceEntry
+	for _, entry := range results {
+		newEntry := true
+		for index := range *prev {
+			old := &(*prev)[index]
+			if old.ServiceInstanceName() == entry.ServiceInstanceName() {
+				newEntry = false
+				if !compareSEEntry(old, entry) {
+					modified++
+				}
+				*old = *entry
+				break
+			}
+		}
+
+		if newEntry {
+			*prev = append(*prev, *entry)
+			added++
+		}
+		seen = append(seen, entry)
+	}
+
+	for index := len(*prev) - 1; index >= 0; index-- {
+		found := false
+		for _, entry := range seen {
+			if entry.ServiceInstanceName() == (*prev)[index].ServiceInstanceName() {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			removed++
+			*prev = append((*prev)[:index], (*prev)[index+1:]...)
+		}
+	}
+
+	return added, modified, removed
+}
+
+// setDiff Compares the results of a browse with prev as watchZCGroups does,
+// returning the number of entries added, modified and removed.
+func setDiff(prev *entrySet, results []*zeroconf.ServiceEntry, seen map[string]bool) (int, int, int) {
+	added, modified := 0, 0
+	clear(seen)
+	for _, entry := range results {
+		if prev.compare(entry, seen, func(old *zeroconf.ServiceEntry) {
+			if !compareSEEntry(old, entry) {
+				modified++
+			}
+		}) {
+			added++
+		}
+	}
+
+	return added, modified, len(prev.removeUnseen(seen))
+}
+
+func BenchmarkDiff(b *testing.B) {
+	for _, n := range []int{1000, 2500, 5000} {
+		previous := testEntries("device", n)
+		results := testBrowse(previous)
+
+		b.Run(fmt.Sprintf("nested/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				prev := slices.Clone(previous)
+				b.StartTimer()
+				nestedDiff(&prev, results)
+			}
+		})
+
+		b.Run(fmt.Sprintf("entrySet/%d", n), func(b *testing.B) {
+			seen := make(map[string]bool)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				prev := newEntrySet(previous)
+				b.StartTimer()
+				setDiff(prev, results, seen)
+			}
+		})
+	}
+}
+
+// TestDiffMatchesNested checks that entrySet finds the same changes as the
+// nested loop it replaced.
+func TestDiffMatchesNested(t *testing.T) {
+	previous := testEntries("device", 1000)
+	results := testBrowse(previous)
+
+	nested := slices.Clone(previous)
+	wantAdded, wantModified, wantRemoved := nestedDiff(&nested, results)
+	added, modified, removed := setDiff(newEntrySet(previous), results, make(map[string]bool))
+	if added != wantAdded || modified != wantModified || removed != wantRemoved {
+		t.Errorf("entrySet found %d added, %d modified and %d removed, want %d, %d and %d",
+			added, modified, removed, wantAdded, wantModified, wantRemoved)
+	}
+}
+
+func TestRemoveUnseen(t *testing.T) {
+	entries := testEntries("device", 6)
+	es := newEntrySet(entries)
+	seen := map[string]bool{
+		entries[0].ServiceInstanceName(): true,
+		entries[2].ServiceInstanceName(): true,
+		entries[5].ServiceInstanceName(): true,
+	}
+
+	removed := es.removeUnseen(seen)
+	var removedNames []string
+	for i := range removed {
+		removedNames = append(removedNames, removed[i].Instance)
+	}
+	if want := []string{"device-4", "device-3", "device-1"}; !slices.Equal(removedNames, want) {
+		t.Errorf("removed %v, want %v last first", removedNames, want)
+	}
+
+	want := []zeroconf.ServiceEntry{entries[0], entries[2], entries[5]}
+	if len(es.entries) != len(want) || len(es.names) != len(want) ||
+		len(es.hashes) != len(want) || len(es.index) != len(want) {
+		t.Fatalf("set holds %d entries, %d names, %d hashes and %d indexed, want %d",
+			len(es.entries), len(es.names), len(es.hashes), len(es.index), len(want))
+	}
+
+	for i := range want {
+		name := want[i].ServiceInstanceName()
+		if es.entries[i].Instance != want[i].Instance || es.names[i] != name {
+			t.Errorf("entry %d is %q named %q, want %q", i,
+				es.entries[i].Instance, es.names[i], want[i].Instance)
+		}
+
+		if es.hashes[i] != payloadHash(&want[i]) {
+			t.Errorf("entry %d has the hash of another entry", i)
+		}
+
+		if index, ok := es.index[name]; !ok || index != i {
+			t.Errorf("%q is indexed at %d, want %d", name, index, i)
+		}
+	}
+
+	if removed := es.removeUnseen(seen); removed != nil {
+		t.Errorf("removed %d entries which were seen", len(removed))
+	}
+
+	if removed := es.removeUnseen(map[string]bool{}); len(removed) != len(want) ||
+		len(es.entries) != 0 || len(es.index) != 0 {
+		t.Errorf("removing every entry left %d entries and %d indexed",
+			len(es.entries), len(es.index))
+	}
+}
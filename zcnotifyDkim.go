@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// dkimWhitespace matches the runs of whitespace relaxed canonicalization
+// reduces to a single space.
+var dkimWhitespace = regexp.MustCompile(`[ \t]+`)
+
+// dkimSigner Adds a DKIM-Signature (RFC 6376) to outgoing emails, with
+// relaxed canonicalization of the headers and body.
+type dkimSigner struct {
+	domain    string
+	selector  string
+	algorithm string
+	key       crypto.Signer
+}
+
+// newDkimSigner Creates a signer for domain and selector from a PEM encoded
+// RSA or Ed25519 private key, in PKCS #1 or PKCS #8 form.
+func newDkimSigner(domain string, selector string, keyPEM string) (*dkimSigner, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("no PEM encoded private key found")
+	}
+
+	var key any
+	var err error
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ds := &dkimSigner{domain: domain, selector: selector}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		ds.algorithm = "rsa-sha256"
+		ds.key = key
+		break
+	case ed25519.PrivateKey:
+		ds.algorithm = "ed25519-sha256"
+		ds.key = key
+		break
+	default:
+		return nil, fmt.Errorf("unsupported %T key, expected RSA or Ed25519", key)
+	}
+
+	return ds, nil
+}
+
+// emailDomain Returns the domain of an email address.
+func emailDomain(address string) string {
+	return strings.TrimSuffix(address[strings.LastIndex(address, "@")+1:], ">")
+}
+
+// dkimHeader Returns a header in relaxed canonical form.
+func dkimHeader(header emailHeader) string {
+	value := strings.ReplaceAll(header.value, "\r\n", "")
+	value = strings.TrimSpace(dkimWhitespace.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(header.name)) + ":" + value
+}
+
+// dkimBody Returns a body, whose lines end in CRLF, in relaxed canonical
+// form.
+func dkimBody(body string) string {
+	lines := strings.Split(body, "\r\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(dkimWhitespace.ReplaceAllString(lines[i], " "), " ")
+	}
+
+	for len(lines) != 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		return ""
+	}
+
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// sign Returns the DKIM-Signature header of an email with headers, every one
+// of which is signed, and body.
+func (ds *dkimSigner) sign(headers []emailHeader, body string, now time.Time) (emailHeader, error) {
+	bodyHash := sha256.Sum256([]byte(dkimBody(body)))
+
+	names := make([]string, 0, len(headers))
+	for _, header := range headers {
+		names = append(names, strings.ToLower(header.name))
+	}
+
+	signature := emailHeader{name: "DKIM-Signature",
+		value: fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+			ds.algorithm,
+			ds.domain,
+			ds.selector,
+			now.Unix(),
+			strings.Join(names, ":"),
+			base64.StdEncoding.EncodeToString(bodyHash[:]))}
+
+	// The signature covers itself with an empty b=, without the CRLF.
+	hash := sha256.New()
+	for _, header := range headers {
+		hash.Write([]byte(dkimHeader(header) + "\r\n"))
+	}
+	hash.Write([]byte(dkimHeader(signature)))
+
+	// Ed25519 signs the hash itself (RFC 8463), RSA its PKCS #1 encoding.
+	var opts crypto.SignerOpts = crypto.SHA256
+	if ds.algorithm == "ed25519-sha256" {
+		opts = crypto.Hash(0)
+	}
+
+	b, err := ds.key.Sign(rand.Reader, hash.Sum(nil), opts)
+	if err != nil {
+		return signature, fmt.Errorf("DKIM signing failed: %s", err.Error())
+	}
+
+	signature.value += base64.StdEncoding.EncodeToString(b)
+	return signature, nil
+}
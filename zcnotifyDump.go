@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"time"
+)
+
+// debugConfig controls the diagnostics of a running instance.
+type debugConfig struct {
+	// DumpFile is where the state dumped on SIGUSR2 is written, stderr if
+	// empty.
+	DumpFile string
+	// Diagnostics serves the pprof handlers and /debug/stats on the API
+	// listener, to admins.
+	Diagnostics bool
+}
+
+// runtimeDump is the Go runtime's view of a running instance.
+type runtimeDump struct {
+	GoVersion      string `json:"goVersion"`
+	Goroutines     int    `json:"goroutines"`
+	HeapAllocBytes uint64 `json:"heapAllocBytes"`
+	HeapObjects    uint64 `json:"heapObjects"`
+	SysBytes       uint64 `json:"sysBytes"`
+	NumGC          uint32 `json:"numGC"`
+}
+
+// backendDump is a backend's health and the filter deciding what it's sent.
+type backendDump struct {
+	backendHealth
+	Filter serviceFilter `json:"filter"`
+}
+
+// stateDump is a snapshot of a running instance's internal state, for
+// debugging one which has been running for a long time.
+type stateDump struct {
+	Time          time.Time       `json:"time"`
+	Version       string          `json:"version"`
+	Pid           int             `json:"pid"`
+	UptimeSeconds int64           `json:"uptimeSeconds"`
+	Status        string          `json:"status"`
+	Runtime       runtimeDump     `json:"runtime"`
+	Watchers      []watcherHealth `json:"watchers"`
+	Backends      []backendDump   `json:"backends"`
+	// Services is the registry, every service currently present.
+	Services           []serviceEntryJSON        `json:"services"`
+	Watches            []watchConfig             `json:"watches"`
+	Severity           []severityRule            `json:"severity"`
+	Scripts            []scriptConfig            `json:"scripts"`
+	MaintenanceWindows []maintenanceWindowConfig `json:"maintenanceWindows"`
+	Silences           []silence                 `json:"silences"`
+	// Stacks of every goroutine, grouped where they're the same.
+	GoroutineStacks string `json:"goroutineStacks"`
+}
+
+// newStateDump Returns a snapshot of the state of a running instance, it's
+// called by the pipeline as that owns zcnConfig.
+func newStateDump(zcnConfig *config,
+	registry *serviceRegistry,
+	health *healthMonitor,
+	silences *silenceStore) *stateDump {
+	now := time.Now().UTC()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	report := health.report()
+	dump := &stateDump{Time: now,
+		Version:       version,
+		Pid:           os.Getpid(),
+		UptimeSeconds: report.UptimeSeconds,
+		Status:        report.Status,
+		Runtime: runtimeDump{GoVersion: runtime.Version(),
+			Goroutines:     runtime.NumGoroutine(),
+			HeapAllocBytes: mem.HeapAlloc,
+			HeapObjects:    mem.HeapObjects,
+			SysBytes:       mem.Sys,
+			NumGC:          mem.NumGC},
+		Watchers:           report.Watchers,
+		Watches:            zcnConfig.Watch,
+		Severity:           zcnConfig.Severity,
+		Scripts:            zcnConfig.Script,
+		MaintenanceWindows: zcnConfig.MaintenanceWindow,
+		Silences:           silences.active(now)}
+
+	for _, bh := range report.Backends {
+		dump.Backends = append(dump.Backends, backendDump{backendHealth: bh,
+			Filter: zcnConfig.backendFilter(strings.TrimPrefix(bh.Backend, "shadow:"))})
+	}
+
+	entries := registry.snapshot()
+	dump.Services = make([]serviceEntryJSON, 0, len(entries))
+	for i := range entries {
+		dump.Services = append(dump.Services, newServiceEntryJSON(&entries[i]))
+	}
+
+	var stacks strings.Builder
+	pprof.Lookup("goroutine").WriteTo(&stacks, 1)
+	dump.GoroutineStacks = stacks.String()
+	return dump
+}
+
+// writeStateDump Writes a dump to the DumpFile, replacing it, or to stderr.
+func writeStateDump(conf debugConfig, dump *stateDump) error {
+	data, err := json.MarshalIndent(dump, "", "    ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if conf.DumpFile == "" {
+		_, err := os.Stderr.Write(data)
+		return err
+	}
+
+	tmp := conf.DumpFile + ".tmp"
+	if err := os.WriteFile(tmp, data, stateFileMode); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, conf.DumpFile)
+}
+
+// dump Serves the state dump.
+func (as *apiServer) dump(w http.ResponseWriter, r *http.Request) {
+	request := adminRequest{action: ADMIN_DUMP,
+		done:   make(chan error, 1),
+		dumped: make(chan *stateDump, 1)}
+	select {
+	case as.admin <- request:
+		break
+	case <-r.Context().Done():
+		return
+	}
+
+	select {
+	case <-request.done:
+		writeJSON(w, <-request.dumped)
+		break
+	case <-r.Context().Done():
+		break
+	}
+}
+
+// dumpCommand Fetches the state dump of a running instance.
+func dumpCommand(name string, args []string) int {
+	fs := newFlagSet(name, "")
+	common := addCommonFlags(fs)
+	addr := fs.String("api", "",
+		"Address of the instance's API, defaults to the configured API listener")
+	token := fs.String("token", "",
+		"Bearer token for the API, defaults to the first [server] admin token")
+	output := fs.String("o", "", "File to write, defaults to stdout")
+	fs.Parse(args)
+
+	client := newCommandAPIClient(common, *addr, *token, ROLE_ADMIN)
+	resp, err := client.get("/dump")
+	if err != nil {
+		fatal("failed to query API", "err", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		fmt.Fprintf(os.Stderr, "dump failed: %s %s\n", resp.Status, body)
+		return 1
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fatal("failed to create file", "err", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		fatal("failed to write dump", "err", err)
+	}
+
+	return 0
+}
@@ -1,66 +1,425 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/smtp"
+	"os/exec"
+	"sort"
 	"strings"
+	"text/template"
+	"time"
+	"unicode"
 )
 
 const (
 	smtpPort  uint = 25
 	smtpsPort uint = 587
+	// Time the sendmail program is given to accept an email.
+	SENDMAIL_TIMEOUT time.Duration = 30 * time.Second
+	// Starts the subject of every email unless SubjectPrefix is set.
+	DEFAULT_SUBJECT_PREFIX string = "[ZCNOTIFY]"
 )
 
-// sendEmail Send an email.
-func sendEmail(to string,
-	from string,
-	password string,
-	ssl bool,
-	server string,
-	subject string,
-	body string) error {
-	serverAndPort := strings.Split(server, ":")
-	auth := smtp.PlainAuth("", from, password, serverAndPort[0])
-
-	if len(serverAndPort) == 1 {
+// emailHeader is a single header of an email.
+type emailHeader struct {
+	name  string
+	value string
+}
+
+// Marks critical and unknown device emails as high priority, unless the
+// block's Headers set them.
+var urgentHeaders = []emailHeader{{"Importance", "high"}, {"X-Priority", "1"}}
+
+// serverAddress Returns the host:port of the SMTP server, adding the default
+// port if none is specified.
+func serverAddress(server string, ssl bool) string {
+	if len(strings.Split(server, ":")) == 1 {
 		// No port specified
 		if ssl {
-			server += ":" + string(smtpsPort)
+			server += fmt.Sprintf(":%d", smtpsPort)
 		} else {
-			server += ":" + string(smtpPort)
+			server += fmt.Sprintf(":%d", smtpPort)
 		}
 	}
 
-	msg := []byte("To: " + to + "\r\n" +
-		"Subject: " + subject + "\r\n\r\n" + body + "\r\n")
-	return smtp.SendMail(server, auth, from, []string{to}, msg)
+	return server
 }
 
-// SendEmail Creates a new email using ServiceEntryChange, receipients are
-// specified by the emailConfig map.
-func SendEmail(emailConfigs map[string]emailConfig,
-	changeEntry *ServiceEntryChange) {
-	for _, emailConf := range emailConfigs {
-		subject := fmt.Sprintf("[ZCNOTIFY] %s %q",
-			changeEntry.ChangeType.String(),
-			changeEntry.Entry.Instance)
-		body, err := json.MarshalIndent(*changeEntry, "", "    ")
-		if err != nil {
-			log.Println("marshal error:", err.Error())
-			return
+// pipeEmail Sends an email by piping it to a sendmail compatible program,
+// which is given args, the sender and the recipient.  The program's output
+// is returned in the error if it fails.
+func pipeEmail(sendmail string,
+	args []string,
+	to string,
+	from string,
+	msg []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), SENDMAIL_TIMEOUT)
+	defer cancel()
+
+	args = append(append([]string(nil), args...), "-i", "-f", from, "--", to)
+	cmd := exec.CommandContext(ctx, sendmail, args...)
+	// sendmail takes lines ending in a bare newline.
+	cmd.Stdin = bytes.NewReader(bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n")))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if text := strings.TrimSpace(string(output)); text != "" {
+			return fmt.Errorf("%s: %s: %s", sendmail, err.Error(), text)
+		}
+		return fmt.Errorf("%s: %s", sendmail, err.Error())
+	}
+
+	return nil
+}
+
+// renderHeaders Returns headers as they're shown by Render.
+func renderHeaders(headers []emailHeader) string {
+	var rendered strings.Builder
+	for _, header := range headers {
+		rendered.WriteString(header.name + ": " + header.value + "\n")
+	}
+
+	return rendered.String()
+}
+
+// highPriority Returns true if the email for change should be marked as high
+// priority.
+func highPriority(change *ServiceEntryChange) bool {
+	return change.UnknownDevice || change.Severity == SEVERITY_CRITICAL
+}
+
+// emailNotifier Delivers notifications to the recipient of a single
+// [email.<name>] block.
+type emailNotifier struct {
+	name    string
+	conf    emailConfig
+	subject *template.Template
+	body    *template.Template
+	// dkim is set if emails are signed.
+	dkim *dkimSigner
+	// session is the connection to Server, nil with Sendmail.
+	session *smtpSession
+}
+
+// newEmailNotifier Creates a notifier for the email block called name.
+func newEmailNotifier(name string, conf emailConfig) *emailNotifier {
+	en := &emailNotifier{name: "email." + name,
+		conf:    conf,
+		subject: parseTemplate("email."+name+" subject", conf.SubjectTemplate),
+		body:    parseTemplate("email."+name, conf.Template)}
+	if conf.DkimKey != "" {
+		// The key has already been checked by ValidEmailConfig.
+		en.dkim, _ = newDkimSigner(conf.DkimDomain, conf.DkimSelector, conf.DkimKey)
+	}
+
+	if conf.Sendmail == "" {
+		en.session = newSmtpSession(en.name, conf)
+	}
+
+	return en
+}
+
+func (en *emailNotifier) Name() string {
+	return en.name
+}
+
+func (en *emailNotifier) Allows(change *ServiceEntryChange) (bool, string) {
+	if en.conf.UnknownOnly && !change.UnknownDevice {
+		return false, "not an unknown device and UnknownOnly is set"
+	}
+
+	if change.Severity < minSeverity(en.conf.MinSeverity) {
+		return false, "severity below MinSeverity"
+	}
+
+	return en.conf.allowsChange(change)
+}
+
+// subjectPrefix Returns the start of the default subject, the configured
+// prefix followed by the site of aggregated events, e.g. "[ZCNOTIFY][dublin]".
+func (en *emailNotifier) subjectPrefix(site string) string {
+	if site == "" {
+		return en.conf.SubjectPrefix
+	}
+
+	return en.conf.SubjectPrefix + "[" + site + "]"
+}
+
+// headerValue Returns text as a single line, as headers can't span lines:
+// runs of white space, including line breaks, become a single space and
+// other control characters are dropped.
+func headerValue(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, text)
+
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// render Creates the subject and body of the email for a change.
+func (en *emailNotifier) render(changeEntry *ServiceEntryChange) (string,
+	string,
+	error) {
+	subject := fmt.Sprintf("%s %s %q",
+		en.subjectPrefix(changeEntry.Site),
+		changeEntry.ChangeType.String(),
+		changeEntry.Entry.Instance)
+	if changeEntry.ChangeType == RENAMED && changeEntry.Previous != nil {
+		subject += fmt.Sprintf(" (was %q)", changeEntry.Previous.Instance)
+	}
+
+	if ago := lastSeenAgo(changeEntry); ago != "" {
+		subject += fmt.Sprintf(" (last seen %s ago)", ago)
+	}
+
+	if changeEntry.Identity != nil && changeEntry.Identity.Owner != "" {
+		subject += fmt.Sprintf(" (%s)", changeEntry.Identity.Owner)
+	}
+
+	if changeEntry.Enrichment != nil && changeEntry.Enrichment.Vendor != "" {
+		subject += ": " + changeEntry.Enrichment.Vendor
+	}
+
+	if changeEntry.Severity != SEVERITY_INFO {
+		subject = "[" + strings.ToUpper(changeEntry.Severity.String()) + "]" + subject
+	}
+
+	if changeEntry.UnknownDevice {
+		subject = "[UNKNOWN DEVICE]" + subject
+	}
+
+	if changeEntry.Shadow {
+		subject = "[SHADOW]" + subject
+	}
+
+	subject = headerValue(applyTemplate(en.subject, changeEntry, subject))
+
+	body, err := en.renderBody(changeEntry)
+	if err != nil {
+		return "", "", err
+	}
+
+	return subject, body, nil
+}
+
+// renderBody Creates the body of the email for a change, the JSON form of
+// the change unless a template is configured.
+func (en *emailNotifier) renderBody(changeEntry *ServiceEntryChange) (string, error) {
+	body, err := json.MarshalIndent(en.conf.encode(changeEntry, en.conf.IncludeTrace),
+		"",
+		"    ")
+	if err != nil {
+		return "", fmt.Errorf("marshal error: %s", err.Error())
+	}
+
+	return applyTemplate(en.body, changeEntry, string(body)), nil
+}
+
+// headers Returns the headers of an email with subject: the addresses, the
+// subject, the urgent headers if urgent is set and the block's Headers.
+func (en *emailNotifier) headers(subject string, urgent bool) []emailHeader {
+	headers := []emailHeader{{"From", en.conf.From},
+		{"To", en.conf.To},
+		{"Subject", subject}}
+	if urgent {
+		for _, header := range urgentHeaders {
+			if _, ok := en.conf.Headers[header.name]; !ok {
+				headers = append(headers, header)
+			}
 		}
+	}
+
+	var names []string
+	for name := range en.conf.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		headers = append(headers, emailHeader{name, en.conf.Headers[name]})
+	}
+
+	return headers
+}
 
-		err = sendEmail(emailConf.To,
-			emailConf.From,
-			emailConf.Password,
-			emailConf.Ssl,
-			emailConf.Server,
-			subject,
-			string(body))
+// message Returns the email, headers and body, to send, signed if DKIM is
+// configured.
+func (en *emailNotifier) message(subject string, urgent bool, body string) ([]byte, error) {
+	now := time.Now()
+	headers := append(en.headers(subject, urgent),
+		emailHeader{"Date", now.Format(time.RFC1123Z)})
+	// Lines end in CRLF on the wire, which is what's signed.
+	body = strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n") + "\r\n"
+	if en.dkim != nil {
+		signature, err := en.dkim.sign(headers, body, now)
 		if err != nil {
-			log.Println("failed to send notification email:", err.Error())
+			return nil, err
+		}
+
+		headers = append([]emailHeader{signature}, headers...)
+	}
+
+	var msg strings.Builder
+	for _, header := range headers {
+		msg.WriteString(header.name + ": " + header.value + "\r\n")
+	}
+	msg.WriteString("\r\n" + body)
+	return []byte(msg.String()), nil
+}
+
+// send Sends an email to the block's recipient, through its sendmail
+// program if it has one and its SMTP server otherwise.
+func (en *emailNotifier) send(subject string, urgent bool, body string) error {
+	msg, err := en.message(subject, urgent, body)
+	if err != nil {
+		return err
+	}
+
+	if en.conf.Sendmail != "" {
+		return pipeEmail(en.conf.Sendmail,
+			en.conf.SendmailArgs,
+			en.conf.To,
+			en.conf.From,
+			msg)
+	}
+
+	return en.session.send(en.conf.To, msg)
+}
+
+// close Closes the connection to the SMTP server, if it's open.
+func (en *emailNotifier) close() {
+	if en.session != nil {
+		en.session.close()
+	}
+}
+
+// Render Returns the email which would be sent for a change.
+func (en *emailNotifier) Render(changeEntry *ServiceEntryChange) (string, error) {
+	subject, body, err := en.render(changeEntry)
+	if err != nil {
+		return "", err
+	}
+
+	return renderHeaders(en.headers(subject, highPriority(changeEntry))) + "\n" + body, nil
+}
+
+// Notify Creates a new email using ServiceEntryChange and sends it to the
+// configured recipient.
+func (en *emailNotifier) Notify(changeEntry *ServiceEntryChange) error {
+	subject, body, err := en.render(changeEntry)
+	if err != nil {
+		return err
+	}
+
+	return en.send(subject, highPriority(changeEntry), body)
+}
+
+// renderDigest Creates the subject and body of a digest email.
+func (en *emailNotifier) renderDigest(changes []ServiceEntryChange) (string,
+	string,
+	error) {
+	site := ""
+	if len(changes) != 0 {
+		site = changes[0].Site
+		for i := range changes {
+			if changes[i].Site != site {
+				site = ""
+				break
+			}
 		}
 	}
+
+	prefix := en.subjectPrefix(site)
+	subject := fmt.Sprintf("%s Digest of %d changes", prefix, len(changes))
+	if len(changes) != 0 && changes[0].Report {
+		subject = fmt.Sprintf("%s Inventory report of %d changes", prefix, len(changes))
+	}
+	if len(changes) != 0 && changes[0].Shadow {
+		subject = "[SHADOW]" + subject
+	}
+	subject = headerValue(subject)
+
+	if en.body != nil {
+		// Each change is rendered with the template.
+		bodies := make([]string, 0, len(changes))
+		for i := range changes {
+			body, err := en.renderBody(&changes[i])
+			if err != nil {
+				return "", "", err
+			}
+			bodies = append(bodies, body)
+		}
+
+		return subject, strings.Join(bodies, "\n\n"), nil
+	}
+
+	digest := make([]any, 0, len(changes))
+	for i := range changes {
+		digest = append(digest, en.conf.encode(&changes[i], en.conf.IncludeTrace))
+	}
+
+	body, err := json.MarshalIndent(digest, "", "    ")
+	if err != nil {
+		return "", "", fmt.Errorf("marshal error: %s", err.Error())
+	}
+
+	return subject, string(body), nil
+}
+
+// RenderDigest Returns the email which would be sent for a digest.
+func (en *emailNotifier) RenderDigest(changes []ServiceEntryChange) (string, error) {
+	subject, body, err := en.renderDigest(changes)
+	if err != nil {
+		return "", err
+	}
+
+	return renderHeaders(en.headers(subject, false)) + "\n" + body, nil
+}
+
+// NotifyDigest Sends the changes held back during quiet hours as a single
+// email.
+func (en *emailNotifier) NotifyDigest(changes []ServiceEntryChange) error {
+	subject, body, err := en.renderDigest(changes)
+	if err != nil {
+		return err
+	}
+
+	return en.send(subject, false, body)
+}
+
+// Check Connects to the SMTP server and authenticates, without sending
+// anything.  With a sendmail program, it's only looked for.
+func (en *emailNotifier) Check() error {
+	if en.conf.Sendmail != "" {
+		_, err := exec.LookPath(en.conf.Sendmail)
+		return err
+	}
+
+	host := strings.Split(en.conf.Server, ":")[0]
+	client, err := smtp.Dial(serverAddress(en.conf.Server, en.conf.Ssl))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+
+	if ok, _ := client.Extension("AUTH"); ok && en.conf.Password != "" {
+		auth := smtp.PlainAuth("", en.conf.From, en.conf.Password, host)
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	return client.Quit()
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_ENRICH_TIMEOUT uint = 2
+	// Reverse DNS names are cached for this long, or lookups which failed
+	// for REVERSE_DNS_FAILURE_CACHE.
+	REVERSE_DNS_CACHE         time.Duration = 10 * time.Minute
+	REVERSE_DNS_FAILURE_CACHE time.Duration = time.Minute
+	// How long a change waits for the reverse DNS lookups of addresses
+	// which aren't cached, later changes are given the names once they're
+	// in.
+	REVERSE_DNS_WAIT time.Duration = 250 * time.Millisecond
+)
+
+// enrichConfig controls the [enrich] stage, which adds details about the
+// device behind each entry from the network itself.
+type enrichConfig struct {
+	// Look up the names of the entry's addresses in DNS.
+	ReverseDNS bool
+	// Find the MAC address of the device in the ARP/NDP neighbour table.
+	Neighbors bool
+	// Vendor database used to name the manufacturer from the MAC address,
+	// in IEEE oui.txt or Wireshark manuf format.
+	OUIFile string
+	// Seconds to wait for each reverse DNS lookup.
+	TimeoutSeconds uint
+}
+
+// deviceEnrichment holds the details found by the enrichment stage.
+type deviceEnrichment struct {
+	Names  []string `json:"names,omitempty"`
+	MAC    string   `json:"mac,omitempty"`
+	Vendor string   `json:"vendor,omitempty"`
+}
+
+// cachedNames is the reverse DNS names of an address and their expiry.
+type cachedNames struct {
+	names   []string
+	expires time.Time
+}
+
+// enricher Adds reverse DNS names, MAC addresses and vendors to changes.
+// Addresses are looked up in the background and their names cached, and
+// the neighbour table is neighborCache, so the pipeline never waits long.
+type enricher struct {
+	conf    enrichConfig
+	vendors map[string]string
+	mutex   sync.Mutex
+	names   map[string]cachedNames
+	// pending holds the lookups in progress by address, each channel is
+	// closed once its names are cached.
+	pending map[string]chan bool
+}
+
+// newEnricher Creates the enrichment stage, loading the vendor database if
+// one is configured.  nil is returned if enrichment is off.
+func newEnricher(conf enrichConfig) (*enricher, error) {
+	if !conf.ReverseDNS && !conf.Neighbors {
+		return nil, nil
+	}
+
+	e := &enricher{conf: conf,
+		names:   make(map[string]cachedNames),
+		pending: make(map[string]chan bool)}
+	if conf.OUIFile != "" {
+		vendors, err := loadOUIFile(conf.OUIFile)
+		if err != nil {
+			return nil, fmt.Errorf("enrich OUIFile: %s", err.Error())
+		}
+
+		slog.Info("loaded vendor database", "file", conf.OUIFile, "vendors", len(vendors))
+		e.vendors = vendors
+	}
+
+	return e, nil
+}
+
+// ouiKey Returns the upper case, colon separated first three octets of mac.
+func ouiKey(mac net.HardwareAddr) string {
+	if len(mac) < 3 {
+		return ""
+	}
+
+	return strings.ToUpper(mac[:3].String())
+}
+
+// loadOUIFile Reads a vendor database, either the IEEE oui.txt format
+// ("00-00-0C   (hex)		Cisco Systems, Inc") or the Wireshark manuf format
+// ("00:00:0C	Cisco	Cisco Systems, Inc").  Longer manuf prefixes are
+// ignored.
+func loadOUIFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vendors := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var prefix, vendor string
+		if strings.Contains(line, "(hex)") {
+			fields := strings.SplitN(line, "(hex)", 2)
+			prefix = strings.TrimSpace(fields[0])
+			vendor = strings.TrimSpace(fields[1])
+		} else {
+			fields := strings.Split(line, "\t")
+			if len(fields) < 2 {
+				continue
+			}
+			prefix = strings.TrimSpace(fields[0])
+			vendor = strings.TrimSpace(fields[len(fields)-1])
+		}
+
+		mac, err := net.ParseMAC(strings.ReplaceAll(prefix, "-", ":") + ":00:00:00")
+		if err != nil || vendor == "" {
+			continue
+		}
+
+		vendors[ouiKey(mac)] = vendor
+	}
+
+	return vendors, scanner.Err()
+}
+
+// reverseNames Returns the reverse DNS names of ips, from the cache or by
+// looking up those which aren't cached in the background and waiting for
+// them for at most REVERSE_DNS_WAIT.
+func (e *enricher) reverseNames(ips []net.IP) []string {
+	var waiting []chan bool
+	e.mutex.Lock()
+	now := time.Now()
+	for _, ip := range ips {
+		addr := ip.String()
+		if cached, ok := e.names[addr]; ok && now.Before(cached.expires) {
+			continue
+		}
+
+		done, ok := e.pending[addr]
+		if !ok {
+			done = make(chan bool)
+			e.pending[addr] = done
+			go e.lookupAddr(addr, done)
+		}
+		waiting = append(waiting, done)
+	}
+	e.mutex.Unlock()
+
+	deadline := time.After(REVERSE_DNS_WAIT)
+wait:
+	for _, done := range waiting {
+		select {
+		case <-done:
+			break
+		case <-deadline:
+			break wait
+		}
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, ip := range ips {
+		for _, name := range e.names[ip.String()].names {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names
+}
+
+// lookupAddr Looks up the names of addr and caches them, closing done once
+// they are.
+func (e *enricher) lookupAddr(addr string, done chan bool) {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(e.conf.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	expires := time.Now().Add(REVERSE_DNS_CACHE)
+	names, err := net.DefaultResolver.LookupAddr(ctx, addr)
+	if err != nil {
+		slog.Debug("reverse DNS lookup failed", "ip", addr, "err", err)
+		expires = time.Now().Add(REVERSE_DNS_FAILURE_CACHE)
+	}
+
+	e.mutex.Lock()
+	e.names[addr] = cachedNames{names: names, expires: expires}
+	delete(e.pending, addr)
+	e.mutex.Unlock()
+	close(done)
+}
+
+// enrich Adds the reverse DNS names, MAC address and vendor of the changed
+// device to the change.
+func (e *enricher) enrich(change *ServiceEntryChange) {
+	if e == nil {
+		return
+	}
+
+	ips := append(append([]net.IP(nil), change.Entry.AddrIPv4...),
+		change.Entry.AddrIPv6...)
+	enrichment := &deviceEnrichment{}
+	if e.conf.ReverseDNS {
+		enrichment.Names = e.reverseNames(ips)
+	}
+
+	if e.conf.Neighbors {
+		addrs := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, ip.String())
+		}
+
+		neighbors := neighborCache.find(addrs)
+		for _, addr := range addrs {
+			if n, ok := neighbors[addr]; ok && n.mac != nil {
+				enrichment.MAC = n.mac.String()
+				enrichment.Vendor = e.vendors[ouiKey(n.mac)]
+				break
+			}
+		}
+	}
+
+	if len(enrichment.Names) == 0 && enrichment.MAC == "" {
+		return
+	}
+
+	change.Enrichment = enrichment
+	change.Trace.add("enrich", "", TRACE_ACCEPTED,
+		fmt.Sprintf("names %v, mac %q, vendor %q",
+			enrichment.Names, enrichment.MAC, enrichment.Vendor))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+const DEFAULT_EVENTLOG_SOURCE string = "zcnotify"
+
+// eventLogConfig describes a single [eventlog.<name>] block.
+type eventLogConfig struct {
+	serviceFilter
+	scheduleConfig
+	// Template replaces the message of the events.
+	templateConfig
+	// Event source the events are written as, registered in the
+	// Application log the first time it's used.
+	Source string
+}
+
+// eventLogLevel is the type of a Windows event.
+type eventLogLevel int
+
+const (
+	EVENTLOG_INFO eventLogLevel = iota
+	EVENTLOG_WARNING
+	EVENTLOG_ERROR
+)
+
+var eventLogLevels = []string{"Information", "Warning", "Error"}
+
+// eventLog is an open event source.
+type eventLog interface {
+	write(level eventLogLevel, eventID uint32, message string) error
+}
+
+// validEventLogConfig Fills in the defaults of every [eventlog.<name>] block,
+// a block called "default" is used if there are none.
+func validEventLogConfig(zcnConfig *config) error {
+	if runtime.GOOS != "windows" {
+		return errors.New("the Windows Event Log is only available on Windows")
+	}
+
+	if len(zcnConfig.EventLog) == 0 {
+		zcnConfig.EventLog = map[string]eventLogConfig{"default": {}}
+	}
+
+	for name, eventLogConf := range zcnConfig.EventLog {
+		if eventLogConf.Source == "" {
+			eventLogConf.Source = DEFAULT_EVENTLOG_SOURCE
+		}
+
+		if err := eventLogConf.setup(fmt.Sprintf("eventlog config: %q", name)); err != nil {
+			return err
+		}
+
+		zcnConfig.EventLog[name] = eventLogConf
+	}
+
+	return nil
+}
+
+// eventLogNotifier Writes every event to the Windows Event Log.  The event ID
+// is the change type, 1 for ADD, 2 for REMOVE and so on, and the type
+// follows the event's severity.
+type eventLogNotifier struct {
+	name     string
+	conf     eventLogConfig
+	template *template.Template
+	mutex    sync.Mutex
+	log      eventLog
+}
+
+// newEventLogNotifier Creates a notifier for the eventlog block called name,
+// the event source isn't opened until it's written to.
+func newEventLogNotifier(name string, conf eventLogConfig) *eventLogNotifier {
+	return &eventLogNotifier{name: "eventlog." + name,
+		conf:     conf,
+		template: parseTemplate("eventlog."+name, conf.Template)}
+}
+
+func (en *eventLogNotifier) Name() string {
+	return en.name
+}
+
+func (en *eventLogNotifier) Allows(change *ServiceEntryChange) (bool, string) {
+	return en.conf.allowsChange(change)
+}
+
+// eventLogEvent Returns the type, ID and message of the event for a change.
+func (en *eventLogNotifier) eventLogEvent(change *ServiceEntryChange) (eventLogLevel,
+	uint32,
+	string) {
+	level := EVENTLOG_INFO
+	switch change.Severity {
+	case SEVERITY_CRITICAL:
+		level = EVENTLOG_ERROR
+		break
+	case SEVERITY_WARNING:
+		level = EVENTLOG_WARNING
+		break
+	}
+
+	var message strings.Builder
+	fmt.Fprintf(&message, "%s %q (%s)\r\n\r\n", change.ChangeType.String(),
+		change.Entry.Instance,
+		change.Entry.Service)
+	fmt.Fprintf(&message, "Event ID: %s\r\n", change.ID)
+	fmt.Fprintf(&message, "Severity: %s\r\n", change.Severity.String())
+	fmt.Fprintf(&message, "Domain: %s\r\n", change.Entry.Domain)
+	fmt.Fprintf(&message, "Host: %s\r\n", change.Entry.HostName)
+	fmt.Fprintf(&message, "Port: %d\r\n", change.Entry.Port)
+	fmt.Fprintf(&message, "IPv4: %s\r\n", change.Entry.AddrIPv4)
+	fmt.Fprintf(&message, "IPv6: %s\r\n", change.Entry.AddrIPv6)
+	fmt.Fprintf(&message, "TXT: %s\r\n", strings.Join(change.Entry.Text, ", "))
+	if change.Previous != nil {
+		fmt.Fprintf(&message, "Previous instance: %s\r\n", change.Previous.Instance)
+	}
+	if change.UnknownDevice {
+		message.WriteString("Unknown device\r\n")
+	}
+
+	return level,
+		uint32(change.ChangeType) + 1,
+		applyTemplate(en.template, change, message.String())
+}
+
+// open Returns the event source, opening it if necessary.
+func (en *eventLogNotifier) open() (eventLog, error) {
+	en.mutex.Lock()
+	defer en.mutex.Unlock()
+
+	if en.log != nil {
+		return en.log, nil
+	}
+
+	log, err := openEventLog(en.conf.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	en.log = log
+	return log, nil
+}
+
+func (en *eventLogNotifier) Render(change *ServiceEntryChange) (string, error) {
+	level, eventID, message := en.eventLogEvent(change)
+	return fmt.Sprintf("Source: %s\nType: %s\nEvent ID: %d\n\n%s",
+		en.conf.Source, eventLogLevels[level], eventID, message), nil
+}
+
+// Notify Writes the event for a change.
+func (en *eventLogNotifier) Notify(change *ServiceEntryChange) error {
+	log, err := en.open()
+	if err != nil {
+		return err
+	}
+
+	return log.write(en.eventLogEvent(change))
+}
+
+func (en *eventLogNotifier) RenderDigest(changes []ServiceEntryChange) (string, error) {
+	var rendered strings.Builder
+	for i := range changes {
+		event, _ := en.Render(&changes[i])
+		rendered.WriteString(event + "\n")
+	}
+
+	return rendered.String(), nil
+}
+
+// NotifyDigest Writes an event for every change held back during quiet
+// hours.
+func (en *eventLogNotifier) NotifyDigest(changes []ServiceEntryChange) error {
+	for i := range changes {
+		if err := en.Notify(&changes[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Check Opens the event source, registering it if necessary.
+func (en *eventLogNotifier) Check() error {
+	_, err := en.open()
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+// openEventLog Fails, the Windows Event Log only exists on Windows.
+func openEventLog(source string) (eventLog, error) {
+	return nil, errors.New("the Windows Event Log is only available on Windows")
+}
@@ -0,0 +1,47 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// windowsEventLog writes to an event source of the Application log.
+type windowsEventLog struct {
+	log *eventlog.Log
+}
+
+// openEventLog Opens the event source, registering it with EventCreate.exe
+// as its message file if it doesn't exist yet.  Registering needs
+// administrator rights, so the source should be created by the installer or
+// the first run as a service.
+func openEventLog(source string) (eventLog, error) {
+	err := eventlog.InstallAsEventCreate(source,
+		eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil && !strings.Contains(err.Error(), "registry key already exists") {
+		return nil, fmt.Errorf("unable to register event source %q: %s",
+			source, err.Error())
+	}
+
+	log, err := eventlog.Open(source)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open event source %q: %s",
+			source, err.Error())
+	}
+
+	return &windowsEventLog{log: log}, nil
+}
+
+func (wel *windowsEventLog) write(level eventLogLevel, eventID uint32, message string) error {
+	switch level {
+	case EVENTLOG_ERROR:
+		return wel.log.Error(eventID, message)
+	case EVENTLOG_WARNING:
+		return wel.log.Warning(eventID, message)
+	default:
+		return wel.log.Info(eventID, message)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	// Seconds an expected service may be absent before it's reported.
+	DEFAULT_EXPECT_GRACE uint = 300
+	// How often the expected services are looked for.
+	EXPECT_CHECK_INTERVAL = 10 * time.Second
+)
+
+// expectConfig is a single [[expect]] block, a service which should always
+// be present.  Every setting given must match, so Instances = ["nas"] with
+// Services = ["_smb._tcp"] expects the NAS's file sharing.
+type expectConfig struct {
+	// Shown in notifications, the patterns if not set.
+	Name     string
+	Services []string
+	// Glob patterns of instance names and host names.
+	Instances []string
+	HostNames []string
+	// Seconds the service may be absent, at startup or after it went,
+	// before it's reported as MISSING.
+	GraceSeconds uint
+
+	match eventMatch
+}
+
+// setupExpect Checks the [[expect]] blocks and fills in the defaults.
+func (zcnConfig *config) setupExpect() error {
+	watched := make(map[string]bool)
+	for _, target := range zcnConfig.browseTargets() {
+		watched[strings.ToLower(target.Service)] = true
+	}
+
+	for i := range zcnConfig.Expect {
+		expect := &zcnConfig.Expect[i]
+		expect.match = eventMatch{Services: expect.Services,
+			Instances: expect.Instances,
+			HostNames: expect.HostNames}
+		if len(expect.Services) == 0 && len(expect.Instances) == 0 && len(expect.HostNames) == 0 {
+			return fmt.Errorf("expect %d: Services, Instances or HostNames is required", i+1)
+		}
+
+		if expect.Name == "" {
+			expect.Name = strings.Join(append(append(append([]string(nil),
+				expect.Instances...), expect.HostNames...), expect.Services...), " ")
+		}
+
+		if err := expect.match.validate(); err != nil {
+			return fmt.Errorf("expect %q: %s", expect.Name, err.Error())
+		}
+
+		for _, service := range expect.Services {
+			if !watched[strings.ToLower(service)] {
+				return fmt.Errorf("expect %q: service %q isn't watched", expect.Name, service)
+			}
+		}
+
+		if expect.GraceSeconds == 0 {
+			expect.GraceSeconds = DEFAULT_EXPECT_GRACE
+		}
+	}
+
+	return nil
+}
+
+// entry Returns the entry reported for an expected service which has never
+// been seen.
+func (ec *expectConfig) entry() *zeroconf.ServiceEntry {
+	service := ""
+	if len(ec.Services) == 1 {
+		service = ec.Services[0]
+	}
+
+	return zeroconf.NewServiceEntry(ec.Name, service, DEFAULT_DOMAIN)
+}
+
+// expectation Tracks a single expected service.
+type expectation struct {
+	conf *expectConfig
+	// absent is when the service was first found missing, zero while
+	// it's present.
+	absent time.Time
+	// last is the last entry which matched, nil if none has.
+	last *zeroconf.ServiceEntry
+	// missing is the entry reported MISSING, nil if it hasn't been.
+	missing *zeroconf.ServiceEntry
+}
+
+// expectMonitor Looks for the expected services in the registry, reporting
+// those absent for longer than their grace period as MISSING and their
+// return as RECOVERED.  The events are passed to the pipeline through
+// changes.
+type expectMonitor struct {
+	registry     *serviceRegistry
+	expectations []*expectation
+	changes      chan ServiceEntryChange
+}
+
+// newExpectMonitor Creates the monitor, or returns nil if no services are
+// expected.  Services absent when it's created have their grace period to
+// turn up.
+func newExpectMonitor(confs []expectConfig, registry *serviceRegistry) *expectMonitor {
+	if len(confs) == 0 {
+		return nil
+	}
+
+	em := &expectMonitor{registry: registry, changes: make(chan ServiceEntryChange)}
+	now := time.Now()
+	for i := range confs {
+		em.expectations = append(em.expectations,
+			&expectation{conf: &confs[i], absent: now})
+	}
+
+	return em
+}
+
+// events Returns the channel of MISSING and RECOVERED events, nil if no
+// services are expected so that it's never ready.
+func (em *expectMonitor) events() <-chan ServiceEntryChange {
+	if em == nil {
+		return nil
+	}
+
+	return em.changes
+}
+
+// check Returns the events for the expected services which have gone
+// missing or returned since the last check.
+func (em *expectMonitor) check(now time.Time) []ServiceEntryChange {
+	entries := em.registry.snapshot()
+	var changes []ServiceEntryChange
+	for _, exp := range em.expectations {
+		var found *zeroconf.ServiceEntry
+		for i := range entries {
+			if exp.conf.match.matchesEntry(&entries[i]) {
+				found = &entries[i]
+				break
+			}
+		}
+
+		if found != nil {
+			if exp.missing != nil {
+				changes = append(changes, ServiceEntryChange{ID: newEventID(),
+					ChangeType: RECOVERED,
+					Timestamp:  now.UTC(),
+					Entry:      *found,
+					Previous:   exp.missing})
+				exp.missing = nil
+			}
+
+			exp.last = found
+			exp.absent = time.Time{}
+			continue
+		}
+
+		if exp.absent.IsZero() {
+			exp.absent = now
+		}
+
+		grace := time.Duration(exp.conf.GraceSeconds) * time.Second
+		if exp.missing != nil || now.Sub(exp.absent) < grace {
+			continue
+		}
+
+		exp.missing = exp.last
+		if exp.missing == nil {
+			exp.missing = exp.conf.entry()
+		}
+
+		slog.Warn("expected service missing",
+			"expect", exp.conf.Name,
+			"since", exp.absent.UTC().Format(time.RFC3339))
+		changes = append(changes, ServiceEntryChange{ID: newEventID(),
+			ChangeType: MISSING,
+			Timestamp:  now.UTC(),
+			Entry:      *exp.missing})
+	}
+
+	return changes
+}
+
+// run Checks for the expected services every EXPECT_CHECK_INTERVAL until
+// the process exits.
+func (em *expectMonitor) run() {
+	if em == nil {
+		return
+	}
+
+	ticker := time.NewTicker(EXPECT_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		for _, change := range em.check(now) {
+			em.changes <- change
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	DEFAULT_FORWARD_TIMEOUT uint = 10
+	// Seconds between sending the whole inventory to the aggregator.
+	DEFAULT_FORWARD_INVENTORY uint = 300
+)
+
+// forwardConfig describes a single [forward.<name>] block, which makes this
+// instance an agent of the aggregator at URL.
+type forwardConfig struct {
+	serviceFilter
+	scheduleConfig
+	// Events are posted to the aggregator's /events/batch in arrays of up
+	// to BatchSize events.
+	batchConfig
+	// Base URL of the aggregator, e.g. "https://central.example.com:9467".
+	URL string
+	// Name of this site at the aggregator, the [site] Name or the host
+	// name if not set.  The client certificate must name it too.
+	Site string
+	// CA certificate the aggregator's certificate is checked against, the
+	// system's CAs if not set.
+	CAFile string
+	// Client certificate and key presented to the aggregator.
+	CertFile string
+	KeyFile  string
+	// Seconds between sending the whole inventory, so that an aggregator
+	// which restarted catches up.
+	InventorySeconds uint
+	TimeoutSeconds   uint
+}
+
+// validForwardConfig Checks every [forward.<name>] block and fills in the
+// defaults.
+func validForwardConfig(fwdConfs map[string]forwardConfig, site string) error {
+	if len(fwdConfs) == 0 {
+		return errors.New("no [forward.<name>] blocks")
+	}
+
+	for name, fwdConf := range fwdConfs {
+		parsed, err := url.Parse(fwdConf.URL)
+		if err != nil || parsed.Scheme != "https" {
+			return fmt.Errorf("forward config: %q invalid URL %q, expected https://",
+				name, fwdConf.URL)
+		}
+
+		if fwdConf.CertFile == "" || fwdConf.KeyFile == "" {
+			return fmt.Errorf("forward config: %q needs a client CertFile and KeyFile", name)
+		}
+
+		if _, err := fwdConf.tlsConfig(); err != nil {
+			return fmt.Errorf("forward config: %q %s", name, err.Error())
+		}
+
+		if fwdConf.Site == "" {
+			fwdConf.Site = site
+		}
+
+		if fwdConf.Site == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return fmt.Errorf("forward config: %q no Site and %s", name, err.Error())
+			}
+			fwdConf.Site = hostname
+		}
+
+		if fwdConf.InventorySeconds == 0 {
+			fwdConf.InventorySeconds = DEFAULT_FORWARD_INVENTORY
+		}
+
+		if fwdConf.TimeoutSeconds == 0 {
+			fwdConf.TimeoutSeconds = DEFAULT_FORWARD_TIMEOUT
+		}
+
+		fwdConf.batchConfig.setup()
+
+		fwdConfs[name] = fwdConf
+	}
+
+	return nil
+}
+
+// tlsConfig Returns the TLS settings used to connect to the aggregator.
+func (fc *forwardConfig) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(fc.CertFile, fc.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("client certificate: %s", err.Error())
+	}
+
+	tlsConf := &tls.Config{Certificates: []tls.Certificate{cert},
+		MinVersion: tls.VersionTLS12}
+	if fc.CAFile != "" {
+		if tlsConf.RootCAs, err = loadCertPool(fc.CAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return tlsConf, nil
+}
+
+// forwardNotifier Sends every event to the aggregator of a single
+// [forward.<name>] block, which notifies on behalf of its agents.  The
+// whole inventory is sent every InventorySeconds from the registry, once the
+// notifier has been given it.
+type forwardNotifier struct {
+	name     string
+	conf     forwardConfig
+	client   *http.Client
+	registry *serviceRegistry
+	syncer   sync.Once
+	exit     chan bool
+}
+
+// newForwardNotifier Creates a notifier for the forward block called name.
+func newForwardNotifier(name string, conf forwardConfig) *forwardNotifier {
+	// The certificates have been checked by validForwardConfig.
+	tlsConf, _ := conf.tlsConfig()
+	return &forwardNotifier{name: "forward." + name,
+		conf: conf,
+		client: &http.Client{Timeout: time.Duration(conf.TimeoutSeconds) * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConf}},
+		exit: make(chan bool)}
+}
+
+func (fn *forwardNotifier) Name() string {
+	return fn.name
+}
+
+func (fn *forwardNotifier) Allows(change *ServiceEntryChange) (bool, string) {
+	return fn.conf.allowsChange(change)
+}
+
+// follow Starts sending the inventory in registry.
+func (fn *forwardNotifier) follow(registry *serviceRegistry) {
+	fn.syncer.Do(func() {
+		fn.registry = registry
+		go fn.syncInventory()
+	})
+}
+
+// inventory Returns the services in the registry which the block's
+// Services and ExcludeServices allow.
+func (fn *forwardNotifier) inventory() []zeroconf.ServiceEntry {
+	var entries []zeroconf.ServiceEntry
+	for _, entry := range fn.registry.snapshot() {
+		if allowed, _ := fn.conf.allows(entry.Service); allowed {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// url Returns the URL of an aggregator endpoint.
+func (fn *forwardNotifier) url(path string) string {
+	return strings.TrimSuffix(fn.conf.URL, "/") + path
+}
+
+// send Makes a request to the aggregator with a JSON body.
+func (fn *forwardNotifier) send(method string, path string, body []byte) error {
+	req, err := http.NewRequest(method, fn.url(path), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := fn.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("aggregator request failed: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// event Returns the change as it's sent to the aggregator, tagged with the
+// site.
+func (fn *forwardNotifier) event(change *ServiceEntryChange) ([]byte, error) {
+	forwarded := *change
+	forwarded.Site = fn.conf.Site
+	body, err := json.Marshal(forwarded)
+	if err != nil {
+		return nil, fmt.Errorf("marshal error: %s", err.Error())
+	}
+
+	return body, nil
+}
+
+func (fn *forwardNotifier) batch() batchConfig {
+	return fn.conf.batchConfig
+}
+
+// NotifyBatch Forwards several changes in a single request.
+func (fn *forwardNotifier) NotifyBatch(changes []ServiceEntryChange) error {
+	forwarded := make([]ServiceEntryChange, 0, len(changes))
+	for i := range changes {
+		change := changes[i]
+		change.Site = fn.conf.Site
+		forwarded = append(forwarded, change)
+	}
+
+	body, err := json.Marshal(forwarded)
+	if err != nil {
+		return fmt.Errorf("marshal error: %s", err.Error())
+	}
+
+	return fn.send(http.MethodPost, "/events/batch", body)
+}
+
+// Notify Forwards a change.
+func (fn *forwardNotifier) Notify(change *ServiceEntryChange) error {
+	body, err := fn.event(change)
+	if err != nil {
+		return err
+	}
+
+	return fn.send(http.MethodPost, "/events", body)
+}
+
+// Render Returns the request which would forward a change.
+func (fn *forwardNotifier) Render(change *ServiceEntryChange) (string, error) {
+	body, err := fn.event(change)
+	if err != nil {
+		return "", err
+	}
+
+	return "POST " + fn.url("/events") + "\n\n" + string(body), nil
+}
+
+// NotifyDigest Forwards the changes held back during quiet hours one at a
+// time, the aggregator has its own digests.
+func (fn *forwardNotifier) NotifyDigest(changes []ServiceEntryChange) error {
+	for i := range changes {
+		if err := fn.Notify(&changes[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RenderDigest Returns the requests which would forward a digest.
+func (fn *forwardNotifier) RenderDigest(changes []ServiceEntryChange) (string, error) {
+	var rendered []string
+	for i := range changes {
+		request, err := fn.Render(&changes[i])
+		if err != nil {
+			return "", err
+		}
+		rendered = append(rendered, request)
+	}
+
+	return strings.Join(rendered, "\n\n"), nil
+}
+
+// syncInventory Sends the whole inventory periodically.
+func (fn *forwardNotifier) syncInventory() {
+	path := "/sites/" + url.PathEscape(fn.conf.Site) + "/inventory"
+	for {
+		entries := fn.inventory()
+		jsonEntries := make([]serviceEntryJSON, 0, len(entries))
+		for i := range entries {
+			jsonEntries = append(jsonEntries, newServiceEntryJSON(&entries[i]))
+		}
+
+		body, err := json.Marshal(jsonEntries)
+		if err == nil {
+			err = fn.send(http.MethodPut, path, body)
+		}
+
+		if err != nil {
+			slog.Warn("failed to send inventory to aggregator",
+				"backend", fn.name,
+				"services", len(entries),
+				"err", err)
+		}
+
+		select {
+		case <-time.After(time.Duration(fn.conf.InventorySeconds) * time.Second):
+			break
+		case <-fn.exit:
+			return
+		}
+	}
+}
+
+// close Stops sending the inventory.
+func (fn *forwardNotifier) close() {
+	close(fn.exit)
+}
+
+// Check Asks the aggregator whether it's up, which also checks the
+// certificates.
+func (fn *forwardNotifier) Check() error {
+	resp, err := fn.client.Get(fn.url("/healthz"))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("aggregator health request failed: %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// A watcher which hasn't completed a browse for this many scan periods
+	// is considered to have hung.
+	HEALTH_STALE_PERIODS uint   = 3
+	HEALTH_OK            string = "ok"
+	HEALTH_DEGRADED      string = "degraded"
+	HEALTH_FAILING       string = "failing"
+)
+
+// watcherStatus Records the browses made by a watcher, for the health
+// endpoints.
+type watcherStatus struct {
+	mutex       sync.Mutex
+	running     bool
+	started     time.Time
+	lastBrowse  time.Time
+	lastError   string
+	lastErrorAt time.Time
+	// period is the scan period in effect, which may adapt to the network.
+	period time.Duration
+}
+
+// starting Records that the watcher has been (re)started, it's not ready
+// again until its first browse completes.
+func (ws *watcherStatus) starting() {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	ws.running = true
+	ws.started = time.Now().UTC()
+}
+
+// adapted Records the scan period now in effect.
+func (ws *watcherStatus) adapted(period time.Duration) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	ws.period = period
+}
+
+// stopping Records that the watcher has been stopped, e.g. because there are
+// no usable interfaces.
+func (ws *watcherStatus) stopping() {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	ws.running = false
+}
+
+// browsed Records the result of a browse.
+func (ws *watcherStatus) browsed(err error) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	if err != nil {
+		ws.lastError = err.Error()
+		ws.lastErrorAt = time.Now().UTC()
+		return
+	}
+
+	ws.lastBrowse = time.Now().UTC()
+}
+
+// backendStatus Records the results of deliveries to a backend, for the
+// health endpoints.
+type backendStatus struct {
+	mutex       sync.Mutex
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastError   string
+	failures    uint
+}
+
+// delivered Records the result of a delivery attempt, failures counts the
+// attempts which have failed since the last success.
+func (bs *backendStatus) delivered(err error) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	if err != nil {
+		bs.lastFailure = time.Now().UTC()
+		bs.lastError = err.Error()
+		bs.failures++
+		return
+	}
+
+	bs.lastSuccess = time.Now().UTC()
+	bs.failures = 0
+}
+
+// watcherHealth is the health of a single watcher as served by the API.
+type watcherHealth struct {
+	Service       string `json:"service"`
+	Domain        string `json:"domain"`
+	Unicast       bool   `json:"unicast"`
+	Running       bool   `json:"running"`
+	PeriodSeconds uint   `json:"periodSeconds"`
+	// EffectivePeriodSeconds is the period in effect, which differs from
+	// PeriodSeconds if it adapts to the network.
+	EffectivePeriodSeconds float64    `json:"effectivePeriodSeconds"`
+	LastBrowse             *time.Time `json:"lastBrowse,omitempty"`
+	LastError              string     `json:"lastError,omitempty"`
+	LastErrorAt            *time.Time `json:"lastErrorAt,omitempty"`
+	Ready                  bool       `json:"ready"`
+	Healthy                bool       `json:"healthy"`
+}
+
+// backendHealth is the health of a single backend and its delivery queue as
+// served by the API.
+type backendHealth struct {
+	Backend             string     `json:"backend"`
+	QueueLength         int        `json:"queueLength"`
+	QueueCapacity       int        `json:"queueCapacity"`
+	Held                int        `json:"held"`
+	LastSuccess         *time.Time `json:"lastSuccess,omitempty"`
+	LastFailure         *time.Time `json:"lastFailure,omitempty"`
+	LastError           string     `json:"lastError,omitempty"`
+	ConsecutiveFailures uint       `json:"consecutiveFailures"`
+	Healthy             bool       `json:"healthy"`
+}
+
+// healthReport is the body of the /healthz and /readyz responses.
+type healthReport struct {
+	Status        string          `json:"status"`
+	Ready         bool            `json:"ready"`
+	UptimeSeconds int64           `json:"uptimeSeconds"`
+	Watchers      []watcherHealth `json:"watchers"`
+	Backends      []backendHealth `json:"backends"`
+}
+
+// healthMonitor Reports on the watchers and delivery queues of a running
+// instance.
+type healthMonitor struct {
+	started  time.Time
+	watchers []*watcher
+	// queues are replaced by a reload.
+	mutex  sync.Mutex
+	queues []*deliveryQueue
+}
+
+// setQueues Replaces the delivery queues reported on.
+func (hm *healthMonitor) setQueues(queues []*deliveryQueue) {
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+
+	hm.queues = queues
+}
+
+// optionalTime Returns nil for the zero time, so it's left out of the JSON.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+// health Returns the health of a watcher at now.  A running watcher is
+// ready once it has completed a browse since it was started, and healthy
+// until it goes HEALTH_STALE_PERIODS scan periods without one, the longest
+// period if it adapts to the network.
+func (w *watcher) health(now time.Time) watcherHealth {
+	w.status.mutex.Lock()
+	defer w.status.mutex.Unlock()
+
+	wh := watcherHealth{Service: w.target.Service,
+		Domain:                 w.target.Domain,
+		Unicast:                w.target.unicast(),
+		Running:                w.status.running,
+		PeriodSeconds:          w.target.ScanPeriodSeconds,
+		EffectivePeriodSeconds: w.status.period.Seconds(),
+		LastBrowse:             optionalTime(w.status.lastBrowse),
+		LastError:              w.status.lastError,
+		LastErrorAt:            optionalTime(w.status.lastErrorAt),
+		Ready:                  true,
+		Healthy:                true}
+	if !w.status.running {
+		return wh
+	}
+
+	since := w.status.started
+	if w.status.lastBrowse.After(since) {
+		since = w.status.lastBrowse
+	} else {
+		wh.Ready = false
+	}
+
+	period := max(time.Duration(w.target.ScanPeriodSeconds)*time.Second, w.timing.maxPeriod)
+	stale := time.Duration(HEALTH_STALE_PERIODS) * period
+	wh.Healthy = now.Sub(since) <= stale
+	return wh
+}
+
+// health Returns the health of the queue's backend.  A backend is healthy
+// if its last delivery attempt succeeded and its queue isn't full.
+func (dq *deliveryQueue) health() backendHealth {
+	dq.heldMutex.Lock()
+	held := len(dq.held)
+	dq.heldMutex.Unlock()
+
+	dq.status.mutex.Lock()
+	defer dq.status.mutex.Unlock()
+
+	bh := backendHealth{Backend: dq.backend.Name(),
+		QueueLength:         len(dq.changes),
+		QueueCapacity:       cap(dq.changes),
+		Held:                held,
+		LastSuccess:         optionalTime(dq.status.lastSuccess),
+		LastFailure:         optionalTime(dq.status.lastFailure),
+		LastError:           dq.status.lastError,
+		ConsecutiveFailures: dq.status.failures}
+	bh.Healthy = bh.ConsecutiveFailures == 0 && bh.QueueLength < bh.QueueCapacity
+	return bh
+}
+
+// report Returns the health of every watcher and backend.  zcnotify is
+// failing if any watcher has stopped browsing, which restarting it may fix,
+// and degraded if any backend is failing, which it won't.
+func (hm *healthMonitor) report() healthReport {
+	now := time.Now().UTC()
+	report := healthReport{Status: HEALTH_OK,
+		Ready:         true,
+		UptimeSeconds: int64(now.Sub(hm.started).Seconds()),
+		Watchers:      []watcherHealth{},
+		Backends:      []backendHealth{}}
+	for _, w := range hm.watchers {
+		wh := w.health(now)
+		if !wh.Ready {
+			report.Ready = false
+		}
+		if !wh.Healthy {
+			report.Status = HEALTH_FAILING
+		}
+		report.Watchers = append(report.Watchers, wh)
+	}
+
+	hm.mutex.Lock()
+	queues := hm.queues
+	hm.mutex.Unlock()
+
+	for _, dq := range queues {
+		bh := dq.health()
+		if !bh.Healthy && report.Status == HEALTH_OK {
+			report.Status = HEALTH_DEGRADED
+		}
+		report.Backends = append(report.Backends, bh)
+	}
+
+	return report
+}
+
+// healthz Serves the liveness check, 503 if any watcher has stopped
+// browsing.
+func (as *apiServer) healthz(w http.ResponseWriter, r *http.Request) {
+	report := as.health.report()
+	status := http.StatusOK
+	if report.Status == HEALTH_FAILING {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSONStatus(w, status, report)
+}
+
+// readyz Serves the readiness check, 503 until every watcher has completed
+// its first browse.
+func (as *apiServer) readyz(w http.ResponseWriter, r *http.Request) {
+	report := as.health.report()
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSONStatus(w, status, report)
+}
+
+// fetchHealth Asks the instance serving the API for its health, or its
+// readiness if ready is set.  The report is returned along with whether the
+// check passed.
+func fetchHealth(client *apiClient, ready bool) (*healthReport, bool, error) {
+	path := "/healthz"
+	if ready {
+		path = "/readyz"
+	}
+
+	resp, err := client.get(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK &&
+		resp.StatusCode != http.StatusServiceUnavailable {
+		return nil, false, fmt.Errorf("API request failed: %s", resp.Status)
+	}
+
+	var report healthReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return nil, false, err
+	}
+
+	return &report, resp.StatusCode == http.StatusOK, nil
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	historyFileMode  = 0644
+	historyFileFlags = os.O_APPEND | os.O_CREATE | os.O_WRONLY
+
+	// How often the history is pruned of events older than MaxAgeDays.
+	HISTORY_PRUNE_INTERVAL time.Duration = time.Hour
+	// The history is pruned at most this often when it goes over MaxEvents
+	// or MaxSizeMB.
+	HISTORY_PRUNE_MIN_INTERVAL time.Duration = 10 * time.Second
+	// Percentage of MaxEvents and MaxSizeMB the history is pruned down to
+	// once it goes over either, so that it isn't rewritten on every event.
+	HISTORY_PRUNE_TARGET_PERCENT int64 = 90
+)
+
+// historyConfig controls where the event history is recorded and how much
+// of it is kept, a limit of 0 keeps everything.
+type historyConfig struct {
+	File string
+	// Events older than this are pruned.
+	MaxAgeDays uint
+	// Most events kept, the oldest are pruned first.
+	MaxEvents uint
+	// Largest size of the history file in megabytes.
+	MaxSizeMB uint
+}
+
+// historyLimits are the events kept by a prune.
+type historyLimits struct {
+	cutoff    time.Time
+	maxEvents int
+	maxBytes  int64
+}
+
+// limits Returns the limits of the config at now, with MaxEvents and
+// MaxSizeMB scaled to percent.
+func (hc *historyConfig) limits(now time.Time, percent int64) historyLimits {
+	var limits historyLimits
+	if hc.MaxAgeDays != 0 {
+		limits.cutoff = now.Add(-time.Duration(hc.MaxAgeDays) * 24 * time.Hour)
+	}
+	limits.maxEvents = int(int64(hc.MaxEvents) * percent / 100)
+	limits.maxBytes = int64(hc.MaxSizeMB) * 1024 * 1024 * percent / 100
+	return limits
+}
+
+// historyWriter Appends every change to the history file, one JSON object
+// per line, and prunes it to the configured limits in the background.
+type historyWriter struct {
+	mutex sync.Mutex
+	path  string
+	conf  historyConfig
+	// Events in the file, counted by the last prune.
+	events int
+	// over is signalled when the history goes over MaxEvents or
+	// MaxSizeMB.
+	over chan bool
+}
+
+func newHistoryWriter(conf historyConfig) *historyWriter {
+	return &historyWriter{path: conf.File, conf: conf, over: make(chan bool, 1)}
+}
+
+// append Records a single change, if no history file is configured this is
+// a no-op.  If the change takes the history over MaxEvents or MaxSizeMB run
+// is asked to prune it.
+func (hw *historyWriter) append(change *ServiceEntryChange) {
+	if hw == nil || hw.path == "" {
+		return
+	}
+
+	line, err := json.Marshal(change)
+	if err != nil {
+		slog.Error("history marshal error", "err", err)
+		return
+	}
+
+	hw.mutex.Lock()
+	defer hw.mutex.Unlock()
+
+	f, err := os.OpenFile(hw.path, historyFileFlags, historyFileMode)
+	if err != nil {
+		slog.Error("failed to open history file", "err", err)
+		return
+	}
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		slog.Error("failed to write history file", "err", err)
+	}
+	hw.events++
+
+	info, err := f.Stat()
+	f.Close()
+	if err != nil {
+		return
+	}
+
+	if (hw.conf.MaxEvents != 0 && hw.events > int(hw.conf.MaxEvents)) ||
+		(hw.conf.MaxSizeMB != 0 && info.Size() > int64(hw.conf.MaxSizeMB)*1024*1024) {
+		select {
+		case hw.over <- true:
+			break
+		default:
+			break
+		}
+	}
+}
+
+// prune Prunes the history to limits, returning the number of events kept
+// and removed and of the unreadable lines skipped.  The file is read and the
+// events kept written out without holding the mutex, which is only held to
+// copy the events appended meanwhile and replace the file.
+func (hw *historyWriter) prune(limits historyLimits) (int, int, int, error) {
+	hw.mutex.Lock()
+	info, err := os.Stat(hw.path)
+	hw.mutex.Unlock()
+	if os.IsNotExist(err) {
+		return 0, 0, 0, nil
+	} else if err != nil {
+		return 0, 0, 0, err
+	}
+
+	tmp := hw.path + ".tmp"
+	kept, removed, skipped, err := pruneHistory(hw.path, tmp, info.Size(), limits)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	hw.mutex.Lock()
+	defer hw.mutex.Unlock()
+
+	if removed != 0 || skipped != 0 {
+		appended, err := appendSince(hw.path, tmp, info.Size())
+		if err == nil {
+			err = os.Rename(tmp, hw.path)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return 0, 0, 0, err
+		}
+		kept += appended
+	}
+
+	hw.events = kept
+	return kept, removed, skipped, nil
+}
+
+// pruneAndLog Prunes the history to limits, logging what was done.
+func (hw *historyWriter) pruneAndLog(limits historyLimits) {
+	kept, removed, skipped, err := hw.prune(limits)
+	if err != nil {
+		slog.Error("failed to prune history file", "file", hw.path, "err", err)
+		return
+	}
+
+	if skipped != 0 {
+		slog.Warn("pruned unreadable lines from history file",
+			"file", hw.path,
+			"lines", skipped)
+	}
+
+	if removed != 0 {
+		slog.Info("pruned history", "file", hw.path, "removed", removed, "kept", kept)
+	}
+}
+
+// run Prunes the history at start up, every HISTORY_PRUNE_INTERVAL and when
+// append finds it over its limits, but at most every
+// HISTORY_PRUNE_MIN_INTERVAL.
+func (hw *historyWriter) run() {
+	if hw == nil || hw.path == "" {
+		return
+	}
+
+	ticker := time.NewTicker(HISTORY_PRUNE_INTERVAL)
+	defer ticker.Stop()
+	percent := int64(100)
+	for {
+		pruned := time.Now()
+		hw.pruneAndLog(hw.conf.limits(pruned, percent))
+
+		select {
+		case <-ticker.C:
+			percent = 100
+			break
+		case <-hw.over:
+			percent = HISTORY_PRUNE_TARGET_PERCENT
+			time.Sleep(HISTORY_PRUNE_MIN_INTERVAL - time.Since(pruned))
+			break
+		}
+	}
+}
+
+// read Returns every change recorded in the history file, oldest first, none
+// if nothing has been recorded yet.  The mutex is only held to open the file
+// and take its size, the events up to that size are read without it so that
+// appends aren't held up, and a prune replacing the file meanwhile leaves
+// the one opened as it was.
+func (hw *historyWriter) read() ([]ServiceEntryChange, error) {
+	hw.mutex.Lock()
+	f, err := os.Open(hw.path)
+	var info os.FileInfo
+	if err == nil {
+		if info, err = f.Stat(); err != nil {
+			f.Close()
+		}
+	}
+	hw.mutex.Unlock()
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return decodeHistory(io.LimitReader(f, info.Size()))
+}
+
+// pruneHistory Writes the first size bytes of the history file at path to
+// tmp without the events recorded before the cutoff, then the oldest until it
+// holds at most maxEvents events and maxBytes bytes.  Lines which can't be
+// read are skipped while looking for the cutoff.  tmp is only written if
+// events were removed or lines skipped.  It returns the number of events
+// kept and removed, and of the lines skipped.
+func pruneHistory(path string, tmp string, size int64, limits historyLimits) (int, int, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(f, size))
+	f.Close()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+
+	first := 0
+	skipped := 0
+	if !limits.cutoff.IsZero() {
+		for ; first < len(lines); first++ {
+			var recorded struct {
+				Timestamp time.Time `json:"timestamp"`
+			}
+			if err := json.Unmarshal(lines[first], &recorded); err != nil {
+				skipped++
+				continue
+			}
+
+			if !recorded.Timestamp.Before(limits.cutoff) {
+				break
+			}
+		}
+	}
+
+	if limits.maxEvents != 0 && len(lines)-first > limits.maxEvents {
+		first = len(lines) - limits.maxEvents
+	}
+
+	kept := int64(0)
+	for _, line := range lines[first:] {
+		kept += int64(len(line))
+	}
+	for limits.maxBytes != 0 && kept > limits.maxBytes && first < len(lines) {
+		kept -= int64(len(lines[first]))
+		first++
+	}
+
+	if first == 0 {
+		return len(lines), 0, 0, nil
+	}
+
+	if err := os.WriteFile(tmp, bytes.Join(lines[first:], nil), historyFileMode); err != nil {
+		return 0, 0, 0, err
+	}
+
+	return len(lines) - first, first - skipped, skipped, nil
+}
+
+// appendSince Appends what was written to the history file at path after
+// its first size bytes to tmp, returning the number of events.
+func appendSince(path string, tmp string, size int64) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	rest, err := io.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+
+	out, err := os.OpenFile(tmp, historyFileFlags, historyFileMode)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := out.Write(rest); err != nil {
+		out.Close()
+		return 0, err
+	}
+
+	return bytes.Count(rest, []byte("\n")), out.Close()
+}
+
+// readHistory Returns every change recorded in the history file, oldest
+// first.
+func readHistory(path string) ([]ServiceEntryChange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return decodeHistory(f)
+}
+
+// decodeHistory Returns the changes in a history, one JSON object per line.
+func decodeHistory(r io.Reader) ([]ServiceEntryChange, error) {
+	var changes []ServiceEntryChange
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var change ServiceEntryChange
+		if err := json.Unmarshal(scanner.Bytes(), &change); err != nil {
+			return nil, err
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes, scanner.Err()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+const OUTPUT_PARQUET string = "parquet"
+
+// historyRecord is a flattened history event, a row of the CSV and Parquet
+// exports.  Lists are separated by ';'.
+type historyRecord struct {
+	ID               string     `parquet:"id"`
+	Timestamp        time.Time  `parquet:"timestamp,timestamp(millisecond)"`
+	ChangeType       string     `parquet:"change_type"`
+	Instance         string     `parquet:"instance"`
+	Service          string     `parquet:"service"`
+	Domain           string     `parquet:"domain"`
+	HostName         string     `parquet:"hostname"`
+	Port             int32      `parquet:"port"`
+	AddrIPv4         string     `parquet:"addr_ipv4"`
+	AddrIPv6         string     `parquet:"addr_ipv6"`
+	Text             string     `parquet:"text"`
+	TTL              int64      `parquet:"ttl"`
+	Interface        string     `parquet:"interface"`
+	Severity         string     `parquet:"severity"`
+	Category         string     `parquet:"category"`
+	Networks         string     `parquet:"networks"`
+	Site             string     `parquet:"site"`
+	Location         string     `parquet:"location"`
+	UnknownDevice    bool       `parquet:"unknown_device"`
+	PreviousInstance string     `parquet:"previous_instance"`
+	FirstSeen        *time.Time `parquet:"first_seen,optional,timestamp(millisecond)"`
+	LastSeen         *time.Time `parquet:"last_seen,optional,timestamp(millisecond)"`
+	Error            string     `parquet:"error"`
+}
+
+var historyCSVHeader = []string{"id",
+	"timestamp",
+	"change_type",
+	"instance",
+	"service",
+	"domain",
+	"hostname",
+	"port",
+	"addr_ipv4",
+	"addr_ipv6",
+	"text",
+	"ttl",
+	"interface",
+	"severity",
+	"category",
+	"networks",
+	"site",
+	"location",
+	"unknown_device",
+	"previous_instance",
+	"first_seen",
+	"last_seen",
+	"error"}
+
+func newHistoryRecord(change *ServiceEntryChange) historyRecord {
+	entry := newEntryRecord(&change.Entry)
+	record := historyRecord{ID: change.ID,
+		Timestamp:     change.Timestamp.UTC(),
+		ChangeType:    change.ChangeType.String(),
+		Instance:      entry.Instance,
+		Service:       entry.Service,
+		Domain:        entry.Domain,
+		HostName:      entry.HostName,
+		Port:          int32(entry.Port),
+		AddrIPv4:      strings.Join(entry.AddrIPv4, ";"),
+		AddrIPv6:      strings.Join(entry.AddrIPv6, ";"),
+		Text:          strings.Join(entry.Text, ";"),
+		TTL:           int64(entry.TTL),
+		Interface:     change.Interface,
+		Severity:      change.Severity.String(),
+		Category:      change.Category,
+		Networks:      strings.Join(change.Networks, ";"),
+		Site:          change.Site,
+		Location:      change.Location,
+		UnknownDevice: change.UnknownDevice,
+		FirstSeen:     change.FirstSeen,
+		LastSeen:      change.LastSeen,
+		Error:         change.Error}
+	if change.Previous != nil {
+		record.PreviousInstance = change.Previous.Instance
+	}
+
+	return record
+}
+
+// csvRow Returns the record as a CSV row, times are RFC 3339 in UTC.
+func (hr *historyRecord) csvRow() []string {
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+
+	return []string{hr.ID,
+		formatTime(&hr.Timestamp),
+		hr.ChangeType,
+		hr.Instance,
+		hr.Service,
+		hr.Domain,
+		hr.HostName,
+		strconv.Itoa(int(hr.Port)),
+		hr.AddrIPv4,
+		hr.AddrIPv6,
+		hr.Text,
+		strconv.FormatInt(hr.TTL, 10),
+		hr.Interface,
+		hr.Severity,
+		hr.Category,
+		hr.Networks,
+		hr.Site,
+		hr.Location,
+		strconv.FormatBool(hr.UnknownDevice),
+		hr.PreviousInstance,
+		formatTime(hr.FirstSeen),
+		formatTime(hr.LastSeen),
+		hr.Error}
+}
+
+// writeHistoryRecords Writes history events as CSV or Parquet.
+func writeHistoryRecords(w io.Writer, changes []ServiceEntryChange, format string) error {
+	records := make([]historyRecord, 0, len(changes))
+	for i := range changes {
+		records = append(records, newHistoryRecord(&changes[i]))
+	}
+
+	switch format {
+	case OUTPUT_CSV:
+		cw := csv.NewWriter(w)
+		cw.Write(historyCSVHeader)
+		for i := range records {
+			cw.Write(records[i].csvRow())
+		}
+		cw.Flush()
+		return cw.Error()
+	case OUTPUT_PARQUET:
+		pw := parquet.NewGenericWriter[historyRecord](w)
+		if _, err := pw.Write(records); err != nil {
+			return err
+		}
+		return pw.Close()
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// historyExportCommand Writes the events recorded between two times as CSV
+// or Parquet, for loading into pandas, DuckDB or a spreadsheet.
+func historyExportCommand(name string, args []string) int {
+	fs := newFlagSet(name, "")
+	common := addCommonFlags(fs)
+	format := fs.String("format", OUTPUT_CSV, "Output format (csv, parquet)")
+	from := fs.String("from", "",
+		"Export the events recorded since this time (RFC 3339, a date, or a period before now such as 30d), all if empty")
+	to := fs.String("to", "", "Only export the events recorded before this time")
+	types := fs.String("type", "", "Comma separated change types to export, all if empty")
+	output := fs.String("o", "", "File to write, defaults to stdout")
+	fs.Parse(args)
+
+	if *format != OUTPUT_CSV && *format != OUTPUT_PARQUET {
+		fatal("unknown export format, use csv or parquet", "format", *format)
+	}
+
+	now := time.Now()
+	var since, until time.Time
+	var err error
+	if *from != "" {
+		if since, err = parseHistoryTime(*from, now); err != nil {
+			fatal(err.Error())
+		}
+	}
+
+	if *to != "" {
+		if until, err = parseHistoryTime(*to, now); err != nil {
+			fatal(err.Error())
+		}
+	}
+
+	var changeTypes []string
+	if *types != "" {
+		changeTypes = strings.Split(*types, ",")
+		for _, changeType := range changeTypes {
+			if _, err := parseServiceChangeType(changeType); err != nil {
+				fatal("invalid change type", "err", err)
+			}
+		}
+	}
+
+	zcnConfig, err := common.setup()
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	if zcnConfig.History.File == "" {
+		fatal("no history file configured")
+	}
+
+	changes, err := readHistory(zcnConfig.History.File)
+	if err != nil {
+		fatal("failed to read history", "err", err)
+	}
+
+	var selected []ServiceEntryChange
+	for _, change := range historyBetween(changes, since, until) {
+		if len(changeTypes) == 0 || matchChangeType(changeTypes, change.ChangeType) {
+			selected = append(selected, change)
+		}
+	}
+
+	if *output == "" {
+		if err := writeHistoryRecords(os.Stdout, selected, *format); err != nil {
+			fatal("failed to write history", "err", err)
+		}
+		return 0
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		fatal("failed to create file", "err", err)
+	}
+
+	if err := writeHistoryRecords(f, selected, *format); err != nil {
+		f.Close()
+		fatal("failed to write file", "err", err)
+	}
+
+	if err := f.Close(); err != nil {
+		fatal("failed to write file", "err", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "exported %d events to %s\n", len(selected), *output)
+	return 0
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	DEFAULT_IDENTITY_TIMEOUT       uint = 5
+	DEFAULT_IDENTITY_CACHE_SECONDS uint = 3600
+	// How long the pipeline waits for a lookup before carrying on without
+	// the identity, which later events of the host are given once it's in.
+	IDENTITY_WAIT time.Duration = 250 * time.Millisecond
+	// Failed lookups are retried after this long rather than CacheSeconds.
+	IDENTITY_FAILURE_CACHE time.Duration = time.Minute
+)
+
+// identityConfig describes a single [[identity]] resolver.
+type identityConfig struct {
+	Name string
+	// Type selects the resolver implementation, see identityResolverTypes.
+	Type string
+	// URL is a Go template expanded with identityLookup, e.g.
+	// "https://jamf.example.com/JSSResource/computers/name/{{.Host}}".
+	URL string
+	// Token is sent as a bearer token, Headers are sent verbatim.  Token may
+	// instead be read from TokenFile.
+	Token     string
+	TokenFile string
+	Headers   map[string]string
+	// Dotted paths into the JSON response of the owner, device name and
+	// any additional fields to copy into the identity.
+	OwnerField  string
+	DeviceField string
+	ExtraFields map[string]string
+	// Seconds to wait for the inventory API and to cache its answers for.
+	TimeoutSeconds uint
+	CacheSeconds   uint
+}
+
+// deviceIdentity is the external identity of a discovered device, as
+// reported by a device inventory.
+type deviceIdentity struct {
+	Source string            `json:"source"`
+	Owner  string            `json:"owner,omitempty"`
+	Device string            `json:"device,omitempty"`
+	Extra  map[string]string `json:"extra,omitempty"`
+}
+
+// identityLookup is passed to resolver URL templates, with each field
+// escaped to go in a URL path.
+type identityLookup struct {
+	// Host is the entry's host name without the trailing ".local.".
+	Host     string
+	HostName string
+	Instance string
+	Service  string
+}
+
+func newIdentityLookup(change *ServiceEntryChange) identityLookup {
+	host := strings.TrimSuffix(change.Entry.HostName, ".")
+	host = strings.TrimSuffix(host, ".local")
+	return identityLookup{Host: host,
+		HostName: change.Entry.HostName,
+		Instance: change.Entry.Instance,
+		Service:  change.Entry.Service}
+}
+
+// identityResolver maps a discovered device to an external identity.
+// Implementations return a nil identity if the device is unknown.
+type identityResolver interface {
+	Name() string
+	Resolve(lookup *identityLookup) (*deviceIdentity, error)
+}
+
+// identityResolverTypes Creates a resolver for each supported Type, further
+// inventories are added by registering a constructor here.
+var identityResolverTypes = map[string]func(conf identityConfig) (identityResolver, error){
+	"http": newHTTPIdentityResolver,
+}
+
+// httpIdentityResolver Queries a JSON device inventory API such as Jamf,
+// Intune (Microsoft Graph) or Google Workspace.
+type httpIdentityResolver struct {
+	conf   identityConfig
+	url    *template.Template
+	client http.Client
+}
+
+func newHTTPIdentityResolver(conf identityConfig) (identityResolver, error) {
+	if conf.URL == "" {
+		return nil, fmt.Errorf("identity %q: no URL specified", conf.Name)
+	}
+
+	url, err := template.New(conf.Name).Parse(conf.URL)
+	if err != nil {
+		return nil, fmt.Errorf("identity %q: invalid URL template: %s",
+			conf.Name, err.Error())
+	}
+
+	return &httpIdentityResolver{conf: conf,
+		url: url,
+		client: http.Client{
+			Timeout: time.Duration(conf.TimeoutSeconds) * time.Second}}, nil
+}
+
+func (hir *httpIdentityResolver) Name() string {
+	return hir.conf.Name
+}
+
+func (hir *httpIdentityResolver) Resolve(lookup *identityLookup) (*deviceIdentity, error) {
+	escaped := identityLookup{Host: url.PathEscape(lookup.Host),
+		HostName: url.PathEscape(lookup.HostName),
+		Instance: url.PathEscape(lookup.Instance),
+		Service:  url.PathEscape(lookup.Service)}
+	var link bytes.Buffer
+	if err := hir.url.Execute(&link, &escaped); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, link.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if hir.conf.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+hir.conf.Token)
+	}
+
+	for name, value := range hir.conf.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := hir.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("inventory request failed: %s", resp.Status)
+	}
+
+	var body any
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	identity := &deviceIdentity{Source: hir.conf.Name,
+		Owner:  jsonField(body, hir.conf.OwnerField),
+		Device: jsonField(body, hir.conf.DeviceField)}
+	for name, path := range hir.conf.ExtraFields {
+		if value := jsonField(body, path); value != "" {
+			if identity.Extra == nil {
+				identity.Extra = make(map[string]string)
+			}
+			identity.Extra[name] = value
+		}
+	}
+
+	if identity.Owner == "" && identity.Device == "" && identity.Extra == nil {
+		return nil, nil
+	}
+
+	return identity, nil
+}
+
+// jsonField Returns the value at a dotted path (e.g. "value.0.userPrincipalName")
+// of a decoded JSON document as a string, or "" if it doesn't exist.
+func jsonField(doc any, path string) string {
+	if path == "" {
+		return ""
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		switch v := doc.(type) {
+		case map[string]any:
+			doc = v[key]
+		case []any:
+			var index int
+			if _, err := fmt.Sscanf(key, "%d", &index); err != nil ||
+				index < 0 || index >= len(v) {
+				return ""
+			}
+			doc = v[index]
+		default:
+			return ""
+		}
+	}
+
+	switch v := doc.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// cachedIdentity is a resolver answer, which may be nil, and its expiry.
+type cachedIdentity struct {
+	identity *deviceIdentity
+	expires  time.Time
+}
+
+// identityResolvers Tries each configured resolver in turn and caches the
+// answers by host name so that inventories aren't queried for every event.
+// Lookups run off the pipeline, a host is only looked up once at a time.
+type identityResolvers struct {
+	resolvers []identityResolver
+	cacheTime time.Duration
+	mutex     sync.Mutex
+	cache     map[string]cachedIdentity
+	// pending holds the lookups in progress by host name, each channel is
+	// closed once its answer is cached.
+	pending map[string]chan bool
+}
+
+// newIdentityResolvers Creates the resolvers described by the [[identity]]
+// sections of the config file.
+func newIdentityResolvers(confs []identityConfig) (*identityResolvers, error) {
+	ir := &identityResolvers{cache: make(map[string]cachedIdentity),
+		pending: make(map[string]chan bool)}
+	for _, conf := range confs {
+		newResolver, ok := identityResolverTypes[strings.ToLower(conf.Type)]
+		if !ok {
+			return nil, fmt.Errorf("identity %q: unknown type %q",
+				conf.Name, conf.Type)
+		}
+
+		resolver, err := newResolver(conf)
+		if err != nil {
+			return nil, err
+		}
+
+		ir.resolvers = append(ir.resolvers, resolver)
+		cacheTime := time.Duration(conf.CacheSeconds) * time.Second
+		if ir.cacheTime == 0 || cacheTime < ir.cacheTime {
+			ir.cacheTime = cacheTime
+		}
+	}
+
+	return ir, nil
+}
+
+// resolve Attaches the identity of the changed device, if any resolver
+// knows it.  A host which isn't cached is looked up in the background and
+// waited for for at most IDENTITY_WAIT.
+func (ir *identityResolvers) resolve(change *ServiceEntryChange) {
+	if ir == nil || len(ir.resolvers) == 0 || change.Entry.HostName == "" {
+		return
+	}
+
+	lookup := newIdentityLookup(change)
+
+	ir.mutex.Lock()
+	cached, ok := ir.cache[lookup.HostName]
+	if ok && time.Now().Before(cached.expires) {
+		ir.mutex.Unlock()
+		change.Identity = cached.identity
+		if cached.identity != nil {
+			change.Trace.add("identity", "", TRACE_ACCEPTED,
+				fmt.Sprintf("owner %q from %s (cached)",
+					cached.identity.Owner, cached.identity.Source))
+		}
+		return
+	}
+
+	done, ok := ir.pending[lookup.HostName]
+	if !ok {
+		done = make(chan bool)
+		ir.pending[lookup.HostName] = done
+		go ir.lookup(lookup, done)
+	}
+	ir.mutex.Unlock()
+
+	select {
+	case <-done:
+		break
+	case <-time.After(IDENTITY_WAIT):
+		slog.Debug("identity lookup still in progress", changeAttrs(change))
+		return
+	}
+
+	ir.mutex.Lock()
+	identity := ir.cache[lookup.HostName].identity
+	ir.mutex.Unlock()
+	change.Identity = identity
+	if identity != nil {
+		change.Trace.add("identity", "", TRACE_ACCEPTED,
+			fmt.Sprintf("owner %q from %s", identity.Owner, identity.Source))
+	}
+}
+
+// lookup Asks each resolver about the host of lookup in turn and caches the
+// answer, closing done once it has.  If every resolver failed the lack of
+// an answer is only cached for IDENTITY_FAILURE_CACHE.
+func (ir *identityResolvers) lookup(lookup identityLookup, done chan bool) {
+	var identity *deviceIdentity
+	failed := 0
+	for _, resolver := range ir.resolvers {
+		var err error
+		identity, err = resolver.Resolve(&lookup)
+		if err != nil {
+			slog.Warn("identity lookup failed",
+				"host", lookup.HostName,
+				"resolver", resolver.Name(),
+				"err", err)
+			failed++
+			continue
+		}
+
+		if identity != nil {
+			break
+		}
+	}
+
+	cacheTime := ir.cacheTime
+	if failed == len(ir.resolvers) && cacheTime > IDENTITY_FAILURE_CACHE {
+		cacheTime = IDENTITY_FAILURE_CACHE
+	}
+
+	ir.mutex.Lock()
+	ir.cache[lookup.HostName] = cachedIdentity{identity: identity,
+		expires: time.Now().Add(cacheTime)}
+	delete(ir.pending, lookup.HostName)
+	ir.mutex.Unlock()
+	close(done)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	DEFAULT_INTERFACE_RESCAN uint = 30
+	// Time to wait after an interface change before acting on it.
+	INTERFACE_SETTLE_TIME = time.Second
+)
+
+// interfaceMatches Returns true if the interface name matches any of the
+// glob patterns, a leading "!" on a pattern is ignored.
+func interfaceMatches(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.TrimPrefix(pattern, "!"), name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// usableInterface Returns an empty string if intf can be used for multicast
+// discovery, otherwise the reason it can't.
+func usableInterface(intf *net.Interface) string {
+	if intf.Flags&net.FlagUp == 0 {
+		return "down"
+	}
+
+	if intf.Flags&net.FlagLoopback != 0 {
+		return "loopback"
+	}
+
+	if intf.Flags&net.FlagMulticast == 0 {
+		return "no multicast"
+	}
+
+	return ""
+}
+
+// selectInterfaces Returns the interfaces of all which match the [interfaces]
+// section.  Use and Exclude are glob patterns, patterns in Use starting with
+// "!" exclude interfaces, and interfaces which are down, loopback or lack
+// multicast are skipped.  Names which match nothing are logged rather than
+// being fatal, as the interface may appear later.
+func selectInterfaces(intfConf interfaceConfig, all []net.Interface) []net.Interface {
+	var use []string
+	exclude := intfConf.Exclude
+	for _, pattern := range intfConf.Use {
+		if strings.HasPrefix(pattern, "!") {
+			exclude = append(exclude, pattern)
+		} else {
+			use = append(use, pattern)
+		}
+	}
+
+	if len(use) == 0 {
+		slog.Info("no interfaces specified, assuming all",
+			"interfaces", interfaceNames(all))
+	}
+
+	for _, pattern := range append(use, exclude...) {
+		found := false
+		for _, intf := range all {
+			if interfaceMatches([]string{pattern}, intf.Name) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			slog.Warn("no interface matches", "pattern", pattern)
+		}
+	}
+
+	var intfs []net.Interface
+	for _, intf := range all {
+		if len(use) != 0 && !interfaceMatches(use, intf.Name) {
+			continue
+		}
+
+		if interfaceMatches(exclude, intf.Name) {
+			slog.Debug("excluding interface", "interface", intf.Name)
+			continue
+		}
+
+		if reason := usableInterface(&intf); reason != "" {
+			slog.Info("skipping interface", "interface", intf.Name, "reason", reason)
+			continue
+		}
+
+		intfs = append(intfs, intf)
+	}
+
+	return intfs
+}
+
+// interfaceSignature Returns a description of the interfaces which changes
+// whenever an interface is added, removed, goes up or down or changes
+// address.
+func interfaceSignature(intfs []net.Interface) string {
+	var parts []string
+	for _, intf := range intfs {
+		var addrs []string
+		if ifAddrs, err := intf.Addrs(); err == nil {
+			for _, addr := range ifAddrs {
+				addrs = append(addrs, addr.String())
+			}
+		}
+		sort.Strings(addrs)
+		parts = append(parts, fmt.Sprintf("%s/%d/%s/%s", intf.Name, intf.Index,
+			intf.Flags, strings.Join(addrs, ",")))
+	}
+	sort.Strings(parts)
+
+	return strings.Join(parts, " ")
+}
+
+// pollInterfaceEvents Returns a channel which is signalled every period, for
+// platforms without interface change notifications.
+func pollInterfaceEvents(period time.Duration) <-chan bool {
+	events := make(chan bool, 1)
+	go func() {
+		for range time.Tick(period) {
+			select {
+			case events <- true:
+			default:
+			}
+		}
+	}()
+
+	return events
+}
+
+// monitorInterfaces Sends the new list of discovery interfaces to changes
+// whenever interfaces appear, disappear or change address.  current is the
+// list in use when monitoring starts.
+func monitorInterfaces(intfConf interfaceConfig,
+	current []net.Interface,
+	changes chan<- []net.Interface) {
+	rescan := time.Duration(intfConf.RescanSeconds) * time.Second
+	signature := interfaceSignature(current)
+	for range interfaceEvents(rescan) {
+		// Changes tend to arrive in bursts, e.g. a link coming up followed
+		// by its addresses, so wait for things to settle.
+		time.Sleep(INTERFACE_SETTLE_TIME)
+
+		all, err := net.Interfaces()
+		if err != nil {
+			slog.Warn("cannot retrieve system interfaces", "err", err)
+			continue
+		}
+
+		intfs := selectInterfaces(intfConf, all)
+		if newSignature := interfaceSignature(intfs); newSignature != signature {
+			signature = newSignature
+			changes <- intfs
+		}
+	}
+}
+
+// entryInterface Returns the name of the local interface whose network
+// contains one of the entry's addresses, which is the segment the device was
+// seen on.  IPv6 link-local addresses are ignored as every interface has
+// that network.  An empty string is returned if no interface matches.
+func entryInterface(entry *zeroconf.ServiceEntry) string {
+	intfs, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+
+	for _, ip := range append(append([]net.IP(nil), entry.AddrIPv4...),
+		entry.AddrIPv6...) {
+		if ip.IsLinkLocalUnicast() && ip.To4() == nil {
+			continue
+		}
+
+		for _, intf := range intfs {
+			addrs, err := intf.Addrs()
+			if err != nil {
+				continue
+			}
+
+			for _, addr := range addrs {
+				if ipNet, ok := addr.(*net.IPNet); ok && ipNet.Contains(ip) {
+					return intf.Name
+				}
+			}
+		}
+	}
+
+	return ""
+}
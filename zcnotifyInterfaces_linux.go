@@ -0,0 +1,64 @@
+//go:build linux
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Multicast groups of the netlink route socket, from linux/rtnetlink.h.
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv6IfAddr = 0x100
+)
+
+// interfaceEvents Returns a channel which is signalled whenever a link or
+// address changes, using a netlink route socket.  If netlink can't be used
+// interfaces are polled every rescan instead.
+func interfaceEvents(rescan time.Duration) <-chan bool {
+	fd, err := syscall.Socket(syscall.AF_NETLINK,
+		syscall.SOCK_RAW|syscall.SOCK_CLOEXEC,
+		syscall.NETLINK_ROUTE)
+	if err != nil {
+		slog.Warn("cannot open netlink socket, polling interfaces", "err", err)
+		return pollInterfaceEvents(rescan)
+	}
+
+	addr := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		slog.Warn("cannot bind netlink socket, polling interfaces", "err", err)
+		return pollInterfaceEvents(rescan)
+	}
+
+	events := make(chan bool, 1)
+	go func() {
+		defer syscall.Close(fd)
+
+		// The messages aren't parsed, any of them means the interfaces
+		// should be enumerated again.  ENOBUFS means messages were lost,
+		// which is fine for the same reason.
+		buf := make([]byte, os.Getpagesize())
+		for {
+			_, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err != nil && err != syscall.EINTR && err != syscall.ENOBUFS {
+				slog.Warn("netlink receive failed, polling interfaces", "err", err)
+				for range pollInterfaceEvents(rescan) {
+					events <- true
+				}
+			}
+
+			select {
+			case events <- true:
+			default:
+			}
+		}
+	}()
+
+	return events
+}
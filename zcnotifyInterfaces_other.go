@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "time"
+
+// interfaceEvents Returns a channel which is signalled every rescan, there
+// are no interface change notifications on this platform.
+func interfaceEvents(rescan time.Duration) <-chan bool {
+	return pollInterfaceEvents(rescan)
+}
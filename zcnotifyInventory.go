@@ -0,0 +1,351 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const DEFAULT_INVENTORY_SNAPSHOT string = "zcnotify.snapshot"
+
+// inventoryReportConfig describes the [inventoryReport] section, a report of
+// how the known services differ from a snapshot taken at the previous
+// report.
+type inventoryReportConfig struct {
+	// Times reports are sent, e.g. "08:00" daily or "Mon 08:00" weekly.
+	At []string
+	// Time zone of At, e.g. "Europe/Dublin", local time if empty.
+	Timezone string
+	// Services known at the last report, in the format of "zcnotify
+	// export".
+	SnapshotFile string
+	// Backends the report is sent to, e.g. "email.pdmorrow", all if empty.
+	Notify []string
+}
+
+// reportTime is a single parsed At time, minute is minutes after midnight.
+type reportTime struct {
+	days   [7]bool
+	minute int
+}
+
+// parseReportTime Parses "[days] HH:MM".
+func parseReportTime(spec string) (reportTime, error) {
+	at := reportTime{days: [7]bool{true, true, true, true, true, true, true}}
+	fields := strings.Fields(spec)
+	if len(fields) == 2 {
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return at, err
+		}
+
+		at.days = days
+		fields = fields[1:]
+	}
+
+	if len(fields) != 1 {
+		return at, errors.New("expected [days] HH:MM")
+	}
+
+	minute, err := parseClock(fields[0])
+	if err != nil {
+		return at, err
+	} else if minute == 24*60 {
+		return at, errors.New("expected a time before 24:00")
+	}
+
+	at.minute = minute
+	return at, nil
+}
+
+// setupInventoryReport Validates the [inventoryReport] section and fills in
+// its defaults.
+func (zcnConfig *config) setupInventoryReport() error {
+	report := &zcnConfig.InventoryReport
+	if len(report.At) == 0 {
+		return nil
+	}
+
+	for _, spec := range report.At {
+		if _, err := parseReportTime(spec); err != nil {
+			return fmt.Errorf("inventoryReport: At %q: %s", spec, err.Error())
+		}
+	}
+
+	if report.Timezone != "" {
+		if _, err := time.LoadLocation(report.Timezone); err != nil {
+			return fmt.Errorf("inventoryReport: Timezone: %s", err.Error())
+		}
+	}
+
+	if report.SnapshotFile == "" {
+		report.SnapshotFile = DEFAULT_INVENTORY_SNAPSHOT
+	}
+
+	backends, err := zcnConfig.backendNames()
+	if err != nil {
+		return err
+	}
+
+	for _, backend := range report.Notify {
+		if !backends[backend] {
+			return fmt.Errorf("inventoryReport: unknown backend %q in Notify", backend)
+		}
+	}
+
+	return nil
+}
+
+// inventoryReporter Sends the inventory report at the configured times.
+type inventoryReporter struct {
+	conf     inventoryReportConfig
+	times    []reportTime
+	location *time.Location
+	modify   *modifyConfig
+	registry *serviceRegistry
+	queues   []*deliveryQueue
+	// exit is closed when a reload replaces the reporter.
+	exit chan bool
+}
+
+// newInventoryReporter Creates the reporter, the config has already been
+// validated by loadConfig.
+func newInventoryReporter(zcnConfig *config,
+	registry *serviceRegistry,
+	queues []*deliveryQueue) *inventoryReporter {
+	ir := &inventoryReporter{conf: zcnConfig.InventoryReport,
+		location: time.Local,
+		modify:   &zcnConfig.Modify,
+		registry: registry,
+		exit:     make(chan bool)}
+	for _, spec := range ir.conf.At {
+		at, _ := parseReportTime(spec)
+		ir.times = append(ir.times, at)
+	}
+
+	if ir.conf.Timezone != "" {
+		ir.location, _ = time.LoadLocation(ir.conf.Timezone)
+	}
+
+	for _, queue := range queues {
+		if len(ir.conf.Notify) == 0 {
+			ir.queues = append(ir.queues, queue)
+			continue
+		}
+
+		for _, name := range ir.conf.Notify {
+			if name == queue.route {
+				ir.queues = append(ir.queues, queue)
+				break
+			}
+		}
+	}
+
+	return ir
+}
+
+// next Returns the first report time after now.
+func (ir *inventoryReporter) next(now time.Time) time.Time {
+	now = now.In(ir.location)
+	var next time.Time
+	for day := 0; day <= 7; day++ {
+		date := now.AddDate(0, 0, day)
+		for _, at := range ir.times {
+			candidate := time.Date(date.Year(), date.Month(), date.Day(),
+				at.minute/60, at.minute%60, 0, 0, ir.location)
+			if at.days[candidate.Weekday()] && candidate.After(now) &&
+				(next.IsZero() || candidate.Before(next)) {
+				next = candidate
+			}
+		}
+
+		if !next.IsZero() {
+			break
+		}
+	}
+
+	return next
+}
+
+// run Sends a report at every configured time until the reporter is
+// stopped.
+func (ir *inventoryReporter) run() {
+	for {
+		next := ir.next(time.Now())
+		slog.Debug("next inventory report", "at", next)
+		select {
+		case <-time.After(time.Until(next)):
+			ir.report()
+			break
+		case <-ir.exit:
+			return
+		}
+	}
+}
+
+// stop Stops sending reports.
+func (ir *inventoryReporter) stop() {
+	if ir != nil {
+		close(ir.exit)
+	}
+}
+
+// inventoryDiff Returns the changes which turn previous into current: an
+// ADD for every new service, a REMOVE for every one which has gone and a
+// modification for any whose records changed in ways which aren't ignored.
+func inventoryDiff(previous []zeroconf.ServiceEntry,
+	current []zeroconf.ServiceEntry,
+	modify *modifyConfig,
+	now time.Time) []ServiceEntryChange {
+	before := make(map[string]zeroconf.ServiceEntry)
+	for _, entry := range previous {
+		before[entry.ServiceInstanceName()] = entry
+	}
+
+	var changes []ServiceEntryChange
+	for _, entry := range current {
+		name := entry.ServiceInstanceName()
+		old, ok := before[name]
+		delete(before, name)
+		if !ok {
+			changes = append(changes, ServiceEntryChange{ChangeType: ADD,
+				Timestamp: now,
+				Entry:     entry})
+		} else if modify.modified(&old, &entry) {
+			changes = append(changes, ServiceEntryChange{
+				ChangeType: modify.changeType(&old, &entry),
+				Timestamp:  now,
+				Entry:      entry,
+				Previous:   &old})
+		}
+	}
+
+	var names []string
+	for name := range before {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		changes = append(changes, ServiceEntryChange{ChangeType: REMOVE,
+			Timestamp: now,
+			Entry:     before[name]})
+	}
+
+	return changes
+}
+
+// readSnapshot Returns the services in the snapshot file, nil if there
+// isn't one yet.
+func readSnapshot(path string) ([]zeroconf.ServiceEntry, bool, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	entries, err := readEntries(f, OUTPUT_JSON)
+	if err != nil {
+		return nil, false, fmt.Errorf("snapshot %q is corrupt: %s", path, err.Error())
+	}
+
+	return entries, true, nil
+}
+
+// writeSnapshot Atomically replaces the snapshot file.
+func writeSnapshot(path string, entries []zeroconf.ServiceEntry) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, stateFileMode)
+	if err != nil {
+		return err
+	}
+
+	if err := writeEntries(f, entries, OUTPUT_JSON); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// report Compares the known services with the snapshot, sends the
+// differences to the report's backends and takes a new snapshot once every
+// backend has been sent them, so that a report which fails is repeated by
+// the next.  The first report only takes the snapshot.
+func (ir *inventoryReporter) report() {
+	previous, found, err := readSnapshot(ir.conf.SnapshotFile)
+	if err != nil {
+		slog.Error("failed to read inventory snapshot", "err", err)
+		return
+	}
+
+	current := ir.registry.snapshot()
+	if !found {
+		if err := writeSnapshot(ir.conf.SnapshotFile, current); err != nil {
+			slog.Error("failed to write inventory snapshot", "err", err)
+			return
+		}
+
+		slog.Info("took the first inventory snapshot",
+			"file", ir.conf.SnapshotFile,
+			"services", len(current))
+		return
+	}
+
+	changes := inventoryDiff(previous, current, ir.modify, time.Now().UTC())
+	slog.Info("inventory report",
+		"services", len(current),
+		"changes", len(changes))
+	for i := range changes {
+		changes[i].ID = newEventID()
+		changes[i].Report = true
+	}
+
+	// The digests go through the backends' workers, quiet hours and
+	// retries like any other notification.
+	var sent sync.WaitGroup
+	var failed atomic.Bool
+	for _, queue := range ir.queues {
+		var allowed []ServiceEntryChange
+		for _, change := range changes {
+			if queue.routes(&change) {
+				allowed = append(allowed, change)
+			}
+		}
+
+		if len(allowed) != 0 {
+			sent.Add(1)
+			queue.EnqueueDigest(allowed, func(delivered bool) {
+				if !delivered {
+					failed.Store(true)
+				}
+				sent.Done()
+			})
+		}
+	}
+	sent.Wait()
+
+	if failed.Load() {
+		slog.Warn("inventory report not delivered to every backend, keeping the snapshot",
+			"file", ir.conf.SnapshotFile)
+		return
+	}
+
+	if err := writeSnapshot(ir.conf.SnapshotFile, current); err != nil {
+		slog.Error("failed to write inventory snapshot", "err", err)
+	}
+}
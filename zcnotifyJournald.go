@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/coreos/go-systemd/v22/journal"
+)
+
+const (
+	DEFAULT_JOURNALD_IDENTIFIER string = "zcnotify"
+	// MESSAGE_ID of every zcnotify event, so they can be found with
+	// "journalctl MESSAGE_ID=...".
+	JOURNALD_MESSAGE_ID string = "5a0f5c1e2b7d4e0b9c6a3f8d1e4b7a29"
+)
+
+// journaldConfig describes a single [journald.<name>] block.
+type journaldConfig struct {
+	serviceFilter
+	scheduleConfig
+	// Template replaces the MESSAGE of the entries.
+	templateConfig
+	// SYSLOG_IDENTIFIER of the entries.
+	Identifier string
+}
+
+// validJournaldConfig Fills in the defaults of every [journald.<name>]
+// block, a block called "default" is used if there are none.
+func validJournaldConfig(zcnConfig *config) error {
+	if len(zcnConfig.Journald) == 0 {
+		zcnConfig.Journald = map[string]journaldConfig{"default": {}}
+	}
+
+	for name, journaldConf := range zcnConfig.Journald {
+		if journaldConf.Identifier == "" {
+			journaldConf.Identifier = DEFAULT_JOURNALD_IDENTIFIER
+		}
+
+		if err := journaldConf.setup(fmt.Sprintf("journald config: %q", name)); err != nil {
+			return err
+		}
+
+		zcnConfig.Journald[name] = journaldConf
+	}
+
+	return nil
+}
+
+// journaldNotifier Writes every event to the systemd journal with the event
+// as structured fields.
+type journaldNotifier struct {
+	name     string
+	conf     journaldConfig
+	template *template.Template
+}
+
+// newJournaldNotifier Creates a notifier for the journald block called name.
+func newJournaldNotifier(name string, conf journaldConfig) *journaldNotifier {
+	return &journaldNotifier{name: "journald." + name,
+		conf:     conf,
+		template: parseTemplate("journald."+name, conf.Template)}
+}
+
+func (jn *journaldNotifier) Name() string {
+	return jn.name
+}
+
+func (jn *journaldNotifier) Allows(change *ServiceEntryChange) (bool, string) {
+	return jn.conf.allowsChange(change)
+}
+
+// journalPriority Returns the journal priority of an event's severity.
+func journalPriority(severity Severity) journal.Priority {
+	switch severity {
+	case SEVERITY_CRITICAL:
+		return journal.PriCrit
+	case SEVERITY_WARNING:
+		return journal.PriWarning
+	default:
+		return journal.PriInfo
+	}
+}
+
+// fields Returns the journal fields of a change.
+func (jn *journaldNotifier) fields(change *ServiceEntryChange) map[string]string {
+	addresses := scopedAddresses(&change.Entry, change.Zones)
+	fields := map[string]string{"SYSLOG_IDENTIFIER": jn.conf.Identifier,
+		"MESSAGE_ID":           JOURNALD_MESSAGE_ID,
+		"ZCNOTIFY_EVENT_ID":    change.ID,
+		"ZCNOTIFY_CHANGE_TYPE": change.ChangeType.String(),
+		"ZCNOTIFY_INSTANCE":    change.Entry.Instance,
+		"ZCNOTIFY_SERVICE":     change.Entry.Service,
+		"ZCNOTIFY_DOMAIN":      strings.TrimSuffix(change.Entry.Domain, "."),
+		"ZCNOTIFY_HOSTNAME":    strings.TrimSuffix(change.Entry.HostName, "."),
+		"ZCNOTIFY_ADDRESSES":   strings.Join(addresses, ","),
+		"ZCNOTIFY_PORT":        strconv.Itoa(change.Entry.Port),
+		"ZCNOTIFY_TXT":         strings.Join(change.Entry.Text, "\n"),
+		"ZCNOTIFY_SEVERITY":    change.Severity.String(),
+		"ZCNOTIFY_INTERFACE":   change.Interface}
+	if change.Previous != nil {
+		fields["ZCNOTIFY_PREVIOUS_INSTANCE"] = change.Previous.Instance
+	}
+	if len(change.Networks) != 0 {
+		fields["ZCNOTIFY_NETWORKS"] = strings.Join(change.Networks, ",")
+	}
+	if change.URL != "" {
+		fields["ZCNOTIFY_URL"] = change.URL
+	}
+	if change.Site != "" {
+		fields["ZCNOTIFY_SITE"] = change.Site
+	}
+	if change.Geo != nil {
+		fields["ZCNOTIFY_GEOIP_COUNTRY"] = change.Geo.CountryCode
+	}
+	if change.Category != "" {
+		fields["ZCNOTIFY_CATEGORY"] = change.Category
+	}
+	if change.Error != "" {
+		fields["ZCNOTIFY_ERROR"] = change.Error
+	}
+	if change.UnknownDevice {
+		fields["ZCNOTIFY_UNKNOWN_DEVICE"] = "1"
+	}
+	if change.Shadow {
+		fields["ZCNOTIFY_SHADOW"] = "1"
+	}
+	if change.Replay {
+		fields["ZCNOTIFY_REPLAY"] = "1"
+	}
+
+	return fields
+}
+
+func (jn *journaldNotifier) Render(change *ServiceEntryChange) (string, error) {
+	fields := jn.fields(change)
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var rendered strings.Builder
+	fmt.Fprintf(&rendered, "PRIORITY=%d\nMESSAGE=%s\n",
+		journalPriority(change.Severity),
+		applyTemplate(jn.template, change, change.String()))
+	for _, name := range names {
+		fmt.Fprintf(&rendered, "%s=%s\n", name, fields[name])
+	}
+
+	return rendered.String(), nil
+}
+
+// Notify Writes the journal entry for a change.
+func (jn *journaldNotifier) Notify(change *ServiceEntryChange) error {
+	return journal.Send(applyTemplate(jn.template, change, change.String()),
+		journalPriority(change.Severity),
+		jn.fields(change))
+}
+
+func (jn *journaldNotifier) RenderDigest(changes []ServiceEntryChange) (string, error) {
+	var rendered strings.Builder
+	for i := range changes {
+		entry, _ := jn.Render(&changes[i])
+		rendered.WriteString(entry + "\n")
+	}
+
+	return rendered.String(), nil
+}
+
+// NotifyDigest Writes an entry for every change held back during quiet
+// hours.
+func (jn *journaldNotifier) NotifyDigest(changes []ServiceEntryChange) error {
+	for i := range changes {
+		if err := jn.Notify(&changes[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Check Verifies that the journal's socket can be written to.
+func (jn *journaldNotifier) Check() error {
+	if !journal.Enabled() {
+		return errors.New("the systemd journal isn't available")
+	}
+
+	return nil
+}
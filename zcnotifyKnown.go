@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// knownDevicesConfig is the [knownDevices] allowlist, devices which match none
+// of the entries are reported as unknown devices.  The list is off if it's
+// empty.
+type knownDevicesConfig struct {
+	// Glob patterns of known instance names and host names.
+	Instances []string
+	HostNames []string
+	// MAC addresses of known devices, requires [enrich] Neighbors.
+	MACs []string
+}
+
+var unknownDevicesMetric = metrics.newCounter("zcnotify_unknown_devices_total",
+	"Events from devices which aren't in the [knownDevices] list.")
+
+// enabled Returns true if an allowlist is configured.
+func (kdc *knownDevicesConfig) enabled() bool {
+	return len(kdc.Instances) != 0 || len(kdc.HostNames) != 0 || len(kdc.MACs) != 0
+}
+
+// setupKnownDevices Validates the [knownDevices] patterns and normalizes the
+// MAC addresses.
+func (zcnConfig *config) setupKnownDevices() error {
+	known := &zcnConfig.KnownDevices
+	for _, pattern := range append(known.Instances, known.HostNames...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("knownDevices: pattern %q: %s", pattern, err.Error())
+		}
+	}
+
+	if len(known.MACs) != 0 && !zcnConfig.Enrich.Neighbors {
+		return fmt.Errorf("knownDevices: MACs requires [enrich] Neighbors = true")
+	}
+
+	for i, mac := range known.MACs {
+		hwAddr, err := net.ParseMAC(strings.ReplaceAll(mac, "-", ":"))
+		if err != nil {
+			return fmt.Errorf("knownDevices: MAC %q: %s", mac, err.Error())
+		}
+
+		known.MACs[i] = hwAddr.String()
+	}
+
+	return nil
+}
+
+// known Returns true if the device of change is in the list, along with the
+// reason for the decision.
+func (kdc *knownDevicesConfig) known(change *ServiceEntryChange) (bool, string) {
+	if matchInstance(kdc.Instances, change.Entry.Instance) {
+		return true, "instance in knownDevices Instances"
+	}
+
+	if matchInstance(kdc.HostNames, strings.TrimSuffix(change.Entry.HostName, ".")) {
+		return true, "host name in knownDevices HostNames"
+	}
+
+	if change.Enrichment != nil && change.Enrichment.MAC != "" {
+		for _, mac := range kdc.MACs {
+			if mac == change.Enrichment.MAC {
+				return true, "MAC address in knownDevices MACs"
+			}
+		}
+	}
+
+	return false, "device not in knownDevices"
+}
+
+// classify Marks the change as being from an unknown device if it isn't in
+// the list.  A device going away isn't worth an alert, so REMOVEs are left
+// alone.
+func (kdc *knownDevicesConfig) classify(change *ServiceEntryChange) {
+	if !kdc.enabled() || change.ChangeType == REMOVE {
+		return
+	}
+
+	known, reason := kdc.known(change)
+	change.Trace.add("known", "", TRACE_ACCEPTED, reason)
+	if known {
+		return
+	}
+
+	change.UnknownDevice = true
+	unknownDevicesMetric.With("service", change.Entry.Service).Inc()
+}
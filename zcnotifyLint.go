@@ -0,0 +1,484 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/badoux/checkmail"
+	"gopkg.in/yaml.v3"
+)
+
+// configProblem is a single problem found in a config file, line is 0 if it
+// isn't known.  Warnings are things which may be fixed by the time zcnotify
+// runs, such as an interface which doesn't exist yet.
+type configProblem struct {
+	line    int
+	message string
+	warning bool
+}
+
+func (cp configProblem) String() string {
+	if cp.line == 0 {
+		return cp.message
+	}
+
+	return fmt.Sprintf("line %d: %s", cp.line, cp.message)
+}
+
+// configLinter Collects the problems in a config file.  lines maps the
+// lower case path of each setting, e.g. "email.ops.to" or "watch[0].service",
+// to the line it's on.
+type configLinter struct {
+	lines    map[string]int
+	problems []configProblem
+}
+
+// line Returns the line of the setting at path, or of the closest section
+// containing it.
+func (cl *configLinter) line(path string) int {
+	path = strings.ToLower(path)
+	for path != "" {
+		if line, ok := cl.lines[path]; ok {
+			return line
+		}
+
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+
+	return 0
+}
+
+func (cl *configLinter) report(path string, format string, args ...any) {
+	cl.problems = append(cl.problems, configProblem{line: cl.line(path),
+		message: fmt.Sprintf(format, args...)})
+}
+
+func (cl *configLinter) warn(path string, format string, args ...any) {
+	cl.problems = append(cl.problems, configProblem{line: cl.line(path),
+		message: fmt.Sprintf(format, args...),
+		warning: true})
+}
+
+// lintConfig Returns every problem in configFile which can be found without
+// loading it: syntax errors, unknown settings, values of the wrong type,
+// invalid glob patterns and email addresses, and interfaces which don't
+// exist.  The problems are sorted by line.
+func lintConfig(configFile string, format string) ([]configProblem, error) {
+	format, err := configFormat(configFile, format)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cl := &configLinter{lines: make(map[string]int)}
+	var document any
+	if format == CONFIG_TOML {
+		var table map[string]any
+		if _, err := toml.Decode(string(data), &table); err != nil {
+			var parseErr toml.ParseError
+			if errors.As(err, &parseErr) {
+				return []configProblem{{line: parseErr.Position.Line,
+					message: parseErr.Message}}, nil
+			}
+			return []configProblem{{message: err.Error()}}, nil
+		}
+
+		document = table
+		cl.indexTOML(string(data))
+	} else {
+		// JSON is read as YAML, of which it's a subset, for the line
+		// numbers.
+		var node yaml.Node
+		if err := yaml.Unmarshal(data, &node); err != nil {
+			return []configProblem{{message: err.Error()}}, nil
+		}
+
+		document = cl.indexYAML(&node, "")
+	}
+
+	if document != nil {
+		cl.lintValue(document, reflect.TypeOf(config{}), "")
+	}
+
+	// The values of settings can only be checked if the file decodes, the
+	// decode error is already reported if there are values of the wrong
+	// type.
+	var zcnConfig config
+	if err := decodeConfig(configFile, format, &zcnConfig); err == nil {
+		cl.lintSettings(&zcnConfig)
+	} else if len(cl.problems) == 0 {
+		cl.report("", "%s", err.Error())
+	}
+
+	sort.SliceStable(cl.problems, func(i, j int) bool {
+		return cl.problems[i].line < cl.problems[j].line
+	})
+
+	return cl.problems, nil
+}
+
+// indexTOML Records the line of every table and key in a TOML file.  Arrays
+// of tables are numbered from 0 in the order they appear.
+func (cl *configLinter) indexTOML(text string) {
+	table := ""
+	counts := make(map[string]int)
+	record := func(path string, line int) {
+		if _, ok := cl.lines[path]; !ok {
+			cl.lines[path] = line
+		}
+	}
+
+	normalize := func(key string) string {
+		key = strings.ReplaceAll(strings.ReplaceAll(key, `"`, ""), "'", "")
+		var parts []string
+		for _, part := range strings.Split(key, ".") {
+			parts = append(parts, strings.ToLower(strings.TrimSpace(part)))
+		}
+		return strings.Join(parts, ".")
+	}
+
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[[") {
+			name, _, _ := strings.Cut(strings.TrimPrefix(line, "[["), "]]")
+			name = normalize(name)
+			table = fmt.Sprintf("%s[%d]", name, counts[name])
+			counts[name]++
+			record(table, i+1)
+		} else if strings.HasPrefix(line, "[") {
+			name, _, _ := strings.Cut(strings.TrimPrefix(line, "["), "]")
+			table = normalize(name)
+			record(table, i+1)
+		} else if key, _, ok := strings.Cut(line, "="); ok && !strings.HasPrefix(line, "#") {
+			path := normalize(key)
+			if table != "" {
+				path = table + "." + path
+			}
+			record(path, i+1)
+		}
+	}
+}
+
+// indexYAML Returns the value of a YAML node, recording the line of every
+// key and list item below it.
+func (cl *configLinter) indexYAML(node *yaml.Node, path string) any {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil
+		}
+		return cl.indexYAML(node.Content[0], path)
+	case yaml.AliasNode:
+		return cl.indexYAML(node.Alias, path)
+	case yaml.MappingNode:
+		mapping := make(map[string]any)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			child := strings.ToLower(key.Value)
+			if path != "" {
+				child = path + "." + child
+			}
+			cl.lines[child] = key.Line
+			mapping[key.Value] = cl.indexYAML(node.Content[i+1], child)
+		}
+		return mapping
+	case yaml.SequenceNode:
+		list := make([]any, 0, len(node.Content))
+		for i, item := range node.Content {
+			child := fmt.Sprintf("%s[%d]", path, i)
+			cl.lines[child] = item.Line
+			list = append(list, cl.indexYAML(item, child))
+		}
+		return list
+	}
+
+	var value any
+	node.Decode(&value)
+	return value
+}
+
+// describe Returns the kind of a decoded value, for messages.
+func describe(value any) string {
+	switch v := value.(type) {
+	case string:
+		return fmt.Sprintf("the string %q", v)
+	case bool:
+		return fmt.Sprintf("%t", v)
+	case map[string]any:
+		return "a section"
+	}
+
+	if reflect.ValueOf(value).Kind() == reflect.Slice {
+		return "a list"
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+// wholeNumber Returns value as an integer if it's a whole number.
+func wholeNumber(value any) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint64:
+		return int64(v), true
+	case float64:
+		return int64(v), v == float64(int64(v))
+	}
+
+	return 0, false
+}
+
+// closestName Returns the name in names closest to name, if it's within two
+// edits, for "did you mean" suggestions.
+func closestName(name string, names []string) string {
+	best, bestDistance := "", 3
+	for _, candidate := range names {
+		if d := editDistance(strings.ToLower(name), strings.ToLower(candidate)); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+
+	return best
+}
+
+// editDistance Returns the Levenshtein distance between a and b.
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+
+	return previous[len(b)]
+}
+
+// settingNames Returns the names of the settings of a section.
+func settingNames(t reflect.Type) []string {
+	var names []string
+	for _, field := range reflect.VisibleFields(t) {
+		if field.IsExported() && !field.Anonymous {
+			names = append(names, field.Name)
+		}
+	}
+
+	return names
+}
+
+// lintValue Checks a decoded value against the type of the setting it's
+// decoded into, reporting unknown settings and values of the wrong type.
+func (cl *configLinter) lintValue(value any, t reflect.Type, path string) {
+	if value == nil {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		section, ok := value.(map[string]any)
+		if !ok {
+			cl.report(path, "%s: expected a section, got %s", path, describe(value))
+			return
+		}
+
+		var keys []string
+		for key := range section {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+
+			field, ok := t.FieldByNameFunc(func(name string) bool {
+				return strings.EqualFold(name, key)
+			})
+			if !ok || !field.IsExported() || field.Anonymous {
+				message := fmt.Sprintf("unknown setting %q", child)
+				if suggestion := closestName(key, settingNames(t)); suggestion != "" {
+					message += fmt.Sprintf(", did you mean %q?", suggestion)
+				}
+				cl.report(child, "%s", message)
+				continue
+			}
+
+			cl.lintValue(section[key], field.Type, child)
+		}
+		break
+	case reflect.Map:
+		section, ok := value.(map[string]any)
+		if !ok {
+			cl.report(path, "%s: expected a section, got %s", path, describe(value))
+			return
+		}
+
+		for key, item := range section {
+			cl.lintValue(item, t.Elem(), path+"."+key)
+		}
+		break
+	case reflect.Slice:
+		list := reflect.ValueOf(value)
+		if list.Kind() != reflect.Slice {
+			cl.report(path, "%s: expected a list, got %s", path, describe(value))
+			return
+		}
+
+		for i := 0; i < list.Len(); i++ {
+			cl.lintValue(list.Index(i).Interface(), t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+		break
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			cl.report(path, "%s: expected a string, got %s", path, describe(value))
+		}
+		break
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			cl.report(path, "%s: expected true or false, got %s", path, describe(value))
+		}
+		break
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n, ok := wholeNumber(value); !ok || n < 0 {
+			cl.report(path, "%s: expected a positive whole number, got %s",
+				path, describe(value))
+		}
+		break
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, ok := wholeNumber(value); !ok {
+			cl.report(path, "%s: expected a whole number, got %s", path, describe(value))
+		}
+		break
+	case reflect.Float32, reflect.Float64:
+		if _, ok := value.(float64); !ok {
+			if _, ok := wholeNumber(value); !ok {
+				cl.report(path, "%s: expected a number, got %s", path, describe(value))
+			}
+		}
+		break
+	}
+}
+
+// lintPatterns Reports the glob patterns of a setting which are invalid.
+func (cl *configLinter) lintPatterns(setting string, patterns []string) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(strings.TrimPrefix(pattern, "!"), ""); err != nil {
+			cl.report(setting, "%s: invalid pattern %q", setting, pattern)
+		}
+	}
+}
+
+// lintSettings Checks the values of settings which loadConfig would only
+// report the first problem with, or not at all.
+func (cl *configLinter) lintSettings(zcnConfig *config) {
+	cl.lintPatterns("interfaces.Use", zcnConfig.Interfaces.Use)
+	cl.lintPatterns("interfaces.Exclude", zcnConfig.Interfaces.Exclude)
+	cl.lintPatterns("knownDevices.Instances", zcnConfig.KnownDevices.Instances)
+	cl.lintPatterns("knownDevices.HostNames", zcnConfig.KnownDevices.HostNames)
+	cl.lintPatterns("modify.IgnoreTXTKeys", zcnConfig.Modify.IgnoreTXTKeys)
+	for i, rule := range zcnConfig.Severity {
+		cl.lintPatterns(fmt.Sprintf("severity[%d].Instances", i), rule.Instances)
+		cl.lintPatterns(fmt.Sprintf("severity[%d].HostNames", i), rule.HostNames)
+	}
+
+	for i, window := range zcnConfig.MaintenanceWindow {
+		cl.lintPatterns(fmt.Sprintf("maintenanceWindow[%d].Instances", i), window.Instances)
+		cl.lintPatterns(fmt.Sprintf("maintenanceWindow[%d].HostNames", i), window.HostNames)
+	}
+
+	for i, expect := range zcnConfig.Expect {
+		cl.lintPatterns(fmt.Sprintf("expect[%d].Instances", i), expect.Instances)
+		cl.lintPatterns(fmt.Sprintf("expect[%d].HostNames", i), expect.HostNames)
+	}
+
+	for i, watch := range zcnConfig.Watch {
+		cl.lintPatterns(fmt.Sprintf("watch[%d].Instances", i), watch.Instances)
+		cl.lintPatterns(fmt.Sprintf("watch[%d].ExcludeInstances", i), watch.ExcludeInstances)
+	}
+
+	if zcnConfig.Zeroconf.UnicastResponse && !zcnConfig.Zeroconf.SharedResolver {
+		cl.warn("zeroconf.UnicastResponse",
+			"zeroconf.UnicastResponse: only applies to the queries of the shared resolver, SharedResolver isn't set")
+	}
+
+	var names []string
+	for name := range zcnConfig.Email {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		emailConf := zcnConfig.Email[name]
+		for _, setting := range []struct{ name, address string }{{"From", emailConf.From},
+			{"To", emailConf.To}} {
+			// Addresses from the environment are checked when it's loaded.
+			if setting.address == "" || strings.Contains(setting.address, "${") {
+				continue
+			}
+
+			if err := checkmail.ValidateFormat(setting.address); err != nil {
+				cl.report("email."+name+"."+setting.name, "email.%s.%s: invalid address %q",
+					name, setting.name, setting.address)
+			}
+		}
+	}
+
+	// Interfaces are only warned about, they may exist by the time zcnotify
+	// runs.
+	intfs, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+
+	for _, pattern := range zcnConfig.Interfaces.Use {
+		pattern = strings.TrimPrefix(pattern, "!")
+		if strings.ContainsAny(pattern, "*?[") {
+			continue
+		}
+
+		var found *net.Interface
+		for i := range intfs {
+			if intfs[i].Name == pattern {
+				found = &intfs[i]
+				break
+			}
+		}
+
+		if found == nil {
+			cl.warn("interfaces.Use", "interfaces.Use: no interface named %q", pattern)
+		} else if reason := usableInterface(found); reason != "" {
+			cl.warn("interfaces.Use", "interfaces.Use: interface %q can't be used: %s",
+				pattern, reason)
+		}
+	}
+}
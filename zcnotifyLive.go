@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// liveWatch Runs a watcher for every target without notifying anything, the
+// changes they find are passed to the returned bus.  stop ends the watchers.
+func liveWatch(zcnConfig *config,
+	ipver zeroconf.IPType,
+	intfs []net.Interface) (*eventBus, func(), error) {
+	var sniffer *passiveSniffer
+	var err error
+	if zcnConfig.Zeroconf.Passive {
+		sniffer, err = newPassiveSniffer(ipver, intfs)
+	} else if zcnConfig.Zeroconf.SharedResolver {
+		sniffer, err = newSharedResolver(ipver,
+			intfs,
+			zcnConfig.Zeroconf)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	targets := zcnConfig.browseTargets()
+	updates := newEventBus(zcnConfig.Bus)
+	done := make(chan error, len(targets))
+	var exits []chan bool
+	for _, target := range targets {
+		create := func() (browseFunc, error) {
+			return newBrowseFunc(target, zcnConfig.Zeroconf, ipver, intfs, sniffer)
+		}
+		browse, err := create()
+		if err != nil {
+			slog.Error("failed to create browser, retrying",
+				"service", target.Service,
+				"domain", target.Domain,
+				"err", err)
+			browse = retryingBrowser(create)
+		}
+
+		exit := make(chan bool, 1)
+		exits = append(exits, exit)
+		go watchZCGroups(done,
+			exit,
+			nil,
+			updates,
+			target.Service,
+			target.Domain,
+			newBrowseTiming(target.ScanPeriodSeconds, zcnConfig),
+			browse,
+			newResolveCache(zcnConfig.Zeroconf.Resolver, ipver, intfs),
+			nil,
+			&zcnConfig.Modify,
+			nil,
+			nil,
+			nil)
+	}
+
+	stop := func() {
+		for _, exit := range exits {
+			exit <- true
+		}
+		for range exits {
+			<-done
+		}
+		if sniffer != nil {
+			sniffer.stop()
+		}
+	}
+
+	return updates, stop, nil
+}
+
+// tagInterface Sets the interface a change's device was seen on, as the
+// pipeline does.
+func tagInterface(change *ServiceEntryChange, intfs []net.Interface) {
+	change.Interface = entryInterface(&change.Entry)
+	change.Zones = linkLocalZones(&change.Entry, change.Interface, intfs)
+	if change.Interface == "" {
+		for _, zone := range change.Zones {
+			change.Interface = zone
+			break
+		}
+	}
+}
+
+// watchCommand Watches the configured services and prints their changes as
+// they happen, or shows them in a terminal UI with -tui, without notifying
+// anything.  It's meant for debugging on site, alongside or instead of a
+// running instance.
+func watchCommand(name string, args []string) int {
+	fs := newFlagSet(name, "")
+	common := addCommonFlags(fs)
+	tui := fs.Bool("tui", false,
+		"Show a live table of the services and a log of their changes")
+	fs.Parse(args)
+
+	zcnConfig, err := common.setup()
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	ipver, intfs, err := discoveryInterfaces(zcnConfig.Interfaces)
+	if err != nil {
+		fatal("invalid interface configuration", "err", err)
+	}
+
+	updates, stop, err := liveWatch(zcnConfig, ipver, intfs)
+	if err != nil {
+		fatal("failed to start watching", "err", err)
+	}
+	defer stop()
+
+	if *tui {
+		if err := runTUI(updates, intfs); err != nil {
+			fatal("terminal UI failed", "err", err)
+		}
+		return 0
+	}
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM)
+	for {
+		select {
+		case change := <-updates.events():
+			tagInterface(&change, intfs)
+			fmt.Println(change.String())
+		case <-sigchan:
+			return 0
+		}
+	}
+}
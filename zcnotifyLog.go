@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const (
+	DEFAULT_LOG_LEVEL  string = "info"
+	DEFAULT_LOG_FORMAT string = "text"
+	DEFAULT_LOG_OUTPUT string = "stderr"
+	logFileMode               = 0644
+	logFileFlags              = os.O_APPEND | os.O_CREATE | os.O_WRONLY
+)
+
+// logConfig controls the level, format and destination of log output.
+type logConfig struct {
+	Level  string
+	Format string
+	Output string
+}
+
+// parseLogLevel Converts a level name from the config file or command line
+// into a slog.Level.
+func parseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q", level)
+	}
+}
+
+// setupLogging Installs the default slog logger described by logConf.
+func setupLogging(logConf logConfig) error {
+	level, err := parseLogLevel(logConf.Level)
+	if err != nil {
+		return err
+	}
+
+	var output io.Writer
+	switch logConf.Output {
+	case "stderr":
+		output = os.Stderr
+	case "stdout":
+		output = os.Stdout
+	default:
+		f, err := os.OpenFile(logConf.Output, logFileFlags, logFileMode)
+		if err != nil {
+			return err
+		}
+		output = f
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(logConf.Format) {
+	case "text":
+		handler = slog.NewTextHandler(output, opts)
+	case "json":
+		handler = slog.NewJSONHandler(output, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", logConf.Format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal Logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// changeAttrs Returns the log attributes describing a change.
+func changeAttrs(change *ServiceEntryChange) slog.Attr {
+	attrs := []any{slog.String("instance", change.Entry.Instance),
+		slog.String("service", change.Entry.Service),
+		slog.String("domain", change.Entry.Domain),
+		slog.String("interface", change.Interface),
+		slog.String("severity", change.Severity.String()),
+		slog.String("changeType", change.ChangeType.String())}
+	if change.Site != "" {
+		attrs = append(attrs, slog.String("site", change.Site))
+	}
+
+	return slog.Group("event", attrs...)
+}
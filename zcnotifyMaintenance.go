@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+var maintenanceMetric = metrics.newCounter("zcnotify_events_maintenance_total",
+	"Events recorded but not notified because of a maintenance window.")
+
+// maintenanceWindowConfig is a single [[maintenanceWindow]] block, a
+// recurring period during which matching events are recorded in the history
+// but not notified, e.g. while devices reboot overnight.
+type maintenanceWindowConfig struct {
+	eventMatch
+	// Shown in logs and traces, the schedule if not set.
+	Name string
+	// Cron expression of when the window opens, e.g. "0 3 * * *" or
+	// "@weekly".
+	Schedule string
+	// How long the window stays open, e.g. "30m" or "2h".
+	Duration string
+	// IANA time zone of the schedule, the local time zone if not set.
+	Timezone string
+
+	opens    cron.Schedule
+	length   time.Duration
+	location *time.Location
+}
+
+// setupMaintenanceWindows Parses the schedule, duration and time zone of
+// every [[maintenanceWindow]] block.
+func (zcnConfig *config) setupMaintenanceWindows() error {
+	for i := range zcnConfig.MaintenanceWindow {
+		window := &zcnConfig.MaintenanceWindow[i]
+		if window.Schedule == "" || window.Duration == "" {
+			return fmt.Errorf("maintenance window %d: Schedule and Duration are required", i+1)
+		}
+
+		if window.Name == "" {
+			window.Name = window.Schedule
+		}
+
+		var err error
+		if window.opens, err = cron.ParseStandard(window.Schedule); err != nil {
+			return fmt.Errorf("maintenance window %q: schedule: %s", window.Name, err.Error())
+		}
+
+		if window.length, err = parsePeriod(window.Duration); err != nil {
+			return fmt.Errorf("maintenance window %q: duration: %s", window.Name, err.Error())
+		}
+
+		if window.length <= 0 {
+			return fmt.Errorf("maintenance window %q: duration must be positive", window.Name)
+		}
+
+		window.location = time.Local
+		if window.Timezone != "" {
+			if window.location, err = time.LoadLocation(window.Timezone); err != nil {
+				return fmt.Errorf("maintenance window %q: timezone: %s", window.Name, err.Error())
+			}
+		}
+
+		if err := window.validate(); err != nil {
+			return fmt.Errorf("maintenance window %q: %s", window.Name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// open Returns true if the window is open at now, which is the case if it
+// last opened no more than its duration ago.
+func (mw *maintenanceWindowConfig) open(now time.Time) bool {
+	return !mw.opens.Next(now.In(mw.location).Add(-mw.length)).After(now)
+}
+
+// maintenance Returns the open maintenance window which applies to change,
+// nil if none does.
+func (zcnConfig *config) maintenance(change *ServiceEntryChange) *maintenanceWindowConfig {
+	now := time.Now()
+	for i := range zcnConfig.MaintenanceWindow {
+		window := &zcnConfig.MaintenanceWindow[i]
+		if window.open(now) && window.matches(change) {
+			return window
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	counterMetric string = "counter"
+	gaugeMetric   string = "gauge"
+)
+
+// metricValue is a single labelled value of a metric.
+type metricValue struct {
+	labels string
+	value  atomic.Int64
+}
+
+func (mv *metricValue) Inc() {
+	mv.value.Add(1)
+}
+
+func (mv *metricValue) Dec() {
+	mv.value.Add(-1)
+}
+
+func (mv *metricValue) Add(delta int64) {
+	mv.value.Add(delta)
+}
+
+func (mv *metricValue) Set(value int64) {
+	mv.value.Store(value)
+}
+
+func (mv *metricValue) Get() int64 {
+	return mv.value.Load()
+}
+
+// metric is a named family of values, distinguished by their labels, which
+// is rendered in the Prometheus text exposition format.
+type metric struct {
+	name   string
+	help   string
+	kind   string
+	mutex  sync.Mutex
+	values map[string]*metricValue
+}
+
+// With Returns the value of the metric for the given label name/value pairs,
+// creating it if this is the first time the labels have been seen.
+func (m *metric) With(labelPairs ...string) *metricValue {
+	var labels []string
+	for i := 0; i+1 < len(labelPairs); i += 2 {
+		labels = append(labels, fmt.Sprintf("%s=%q", labelPairs[i],
+			labelPairs[i+1]))
+	}
+
+	key := strings.Join(labels, ",")
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mv, ok := m.values[key]
+	if !ok {
+		mv = &metricValue{labels: key}
+		m.values[key] = mv
+	}
+
+	return mv
+}
+
+// total Returns the sum of the metric's values whose labels contain match,
+// of all of them if match is empty.
+func (m *metric) total(match string) int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var total int64
+	for key, mv := range m.values {
+		if strings.Contains(key, match) {
+			total += mv.Get()
+		}
+	}
+
+	return total
+}
+
+// metricsRegistry holds every metric exported by zcnotify.
+type metricsRegistry struct {
+	mutex   sync.Mutex
+	metrics []*metric
+}
+
+var metrics metricsRegistry
+
+func (mr *metricsRegistry) register(name string, help string, kind string) *metric {
+	m := &metric{name: name,
+		help:   help,
+		kind:   kind,
+		values: make(map[string]*metricValue)}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	mr.metrics = append(mr.metrics, m)
+	return m
+}
+
+// newCounter Registers a metric which only ever increases.
+func (mr *metricsRegistry) newCounter(name string, help string) *metric {
+	return mr.register(name, help, counterMetric)
+}
+
+// newGauge Registers a metric which can go up and down.
+func (mr *metricsRegistry) newGauge(name string, help string) *metric {
+	return mr.register(name, help, gaugeMetric)
+}
+
+// writeText Writes every metric in the Prometheus text exposition format.
+func (mr *metricsRegistry) writeText(w io.Writer) error {
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	for _, m := range mr.metrics {
+		m.mutex.Lock()
+		var keys []string
+		for key := range m.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n",
+			m.name, m.help, m.name, m.kind)
+		for _, key := range keys {
+			if err != nil {
+				break
+			}
+
+			if key == "" {
+				_, err = fmt.Fprintf(w, "%s %d\n", m.name, m.values[key].Get())
+			} else {
+				_, err = fmt.Fprintf(w, "%s{%s} %d\n", m.name, key,
+					m.values[key].Get())
+			}
+		}
+		m.mutex.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ServeHTTP Serves the registry on the metrics listener.
+func (mr *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := mr.writeText(w); err != nil {
+		slog.Warn("failed to write metrics", "err", err)
+	}
+}
+
+// serveMetrics Serves /metrics on the given address, or the "metrics"
+// socket from systemd, until the process exits.
+func serveMetrics(address string, server *serverConfig) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", &metrics)
+	if err := server.serveHTTP("metrics", address, server.protect(mux)); err != nil {
+		slog.Error("metrics listener failed", "err", err)
+	}
+}
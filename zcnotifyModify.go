@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// Entry fields which can be excluded from MODIFY detection.
+var modifyFields = []string{"hostname", "port", "ttl", "text", "ipv4", "ipv6"}
+
+// modifyConfig excludes values which some devices rotate with every
+// announcement from MODIFY detection.
+type modifyConfig struct {
+	// Glob patterns of the fields to ignore, any of hostname, port, ttl,
+	// text, ipv4 and ipv6, e.g. "ipv*" for both addresses.
+	IgnoreFields []string
+	// Glob patterns of TXT record keys to ignore, e.g. "ts" or "seq*".
+	IgnoreTXTKeys []string
+	// Only report IPv6 address changes if none of the previous addresses
+	// are still advertised, so that rotating temporary addresses are
+	// ignored.
+	IgnoreTemporaryIPv6 bool
+}
+
+// setupModify Validates the [modify] settings.
+func (zcnConfig *config) setupModify() error {
+	modify := &zcnConfig.Modify
+	for i, field := range modify.IgnoreFields {
+		modify.IgnoreFields[i] = strings.ToLower(field)
+		if _, err := path.Match(modify.IgnoreFields[i], ""); err != nil {
+			return fmt.Errorf("modify: IgnoreFields pattern %q: %s", field, err.Error())
+		}
+
+		if !slices.ContainsFunc(modifyFields, func(name string) bool {
+			return matchField(modify.IgnoreFields[i], name)
+		}) {
+			return fmt.Errorf("modify: unknown field %q in IgnoreFields, expected one of %s",
+				field, strings.Join(modifyFields, ", "))
+		}
+	}
+
+	for _, pattern := range modify.IgnoreTXTKeys {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("modify: TXT key pattern %q: %s", pattern, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// ignores Returns true if field matches one of IgnoreFields.
+func (mc *modifyConfig) ignores(field string) bool {
+	for _, pattern := range mc.IgnoreFields {
+		if matchField(pattern, field) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchField Returns true if the glob pattern matches field.
+func matchField(pattern string, field string) bool {
+	matched, _ := path.Match(pattern, field)
+	return matched
+}
+
+// normalize Returns a copy of entry without the ignored fields and TXT keys.
+func (mc *modifyConfig) normalize(entry *zeroconf.ServiceEntry) zeroconf.ServiceEntry {
+	normalized := *entry
+	if mc.ignores("hostname") {
+		normalized.HostName = ""
+	}
+
+	if mc.ignores("port") {
+		normalized.Port = 0
+	}
+
+	if mc.ignores("ttl") {
+		normalized.TTL = 0
+	}
+
+	if mc.ignores("ipv4") {
+		normalized.AddrIPv4 = nil
+	}
+
+	if mc.ignores("ipv6") {
+		normalized.AddrIPv6 = nil
+	}
+
+	if mc.ignores("text") {
+		normalized.Text = nil
+	} else if len(mc.IgnoreTXTKeys) != 0 {
+		normalized.Text = nil
+		for _, txt := range entry.Text {
+			key, _, _ := strings.Cut(txt, "=")
+			if !matchInstance(mc.IgnoreTXTKeys, key) {
+				normalized.Text = append(normalized.Text, txt)
+			}
+		}
+	}
+
+	return normalized
+}
+
+// normalizePair Returns copies of a and b without the differences which
+// are ignored.  A nil config ignores nothing.
+func (mc *modifyConfig) normalizePair(a *zeroconf.ServiceEntry,
+	b *zeroconf.ServiceEntry) (zeroconf.ServiceEntry, zeroconf.ServiceEntry) {
+	if mc == nil {
+		return *a, *b
+	}
+
+	aNormalized := mc.normalize(a)
+	bNormalized := mc.normalize(b)
+	if mc.IgnoreTemporaryIPv6 && len(aNormalized.AddrIPv6) != 0 {
+		for _, ip := range aNormalized.AddrIPv6 {
+			if containsIP(bNormalized.AddrIPv6, ip) {
+				aNormalized.AddrIPv6 = nil
+				bNormalized.AddrIPv6 = nil
+				break
+			}
+		}
+	}
+
+	return aNormalized, bNormalized
+}
+
+// modified Returns true if the differences between a and b aren't all
+// ignored.  A nil config ignores nothing.
+func (mc *modifyConfig) modified(a *zeroconf.ServiceEntry, b *zeroconf.ServiceEntry) bool {
+	aNormalized, bNormalized := mc.normalizePair(a, b)
+	return !compareSEEntry(&aNormalized, &bNormalized)
+}
+
+// changeType Returns the change type of a modification from a to b:
+// ADDRESS_CHANGED, PORT_CHANGED, TXT_CHANGED or TTL_CHANGED if that's all
+// which changed, ignoring what's ignored, and MODIFY otherwise.
+func (mc *modifyConfig) changeType(a *zeroconf.ServiceEntry,
+	b *zeroconf.ServiceEntry) ServiceChangeType {
+	aNormalized, bNormalized := mc.normalizePair(a, b)
+	addresses := bNormalized
+	addresses.AddrIPv4, addresses.AddrIPv6 = aNormalized.AddrIPv4, aNormalized.AddrIPv6
+	text := bNormalized
+	text.Text = aNormalized.Text
+
+	var changed []ServiceChangeType
+	if aNormalized.HostName != bNormalized.HostName {
+		changed = append(changed, MODIFY)
+	}
+
+	if !compareSEEntry(&addresses, &bNormalized) {
+		changed = append(changed, ADDRESS_CHANGED)
+	}
+
+	if aNormalized.Port != bNormalized.Port {
+		changed = append(changed, PORT_CHANGED)
+	}
+
+	if !compareSEEntry(&text, &bNormalized) {
+		changed = append(changed, TXT_CHANGED)
+	}
+
+	if aNormalized.TTL != bNormalized.TTL {
+		changed = append(changed, TTL_CHANGED)
+	}
+
+	if len(changed) != 1 {
+		return MODIFY
+	}
+
+	return changed[0]
+}
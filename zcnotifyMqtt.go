@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	DEFAULT_MQTT_TIMEOUT          uint   = 10
+	DEFAULT_MQTT_QOS              uint   = 1
+	DEFAULT_MQTT_BASE_TOPIC       string = "zcnotify"
+	DEFAULT_MQTT_DISCOVERY_PREFIX string = "homeassistant"
+)
+
+// mqttConfig describes a single [mqtt.<name>] block.
+type mqttConfig struct {
+	serviceFilter
+	scheduleConfig
+	// Template replaces the JSON payload of the events topic.
+	templateConfig
+	eventFormatConfig
+	// Events are published as a JSON array of up to BatchSize events.
+	batchConfig
+	// Broker URL, e.g. "tcp://mqtt:1883" or "ssl://mqtt:8883".
+	Broker string
+	// Client ID, a random one is used if empty.
+	ClientID     string
+	Username     string
+	Password     string
+	PasswordFile string
+	// Events are published as JSON to <BaseTopic>/events.
+	BaseTopic string
+	QoS       uint
+	// Publish Home Assistant MQTT discovery configs, so that every service
+	// appears as a binary_sensor which is on while the service is present.
+	HomeAssistant bool
+	// Home Assistant's discovery prefix.
+	DiscoveryPrefix string
+	TimeoutSeconds  uint
+}
+
+// validMqttConfig Checks every [mqtt.<name>] block and fills in the
+// defaults.
+func validMqttConfig(mqttConfs map[string]mqttConfig) error {
+	if len(mqttConfs) == 0 {
+		return errors.New("no [mqtt.<name>] blocks")
+	}
+
+	for name, mqttConf := range mqttConfs {
+		parsed, err := url.Parse(mqttConf.Broker)
+		if err != nil || parsed.Host == "" {
+			return fmt.Errorf("mqtt config: %q invalid Broker %q", name, mqttConf.Broker)
+		}
+
+		switch parsed.Scheme {
+		case "tcp", "ssl", "tls", "ws", "wss":
+			break
+		default:
+			return fmt.Errorf("mqtt config: %q unsupported Broker scheme %q",
+				name, parsed.Scheme)
+		}
+
+		if mqttConf.BaseTopic == "" {
+			mqttConf.BaseTopic = DEFAULT_MQTT_BASE_TOPIC
+		}
+		mqttConf.BaseTopic = strings.TrimSuffix(mqttConf.BaseTopic, "/")
+
+		if mqttConf.DiscoveryPrefix == "" {
+			mqttConf.DiscoveryPrefix = DEFAULT_MQTT_DISCOVERY_PREFIX
+		}
+		mqttConf.DiscoveryPrefix = strings.TrimSuffix(mqttConf.DiscoveryPrefix, "/")
+
+		if mqttConf.QoS == 0 {
+			mqttConf.QoS = DEFAULT_MQTT_QOS
+		} else if mqttConf.QoS > 2 {
+			return fmt.Errorf("mqtt config: %q QoS must be 1 or 2", name)
+		}
+
+		if mqttConf.TimeoutSeconds == 0 {
+			mqttConf.TimeoutSeconds = DEFAULT_MQTT_TIMEOUT
+		}
+
+		if mqttConf.ClientID == "" {
+			mqttConf.ClientID = "zcnotify-" + newEventID()
+		}
+
+		mqttConf.batchConfig.setup()
+
+		prefix := fmt.Sprintf("mqtt config: %q", name)
+		if err := mqttConf.templateConfig.setup(prefix); err != nil {
+			return err
+		}
+
+		if err := mqttConf.eventFormatConfig.setup(prefix); err != nil {
+			return err
+		}
+
+		mqttConfs[name] = mqttConf
+	}
+
+	return nil
+}
+
+// mqttMessage is a single message to publish.
+type mqttMessage struct {
+	topic    string
+	retained bool
+	payload  []byte
+}
+
+// mqttNotifier Publishes events to the broker of a single [mqtt.<name>]
+// block, and optionally keeps a Home Assistant binary_sensor for every
+// service up to date.
+type mqttNotifier struct {
+	name     string
+	conf     mqttConfig
+	template *template.Template
+	timeout  time.Duration
+	mutex    sync.Mutex
+	client   mqtt.Client
+}
+
+// newMqttNotifier Creates a notifier for the mqtt block called name, the
+// broker isn't connected to until something is published.
+func newMqttNotifier(name string, conf mqttConfig) *mqttNotifier {
+	return &mqttNotifier{name: "mqtt." + name,
+		conf:     conf,
+		template: parseTemplate("mqtt."+name, conf.Template),
+		timeout:  time.Duration(conf.TimeoutSeconds) * time.Second}
+}
+
+func (mn *mqttNotifier) Name() string {
+	return mn.name
+}
+
+func (mn *mqttNotifier) Allows(change *ServiceEntryChange) (bool, string) {
+	return mn.conf.allowsChange(change)
+}
+
+// availabilityTopic Returns the topic which says whether zcnotify is
+// running, Home Assistant shows the sensors as unavailable when it isn't.
+func (mn *mqttNotifier) availabilityTopic() string {
+	return mn.conf.BaseTopic + "/status"
+}
+
+// objectID Returns the Home Assistant object ID of a service.  Instance names
+// may contain anything, so a hash of the full name keeps IDs unique once
+// they've been reduced to the characters allowed in a topic.
+func objectID(entry *zeroconf.ServiceEntry) string {
+	name := entry.ServiceInstanceName()
+	id := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(entry.Instance+entry.Service))
+
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return fmt.Sprintf("%s_%08x", strings.Trim(id, "_"), hash.Sum32())
+}
+
+// discovery Returns the messages which describe the binary_sensor of a
+// service to Home Assistant and set its state and attributes.
+func (mn *mqttNotifier) discovery(change *ServiceEntryChange, present bool) []mqttMessage {
+	id := objectID(&change.Entry)
+	stateTopic := mn.conf.BaseTopic + "/" + id + "/state"
+	attributesTopic := mn.conf.BaseTopic + "/" + id + "/attributes"
+
+	device := map[string]interface{}{"identifiers": []string{"zcnotify_" + id},
+		"name":  change.Entry.Instance,
+		"model": change.Entry.Service}
+	if change.Enrichment != nil && change.Enrichment.Vendor != "" {
+		device["manufacturer"] = change.Enrichment.Vendor
+	}
+
+	config, _ := json.Marshal(map[string]interface{}{
+		"name":                  nil,
+		"unique_id":             "zcnotify_" + id,
+		"object_id":             "zcnotify_" + id,
+		"device_class":          "connectivity",
+		"state_topic":           stateTopic,
+		"json_attributes_topic": attributesTopic,
+		"availability_topic":    mn.availabilityTopic(),
+		"device":                device})
+	attributes, _ := json.Marshal(change.toJSON(false))
+
+	state := "OFF"
+	if present {
+		state = "ON"
+	}
+
+	return []mqttMessage{
+		{topic: mn.conf.DiscoveryPrefix + "/binary_sensor/zcnotify/" + id + "/config",
+			retained: true,
+			payload:  config},
+		{topic: attributesTopic, retained: true, payload: attributes},
+		{topic: stateTopic, retained: true, payload: []byte(state)}}
+}
+
+// messages Returns the messages to publish for a change.
+func (mn *mqttNotifier) messages(change *ServiceEntryChange) []mqttMessage {
+	event, _ := json.Marshal(mn.conf.encode(change, false))
+	payload := applyTemplate(mn.template, change, string(event))
+	return append([]mqttMessage{{topic: mn.conf.BaseTopic + "/events",
+		payload: []byte(payload)}}, mn.sensors(change)...)
+}
+
+// batchMessages Returns the messages to publish for a batch of changes,
+// which are a single message on the events topic: a JSON array of the
+// events, or their templated payloads one per line.
+func (mn *mqttNotifier) batchMessages(changes []ServiceEntryChange) []mqttMessage {
+	var payload []byte
+	if mn.template != nil {
+		var lines []string
+		for i := range changes {
+			event, _ := json.Marshal(mn.conf.encode(&changes[i], false))
+			lines = append(lines, applyTemplate(mn.template, &changes[i], string(event)))
+		}
+		payload = []byte(strings.Join(lines, "\n"))
+	} else {
+		events := make([]any, 0, len(changes))
+		for i := range changes {
+			events = append(events, mn.conf.encode(&changes[i], false))
+		}
+		payload, _ = json.Marshal(events)
+	}
+
+	messages := []mqttMessage{{topic: mn.conf.BaseTopic + "/events", payload: payload}}
+	for i := range changes {
+		messages = append(messages, mn.sensors(&changes[i])...)
+	}
+
+	return messages
+}
+
+// sensors Returns the Home Assistant messages for a change, none unless
+// HomeAssistant is set.  zcnotify's own events aren't about a service, so
+// they have no sensor.
+func (mn *mqttNotifier) sensors(change *ServiceEntryChange) []mqttMessage {
+	if !mn.conf.HomeAssistant || change.ChangeType.ops() {
+		return nil
+	}
+
+	var messages []mqttMessage
+	if change.ChangeType == RENAMED && change.Previous != nil {
+		// Remove the sensor of the old name, an empty retained config
+		// deletes it from Home Assistant.
+		messages = append(messages, mqttMessage{
+			topic: mn.conf.DiscoveryPrefix + "/binary_sensor/zcnotify/" +
+				objectID(change.Previous) + "/config",
+			retained: true})
+	}
+
+	present := !firingChange(change.ChangeType)
+	return append(messages, mn.discovery(change, present)...)
+}
+
+// connect Returns the client, connecting to the broker if necessary.  The
+// client reconnects by itself once it has connected.
+func (mn *mqttNotifier) connect() (mqtt.Client, error) {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+
+	if mn.client != nil {
+		return mn.client, nil
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(mn.conf.Broker).
+		SetClientID(mn.conf.ClientID).
+		SetUsername(mn.conf.Username).
+		SetPassword(mn.conf.Password).
+		SetConnectTimeout(mn.timeout).
+		SetAutoReconnect(true)
+	if mn.conf.HomeAssistant {
+		// The broker marks the sensors unavailable if zcnotify goes away.
+		opts.SetWill(mn.availabilityTopic(), "offline", byte(mn.conf.QoS), true)
+		opts.SetOnConnectHandler(func(client mqtt.Client) {
+			client.Publish(mn.availabilityTopic(), byte(mn.conf.QoS), true, "online")
+		})
+	}
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(mn.timeout) {
+		return nil, fmt.Errorf("timed out connecting to %s", mn.conf.Broker)
+	}
+
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+
+	mn.client = client
+	return client, nil
+}
+
+// close Disconnects from the broker.
+func (mn *mqttNotifier) close() {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+
+	if mn.client != nil {
+		mn.client.Disconnect(uint(mn.timeout.Milliseconds()))
+		mn.client = nil
+	}
+}
+
+// publish Publishes messages, waiting for the broker to acknowledge them.
+func (mn *mqttNotifier) publish(messages []mqttMessage) error {
+	client, err := mn.connect()
+	if err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		token := client.Publish(message.topic,
+			byte(mn.conf.QoS),
+			message.retained,
+			message.payload)
+		if !token.WaitTimeout(mn.timeout) {
+			return fmt.Errorf("timed out publishing to %s", message.topic)
+		}
+
+		if err := token.Error(); err != nil {
+			return fmt.Errorf("publish to %s failed: %s", message.topic, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// render Returns the messages as they would be published.
+func (mn *mqttNotifier) render(messages []mqttMessage) string {
+	var rendered strings.Builder
+	for _, message := range messages {
+		retained := ""
+		if message.retained {
+			retained = " (retained)"
+		}
+
+		fmt.Fprintf(&rendered, "%s%s: %s\n", message.topic, retained, message.payload)
+	}
+
+	return rendered.String()
+}
+
+func (mn *mqttNotifier) Render(change *ServiceEntryChange) (string, error) {
+	return mn.render(mn.messages(change)), nil
+}
+
+// Notify Publishes the messages for a change.
+func (mn *mqttNotifier) Notify(change *ServiceEntryChange) error {
+	return mn.publish(mn.messages(change))
+}
+
+func (mn *mqttNotifier) RenderDigest(changes []ServiceEntryChange) (string, error) {
+	var messages []mqttMessage
+	for i := range changes {
+		messages = append(messages, mn.messages(&changes[i])...)
+	}
+
+	return mn.render(messages), nil
+}
+
+// NotifyDigest Publishes the messages for every change held back during
+// quiet hours, which leaves the Home Assistant sensors as they'd have been.
+func (mn *mqttNotifier) NotifyDigest(changes []ServiceEntryChange) error {
+	var messages []mqttMessage
+	for i := range changes {
+		messages = append(messages, mn.messages(&changes[i])...)
+	}
+
+	return mn.publish(messages)
+}
+
+func (mn *mqttNotifier) batch() batchConfig {
+	return mn.conf.batchConfig
+}
+
+// NotifyBatch Publishes a batch of changes as a single event message.
+func (mn *mqttNotifier) NotifyBatch(changes []ServiceEntryChange) error {
+	return mn.publish(mn.batchMessages(changes))
+}
+
+// seed Publishes the Home Assistant sensors of the services known from a
+// previous run, which won't be reported as added.
+func (mn *mqttNotifier) seed(entries []zeroconf.ServiceEntry) {
+	if !mn.conf.HomeAssistant {
+		return
+	}
+
+	var messages []mqttMessage
+	for _, entry := range entries {
+		if allowed, _ := mn.conf.allows(entry.Service); allowed {
+			messages = append(messages,
+				mn.discovery(&ServiceEntryChange{Timestamp: time.Now().UTC(),
+					Entry: entry}, true)...)
+		}
+	}
+
+	if len(messages) == 0 {
+		return
+	}
+
+	go func() {
+		if err := mn.publish(messages); err != nil {
+			slog.Warn("failed to publish Home Assistant sensors of known services",
+				"backend", mn.name,
+				"err", err)
+		}
+	}()
+}
+
+// Check Connects to the broker.
+func (mn *mqttNotifier) Check() error {
+	_, err := mn.connect()
+	return err
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Neighbour table used on Linux if the ip command isn't available.
+	procNetARP string = "/proc/net/arp"
+	// The neighbour table is read again once it's this old...
+	NEIGHBOR_TABLE_MAX_AGE time.Duration = 30 * time.Second
+	// ...or when an address isn't in it, but at most this often.
+	NEIGHBOR_TABLE_MIN_AGE time.Duration = 2 * time.Second
+	// How long a lookup of an address which isn't in the table waits for
+	// it to be read again.
+	NEIGHBOR_WAIT time.Duration = 250 * time.Millisecond
+)
+
+// neighbor is what the neighbour table says about a single address: its
+// MAC address, nil if it hasn't been resolved, and the interface it's on,
+// if the table says.
+type neighbor struct {
+	mac  net.HardwareAddr
+	zone string
+}
+
+// neighborTable Caches the ARP/NDP neighbour table, which is read in the
+// background so that the pipeline never waits on the commands which list
+// it for more than NEIGHBOR_WAIT.
+type neighborTable struct {
+	mutex     sync.Mutex
+	neighbors map[string]neighbor
+	read      time.Time
+	// reading is closed when the read in progress finishes, nil if the
+	// table isn't being read.
+	reading chan bool
+}
+
+// neighborCache is the neighbour table shared by every stage which needs it.
+var neighborCache = &neighborTable{}
+
+// find Returns the neighbours of addrs which are in the table, by address.
+// If any isn't the table is read again, unless it just was, and the read
+// waited for for at most NEIGHBOR_WAIT.
+func (nt *neighborTable) find(addrs []string) map[string]neighbor {
+	found, reading := nt.cached(addrs)
+	if len(found) == len(addrs) || reading == nil {
+		return found
+	}
+
+	select {
+	case <-reading:
+		break
+	case <-time.After(NEIGHBOR_WAIT):
+		return found
+	}
+
+	found, _ = nt.cached(addrs)
+	return found
+}
+
+// cached Returns the neighbours of addrs in the table as it is, starting to
+// read it again if it's old, or some of addrs aren't in it and it wasn't
+// just read.  The read in progress is returned, if there is one.
+func (nt *neighborTable) cached(addrs []string) (map[string]neighbor, chan bool) {
+	nt.mutex.Lock()
+	defer nt.mutex.Unlock()
+
+	found := make(map[string]neighbor)
+	for _, addr := range addrs {
+		if n, ok := nt.neighbors[addr]; ok {
+			found[addr] = n
+		}
+	}
+
+	age := time.Since(nt.read)
+	if age > NEIGHBOR_TABLE_MAX_AGE ||
+		(len(found) < len(addrs) && age > NEIGHBOR_TABLE_MIN_AGE) {
+		nt.refresh()
+	}
+
+	return found, nt.reading
+}
+
+// refresh Starts reading the table unless it's being read, called with the
+// mutex held.  If the read fails the table is left as it was.
+func (nt *neighborTable) refresh() {
+	if nt.reading != nil {
+		return
+	}
+
+	reading := make(chan bool)
+	nt.reading = reading
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			time.Duration(DEFAULT_ENRICH_TIMEOUT)*time.Second)
+		defer cancel()
+
+		neighbors, err := readNeighbors(ctx)
+		if err != nil {
+			slog.Warn("failed to read neighbour table", "err", err)
+		}
+
+		nt.mutex.Lock()
+		if err == nil {
+			nt.neighbors = neighbors
+		}
+		nt.read = time.Now()
+		nt.reading = nil
+		nt.mutex.Unlock()
+		close(reading)
+	}()
+}
+
+// neighborCommands Returns the commands which list the neighbour tables on
+// this platform, IPv4 and IPv6.  Windows' arp only lists IPv4 neighbours,
+// its IPv6 table is grouped by interface index.
+func neighborCommands() [][]string {
+	switch runtime.GOOS {
+	case "linux":
+		return [][]string{{"ip", "neigh", "show"}}
+	case "windows":
+		return [][]string{{"arp", "-a"}}
+	default:
+		return [][]string{{"arp", "-an"}, {"ndp", "-an"}}
+	}
+}
+
+// readNeighbors Reads the neighbour tables, failing only if none of them
+// could be read.
+func readNeighbors(ctx context.Context) (map[string]neighbor, error) {
+	var tables []byte
+	var err error
+	for _, args := range neighborCommands() {
+		table, cmdErr := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+		if cmdErr != nil {
+			err = cmdErr
+			continue
+		}
+
+		tables = append(tables, table...)
+	}
+
+	if tables == nil && runtime.GOOS == "linux" {
+		tables, err = os.ReadFile(procNetARP)
+	}
+
+	if tables == nil {
+		return nil, err
+	}
+
+	return parseNeighbors(tables), nil
+}
+
+// parseNeighbors Returns the neighbours in a neighbour table by address.
+// The output of ip neigh, arp, ndp and /proc/net/arp all have the IP
+// address before the MAC address on each line, so the first of each is
+// taken.  The interface is either the address's zone ("fe80::1%en0 ...") or
+// follows "dev" ("fe80::1 dev eth0 lladdr ...") or "on" ("? (10.0.0.1) at
+// ... on en0").
+func parseNeighbors(table []byte) map[string]neighbor {
+	neighbors := make(map[string]neighbor)
+	scanner := bufio.NewScanner(bytes.NewReader(table))
+	for scanner.Scan() {
+		var ip net.IP
+		var n neighbor
+		fields := strings.Fields(scanner.Text())
+		for index, field := range fields {
+			field = strings.Trim(field, "()")
+			if ip == nil {
+				var addr string
+				addr, n.zone, _ = strings.Cut(field, "%")
+				ip = net.ParseIP(addr)
+				continue
+			}
+
+			if (field == "dev" || field == "on") && n.zone == "" &&
+				index+1 < len(fields) {
+				n.zone = fields[index+1]
+				continue
+			}
+
+			if n.mac != nil {
+				continue
+			}
+
+			mac, err := net.ParseMAC(normalizeMAC(field))
+			if err == nil && len(mac) == 6 && !bytes.Equal(mac, make([]byte, 6)) {
+				n.mac = mac
+			}
+		}
+
+		if ip != nil && (n.mac != nil || n.zone != "") {
+			neighbors[ip.String()] = n
+		}
+	}
+
+	return neighbors
+}
+
+// normalizeMAC Returns a MAC address as net.ParseMAC takes it, colon
+// separated with two digits an octet.  Windows separates the octets with
+// dashes and macOS's arp leaves out leading zeros, e.g. "0:1b:63:a:b:c".
+func normalizeMAC(field string) string {
+	octets := strings.Split(strings.ReplaceAll(field, "-", ":"), ":")
+	if len(octets) != 6 {
+		return field
+	}
+
+	for i, octet := range octets {
+		if len(octet) == 1 {
+			octets[i] = "0" + octet
+		}
+	}
+
+	return strings.Join(octets, ":")
+}
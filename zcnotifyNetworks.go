@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// networksConfig is the [networks] section of the config file, which maps
+// CIDR ranges to the name of the segment, e.g. "192.168.20.0/24" = "IoT
+// VLAN".
+type networksConfig map[string]string
+
+// setupNetworks Checks that every [networks] key is a CIDR range with a
+// label.
+func (zcnConfig *config) setupNetworks() error {
+	for cidr, label := range zcnConfig.Networks {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("networks: %q isn't a CIDR range, e.g. 192.168.20.0/24",
+				cidr)
+		}
+
+		if strings.TrimSpace(label) == "" {
+			return fmt.Errorf("networks: %q has no label", cidr)
+		}
+	}
+
+	return nil
+}
+
+// labels Returns the labels of the networks containing any of ips, the most
+// specific network first.
+func (nc networksConfig) labels(ips []net.IP) []string {
+	type match struct {
+		label  string
+		prefix int
+	}
+
+	var matches []match
+	for cidr, label := range nc {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+
+		for _, ip := range ips {
+			if network.Contains(ip) {
+				prefix, _ := network.Mask.Size()
+				matches = append(matches, match{label: label, prefix: prefix})
+				break
+			}
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].prefix != matches[j].prefix {
+			return matches[i].prefix > matches[j].prefix
+		}
+
+		return matches[i].label < matches[j].label
+	})
+
+	var labels []string
+	seen := make(map[string]bool)
+	for _, m := range matches {
+		if !seen[m.label] {
+			seen[m.label] = true
+			labels = append(labels, m.label)
+		}
+	}
+
+	return labels
+}
+
+// tag Sets the change's Networks to the labels of the networks its
+// addresses are on.
+func (nc networksConfig) tag(change *ServiceEntryChange) {
+	if len(nc) == 0 {
+		return
+	}
+
+	change.Networks = nc.labels(append(append([]net.IP(nil),
+		change.Entry.AddrIPv4...),
+		change.Entry.AddrIPv6...))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// notifier is implemented by every notification backend.  Each configured
+// backend block (e.g. [email.pdmorrow]) is a separate notifier.
+type notifier interface {
+	// Name returns the unique name of the backend block, e.g. "email.pdmorrow".
+	Name() string
+	// Allows returns true if the change passes the backend's service filter,
+	// along with the reason for the decision.
+	Allows(change *ServiceEntryChange) (bool, string)
+	// Notify delivers a single change, an error is returned if delivery
+	// failed and should be retried.
+	Notify(change *ServiceEntryChange) error
+	// Render returns the notification which Notify would deliver, without
+	// delivering it.
+	Render(change *ServiceEntryChange) (string, error)
+	// NotifyDigest delivers the changes held back during quiet hours as a
+	// single notification.
+	NotifyDigest(changes []ServiceEntryChange) error
+	// RenderDigest returns the notification which NotifyDigest would
+	// deliver, without delivering it.
+	RenderDigest(changes []ServiceEntryChange) (string, error)
+	// Check verifies that the backend can be reached with the configured
+	// settings, without delivering anything.
+	Check() error
+}
+
+// seeder is implemented by notifiers which need to know about the services
+// found by a previous run, as those aren't reported as added.
+type seeder interface {
+	seed(entries []zeroconf.ServiceEntry)
+}
+
+// follower is implemented by notifiers which send the whole inventory, they
+// are given the registry of the services present to take it from.
+type follower interface {
+	follow(registry *serviceRegistry)
+}
+
+// inheritor is implemented by notifiers with state which outlives a reload,
+// they take it over from the notifier of the same block they replace.
+type inheritor interface {
+	inherit(previous notifier)
+}
+
+// closer is implemented by notifiers which hold connections or run
+// goroutines, which are released once a reload has replaced the notifier.
+type closer interface {
+	close()
+}
+
+// batcher is implemented by notifiers which can deliver several changes in
+// a single message, they do so if their block's BatchSize is over 1.
+type batcher interface {
+	batch() batchConfig
+	// NotifyBatch delivers changes as a single message, an error is
+	// returned if delivery failed and the whole batch should be retried.
+	NotifyBatch(changes []ServiceEntryChange) error
+}
+
+// buildNotifiers Creates a notifier for every backend block of every
+// configured notification type.
+func buildNotifiers(zConfig *config) ([]notifier, error) {
+	var notifiers []notifier
+	for _, notifyType := range zConfig.NotifyTypes {
+		bt, err := lookupBackendType(notifyType)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range bt.names(zConfig) {
+			notifiers = append(notifiers, bt.create(zConfig, name))
+		}
+	}
+
+	return notifiers, nil
+}
+
+// backendNames Returns the names of the backends buildNotifiers creates,
+// e.g. "email.ops", without creating them, so that the sections which name
+// backends can be checked without connecting to anything.
+func (zcnConfig *config) backendNames() (map[string]bool, error) {
+	backends := make(map[string]bool)
+	for _, notifyType := range zcnConfig.NotifyTypes {
+		bt, err := lookupBackendType(notifyType)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range bt.names(zcnConfig) {
+			backends[bt.name+"."+name] = true
+		}
+	}
+
+	return backends, nil
+}
+
+// dryRunNotifier Wraps a notifier so that notifications are rendered and
+// logged rather than delivered.
+type dryRunNotifier struct {
+	notifier
+}
+
+func (drn dryRunNotifier) Notify(change *ServiceEntryChange) error {
+	rendered, err := drn.Render(change)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("dry run, not sending notification",
+		changeAttrs(change),
+		"backend", drn.Name(),
+		"notification", rendered)
+	return nil
+}
+
+func (drn dryRunNotifier) NotifyDigest(changes []ServiceEntryChange) error {
+	rendered, err := drn.RenderDigest(changes)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("dry run, not sending digest",
+		"backend", drn.Name(),
+		"changes", len(changes),
+		"notification", rendered)
+	return nil
+}
+
+// dryRun Wraps every notifier so that nothing is delivered.
+func dryRun(notifiers []notifier) []notifier {
+	wrapped := make([]notifier, 0, len(notifiers))
+	for _, n := range notifiers {
+		wrapped = append(wrapped, dryRunNotifier{n})
+	}
+
+	return wrapped
+}
+
+// shadowNotifier Renames a notifier of the shadow pipeline.
+type shadowNotifier struct {
+	notifier
+}
+
+func (sn shadowNotifier) Name() string {
+	return "shadow:" + sn.notifier.Name()
+}
+
+// shadowed Wraps every notifier of the shadow pipeline.
+func shadowed(notifiers []notifier) []notifier {
+	wrapped := make([]notifier, 0, len(notifiers))
+	for _, n := range notifiers {
+		wrapped = append(wrapped, shadowNotifier{n})
+	}
+
+	return wrapped
+}
+
+// testChange Returns a synthetic change, used to check that backends are
+// configured correctly.  The addresses are from the documentation ranges.
+func testChange(changeType ServiceChangeType, zcnConfig *config) ServiceEntryChange {
+	entry := zeroconf.NewServiceEntry("zcnotify test notification",
+		zcnConfig.Watch[0].Service,
+		zcnConfig.Watch[0].Domains[0])
+	entry.HostName = "zcnotify-test.local."
+	entry.Port = 9
+	entry.Text = []string{"test=1"}
+	entry.TTL = 120
+	entry.AddrIPv4 = []net.IP{net.ParseIP("192.0.2.1")}
+	entry.AddrIPv6 = []net.IP{net.ParseIP("2001:db8::1")}
+
+	return ServiceEntryChange{ChangeType: changeType,
+		Timestamp: time.Now().UTC(),
+		Entry:     *entry}
+}
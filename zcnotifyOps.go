@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	// OPS_INSTANCE is the instance name of the entries of ops events.
+	OPS_INSTANCE string = "zcnotify"
+	// Number of ops events waiting for the pipeline before more are
+	// dropped.
+	OPS_EVENT_BACKLOG uint = 16
+	// How long the STOPPED event may take to deliver before zcnotify exits
+	// anyway.
+	OPS_STOP_TIMEOUT time.Duration = 10 * time.Second
+)
+
+// opsEvents carries zcnotify's own events, raised by the watchers, the
+// delivery queues and run, to the pipeline.
+var opsEvents = make(chan ServiceEntryChange, OPS_EVENT_BACKLOG)
+
+// opsConfig controls the events zcnotify raises about itself: starting,
+// stopping, reloading its config, watchers whose browses fail and backends
+// which give up on notifications.
+type opsConfig struct {
+	// Backends to notify of ops events, they're only logged and written to
+	// the history if empty.
+	Notify []string
+	// Events to raise, of STARTED, STOPPED, RELOADED, ERROR and
+	// BACKEND_FAILED, all of them if empty.
+	Events []string
+}
+
+// setupOps Checks the [ops] section.
+func (zcnConfig *config) setupOps() error {
+	for _, event := range zcnConfig.Ops.Events {
+		changeType, err := parseServiceChangeType(event)
+		if err != nil || !changeType.ops() {
+			return fmt.Errorf("ops: unknown event %q in Events", event)
+		}
+	}
+
+	if len(zcnConfig.Ops.Notify) == 0 {
+		return nil
+	}
+
+	backends, err := zcnConfig.backendNames()
+	if err != nil {
+		return err
+	}
+
+	for _, backend := range zcnConfig.Ops.Notify {
+		if !backends[backend] {
+			return fmt.Errorf("ops: unknown backend %q in Notify", backend)
+		}
+	}
+
+	return nil
+}
+
+// raises Returns true if events of changeType are raised.
+func (oc *opsConfig) raises(changeType ServiceChangeType) bool {
+	return len(oc.Events) == 0 || matchChangeType(oc.Events, changeType)
+}
+
+// newOpsEvent Returns an ops event, its entry stands for this host's
+// zcnotify.
+func newOpsEvent(changeType ServiceChangeType,
+	details map[string]string) ServiceEntryChange {
+	entry := zeroconf.NewServiceEntry(OPS_INSTANCE, "", "")
+	entry.HostName, _ = os.Hostname()
+	return ServiceEntryChange{ChangeType: changeType,
+		Timestamp: time.Now().UTC(),
+		Entry:     *entry,
+		Details:   details}
+}
+
+// newErrorEvent Returns the ERROR event for a failure browsing service in
+// domain.
+func newErrorEvent(service string, domain string, err error) ServiceEntryChange {
+	change := newOpsEvent(ERROR, nil)
+	change.Entry.Service = service
+	change.Entry.Domain = domain
+	change.Error = err.Error()
+	return change
+}
+
+// newBackendFailedEvent Returns the BACKEND_FAILED event for a backend which
+// gave up on a notification.
+func newBackendFailedEvent(backend string, err error) ServiceEntryChange {
+	change := newOpsEvent(BACKEND_FAILED, map[string]string{"backend": backend})
+	change.Error = err.Error()
+	return change
+}
+
+// raiseOpsEvent Passes an ops event to the pipeline, dropping it rather than
+// blocking if the pipeline is backlogged.
+func raiseOpsEvent(change ServiceEntryChange) {
+	select {
+	case opsEvents <- change:
+		break
+	default:
+		slog.Warn("ops events backlogged, dropping one",
+			"changeType", change.ChangeType.String())
+	}
+}
+
+// errorReporter Raises an ERROR event when a watcher's browses start
+// failing, rather than on every retry, and logs when they work again.
+type errorReporter struct {
+	service string
+	domain  string
+	failing bool
+}
+
+// browsed Records the result of a browse.
+func (er *errorReporter) browsed(err error) {
+	if err == nil {
+		if er.failing {
+			er.failing = false
+			slog.Info("browsing recovered", "service", er.service, "domain", er.domain)
+		}
+		return
+	}
+
+	// Browses of the shared resolver which waited too long for their turn
+	// are retried without raising an alarm.
+	if !er.failing && !errors.Is(err, errBrowseStarved) {
+		er.failing = true
+		raiseOpsEvent(newErrorEvent(er.service, er.domain, err))
+	}
+}
+
+// configSummary Returns the details of the STARTED event.
+func configSummary(zcnConfig *config,
+	queues []*deliveryQueue,
+	intfs []net.Interface) map[string]string {
+	var watched []string
+	for _, target := range zcnConfig.browseTargets() {
+		watched = append(watched, target.Service+"."+target.Domain)
+	}
+
+	var backends []string
+	for _, queue := range queues {
+		backends = append(backends, queue.route)
+	}
+
+	return map[string]string{"version": version,
+		"watching":   strings.Join(watched, ", "),
+		"backends":   strings.Join(backends, ", "),
+		"interfaces": strings.Join(interfaceNames(intfs), ", "),
+		"passive":    strconv.FormatBool(zcnConfig.Zeroconf.Passive),
+		"dryRun":     strconv.FormatBool(zcnConfig.DryRun)}
+}
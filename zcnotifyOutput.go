@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	OUTPUT_TABLE string = "table"
+	OUTPUT_JSON  string = "json"
+	OUTPUT_YAML  string = "yaml"
+	OUTPUT_CSV   string = "csv"
+)
+
+// entryRecord is a flattened service entry used for the YAML and CSV
+// output formats.
+type entryRecord struct {
+	Instance string   `yaml:"instance"`
+	Service  string   `yaml:"service"`
+	Domain   string   `yaml:"domain"`
+	HostName string   `yaml:"hostname"`
+	Port     int      `yaml:"port"`
+	AddrIPv4 []string `yaml:"addrIPv4"`
+	AddrIPv6 []string `yaml:"addrIPv6"`
+	Text     []string `yaml:"text"`
+	TTL      uint32   `yaml:"ttl"`
+}
+
+func newEntryRecord(entry *zeroconf.ServiceEntry) entryRecord {
+	record := entryRecord{Instance: entry.Instance,
+		Service:  entry.Service,
+		Domain:   entry.Domain,
+		HostName: entry.HostName,
+		Port:     entry.Port,
+		Text:     entry.Text,
+		TTL:      entry.TTL}
+	for _, ip := range entry.AddrIPv4 {
+		record.AddrIPv4 = append(record.AddrIPv4, ip.String())
+	}
+
+	for _, ip := range entry.AddrIPv6 {
+		record.AddrIPv6 = append(record.AddrIPv6, ip.String())
+	}
+
+	return record
+}
+
+// serviceEntry Returns the service entry described by the record.
+func (er *entryRecord) serviceEntry() (zeroconf.ServiceEntry, error) {
+	entry := zeroconf.NewServiceEntry(er.Instance, er.Service, er.Domain)
+	entry.HostName = er.HostName
+	entry.Port = er.Port
+	entry.Text = er.Text
+	entry.TTL = er.TTL
+	for _, addr := range er.AddrIPv4 {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return *entry, fmt.Errorf("%q: invalid address %q", er.Instance, addr)
+		}
+		entry.AddrIPv4 = append(entry.AddrIPv4, ip)
+	}
+
+	for _, addr := range er.AddrIPv6 {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return *entry, fmt.Errorf("%q: invalid address %q", er.Instance, addr)
+		}
+		entry.AddrIPv6 = append(entry.AddrIPv6, ip)
+	}
+
+	return *entry, nil
+}
+
+// csvRow Returns the record as a CSV row, lists are separated by ';'.
+func (er *entryRecord) csvRow() []string {
+	return []string{er.Instance,
+		er.Service,
+		er.Domain,
+		er.HostName,
+		strconv.Itoa(er.Port),
+		strings.Join(er.AddrIPv4, ";"),
+		strings.Join(er.AddrIPv6, ";"),
+		strings.Join(er.Text, ";"),
+		strconv.FormatUint(uint64(er.TTL), 10)}
+}
+
+var entryCSVHeader = []string{"instance",
+	"service",
+	"domain",
+	"hostname",
+	"port",
+	"addrIPv4",
+	"addrIPv6",
+	"text",
+	"ttl"}
+
+// newCSVRecord Returns the record held by a CSV row, columns are found by
+// their name in header.
+func newCSVRecord(header []string, row []string) (entryRecord, error) {
+	fields := make(map[string]string)
+	for i, name := range header {
+		if i < len(row) {
+			fields[strings.ToLower(name)] = row[i]
+		}
+	}
+
+	list := func(field string) []string {
+		if fields[field] == "" {
+			return nil
+		}
+		return strings.Split(fields[field], ";")
+	}
+
+	record := entryRecord{Instance: fields["instance"],
+		Service:  fields["service"],
+		Domain:   fields["domain"],
+		HostName: fields["hostname"],
+		AddrIPv4: list("addripv4"),
+		AddrIPv6: list("addripv6"),
+		Text:     list("text")}
+
+	var err error
+	if fields["port"] != "" {
+		if record.Port, err = strconv.Atoi(fields["port"]); err != nil {
+			return record, fmt.Errorf("%q: invalid port %q", record.Instance, fields["port"])
+		}
+	}
+
+	if fields["ttl"] != "" {
+		ttl, err := strconv.ParseUint(fields["ttl"], 10, 32)
+		if err != nil {
+			return record, fmt.Errorf("%q: invalid ttl %q", record.Instance, fields["ttl"])
+		}
+		record.TTL = uint32(ttl)
+	}
+
+	return record, nil
+}
+
+// readEntries Reads a list of services in the given format, as written by
+// writeEntries.
+func readEntries(r io.Reader, format string) ([]zeroconf.ServiceEntry, error) {
+	var records []entryRecord
+	switch format {
+	case OUTPUT_JSON:
+		var jsonEntries []serviceEntryJSON
+		if err := json.NewDecoder(r).Decode(&jsonEntries); err != nil {
+			return nil, err
+		}
+
+		entries := make([]zeroconf.ServiceEntry, 0, len(jsonEntries))
+		for i := range jsonEntries {
+			entries = append(entries, jsonEntries[i].serviceEntry())
+		}
+		return entries, nil
+	case OUTPUT_YAML:
+		if err := yaml.NewDecoder(r).Decode(&records); err != nil && err != io.EOF {
+			return nil, err
+		}
+		break
+	case OUTPUT_CSV:
+		rows, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+
+		for i := 1; i < len(rows); i++ {
+			record, err := newCSVRecord(rows[0], rows[i])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", i+1, err.Error())
+			}
+			records = append(records, record)
+		}
+		break
+	default:
+		return nil, fmt.Errorf("unknown input format %q", format)
+	}
+
+	entries := make([]zeroconf.ServiceEntry, 0, len(records))
+	for i := range records {
+		entry, err := records[i].serviceEntry()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// joinIPs Returns a comma separated list of addresses, or "-" if there are
+// none.
+func joinIPs(ips []net.IP) string {
+	if len(ips) == 0 {
+		return "-"
+	}
+
+	var strs []string
+	for _, ip := range ips {
+		strs = append(strs, ip.String())
+	}
+
+	return strings.Join(strs, ",")
+}
+
+// writeEntries Writes a list of services in the requested format.
+func writeEntries(w io.Writer, entries []zeroconf.ServiceEntry, format string) error {
+	switch format {
+	case OUTPUT_TABLE:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "INSTANCE\tSERVICE\tHOST\tPORT\tIPV4\tIPV6\tTTL")
+		for i := range entries {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%d\n",
+				entries[i].Instance,
+				entries[i].Service,
+				entries[i].HostName,
+				entries[i].Port,
+				joinIPs(entries[i].AddrIPv4),
+				joinIPs(entries[i].AddrIPv6),
+				entries[i].TTL)
+		}
+		return tw.Flush()
+	case OUTPUT_JSON:
+		jsonEntries := make([]serviceEntryJSON, 0, len(entries))
+		for i := range entries {
+			jsonEntries = append(jsonEntries, newServiceEntryJSON(&entries[i]))
+		}
+
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "    ")
+		return encoder.Encode(jsonEntries)
+	case OUTPUT_YAML:
+		records := make([]entryRecord, 0, len(entries))
+		for i := range entries {
+			records = append(records, newEntryRecord(&entries[i]))
+		}
+
+		encoder := yaml.NewEncoder(w)
+		if err := encoder.Encode(records); err != nil {
+			return err
+		}
+		return encoder.Close()
+	case OUTPUT_CSV:
+		cw := csv.NewWriter(w)
+		cw.Write(entryCSVHeader)
+		for i := range entries {
+			record := newEntryRecord(&entries[i])
+			cw.Write(record.csvRow())
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// writeChanges Writes a list of changes in the requested format.
+func writeChanges(w io.Writer, changes []ServiceEntryChange, format string) error {
+	switch format {
+	case OUTPUT_TABLE:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "TIMESTAMP\tCHANGE\tINSTANCE\tSERVICE\tHOST\tPORT\tINTERFACE")
+		for _, change := range changes {
+			intf := change.Interface
+			if intf == "" {
+				intf = "-"
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+				change.Timestamp.Format(time.RFC3339),
+				change.ChangeType.String(),
+				change.Entry.Instance,
+				change.Entry.Service,
+				change.Entry.HostName,
+				change.Entry.Port,
+				intf)
+		}
+		return tw.Flush()
+	case OUTPUT_JSON:
+		if changes == nil {
+			changes = []ServiceEntryChange{}
+		}
+
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "    ")
+		return encoder.Encode(changes)
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// writeAvailability Writes an availability report in the requested format.
+func writeAvailability(w io.Writer, report []availability, format string) error {
+	switch format {
+	case OUTPUT_TABLE:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "INSTANCE\tSERVICE\tAVAILABILITY\tOUTAGES\tPRESENT\tFIRST SEEN\tLAST SEEN")
+		for _, row := range report {
+			fmt.Fprintf(tw, "%s\t%s\t%.2f%%\t%d\t%t\t%s\t%s\n",
+				row.Instance,
+				row.Service,
+				row.Percent,
+				row.Outages,
+				row.Present,
+				row.FirstSeen.Format(time.RFC3339),
+				row.LastSeen.Format(time.RFC3339))
+		}
+		return tw.Flush()
+	case OUTPUT_JSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "    ")
+		return encoder.Encode(report)
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
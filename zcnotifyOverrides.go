@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const CONFIG_ENV_PREFIX string = "ZCNOTIFY_"
+
+var (
+	// errUnknownSetting is returned for an override which doesn't name a
+	// config setting.
+	errUnknownSetting = errors.New("unknown setting")
+	// errNotScalar is returned for an override which names a section or
+	// block rather than a single setting.
+	errNotScalar = errors.New("can only be set in the config file")
+)
+
+// configOverride replaces a single config setting.  path names the setting
+// as in the config file with sections separated by dots, e.g.
+// "zeroconf.service" or "email.ops.to".
+type configOverride struct {
+	path  string
+	value string
+}
+
+// configShortcut is a flag and environment variable for a commonly set
+// setting.  The settings in clear are emptied, so the shortcut replaces
+// rather than adds to what the config file says.
+type configShortcut struct {
+	name  string
+	path  string
+	clear []string
+	usage string
+}
+
+var configShortcuts = []configShortcut{
+	{"service", "Zeroconf.Service", nil,
+		"Service type to watch, e.g. _http._tcp"},
+	{"domain", "Zeroconf.Domains", []string{"Zeroconf.Domain"},
+		"Domains to browse, comma separated"},
+	{"scan-period", "ScanPeriodSeconds", nil,
+		"Seconds between scans"},
+	{"interfaces", "Interfaces.Use", nil,
+		"Interfaces to use, comma separated glob patterns"},
+	{"notify-types", "NotifyTypes", nil,
+		"Backends to notify, comma separated (email, alertmanager, mqtt, ...)"},
+	{"console-format", "Console.default.Format", nil,
+		"Format of the console backend's events, text or json"},
+}
+
+// overrides Returns the overrides for the shortcut set to value.
+func (cs *configShortcut) overrides(value string) []configOverride {
+	overrides := []configOverride{{path: cs.path, value: value}}
+	for _, path := range cs.clear {
+		overrides = append(overrides, configOverride{path: path})
+	}
+
+	return overrides
+}
+
+// addOverrideFlags Registers -set and the shortcut flags on fs, the overrides
+// are appended to overrides in the order they're given.
+func addOverrideFlags(fs *flag.FlagSet, overrides *[]configOverride) {
+	fs.Func("set",
+		"Override a config setting, e.g. -set zeroconf.service=_http._tcp (repeatable)",
+		func(arg string) error {
+			path, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				return errors.New("expected setting=value")
+			}
+
+			*overrides = append(*overrides, configOverride{path: path, value: value})
+			return nil
+		})
+
+	for i := range configShortcuts {
+		shortcut := &configShortcuts[i]
+		fs.Func(shortcut.name,
+			shortcut.usage+", overrides the config file",
+			func(value string) error {
+				*overrides = append(*overrides, shortcut.overrides(value)...)
+				return nil
+			})
+	}
+}
+
+// envOverrides Returns the overrides given by ZCNOTIFY_* variables in
+// environ, which name a setting with underscores between sections, e.g.
+// ZCNOTIFY_ZEROCONF_SERVICE, or are a shortcut such as ZCNOTIFY_SERVICE.
+// Variables which don't name a setting are left alone, they may be secrets
+// referred to by the config file.
+func envOverrides(environ []string) []configOverride {
+	var overrides []configOverride
+	for _, variable := range environ {
+		name, value, _ := strings.Cut(variable, "=")
+		if !strings.HasPrefix(name, CONFIG_ENV_PREFIX) {
+			continue
+		}
+
+		name = strings.ToLower(strings.TrimPrefix(name, CONFIG_ENV_PREFIX))
+		shortcut := strings.ReplaceAll(name, "_", "-")
+		found := false
+		for i := range configShortcuts {
+			if configShortcuts[i].name == shortcut {
+				overrides = append(overrides, configShortcuts[i].overrides(value)...)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			overrides = append(overrides,
+				configOverride{path: strings.ReplaceAll(name, "_", "."), value: value})
+		}
+	}
+
+	return overrides
+}
+
+// applyOverrides Sets each override in zcnConfig, in order.  If ignoreUnknown
+// is set overrides which don't name a setting, or name a whole section, are
+// skipped.
+func applyOverrides(zcnConfig *config,
+	overrides []configOverride,
+	ignoreUnknown bool) error {
+	for _, override := range overrides {
+		err := setConfigField(reflect.ValueOf(zcnConfig).Elem(),
+			strings.Split(override.path, "."),
+			override.value)
+		if (errors.Is(err, errUnknownSetting) || errors.Is(err, errNotScalar)) &&
+			ignoreUnknown {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("setting %q: %s", override.path, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// setConfigField Sets the setting named by names within v.  Names are
+// matched without regard to case as they are in the config file, and backend
+// blocks are created if they don't exist.  A setting of the backend blocks
+// named without a block, e.g. "email.password", is set in every block.
+func setConfigField(v reflect.Value, names []string, value string) error {
+	if len(names) == 0 {
+		return parseConfigValue(v, value)
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		field := v.FieldByNameFunc(func(name string) bool {
+			return strings.EqualFold(name, names[0])
+		})
+		if !field.IsValid() || !field.CanSet() {
+			return errUnknownSetting
+		}
+
+		return setConfigField(field, names[1:], value)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return errUnknownSetting
+		}
+
+		if len(names) == 1 && v.Type().Elem().Kind() == reflect.Struct &&
+			blockField(v.Type().Elem(), names[0]) {
+			return setBlocksField(v, names[0], value)
+		}
+
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+
+		// Map elements can't be set in place, so the block is copied,
+		// updated and stored.
+		key := reflect.ValueOf(names[0]).Convert(v.Type().Key())
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if existing := v.MapIndex(key); existing.IsValid() {
+			elem.Set(existing)
+		}
+
+		if err := setConfigField(elem, names[1:], value); err != nil {
+			return err
+		}
+
+		v.SetMapIndex(key, elem)
+		return nil
+	}
+
+	return errUnknownSetting
+}
+
+// blockField Returns true if the block type t has a setting called name
+// which holds a single value rather than a section.
+func blockField(t reflect.Type, name string) bool {
+	field, ok := t.FieldByNameFunc(func(fieldName string) bool {
+		return strings.EqualFold(fieldName, name)
+	})
+	if !ok || !field.IsExported() {
+		return false
+	}
+
+	switch field.Type.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Pointer, reflect.Interface:
+		return false
+	}
+
+	return true
+}
+
+// setBlocksField Sets the setting called name in every block of the map v.
+func setBlocksField(v reflect.Value, name string, value string) error {
+	iter := v.MapRange()
+	for iter.Next() {
+		elem := reflect.New(v.Type().Elem()).Elem()
+		elem.Set(iter.Value())
+		if err := setConfigField(elem, []string{name}, value); err != nil {
+			return err
+		}
+
+		v.SetMapIndex(iter.Key(), elem)
+	}
+
+	return nil
+}
+
+// parseConfigValue Sets v from its string form.  Lists are comma separated
+// and maps are comma separated key=value pairs.
+func parseConfigValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+		return nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q isn't true or false", value)
+		}
+		v.SetBool(b)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q isn't a positive whole number", value)
+		}
+		v.SetUint(u)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q isn't a whole number", value)
+		}
+		v.SetInt(i)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q isn't a number", value)
+		}
+		v.SetFloat(f)
+		return nil
+	case reflect.Slice:
+		list := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, item := range splitList(value) {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := parseConfigValue(elem, item); err != nil {
+				return err
+			}
+			list = reflect.Append(list, elem)
+		}
+		v.Set(list)
+		return nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String ||
+			v.Type().Elem().Kind() == reflect.Struct {
+			break
+		}
+
+		m := reflect.MakeMap(v.Type())
+		for _, item := range splitList(value) {
+			key, itemValue, ok := strings.Cut(item, "=")
+			if !ok {
+				return fmt.Errorf("expected key=value, got %q", item)
+			}
+
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := parseConfigValue(elem, itemValue); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		}
+		v.Set(m)
+		return nil
+	}
+
+	return errNotScalar
+}
+
+// splitList Splits a comma separated list, an empty value is an empty list.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
+)
+
+const (
+	// How long an instance whose PTR record hasn't been seen is kept, the
+	// TTL RFC 6762 recommends for PTR records.
+	DEFAULT_PASSIVE_TTL uint32 = 4500
+	// Largest mDNS packet, RFC 6762 section 17.
+	mdnsMaxPacket int = 9000
+	// Top bit of the class of a record which replaces those cached.
+	mdnsCacheFlush uint16 = 1 << 15
+	// Most instances and hosts a sniffer remembers, beyond which those
+	// heard from longest ago are forgotten, so a flood of made up records
+	// can't use up the memory.
+	PASSIVE_MAX_INSTANCES int = 8192
+	PASSIVE_MAX_HOSTS     int = 8192
+	// How often the instances whose PTR record has expired are forgotten,
+	// along with the instances and hosts not heard from for
+	// DEFAULT_PASSIVE_TTL.
+	PASSIVE_SWEEP_INTERVAL = time.Minute
+)
+
+var (
+	mdnsIPv4Group = &net.UDPAddr{IP: net.ParseIP("224.0.0.251"), Port: 5353}
+	mdnsIPv6Group = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+
+	passivePacketsMetric = metrics.newCounter("zcnotify_passive_packets_total",
+		"mDNS responses observed in passive mode.")
+)
+
+// sniffedInstance is what has been heard about a single service instance.
+type sniffedInstance struct {
+	instance string
+	service  string
+	domain   string
+	// When the instance's PTR record expires, zero until one is seen.
+	expires time.Time
+	// When the PTR record was last heard.
+	heard time.Time
+	// When any of the instance's records was last heard.
+	updated  time.Time
+	ttl      uint32
+	hostName string
+	port     int
+	text     []string
+	// Addresses last seen for the host, kept once its address records
+	// have expired as they're only sent when someone asks.
+	addrIPv4 []net.IP
+	addrIPv6 []net.IP
+	// When the PTR record of each subtype the instance has been heard of
+	// expires, by subtype in lower case.
+	subtypes map[string]time.Time
+}
+
+// hasSubtype Returns true if the instance has subtype, or subtype is empty.
+func (si *sniffedInstance) hasSubtype(subtype string, now time.Time) bool {
+	if subtype == "" {
+		return true
+	}
+
+	expires, ok := si.subtypes[strings.ToLower(subtype)]
+	return ok && now.Before(expires)
+}
+
+// sniffedHost is the addresses heard for a single host name.
+type sniffedHost struct {
+	addrIPv4 []net.IP
+	addrIPv6 []net.IP
+	// When an address of the host was last heard.
+	heard time.Time
+}
+
+// passiveSniffer Builds the inventory from the mDNS responses other hosts
+// send, without sending any queries itself.  A service is only seen when it
+// announces itself or answers somebody else's query, so it may take a while
+// for everything to appear.  The shared resolver is a sniffer whose
+// scheduler does send queries.
+type passiveSniffer struct {
+	mutex     sync.Mutex
+	conns     []*net.UDPConn
+	instances map[string]*sniffedInstance
+	hosts     map[string]*sniffedHost
+	swept     time.Time
+	scheduler *browseScheduler
+}
+
+// mdnsHandler is called with every mDNS packet received, from the sender to
+// the group.
+type mdnsHandler func(packet []byte, from *net.UDPAddr, group *net.UDPAddr)
+
+// listenMDNS Joins the mDNS groups of the given IP versions on intfs and
+// passes every packet received to handle until the connections returned are
+// closed.  Interfaces which can't be listened on are logged and skipped.
+func listenMDNS(ipver zeroconf.IPType,
+	intfs []net.Interface,
+	handle mdnsHandler) ([]*net.UDPConn, error) {
+	var conns []*net.UDPConn
+	for index := range intfs {
+		for _, group := range []*net.UDPAddr{mdnsIPv4Group, mdnsIPv6Group} {
+			network := "udp4"
+			if group == mdnsIPv6Group {
+				if ipver&zeroconf.IPv6 == 0 {
+					continue
+				}
+				network = "udp6"
+			} else if ipver&zeroconf.IPv4 == 0 {
+				continue
+			}
+
+			conn, err := net.ListenMulticastUDP(network, &intfs[index], group)
+			if err != nil {
+				slog.Warn("failed to listen for mDNS",
+					"interface", intfs[index].Name,
+					"group", group.IP,
+					"err", err)
+				continue
+			}
+
+			conns = append(conns, conn)
+			go readMDNS(conn, group, handle)
+		}
+	}
+
+	if len(conns) == 0 {
+		return nil, errors.New("failed to listen for mDNS on any interface")
+	}
+
+	return conns, nil
+}
+
+// readMDNS Reads packets from conn until it's closed.
+func readMDNS(conn *net.UDPConn, group *net.UDPAddr, handle mdnsHandler) {
+	buf := make([]byte, mdnsMaxPacket)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			slog.Debug("failed to read mDNS packet", "err", err)
+			continue
+		}
+
+		handle(buf[:n], from, group)
+	}
+}
+
+// newPassiveSniffer Starts listening for mDNS traffic on intfs with the given
+// IP versions.
+func newPassiveSniffer(ipver zeroconf.IPType,
+	intfs []net.Interface) (*passiveSniffer, error) {
+	ps := &passiveSniffer{instances: make(map[string]*sniffedInstance),
+		hosts: make(map[string]*sniffedHost)}
+
+	conns, err := listenMDNS(ipver, intfs, ps.handle)
+	if err != nil {
+		return nil, err
+	}
+
+	ps.conns = conns
+	return ps, nil
+}
+
+// stop Stops listening.
+func (ps *passiveSniffer) stop() {
+	if ps.scheduler != nil {
+		ps.scheduler.stop()
+	}
+
+	for _, conn := range ps.conns {
+		conn.Close()
+	}
+}
+
+// seed Adds services which are already known, so they aren't reported as
+// removed just because they haven't been heard from yet.  They're kept for
+// DEFAULT_PASSIVE_TTL unless they say goodbye first.
+func (ps *passiveSniffer) seed(known []zeroconf.ServiceEntry) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	expires := time.Now().Add(time.Duration(DEFAULT_PASSIVE_TTL) * time.Second)
+	for _, entry := range known {
+		if entry.Domain != DEFAULT_DOMAIN {
+			continue
+		}
+
+		// The instances of a subtype are those of its service type.
+		subtype, service := splitSubtype(entry.Service)
+		key := strings.ToLower(zeroconf.NewServiceEntry(entry.Instance,
+			service,
+			entry.Domain).ServiceInstanceName())
+		si, ok := ps.instances[key]
+		if !ok {
+			si = &sniffedInstance{instance: entry.Instance,
+				service:  service,
+				domain:   entry.Domain,
+				expires:  expires,
+				updated:  time.Now(),
+				ttl:      entry.TTL,
+				hostName: entry.HostName,
+				port:     entry.Port,
+				text:     entry.Text,
+				addrIPv4: entry.AddrIPv4,
+				addrIPv6: entry.AddrIPv6}
+			ps.instances[key] = si
+		}
+
+		if subtype != "" {
+			if si.subtypes == nil {
+				si.subtypes = make(map[string]time.Time)
+			}
+			si.subtypes[strings.ToLower(subtype)] = expires
+		}
+	}
+}
+
+// handle Implements mdnsHandler.  Queries are ignored, the known answers
+// they carry may be out of date.
+func (ps *passiveSniffer) handle(packet []byte, from *net.UDPAddr, group *net.UDPAddr) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(packet); err != nil || !msg.Response {
+		return
+	}
+
+	passivePacketsMetric.With().Inc()
+	ps.observe(append(msg.Answer, msg.Extra...))
+}
+
+// instanceKey Returns the key of the instance named name in DNS presentation
+// format, which is its ServiceInstanceName in lower case.
+func instanceKey(name string) string {
+	return strings.ToLower(unescapeInstance(name))
+}
+
+// instance Returns the record of the instance named name, creating it if
+// need be, and marks it as heard.  The mutex is held.
+func (ps *passiveSniffer) instance(name string, now time.Time) *sniffedInstance {
+	key := instanceKey(name)
+	si, ok := ps.instances[key]
+	if !ok {
+		if len(ps.instances) >= PASSIVE_MAX_INSTANCES {
+			ps.sweep(now)
+		}
+		if len(ps.instances) >= PASSIVE_MAX_INSTANCES {
+			evictOldest(ps.instances, func(si *sniffedInstance) time.Time {
+				return si.updated
+			})
+		}
+
+		si = &sniffedInstance{}
+		ps.instances[key] = si
+	}
+	si.updated = now
+
+	return si
+}
+
+// addHost Stores the addresses of host, making room for it if need be.  The
+// mutex is held.
+func (ps *passiveSniffer) addHost(host string, sh *sniffedHost, now time.Time) {
+	if _, ok := ps.hosts[host]; !ok {
+		if len(ps.hosts) >= PASSIVE_MAX_HOSTS {
+			ps.sweep(now)
+		}
+		if len(ps.hosts) >= PASSIVE_MAX_HOSTS {
+			evictOldest(ps.hosts, func(sh *sniffedHost) time.Time {
+				return sh.heard
+			})
+		}
+	}
+
+	ps.hosts[host] = sh
+}
+
+// sweep Forgets the instances which have expired, those whose PTR record
+// hasn't been heard which haven't been heard from for DEFAULT_PASSIVE_TTL,
+// and the hosts whose addresses haven't been heard for as long.  The mutex
+// is held.
+func (ps *passiveSniffer) sweep(now time.Time) {
+	ps.swept = now
+	stale := now.Add(-time.Duration(DEFAULT_PASSIVE_TTL) * time.Second)
+	for key, si := range ps.instances {
+		if (si.expires.IsZero() && si.updated.Before(stale)) ||
+			(!si.expires.IsZero() && now.After(si.expires)) {
+			delete(ps.instances, key)
+		}
+	}
+
+	for host, sh := range ps.hosts {
+		if sh.heard.Before(stale) {
+			delete(ps.hosts, host)
+		}
+	}
+}
+
+// evictOldest Removes the item heard from longest ago, as heard says.
+func evictOldest[T any](items map[string]T, heard func(item T) time.Time) {
+	var oldest string
+	var oldestHeard time.Time
+	for key, item := range items {
+		if oldest == "" || heard(item).Before(oldestHeard) {
+			oldest = key
+			oldestHeard = heard(item)
+		}
+	}
+
+	delete(items, oldest)
+}
+
+// observe Records what a single response says.  A TTL of zero is a goodbye,
+// the record is withdrawn.
+func (ps *passiveSniffer) observe(records []dns.RR) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(ps.swept) >= PASSIVE_SWEEP_INTERVAL {
+		ps.sweep(now)
+	}
+
+	// Address records with the cache flush bit replace what was known of
+	// the host, so collect each host's addresses before storing them.
+	flushed := make(map[string]*sniffedHost)
+	for _, rr := range records {
+		hdr := rr.Header()
+		switch record := rr.(type) {
+		case *dns.PTR:
+			subtype := ""
+			service, domain, ok := splitServiceName(hdr.Name)
+			if !ok {
+				subtype, service, domain, ok = splitSubtypeName(hdr.Name)
+			}
+			if !ok {
+				break
+			}
+
+			instanceName := strings.TrimSuffix(record.Ptr, ".")
+			suffix := "." + service + "." + domain
+			if len(instanceName) <= len(suffix) ||
+				!strings.EqualFold(instanceName[len(instanceName)-len(suffix):], suffix) {
+				break
+			}
+
+			// A subtype's goodbye only withdraws the instance from the
+			// subtype.
+			if hdr.Ttl == 0 {
+				if subtype == "" {
+					delete(ps.instances, instanceKey(record.Ptr))
+				} else if si, ok := ps.instances[instanceKey(record.Ptr)]; ok {
+					delete(si.subtypes, strings.ToLower(subtype))
+				}
+				break
+			}
+
+			si := ps.instance(record.Ptr, now)
+			si.instance = unescapeInstance(instanceName[:len(instanceName)-len(suffix)])
+			si.service = strings.ToLower(service)
+			si.domain = strings.ToLower(domain)
+			si.ttl = hdr.Ttl
+			si.heard = now
+			si.expires = si.heard.Add(time.Duration(hdr.Ttl) * time.Second)
+			if subtype != "" {
+				if si.subtypes == nil {
+					si.subtypes = make(map[string]time.Time)
+				}
+				si.subtypes[strings.ToLower(subtype)] = si.expires
+			}
+			break
+		case *dns.SRV:
+			si := ps.instance(hdr.Name, now)
+			if hdr.Ttl == 0 {
+				si.hostName = ""
+				break
+			}
+
+			si.hostName = record.Target
+			si.port = int(record.Port)
+			break
+		case *dns.TXT:
+			si := ps.instance(hdr.Name, now)
+			si.text = record.Txt
+			break
+		case *dns.A, *dns.AAAA:
+			host := strings.ToLower(hdr.Name)
+			var ip net.IP
+			if a, ok := rr.(*dns.A); ok {
+				ip = a.A
+			} else {
+				ip = rr.(*dns.AAAA).AAAA
+			}
+
+			if hdr.Ttl == 0 {
+				if sh, ok := ps.hosts[host]; ok {
+					sh.addrIPv4 = removeIP(sh.addrIPv4, ip)
+					sh.addrIPv6 = removeIP(sh.addrIPv6, ip)
+				}
+				break
+			}
+
+			sh := ps.hosts[host]
+			if hdr.Class&mdnsCacheFlush != 0 {
+				if flushed[host] == nil {
+					flushed[host] = &sniffedHost{}
+				}
+				sh = flushed[host]
+			} else if sh == nil {
+				sh = &sniffedHost{}
+				ps.addHost(host, sh, now)
+			}
+			sh.heard = now
+
+			if ip.To4() != nil {
+				if !containsIP(sh.addrIPv4, ip) {
+					sh.addrIPv4 = append(sh.addrIPv4, ip)
+				}
+			} else if !containsIP(sh.addrIPv6, ip) {
+				sh.addrIPv6 = append(sh.addrIPv6, ip)
+			}
+			break
+		}
+	}
+
+	for host, sh := range flushed {
+		ps.addHost(host, sh, now)
+	}
+}
+
+// browse Implements browseFunc, the instances of service in domain which
+// are current when ctx is done are sent to entries.  Instances whose SRV
+// record hasn't been heard are left out until it is.
+func (ps *passiveSniffer) browse(ctx context.Context,
+	service string,
+	domain string,
+	entries chan<- *zeroconf.ServiceEntry) error {
+	if ps.scheduler != nil {
+		return ps.scheduler.browse(ctx, service, domain, entries)
+	}
+
+	go func() {
+		defer close(entries)
+		<-ctx.Done()
+		for _, entry := range ps.current(service, domain, time.Time{}) {
+			entries <- entry
+		}
+	}()
+
+	return nil
+}
+
+// current Returns the instances of service in domain heard of, forgetting
+// those which have expired.  If since is set only the instances which have
+// answered since are returned.  If service is a subtype the instances of
+// its service type heard of as having it are returned.
+func (ps *passiveSniffer) current(service string,
+	domain string,
+	since time.Time) []*zeroconf.ServiceEntry {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	var found []*zeroconf.ServiceEntry
+	subtype, serviceType := splitSubtype(service)
+	now := time.Now()
+	for key, si := range ps.instances {
+		if si.expires.IsZero() {
+			continue
+		}
+
+		if now.After(si.expires) {
+			delete(ps.instances, key)
+			continue
+		}
+
+		if si.hostName == "" || si.heard.Before(since) ||
+			!strings.EqualFold(si.service, serviceType) ||
+			!strings.EqualFold(si.domain, domain) ||
+			!si.hasSubtype(subtype, now) {
+			continue
+		}
+
+		if sh, ok := ps.hosts[strings.ToLower(si.hostName)]; ok &&
+			(len(sh.addrIPv4) != 0 || len(sh.addrIPv6) != 0) {
+			si.addrIPv4 = sh.addrIPv4
+			si.addrIPv6 = sh.addrIPv6
+		}
+
+		entry := zeroconf.NewServiceEntry(si.instance, service, domain)
+		entry.HostName = si.hostName
+		entry.Port = si.port
+		entry.Text = si.text
+		entry.TTL = si.ttl
+		entry.AddrIPv4 = si.addrIPv4
+		entry.AddrIPv6 = si.addrIPv6
+		found = append(found, entry)
+	}
+
+	return found
+}
+
+// splitServiceName Splits a service type's name, e.g.
+// "_http._tcp.local.", into the service and domain.  Subtypes and the
+// service type enumeration aren't service names.
+func splitServiceName(name string) (string, string, bool) {
+	labels := dns.SplitDomainName(name)
+	if len(labels) < 3 || !strings.HasPrefix(labels[0], "_") ||
+		(labels[1] != "_tcp" && labels[1] != "_udp") {
+		return "", "", false
+	}
+
+	return labels[0] + "." + labels[1], strings.Join(labels[2:], "."), true
+}
+
+// splitSubtypeName Splits a subtype's name, e.g.
+// "_printer._sub._http._tcp.local.", into the subtype, the service type and
+// the domain.
+func splitSubtypeName(name string) (string, string, string, bool) {
+	labels := dns.SplitDomainName(name)
+	if len(labels) < 5 || !strings.EqualFold(labels[1], "_sub") {
+		return "", "", "", false
+	}
+
+	service, domain, ok := splitServiceName(strings.Join(labels[2:], "."))
+	if !ok {
+		return "", "", "", false
+	}
+
+	return labels[0], service, domain, true
+}
+
+// removeIP Returns ips without ip.
+func removeIP(ips []net.IP, ip net.IP) []net.IP {
+	var kept []net.IP
+	for _, candidate := range ips {
+		if !candidate.Equal(ip) {
+			kept = append(kept, candidate)
+		}
+	}
+
+	return kept
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// OUTPUT_NDJSON writes every event to stdout as a JSON object per line.
+const OUTPUT_NDJSON string = "ndjson"
+
+// checkOutput Checks that nothing but the events is written to stdout when
+// Output is "ndjson", so that what reads them needn't pick them out.
+func (zcnConfig *config) checkOutput() error {
+	switch strings.ToLower(zcnConfig.Output) {
+	case "":
+		return nil
+	case OUTPUT_NDJSON:
+		break
+	default:
+		return fmt.Errorf("unknown Output %q, expected ndjson", zcnConfig.Output)
+	}
+
+	if zcnConfig.Log.Output == "stdout" {
+		return errors.New("ndjson output writes events to stdout, log to stderr or a file instead")
+	}
+
+	for _, notifyType := range zcnConfig.NotifyTypes {
+		if strings.ToLower(notifyType) == "console" {
+			return errors.New("ndjson output writes events to stdout, remove the console backend")
+		}
+	}
+
+	return nil
+}
+
+// eventPipe Writes every event to stdout, recorded or notified or not, for
+// another program to read as in "zcnotify run -output ndjson | processor".
+type eventPipe struct {
+	encoder *json.Encoder
+}
+
+// newEventPipe Returns the pipe for output, nil if there isn't one.
+func newEventPipe(output string, w io.Writer) *eventPipe {
+	if strings.ToLower(output) != OUTPUT_NDJSON {
+		return nil
+	}
+
+	return &eventPipe{encoder: json.NewEncoder(w)}
+}
+
+// write Writes a single event, if there's no pipe this is a no-op.
+func (ep *eventPipe) write(change *ServiceEntryChange) {
+	if ep == nil {
+		return
+	}
+
+	if err := ep.encoder.Encode(change); err != nil {
+		slog.Error("failed to write event to stdout", "err", err)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	// Seconds a plugin has to answer a request before it's restarted.
+	DEFAULT_PLUGIN_TIMEOUT uint = 30
+	// Version of the plugin protocol, sent to plugins when they start.
+	PLUGIN_PROTOCOL_VERSION int = 1
+	// Longest line a plugin may write to stdout.
+	PLUGIN_MAX_LINE int = 1024 * 1024
+)
+
+// pluginConfig describes a single [plugin.<name>] block, a notifier shipped
+// as a separate program.
+type pluginConfig struct {
+	serviceFilter
+	scheduleConfig
+	// Program to run and its arguments.
+	Command string
+	Args    []string
+	// Environment variables added to the plugin's, the values may
+	// reference ${ENV_VAR}s.
+	Env map[string]string
+	// Settings passed to the plugin when it starts, e.g. the URL of what
+	// it notifies.  The values may reference ${ENV_VAR}s.
+	Settings       map[string]string
+	TimeoutSeconds uint
+}
+
+// validPluginConfig Checks every [plugin.<name>] block and fills in the
+// defaults.
+func validPluginConfig(pluginConfs map[string]pluginConfig) error {
+	if len(pluginConfs) == 0 {
+		return errors.New("no [plugin.<name>] blocks")
+	}
+
+	for name, pluginConf := range pluginConfs {
+		if pluginConf.Command == "" {
+			return fmt.Errorf("plugin config: %q no Command specified", name)
+		}
+
+		path, err := exec.LookPath(pluginConf.Command)
+		if err != nil {
+			return fmt.Errorf("plugin config: %q %s", name, err.Error())
+		}
+		pluginConf.Command = path
+
+		if pluginConf.TimeoutSeconds == 0 {
+			pluginConf.TimeoutSeconds = DEFAULT_PLUGIN_TIMEOUT
+		}
+
+		pluginConfs[name] = pluginConf
+	}
+
+	return nil
+}
+
+// pluginRequest is a line written to a plugin's stdin.  The method is
+// "configure" when the plugin starts, then "notify", "notify_digest" or
+// "check".
+type pluginRequest struct {
+	ID       uint64                   `json:"id"`
+	Method   string                   `json:"method"`
+	Protocol int                      `json:"protocol,omitempty"`
+	Name     string                   `json:"name,omitempty"`
+	Settings map[string]string        `json:"settings,omitempty"`
+	Event    *serviceEntryChangeJSON  `json:"event,omitempty"`
+	Events   []serviceEntryChangeJSON `json:"events,omitempty"`
+}
+
+// pluginResponse is a line the plugin writes to stdout for each request,
+// with the request's ID.  A non-empty error fails the request, which is
+// retried as for any other backend.
+type pluginResponse struct {
+	ID    uint64 `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+// pluginNotifier Runs the program of a single [plugin.<name>] block and
+// passes it events as JSON lines.  The plugin is started by the first
+// request and restarted if it exits or stops answering.
+type pluginNotifier struct {
+	name    string
+	conf    pluginConfig
+	timeout time.Duration
+
+	mutex     sync.Mutex
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	responses chan pluginResponse
+	// done is closed when the plugin is stopped.
+	done   chan struct{}
+	nextID uint64
+}
+
+// newPluginNotifier Creates a notifier for the plugin block called name.
+func newPluginNotifier(name string, conf pluginConfig) *pluginNotifier {
+	return &pluginNotifier{name: "plugin." + name,
+		conf:    conf,
+		timeout: time.Duration(conf.TimeoutSeconds) * time.Second}
+}
+
+func (pn *pluginNotifier) Name() string {
+	return pn.name
+}
+
+func (pn *pluginNotifier) Allows(change *ServiceEntryChange) (bool, string) {
+	return pn.conf.allowsChange(change)
+}
+
+// start Runs the plugin and sends it its settings, the mutex is held.
+func (pn *pluginNotifier) start() error {
+	cmd := exec.Command(pn.conf.Command, pn.conf.Args...)
+	cmd.Env = os.Environ()
+	for name, value := range pn.conf.Env {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting plugin: %s", err.Error())
+	}
+
+	slog.Info("started plugin", "backend", pn.name, "pid", cmd.Process.Pid)
+	responses := make(chan pluginResponse)
+	done := make(chan struct{})
+	go pn.log(stderr)
+	go func() {
+		// Wait closes stdout, so it's only called once it has been read.
+		pn.read(stdout, responses, done)
+		err := cmd.Wait()
+		slog.Info("plugin exited", "backend", pn.name, "err", err)
+	}()
+
+	pn.cmd = cmd
+	pn.stdin = stdin
+	pn.responses = responses
+	pn.done = done
+	if err := pn.exchange(pluginRequest{Method: "configure",
+		Protocol: PLUGIN_PROTOCOL_VERSION,
+		Name:     pn.name,
+		Settings: pn.conf.Settings}); err != nil {
+		return fmt.Errorf("configuring plugin: %s", err.Error())
+	}
+
+	return nil
+}
+
+// read Passes the responses the plugin writes to stdout to responses,
+// which is closed when the plugin exits.  Responses are dropped once done
+// is closed.
+func (pn *pluginNotifier) read(stdout io.Reader,
+	responses chan<- pluginResponse,
+	done <-chan struct{}) {
+	defer close(responses)
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 4096), PLUGIN_MAX_LINE)
+	for scanner.Scan() {
+		var response pluginResponse
+		if err := json.Unmarshal(scanner.Bytes(), &response); err != nil {
+			slog.Warn("ignoring plugin output",
+				"backend", pn.name,
+				"output", scanner.Text(),
+				"err", err)
+			continue
+		}
+
+		select {
+		case responses <- response:
+			break
+		case <-done:
+			break
+		}
+	}
+}
+
+// log Logs what the plugin writes to stderr.
+func (pn *pluginNotifier) log(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		slog.Info("plugin", "backend", pn.name, "output", scanner.Text())
+	}
+}
+
+// stop Kills the plugin so that the next request restarts it, the mutex is
+// held.
+func (pn *pluginNotifier) stop() {
+	if pn.cmd == nil {
+		return
+	}
+
+	close(pn.done)
+	pn.stdin.Close()
+	pn.cmd.Process.Kill()
+	pn.cmd = nil
+}
+
+// exchange Sends a request and waits for its response, the mutex is held.
+// The plugin is stopped if it doesn't answer, as its responses can't be
+// matched with the requests any longer.
+func (pn *pluginNotifier) exchange(request pluginRequest) error {
+	pn.nextID++
+	request.ID = pn.nextID
+	line, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("marshal error: %s", err.Error())
+	}
+
+	if _, err := pn.stdin.Write(append(line, '\n')); err != nil {
+		pn.stop()
+		return err
+	}
+
+	timeout := time.NewTimer(pn.timeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case response, ok := <-pn.responses:
+			if !ok {
+				pn.stop()
+				return errors.New("plugin exited")
+			}
+
+			if response.ID != request.ID {
+				// The answer to a request which timed out.
+				continue
+			}
+
+			if response.Error != "" {
+				return errors.New(response.Error)
+			}
+			return nil
+		case <-timeout.C:
+			pn.stop()
+			return fmt.Errorf("plugin didn't answer within %s", pn.timeout)
+		}
+	}
+}
+
+// call Sends a request to the plugin, starting it if it isn't running.
+func (pn *pluginNotifier) call(request pluginRequest) error {
+	pn.mutex.Lock()
+	defer pn.mutex.Unlock()
+
+	if pn.cmd == nil {
+		if err := pn.start(); err != nil {
+			pn.stop()
+			return err
+		}
+	}
+
+	return pn.exchange(request)
+}
+
+// close Stops the plugin once a reload has replaced the notifier.
+func (pn *pluginNotifier) close() {
+	pn.mutex.Lock()
+	defer pn.mutex.Unlock()
+
+	pn.stop()
+}
+
+// notifyRequest Returns the request which delivers a change.
+func notifyRequest(change *ServiceEntryChange) pluginRequest {
+	event := change.toJSON(false)
+	return pluginRequest{Method: "notify", Event: &event}
+}
+
+// digestRequest Returns the request which delivers a digest.
+func digestRequest(changes []ServiceEntryChange) pluginRequest {
+	events := make([]serviceEntryChangeJSON, 0, len(changes))
+	for i := range changes {
+		events = append(events, changes[i].toJSON(false))
+	}
+
+	return pluginRequest{Method: "notify_digest", Events: events}
+}
+
+// render Returns a request as it would be written to the plugin.
+func (pn *pluginNotifier) render(request pluginRequest) (string, error) {
+	line, err := json.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("marshal error: %s", err.Error())
+	}
+
+	return pn.conf.Command + " <<< " + string(line), nil
+}
+
+func (pn *pluginNotifier) Render(change *ServiceEntryChange) (string, error) {
+	return pn.render(notifyRequest(change))
+}
+
+// Notify Passes a change to the plugin.
+func (pn *pluginNotifier) Notify(change *ServiceEntryChange) error {
+	return pn.call(notifyRequest(change))
+}
+
+func (pn *pluginNotifier) RenderDigest(changes []ServiceEntryChange) (string, error) {
+	return pn.render(digestRequest(changes))
+}
+
+// NotifyDigest Passes the changes held back during quiet hours to the
+// plugin in a single request.
+func (pn *pluginNotifier) NotifyDigest(changes []ServiceEntryChange) error {
+	return pn.call(digestRequest(changes))
+}
+
+// Check Starts the plugin and asks it to check its settings.
+func (pn *pluginNotifier) Check() error {
+	return pn.call(pluginRequest{Method: "check"})
+}
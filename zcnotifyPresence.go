@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// Days of presence history kept in the state file by default.
+const DEFAULT_PRESENCE_DAYS uint = 30
+
+// presencePeriod is a time during which a service was present, End is nil
+// while it still is.
+type presencePeriod struct {
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end,omitempty"`
+}
+
+// servicePresence is the presence history of a single service instance.
+type servicePresence struct {
+	Name      string           `json:"name"`
+	Instance  string           `json:"instance"`
+	Service   string           `json:"service"`
+	FirstSeen time.Time        `json:"firstSeen"`
+	LastSeen  time.Time        `json:"lastSeen"`
+	Periods   []presencePeriod `json:"periods"`
+}
+
+// present Returns true if the service is currently present.
+func (sp *servicePresence) present() bool {
+	return len(sp.Periods) != 0 && sp.Periods[len(sp.Periods)-1].End == nil
+}
+
+// presenceTracker Records when each service comes and goes, kept up to date
+// by applying every change like the registry.
+type presenceTracker struct {
+	mutex       sync.Mutex
+	retention   time.Duration
+	maxServices int
+	services    map[string]*servicePresence
+}
+
+// newPresenceTracker Creates a tracker from the history saved in the state
+// file.  Services known from the previous run are assumed to have been
+// present while zcnotify wasn't running.
+func newPresenceTracker(conf stateConfig,
+	saved []servicePresence,
+	known []zeroconf.ServiceEntry) *presenceTracker {
+	pt := &presenceTracker{retention: time.Duration(conf.PresenceDays) * 24 * time.Hour,
+		maxServices: int(conf.PresenceMaxServices),
+		services:    make(map[string]*servicePresence)}
+	for i := range saved {
+		pt.services[saved[i].Name] = &saved[i]
+	}
+
+	now := time.Now().UTC()
+	for i := range known {
+		pt.open(&known[i], now)
+	}
+
+	return pt
+}
+
+// open Starts a presence period for entry, if it isn't already present.
+func (pt *presenceTracker) open(entry *zeroconf.ServiceEntry, now time.Time) {
+	name := entry.ServiceInstanceName()
+	sp, ok := pt.services[name]
+	if !ok {
+		sp = &servicePresence{Name: name,
+			Instance:  entry.Instance,
+			Service:   entry.Service,
+			FirstSeen: now}
+		pt.services[name] = sp
+	}
+
+	sp.LastSeen = now
+	if !sp.present() {
+		sp.Periods = append(sp.Periods, presencePeriod{Start: now})
+	}
+}
+
+// close Ends the presence period of the service called name.
+func (pt *presenceTracker) close(name string, now time.Time) {
+	sp, ok := pt.services[name]
+	if !ok || !sp.present() {
+		return
+	}
+
+	end := now
+	sp.LastSeen = now
+	sp.Periods[len(sp.Periods)-1].End = &end
+}
+
+// stamp Sets the times the service of change was first seen and, if it's
+// returning, last seen, from its history before change is applied.  A
+// renamed service keeps the history of its previous name until it has one
+// of its own.
+func (pt *presenceTracker) stamp(change *ServiceEntryChange) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	sp, ok := pt.services[change.Entry.ServiceInstanceName()]
+	if !ok && change.ChangeType == RENAMED && change.Previous != nil {
+		sp, ok = pt.services[change.Previous.ServiceInstanceName()]
+	}
+	if !ok {
+		return
+	}
+
+	firstSeen := sp.FirstSeen
+	change.FirstSeen = &firstSeen
+	if !sp.present() {
+		lastSeen := sp.LastSeen
+		change.LastSeen = &lastSeen
+	}
+}
+
+// seen Returns when the service called name was first and last seen, the
+// latter being now if it's present.  Both are nil if it has no history.
+func (pt *presenceTracker) seen(name string, now time.Time) (*time.Time, *time.Time) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	sp, ok := pt.services[name]
+	if !ok {
+		return nil, nil
+	}
+
+	firstSeen := sp.FirstSeen
+	lastSeen := sp.LastSeen
+	if sp.present() {
+		lastSeen = now
+	}
+
+	return &firstSeen, &lastSeen
+}
+
+// lastSeenAgo Returns how long a returning service had been gone when change
+// reported it, e.g. "3d 4h", or "" if it isn't returning.
+func lastSeenAgo(change *ServiceEntryChange) string {
+	if change.LastSeen == nil {
+		return ""
+	}
+
+	return humanizeDuration(change.Timestamp.Sub(*change.LastSeen))
+}
+
+// clear Forgets the presence history of every service.
+func (pt *presenceTracker) clear() {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	pt.services = make(map[string]*servicePresence)
+}
+
+// apply Updates the presence history with a single change.
+func (pt *presenceTracker) apply(change *ServiceEntryChange) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	now := change.Timestamp
+	switch change.ChangeType {
+	case REMOVE:
+		pt.close(change.Entry.ServiceInstanceName(), now)
+		break
+	case RENAMED:
+		if change.Previous != nil {
+			pt.close(change.Previous.ServiceInstanceName(), now)
+		}
+		pt.open(&change.Entry, now)
+		break
+	default:
+		pt.open(&change.Entry, now)
+		break
+	}
+}
+
+// snapshot Returns the presence history to save, dropping periods which
+// ended before the retention time and services with no periods left, then
+// the services gone longest if there are more than maxServices.
+func (pt *presenceTracker) snapshot() []servicePresence {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	pt.forgetOldest()
+
+	cutoff := time.Now().Add(-pt.retention)
+	var presence []servicePresence
+	for name, sp := range pt.services {
+		var periods []presencePeriod
+		for _, period := range sp.Periods {
+			if period.End == nil || period.End.After(cutoff) {
+				periods = append(periods, period)
+			}
+		}
+
+		if len(periods) == 0 {
+			delete(pt.services, name)
+			continue
+		}
+
+		sp.Periods = periods
+		record := *sp
+		record.Periods = append([]presencePeriod(nil), periods...)
+		presence = append(presence, record)
+	}
+
+	sort.Slice(presence, func(i, j int) bool {
+		return presence[i].Name < presence[j].Name
+	})
+	return presence
+}
+
+// forgetOldest Forgets the services which aren't present, longest gone
+// first, until there are at most maxServices.
+func (pt *presenceTracker) forgetOldest() {
+	if pt.maxServices == 0 || len(pt.services) <= pt.maxServices {
+		return
+	}
+
+	var gone []*servicePresence
+	for _, sp := range pt.services {
+		if !sp.present() {
+			gone = append(gone, sp)
+		}
+	}
+
+	sort.Slice(gone, func(i, j int) bool {
+		return gone[i].LastSeen.Before(gone[j].LastSeen)
+	})
+	for _, sp := range gone {
+		if len(pt.services) <= pt.maxServices {
+			break
+		}
+		delete(pt.services, sp.Name)
+	}
+}
+
+// availability is a single row of the availability report.
+type availability struct {
+	Instance  string    `json:"instance"`
+	Service   string    `json:"service"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Present   bool      `json:"present"`
+	// Percentage of the period, or of the time since the service was first
+	// seen if that's shorter, during which it was present.
+	Percent float64 `json:"percent"`
+	// Seconds present during the period.
+	PresentSeconds int64 `json:"presentSeconds"`
+	// Number of times the service went away during the period.
+	Outages int `json:"outages"`
+}
+
+// availabilityReport Returns the availability of every service over the
+// period before now, least available first.
+func availabilityReport(presence []servicePresence,
+	period time.Duration,
+	now time.Time) []availability {
+	since := now.Add(-period)
+	report := make([]availability, 0, len(presence))
+	for _, sp := range presence {
+		start := since
+		if sp.FirstSeen.After(start) {
+			start = sp.FirstSeen
+		}
+
+		row := availability{Instance: sp.Instance,
+			Service:   sp.Service,
+			FirstSeen: sp.FirstSeen,
+			LastSeen:  sp.LastSeen,
+			Present:   sp.present()}
+		if row.Present {
+			row.LastSeen = now
+		}
+
+		var present time.Duration
+		for _, p := range sp.Periods {
+			end := now
+			if p.End != nil {
+				end = *p.End
+				if end.After(start) && end.Before(now) {
+					row.Outages++
+				}
+			}
+
+			pStart := p.Start
+			if pStart.Before(start) {
+				pStart = start
+			}
+
+			if end.After(pStart) {
+				present += end.Sub(pStart)
+			}
+		}
+
+		row.PresentSeconds = int64(present.Seconds())
+		if window := now.Sub(start); window > 0 {
+			row.Percent = 100 * float64(present) / float64(window)
+		} else if row.Present {
+			row.Percent = 100
+		}
+
+		report = append(report, row)
+	}
+
+	sort.SliceStable(report, func(i, j int) bool {
+		return report[i].Percent < report[j].Percent
+	})
+	return report
+}
+
+// parsePeriod Parses a report period, a Go duration such as "12h" or a
+// number of days such as "7d".
+func parsePeriod(period string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(period, "d"); found {
+		n, err := strconv.ParseUint(days, 10, 32)
+		if err != nil || n == 0 {
+			return 0, fmt.Errorf("invalid period %q", period)
+		}
+
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	duration, err := time.ParseDuration(period)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid period %q", period)
+	}
+
+	return duration, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	DEFAULT_PROBE_TIMEOUT  uint = 3
+	DEFAULT_PROBE_INTERVAL uint = 60
+)
+
+// probeConfig controls the [probe] stage, which checks that discovered
+// services can actually be connected to.
+type probeConfig struct {
+	// Services and ExcludeServices select the service types probed.
+	serviceFilter
+	Enabled bool
+	// Seconds to wait for a connection or HTTP response.
+	TimeoutSeconds uint
+	// Seconds between probes of the services already present.
+	IntervalSeconds uint
+}
+
+// probeResult is the outcome of probing a service.
+type probeResult struct {
+	Reachable bool    `json:"reachable"`
+	Method    string  `json:"method"`
+	Address   string  `json:"address"`
+	LatencyMs float64 `json:"latencyMs,omitempty"`
+	Status    int     `json:"status,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// prober Probes services as they're discovered and periodically afterwards,
+// remembering which were unreachable so that UNREACHABLE is only reported
+// when a service stops answering.
+type prober struct {
+	conf        probeConfig
+	client      *http.Client
+	mutex       sync.Mutex
+	unreachable map[string]bool
+	// waiting holds the changes of each instance being probed which came
+	// after the one being probed, by instance name.  Only the pipeline's
+	// goroutine uses it.
+	waiting map[string][]ServiceEntryChange
+}
+
+// newProber Creates the probe stage, nil is returned if probing is off.
+func newProber(conf probeConfig) *prober {
+	if !conf.Enabled {
+		return nil
+	}
+
+	// Devices rarely have certificates which would verify, only
+	// reachability is of interest.  Connections aren't kept alive, a
+	// service is probed too seldom for one to be reused.
+	client := &http.Client{Timeout: time.Duration(conf.TimeoutSeconds) * time.Second,
+		Transport: &http.Transport{DisableKeepAlives: true,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	return &prober{conf: conf,
+		client:      client,
+		unreachable: make(map[string]bool),
+		waiting:     make(map[string][]ServiceEntryChange)}
+}
+
+// probeAddress Returns the host:port to probe for entry, IPv4 addresses are
+// preferred as IPv6 link-local addresses would need a zone.
+func probeAddress(entry *zeroconf.ServiceEntry) string {
+	port := strconv.Itoa(entry.Port)
+	if len(entry.AddrIPv4) != 0 {
+		return net.JoinHostPort(entry.AddrIPv4[0].String(), port)
+	}
+
+	for _, ip := range entry.AddrIPv6 {
+		if !ip.IsLinkLocalUnicast() {
+			return net.JoinHostPort(ip.String(), port)
+		}
+	}
+
+	return net.JoinHostPort(strings.TrimSuffix(entry.HostName, "."), port)
+}
+
+// txtValue Returns the value of the TXT record key of entry, or "".
+func txtValue(entry *zeroconf.ServiceEntry, key string) string {
+	for _, txt := range entry.Text {
+		if k, value, found := strings.Cut(txt, "="); found && strings.EqualFold(k, key) {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// probe Connects to the service, web services are sent a GET request for
+// the path in their "path" TXT record.
+func (p *prober) probe(entry *zeroconf.ServiceEntry) *probeResult {
+	timeout := time.Duration(p.conf.TimeoutSeconds) * time.Second
+	result := &probeResult{Method: "tcp", Address: probeAddress(entry)}
+	start := time.Now()
+
+	scheme := ""
+	switch strings.ToLower(entry.Service) {
+	case "_http._tcp":
+		scheme = "http"
+		break
+	case "_https._tcp":
+		scheme = "https"
+		break
+	}
+
+	if scheme == "" {
+		conn, err := net.DialTimeout("tcp", result.Address, timeout)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		conn.Close()
+	} else {
+		result.Method = scheme
+		path := txtValue(entry, "path")
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+
+		resp, err := p.client.Get(scheme + "://" + result.Address + path)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		resp.Body.Close()
+		result.Status = resp.StatusCode
+	}
+
+	result.Reachable = true
+	result.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	return result
+}
+
+// wants Returns true if the service of change is probed.
+func (p *prober) wants(change *ServiceEntryChange) bool {
+	if change.ChangeType == REMOVE || change.ChangeType == UNREACHABLE {
+		return false
+	}
+
+	allowed, _ := p.conf.allows(change.Entry.Service)
+	return allowed
+}
+
+// check Probes the service of change in the background, if it's probed, and
+// has the pipeline finish the change through tasks once it has the result.
+// Otherwise the change is finished straight away, unless an earlier change
+// of the instance is being probed in which case it waits for it, so each
+// instance's changes are finished in order.  Called by the pipeline's
+// goroutine.
+func (p *prober) check(change ServiceEntryChange,
+	tasks chan<- func(),
+	finish func(change *ServiceEntryChange)) {
+	if p == nil {
+		finish(&change)
+		return
+	}
+
+	name := change.Entry.ServiceInstanceName()
+	if waiting, ok := p.waiting[name]; ok {
+		p.waiting[name] = append(waiting, change)
+		return
+	}
+
+	if !p.wants(&change) {
+		finish(&change)
+		return
+	}
+
+	p.waiting[name] = nil
+	go func() {
+		result := p.probe(&change.Entry)
+		tasks <- func() {
+			p.record(&change, result)
+			finish(&change)
+			waiting := p.waiting[name]
+			delete(p.waiting, name)
+			for _, next := range waiting {
+				p.check(next, tasks, finish)
+			}
+		}
+	}()
+}
+
+// record Records the result of probing the service of change, an ADD of a
+// service which can't be connected to is reported as UNREACHABLE.
+func (p *prober) record(change *ServiceEntryChange, result *probeResult) {
+	change.Probe = result
+	p.mutex.Lock()
+	p.unreachable[change.Entry.ServiceInstanceName()] = !change.Probe.Reachable
+	p.mutex.Unlock()
+
+	if change.Probe.Reachable {
+		change.Trace.add("probe", "", TRACE_ACCEPTED,
+			fmt.Sprintf("%s %s reachable in %.1fms",
+				change.Probe.Method, change.Probe.Address, change.Probe.LatencyMs))
+		return
+	}
+
+	change.Trace.add("probe", "", TRACE_ACCEPTED,
+		fmt.Sprintf("%s %s unreachable: %s",
+			change.Probe.Method, change.Probe.Address, change.Probe.Error))
+	if change.ChangeType == ADD {
+		change.ChangeType = UNREACHABLE
+	}
+}
+
+// run Periodically probes the services present, reporting those which stop
+// answering as UNREACHABLE.
+func (p *prober) run(registry *serviceRegistry, updates *eventBus) {
+	if p == nil {
+		return
+	}
+
+	for range time.Tick(time.Duration(p.conf.IntervalSeconds) * time.Second) {
+		present := make(map[string]bool)
+		for _, entry := range registry.snapshot() {
+			name := entry.ServiceInstanceName()
+			present[name] = true
+			if allowed, _ := p.conf.allows(entry.Service); !allowed {
+				continue
+			}
+
+			result := p.probe(&entry)
+			p.mutex.Lock()
+			wasUnreachable := p.unreachable[name]
+			p.unreachable[name] = !result.Reachable
+			p.mutex.Unlock()
+
+			if result.Reachable && wasUnreachable {
+				slog.Info("service reachable again",
+					"instance", entry.Instance,
+					"service", entry.Service,
+					"latencyMs", result.LatencyMs)
+			} else if !result.Reachable && !wasUnreachable {
+				updates.publish(ServiceEntryChange{ChangeType: UNREACHABLE,
+					Timestamp: time.Now().UTC(),
+					Entry:     entry,
+					Probe:     result})
+			}
+		}
+
+		// Forget services which have gone.
+		p.mutex.Lock()
+		for name := range p.unreachable {
+			if !present[name] {
+				delete(p.unreachable, name)
+			}
+		}
+		p.mutex.Unlock()
+	}
+}
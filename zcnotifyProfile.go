@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// validProfileName matches the names profiles may have, they become part of
+// the names of their backends.
+var validProfileName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// profileConfig is a single [profile.<name>] block, or a file in ProfileDir
+// named after the profile, with the watched services and backends of one
+// team.  Its backend blocks are renamed "<profile>.<block>", so "[email.ops]"
+// of profile "lab" is the backend "email.lab.ops", and only notify about the
+// services found by the profile's own [[watch]] blocks.
+type profileConfig struct {
+	Watch        []watchConfig
+	Email        map[string]emailConfig
+	Alertmanager map[string]alertmanagerConfig
+	Mqtt         map[string]mqttConfig
+	SnmpTrap     map[string]snmpTrapConfig
+	Journald     map[string]journaldConfig
+	Console      map[string]consoleConfig
+	EventLog     map[string]eventLogConfig
+	Forward      map[string]forwardConfig
+	Sms          map[string]smsConfig
+	Teams        map[string]chatConfig
+	GoogleChat   map[string]chatConfig
+	Plugin       map[string]pluginConfig
+}
+
+// mergeBlocks Adds the backend blocks of a profile to those of the config,
+// enabling notifyType if need be, and returns the names of their backends.
+func mergeBlocks[T any](zcnConfig *config,
+	profile string,
+	notifyType string,
+	into *map[string]T,
+	blocks map[string]T) ([]string, error) {
+	if len(blocks) == 0 {
+		return nil, nil
+	}
+
+	if !slices.ContainsFunc(zcnConfig.NotifyTypes, func(t string) bool {
+		return strings.EqualFold(t, notifyType)
+	}) {
+		// Enabling the type mustn't enable blocks of the config which
+		// NotifyTypes leaves out.
+		if len(*into) != 0 {
+			return nil, fmt.Errorf("profile %q: %s isn't in NotifyTypes, so the config's own %s blocks are unused, add it or remove them",
+				profile, notifyType, notifyType)
+		}
+		zcnConfig.NotifyTypes = append(zcnConfig.NotifyTypes, notifyType)
+	}
+
+	if *into == nil {
+		*into = make(map[string]T)
+	}
+
+	var backends []string
+	for name, block := range blocks {
+		merged := profile + "." + name
+		if _, ok := (*into)[merged]; ok {
+			return nil, fmt.Errorf("profile %q: %s block %q is also in the config",
+				profile, notifyType, merged)
+		}
+		(*into)[merged] = block
+		backends = append(backends, notifyType+"."+merged)
+	}
+
+	return backends, nil
+}
+
+// readProfileDir Adds a profile for every TOML, YAML or JSON file in
+// ProfileDir, named after the file.
+func (zcnConfig *config) readProfileDir() error {
+	files, err := os.ReadDir(zcnConfig.ProfileDir)
+	if err != nil {
+		return fmt.Errorf("ProfileDir: %s", err.Error())
+	}
+
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		switch strings.ToLower(ext) {
+		case ".toml", ".yaml", ".yml", ".json":
+			break
+		default:
+			continue
+		}
+
+		if file.IsDir() {
+			continue
+		}
+
+		name := strings.TrimSuffix(file.Name(), ext)
+		if _, ok := zcnConfig.Profile[name]; ok {
+			return fmt.Errorf("profile %q is in both the config and ProfileDir", name)
+		}
+
+		var profile profileConfig
+		if err := decodeConfig(filepath.Join(zcnConfig.ProfileDir, file.Name()),
+			"",
+			&profile); err != nil {
+			return fmt.Errorf("profile %q: %s", name, err.Error())
+		}
+
+		if zcnConfig.Profile == nil {
+			zcnConfig.Profile = make(map[string]profileConfig)
+		}
+		zcnConfig.Profile[name] = profile
+	}
+
+	return nil
+}
+
+// setupProfiles Merges the watches and backends of every profile into the
+// config.  A profile's watches notify its own backends, and the config's
+// watches which don't name their backends notify every backend which isn't
+// a profile's.
+func (zcnConfig *config) setupProfiles() error {
+	if zcnConfig.ProfileDir != "" {
+		if err := zcnConfig.readProfileDir(); err != nil {
+			return err
+		}
+	}
+
+	var names []string
+	for name := range zcnConfig.Profile {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	zcnConfig.backendProfiles = make(map[string]string)
+	for _, name := range names {
+		if !validProfileName.MatchString(name) {
+			return fmt.Errorf("invalid profile name %q, expected letters, digits, - and _",
+				name)
+		}
+
+		profile := zcnConfig.Profile[name]
+		if len(profile.Watch) == 0 {
+			return fmt.Errorf("profile %q: no [[watch]] blocks", name)
+		}
+
+		var backends []string
+		var err error
+		add := func(merged []string, mergeErr error) {
+			backends = append(backends, merged...)
+			err = errors.Join(err, mergeErr)
+		}
+		for _, bt := range backendTypes {
+			add(bt.merge(zcnConfig, name, &profile))
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(backends) == 0 {
+			return fmt.Errorf("profile %q: no backend blocks", name)
+		}
+
+		sort.Strings(backends)
+		for _, backend := range backends {
+			zcnConfig.backendProfiles[backend] = name
+		}
+
+		for _, watch := range profile.Watch {
+			// The profile's watches name its backends as they're written
+			// in the profile, e.g. "email.ops".
+			notify := backends
+			if len(watch.Notify) != 0 {
+				notify = nil
+				for _, backend := range watch.Notify {
+					notifyType, block, _ := strings.Cut(backend, ".")
+					notify = append(notify, notifyType+"."+name+"."+block)
+				}
+			}
+			watch.Notify = notify
+			zcnConfig.Watch = append(zcnConfig.Watch, watch)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_RETRY_MAX_ATTEMPTS    uint = 5
+	DEFAULT_RETRY_INITIAL_BACKOFF uint = 1
+	DEFAULT_RETRY_MAX_BACKOFF     uint = 300
+	DEFAULT_QUEUE_WORKERS         uint = 1
+	DEFAULT_QUEUE_LENGTH          uint = 64
+	// Digests, such as inventory reports, waiting for a backend's workers.
+	DIGEST_QUEUE_LENGTH = 4
+	// Time deliveries in progress have to finish before a retired
+	// queue's backend is closed.
+	QUEUE_RETIRE_GRACE  = time.Minute
+	deadLetterFileMode  = 0600
+	deadLetterFileFlags = os.O_APPEND | os.O_CREATE | os.O_WRONLY
+)
+
+// deadLetter is the record written to the dead-letter file for every change
+// which could not be delivered, one JSON object per line.
+type deadLetter struct {
+	Backend   string             `json:"backend"`
+	Attempts  uint               `json:"attempts"`
+	LastError string             `json:"lastError"`
+	FailedAt  time.Time          `json:"failedAt"`
+	Change    ServiceEntryChange `json:"change"`
+}
+
+// deadLetterWriter Serializes appends to the dead-letter file, which is
+// shared by all delivery queues.
+type deadLetterWriter struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// write Appends a single dead letter to the file, if no file is configured
+// the dead letter is only logged.
+func (dlw *deadLetterWriter) write(dl *deadLetter) {
+	slog.Error("giving up on notification",
+		changeAttrs(&dl.Change),
+		"backend", dl.Backend,
+		"attempts", dl.Attempts,
+		"err", dl.LastError)
+	if dlw == nil || dlw.path == "" {
+		return
+	}
+
+	line, err := json.Marshal(dl)
+	if err != nil {
+		slog.Error("dead letter marshal error", "err", err)
+		return
+	}
+
+	dlw.mutex.Lock()
+	defer dlw.mutex.Unlock()
+
+	f, err := os.OpenFile(dlw.path, deadLetterFileFlags, deadLetterFileMode)
+	if err != nil {
+		slog.Error("failed to open dead letter file", "err", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		slog.Error("failed to write dead letter file", "err", err)
+	}
+}
+
+var (
+	queueLengthMetric = metrics.newGauge("zcnotify_queue_length",
+		"Number of notifications waiting in a backend delivery queue.")
+	queueCapacityMetric = metrics.newGauge("zcnotify_queue_capacity",
+		"Maximum number of notifications a backend delivery queue can hold.")
+	queueBusyWorkersMetric = metrics.newGauge("zcnotify_queue_busy_workers",
+		"Number of backend workers currently delivering a notification.")
+	queueDroppedMetric = metrics.newCounter("zcnotify_queue_dropped_total",
+		"Notifications dropped because the backend delivery queue was full.")
+	notificationsMetric = metrics.newCounter("zcnotify_notifications_total",
+		"Notification delivery attempts by backend and result.")
+)
+
+// queuedDigest is a digest waiting for a queue's workers, done is called
+// with whether it was delivered, if it's set.
+type queuedDigest struct {
+	changes []ServiceEntryChange
+	done    func(bool)
+}
+
+// deliveryQueue Delivers changes to a single backend using a bounded queue
+// and a fixed number of workers, retrying failed deliveries with exponential
+// backoff.
+type deliveryQueue struct {
+	backend notifier
+	// route is the name of the backend block, which [[watch]] Notify lists
+	// refer to.
+	route     string
+	zcnConfig *config
+	schedule  *schedule
+	// held are the changes waiting for the digest at the end of quiet
+	// hours.
+	heldMutex   sync.Mutex
+	held        []ServiceEntryChange
+	retry       retryConfig
+	deadLetters *deadLetterWriter
+	changes     chan ServiceEntryChange
+	digests     chan queuedDigest
+	// exit is closed when a reload replaces the queue, or zcnotify stops,
+	// workers is done once they've delivered what was queued.
+	exit        chan bool
+	workers     sync.WaitGroup
+	length      *metricValue
+	busyWorkers *metricValue
+	dropped     *metricValue
+	status      backendStatus
+
+	// failing is set once the backend gives up on a notification, and
+	// cleared by its next delivery, so that only the first raises a
+	// BACKEND_FAILED event.
+	failing atomic.Bool
+}
+
+// newDeliveryQueue Creates a delivery queue for backend and starts its
+// workers, the queue and retry settings are taken from zcnConfig.
+func newDeliveryQueue(backend notifier,
+	route string,
+	zcnConfig *config,
+	deadLetters *deadLetterWriter) *deliveryQueue {
+	queue := zcnConfig.Queue
+	// The quiet hours have already been validated by loadConfig.
+	quietHours, _ := newSchedule(zcnConfig.backendSchedule(route))
+	dq := &deliveryQueue{
+		backend:     backend,
+		route:       route,
+		zcnConfig:   zcnConfig,
+		schedule:    quietHours,
+		retry:       zcnConfig.Retry,
+		deadLetters: deadLetters,
+		changes:     make(chan ServiceEntryChange, queue.Length),
+		digests:     make(chan queuedDigest, DIGEST_QUEUE_LENGTH),
+		exit:        make(chan bool),
+		length:      queueLengthMetric.With("backend", backend.Name()),
+		busyWorkers: queueBusyWorkersMetric.With("backend", backend.Name()),
+		dropped:     queueDroppedMetric.With("backend", backend.Name()),
+	}
+
+	queueCapacityMetric.With("backend", backend.Name()).Set(int64(queue.Length))
+	for worker := uint(0); worker < queue.Workers; worker++ {
+		dq.workers.Add(1)
+		go func() {
+			defer dq.workers.Done()
+			dq.run()
+		}()
+	}
+
+	if quietHours != nil && quietHours.digest {
+		go dq.sendDigests()
+	}
+
+	return dq
+}
+
+// newDeliveryQueues Creates the notifiers described by zcnConfig along with a
+// delivery queue for each.  Shadow notifiers are named "shadow:<backend>" so
+// they can be told apart from the live pipeline.
+func newDeliveryQueues(zcnConfig *config, shadow bool) ([]*deliveryQueue, error) {
+	notifiers, err := buildNotifiers(zcnConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []string
+	for _, n := range notifiers {
+		routes = append(routes, n.Name())
+	}
+
+	if shadow {
+		notifiers = shadowed(notifiers)
+	}
+
+	if zcnConfig.DryRun {
+		slog.Info("dry run, notifications will be logged instead of sent",
+			"shadow", shadow)
+		notifiers = dryRun(notifiers)
+	}
+
+	if zcnConfig.Retry.DeadLetterFile != "" {
+		slog.Info("undeliverable notifications will be written to file",
+			"file", zcnConfig.Retry.DeadLetterFile,
+			"shadow", shadow)
+	}
+
+	// Each backend gets its own delivery queue so that a backend which is
+	// failing and retrying doesn't hold up the others.
+	deadLetters := &deadLetterWriter{path: zcnConfig.Retry.DeadLetterFile}
+	var queues []*deliveryQueue
+	for i, n := range notifiers {
+		queues = append(queues,
+			newDeliveryQueue(n, routes[i], zcnConfig, deadLetters))
+	}
+
+	return queues, nil
+}
+
+// routes Returns true if a change is for this queue's backend: a script
+// hasn't routed it elsewhere, the [ops] section or the watches which found
+// it, with their profiles, allow the backend, and the backend's own filter
+// allows it.  The reason is added to the change's trace.
+func (dq *deliveryQueue) routes(change *ServiceEntryChange) bool {
+	if len(change.Routes) != 0 && !slices.Contains(change.Routes, dq.route) {
+		change.Trace.add("script", dq.backend.Name(), TRACE_SUPPRESSED,
+			"backend not in script Notify")
+		return false
+	}
+
+	// zcnotify's own events weren't found by a watch, they only go to the
+	// backends [ops] names.  Other changes are delivered if any of the
+	// watches which found them, which are more than one if profiles share
+	// a service, allows them.
+	if change.ChangeType.ops() {
+		if !slices.Contains(dq.zcnConfig.Ops.Notify, dq.route) {
+			change.Trace.add("ops", dq.backend.Name(), TRACE_SUPPRESSED,
+				"backend not in ops Notify")
+			return false
+		}
+	} else if watches := dq.zcnConfig.watchesFor(&change.Entry); len(watches) != 0 {
+		allowed, reason := false, ""
+		for _, watch := range watches {
+			allowed, reason = watch.allows(change,
+				dq.route,
+				dq.zcnConfig.backendProfiles[dq.route])
+			if allowed {
+				break
+			}
+		}
+
+		if !allowed {
+			change.Trace.add("watch", dq.backend.Name(), TRACE_SUPPRESSED, reason)
+			return false
+		}
+	}
+
+	allowed, reason := dq.backend.Allows(change)
+	if !allowed {
+		change.Trace.add("filter", dq.backend.Name(), TRACE_SUPPRESSED, reason)
+		return false
+	}
+
+	change.Trace.add("filter", dq.backend.Name(), TRACE_ACCEPTED, reason)
+	return true
+}
+
+// Enqueue Queues a change for delivery, if the queue is full the change is
+// dropped rather than blocking the caller.  Changes the backend isn't
+// interested in are ignored.
+func (dq *deliveryQueue) Enqueue(change ServiceEntryChange) {
+	if !dq.routes(&change) {
+		return
+	}
+
+	if dq.schedule.quiet(time.Now()) {
+		if dq.schedule.digest {
+			dq.hold(change)
+		} else {
+			change.Trace.add("schedule", dq.backend.Name(), TRACE_SUPPRESSED,
+				"quiet hours")
+		}
+		return
+	}
+
+	select {
+	case dq.changes <- change:
+		dq.length.Inc()
+	default:
+		dq.dropped.Inc()
+		change.Trace.add("queue", dq.backend.Name(), TRACE_SUPPRESSED,
+			"delivery queue full")
+		slog.Warn("delivery queue full, dropping notification",
+			changeAttrs(&change),
+			"backend", dq.backend.Name())
+	}
+}
+
+// EnqueueDigest Queues a digest of changes which have been through routes,
+// such as an inventory report, for the workers to deliver.  During quiet
+// hours its changes are held for the quiet hours digest, or dropped if the
+// backend has none.  done, if set, is called with whether the digest was
+// delivered or held.
+func (dq *deliveryQueue) EnqueueDigest(changes []ServiceEntryChange, done func(bool)) {
+	if done == nil {
+		done = func(bool) {}
+	}
+
+	select {
+	case <-dq.exit:
+		// A reload retired the queue, nothing takes digests off it.
+		done(false)
+		return
+	default:
+		break
+	}
+
+	if dq.schedule.quiet(time.Now()) {
+		held := dq.schedule.digest
+		for _, change := range changes {
+			if !dq.schedule.digest {
+				change.Trace.add("schedule", dq.backend.Name(), TRACE_SUPPRESSED,
+					"quiet hours")
+			} else if !dq.hold(change) {
+				held = false
+			}
+		}
+		done(held)
+		return
+	}
+
+	select {
+	case dq.digests <- queuedDigest{changes: changes, done: done}:
+		break
+	default:
+		dq.dropped.Inc()
+		for i := range changes {
+			changes[i].Trace.add("queue", dq.backend.Name(), TRACE_SUPPRESSED,
+				"digest queue full")
+		}
+		slog.Warn("digest queue full, dropping digest",
+			"backend", dq.backend.Name(),
+			"changes", len(changes))
+		done(false)
+	}
+}
+
+// hold Keeps a change for the digest sent when quiet hours end, at most a
+// queue's worth of changes are kept.  Returns false if the change was
+// dropped as the digest is full.
+func (dq *deliveryQueue) hold(change ServiceEntryChange) bool {
+	dq.heldMutex.Lock()
+	defer dq.heldMutex.Unlock()
+
+	if len(dq.held) >= cap(dq.changes) {
+		dq.dropped.Inc()
+		change.Trace.add("schedule", dq.backend.Name(), TRACE_SUPPRESSED,
+			"quiet hours, digest full")
+		return false
+	}
+
+	change.Trace.add("schedule", dq.backend.Name(), TRACE_SUPPRESSED,
+		"quiet hours, held for the digest")
+	dq.held = append(dq.held, change)
+	return true
+}
+
+// sendDigests Delivers the changes held during quiet hours as a single
+// digest once they end.
+func (dq *deliveryQueue) sendDigests() {
+	ticker := time.NewTicker(DIGEST_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			break
+		case <-dq.exit:
+			return
+		}
+
+		if dq.schedule.quiet(time.Now()) {
+			continue
+		}
+
+		dq.heldMutex.Lock()
+		held := dq.held
+		dq.held = nil
+		dq.heldMutex.Unlock()
+
+		if len(held) != 0 {
+			dq.deliverDigest(held)
+		}
+	}
+}
+
+// deliverDigest Attempts delivery of a digest until it succeeds or the
+// maximum number of attempts is reached, at which point every change in it
+// is written to the dead-letter file.  Returns true if it was delivered.
+func (dq *deliveryQueue) deliverDigest(changes []ServiceEntryChange) bool {
+	return dq.deliverAll("digest", changes, dq.backend.NotifyDigest)
+}
+
+// processDigest Delivers a digest taken from the queue.
+func (dq *deliveryQueue) processDigest(digest queuedDigest) {
+	dq.busyWorkers.Inc()
+	digest.done(dq.deliverDigest(digest.changes))
+	dq.busyWorkers.Dec()
+}
+
+// deliverAll Attempts delivery of several changes at once with send, as a
+// digest or a batch, until it succeeds or the maximum number of attempts is
+// reached, at which point every change is written to the dead-letter file.
+// Returns true if they were delivered.
+func (dq *deliveryQueue) deliverAll(stage string,
+	changes []ServiceEntryChange,
+	send func([]ServiceEntryChange) error) bool {
+	var err error
+
+	for attempt := uint(1); attempt <= dq.retry.MaxAttempts; attempt++ {
+		err = send(changes)
+		dq.status.delivered(err)
+		if err == nil {
+			notificationsMetric.With("backend", dq.backend.Name(),
+				"result", "sent").Inc()
+			dq.failing.Store(false)
+			for i := range changes {
+				changes[i].Trace.add(stage, dq.backend.Name(),
+					TRACE_DELIVERED, fmt.Sprintf("attempt %d", attempt))
+			}
+			slog.Debug(stage+" sent",
+				"backend", dq.backend.Name(),
+				"changes", len(changes))
+			return true
+		}
+
+		notificationsMetric.With("backend", dq.backend.Name(),
+			"result", "failed").Inc()
+		slog.Warn(stage+" attempt failed",
+			"backend", dq.backend.Name(),
+			"changes", len(changes),
+			"attempt", attempt,
+			"maxAttempts", dq.retry.MaxAttempts,
+			"err", err)
+		if attempt < dq.retry.MaxAttempts {
+			time.Sleep(dq.retry.backoff(attempt))
+		}
+	}
+
+	dq.gaveUp(err)
+	for i := range changes {
+		changes[i].Trace.add(stage, dq.backend.Name(), TRACE_FAILED,
+			fmt.Sprintf("gave up after %d attempts", dq.retry.MaxAttempts))
+		dq.deadLetters.write(&deadLetter{
+			Backend:   dq.backend.Name(),
+			Attempts:  dq.retry.MaxAttempts,
+			LastError: err.Error(),
+			FailedAt:  time.Now().UTC(),
+			Change:    changes[i],
+		})
+	}
+
+	return false
+}
+
+// run Processes queued changes, one worker goroutine runs this per
+// configured worker.  Once the queue is retired the changes already queued
+// are delivered before the worker exits.
+func (dq *deliveryQueue) run() {
+	if b, ok := dq.backend.(batcher); ok && b.batch().BatchSize > 1 {
+		dq.runBatches(b)
+		return
+	}
+
+	for {
+		select {
+		case change := <-dq.changes:
+			dq.process(&change)
+			break
+		case digest := <-dq.digests:
+			dq.processDigest(digest)
+			break
+		case <-dq.exit:
+			for {
+				select {
+				case change := <-dq.changes:
+					dq.process(&change)
+					break
+				case digest := <-dq.digests:
+					dq.processDigest(digest)
+					break
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// runBatches Processes queued changes in batches, which are sent once they
+// hold BatchSize changes or the first has waited for the batch latency.
+func (dq *deliveryQueue) runBatches(b batcher) {
+	conf := b.batch()
+	for {
+		var first ServiceEntryChange
+		select {
+		case first = <-dq.changes:
+			break
+		case digest := <-dq.digests:
+			dq.processDigest(digest)
+			continue
+		case <-dq.exit:
+			select {
+			case first = <-dq.changes:
+				break
+			case digest := <-dq.digests:
+				dq.processDigest(digest)
+				continue
+			default:
+				return
+			}
+		}
+
+		batch := conf.collect(first, dq.changes, dq.exit)
+		dq.length.Add(-int64(len(batch)))
+		dq.busyWorkers.Inc()
+		dq.deliverAll("batch", batch, b.NotifyBatch)
+		dq.busyWorkers.Dec()
+	}
+}
+
+// process Delivers a change taken from the queue.
+func (dq *deliveryQueue) process(change *ServiceEntryChange) {
+	dq.length.Dec()
+	dq.busyWorkers.Inc()
+	dq.deliver(change)
+	dq.busyWorkers.Dec()
+}
+
+// retire Stops the queue once its changes have been delivered, the changes
+// held for a digest are handed to next if it's for the same backend block.
+// Backends holding connections are closed after a grace period for the
+// deliveries in progress.
+func (dq *deliveryQueue) retire(next []*deliveryQueue) {
+	close(dq.exit)
+
+	dq.heldMutex.Lock()
+	held := dq.held
+	dq.held = nil
+	dq.heldMutex.Unlock()
+
+	for _, queue := range next {
+		if queue.route == dq.route && queue.backend.Name() == dq.backend.Name() {
+			for _, change := range held {
+				queue.Enqueue(change)
+			}
+			held = nil
+			break
+		}
+	}
+
+	if len(held) != 0 {
+		slog.Warn("backend removed, dropping changes held for its digest",
+			"backend", dq.backend.Name(),
+			"changes", len(held))
+	}
+
+	if c, ok := dq.backend.(closer); ok {
+		time.AfterFunc(QUEUE_RETIRE_GRACE, c.close)
+	}
+}
+
+// wait Waits for the workers of a retired queue to deliver the changes which
+// were queued.
+func (dq *deliveryQueue) wait() {
+	dq.workers.Wait()
+}
+
+// deliver Attempts delivery of a single change until it succeeds or the
+// maximum number of attempts is reached, at which point the change is
+// written to the dead-letter file.
+func (dq *deliveryQueue) deliver(change *ServiceEntryChange) {
+	var err error
+
+	for attempt := uint(1); attempt <= dq.retry.MaxAttempts; attempt++ {
+		err = dq.backend.Notify(change)
+		dq.status.delivered(err)
+		if err == nil {
+			notificationsMetric.With("backend", dq.backend.Name(),
+				"result", "sent").Inc()
+			dq.failing.Store(false)
+			if _, ok := dq.backend.(dryRunNotifier); ok {
+				change.Trace.add("deliver", dq.backend.Name(),
+					TRACE_SUPPRESSED, "dry run")
+			} else {
+				change.Trace.add("deliver", dq.backend.Name(),
+					TRACE_DELIVERED, fmt.Sprintf("attempt %d", attempt))
+			}
+			slog.Debug("notification sent",
+				changeAttrs(change),
+				"backend", dq.backend.Name())
+			return
+		}
+
+		notificationsMetric.With("backend", dq.backend.Name(),
+			"result", "failed").Inc()
+		change.Trace.add("deliver", dq.backend.Name(), TRACE_FAILED,
+			fmt.Sprintf("attempt %d: %s", attempt, err.Error()))
+
+		slog.Warn("notification attempt failed",
+			changeAttrs(change),
+			"backend", dq.backend.Name(),
+			"attempt", attempt,
+			"maxAttempts", dq.retry.MaxAttempts,
+			"err", err)
+		if attempt < dq.retry.MaxAttempts {
+			time.Sleep(dq.retry.backoff(attempt))
+		}
+	}
+
+	dq.gaveUp(err)
+	change.Trace.add("deliver", dq.backend.Name(), TRACE_FAILED,
+		fmt.Sprintf("gave up after %d attempts", dq.retry.MaxAttempts))
+	dq.deadLetters.write(&deadLetter{
+		Backend:   dq.backend.Name(),
+		Attempts:  dq.retry.MaxAttempts,
+		LastError: err.Error(),
+		FailedAt:  time.Now().UTC(),
+		Change:    *change,
+	})
+}
+
+// gaveUp Raises a BACKEND_FAILED event the first time the backend gives up
+// on a notification since it last delivered one.
+func (dq *deliveryQueue) gaveUp(err error) {
+	if !dq.failing.Swap(true) {
+		raiseOpsEvent(newBackendFailedEvent(dq.backend.Name(), err))
+	}
+}
+
+// backoff Returns the delay before the next delivery attempt, the delay
+// doubles with each failed attempt up to the configured maximum.  Half of the
+// delay is randomized so that queues retrying against the same server don't
+// do so in lock step.
+func (rc retryConfig) backoff(attempt uint) time.Duration {
+	maxBackoff := time.Duration(rc.MaxBackoffSeconds) * time.Second
+	delay := time.Duration(rc.InitialBackoffSeconds) * time.Second
+	for i := uint(1); i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+
+	if delay < 2 {
+		return delay
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// serviceRegistry Tracks the services which are currently present on the
+// network, it is kept up to date by applying every change reported by the
+// watcher.
+type serviceRegistry struct {
+	mutex    sync.RWMutex
+	services map[string]zeroconf.ServiceEntry
+}
+
+func newServiceRegistry() *serviceRegistry {
+	return &serviceRegistry{services: make(map[string]zeroconf.ServiceEntry)}
+}
+
+// seed Adds services known from a previous run.
+func (sr *serviceRegistry) seed(entries []zeroconf.ServiceEntry) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	for _, entry := range entries {
+		sr.services[entry.ServiceInstanceName()] = entry
+	}
+}
+
+// clear Forgets every service.
+func (sr *serviceRegistry) clear() {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	sr.services = make(map[string]zeroconf.ServiceEntry)
+}
+
+// apply Updates the registry with a single change.  zcnotify's own events,
+// e.g. those an agent forwards, aren't about a service and are ignored.
+func (sr *serviceRegistry) apply(change *ServiceEntryChange) {
+	if change.ChangeType.ops() {
+		return
+	}
+
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	name := change.Entry.ServiceInstanceName()
+	switch change.ChangeType {
+	case REMOVE:
+		delete(sr.services, name)
+	case MISSING:
+		// Reported by [[expect]], the service wasn't there to discover.
+	case RENAMED:
+		if change.Previous != nil {
+			delete(sr.services, change.Previous.ServiceInstanceName())
+		}
+		sr.services[name] = change.Entry
+	default:
+		sr.services[name] = change.Entry
+	}
+}
+
+// snapshot Returns every service currently present, sorted by instance
+// name.
+func (sr *serviceRegistry) snapshot() []zeroconf.ServiceEntry {
+	sr.mutex.RLock()
+	defer sr.mutex.RUnlock()
+
+	var names []string
+	for name := range sr.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]zeroconf.ServiceEntry, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, sr.services[name])
+	}
+
+	return entries
+}
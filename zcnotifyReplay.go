@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// parseHistoryTime Parses a point in the history given on the command line,
+// an RFC 3339 time, a date or a period before now such as "24h" or "7d".
+func parseHistoryTime(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	if t, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		return t, nil
+	}
+
+	period, err := parsePeriod(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339, a date or a period such as 24h or 7d",
+			value)
+	}
+
+	return now.Add(-period), nil
+}
+
+// historyBetween Returns the changes recorded from since until until, a zero
+// until being now.
+func historyBetween(changes []ServiceEntryChange,
+	since time.Time,
+	until time.Time) []ServiceEntryChange {
+	var selected []ServiceEntryChange
+	for _, change := range changes {
+		if change.Timestamp.Before(since) ||
+			(!until.IsZero() && !change.Timestamp.Before(until)) {
+			continue
+		}
+
+		selected = append(selected, change)
+	}
+
+	return selected
+}
+
+// replayCommand Sends the events recorded in the history again through the
+// selected backends, e.g. to catch a consumer up after an outage.  The
+// events keep their IDs and timestamps and are marked as replayed.
+func replayCommand(name string, args []string) int {
+	fs := newFlagSet(name, "")
+	common := addCommonFlags(fs)
+	sinceFlag := fs.String("since", "",
+		"Replay the events recorded since this time (RFC 3339, a date, or a period before now such as 24h or 7d)")
+	untilFlag := fs.String("until", "", "Only replay the events recorded before this time")
+	backends := fs.String("backend", "",
+		"Comma separated backends to send to, by name (\"email.ops\") or type (\"email\")")
+	types := fs.String("type", "", "Comma separated change types to replay, all if empty")
+	dryRunFlag := fs.Bool("dry-run", false,
+		"Log rendered notifications instead of sending them")
+	delay := fs.Duration("delay", 0, "Time to wait between events")
+	fs.Parse(args)
+
+	if *sinceFlag == "" || *backends == "" {
+		fs.Usage()
+		return 2
+	}
+
+	now := time.Now()
+	since, err := parseHistoryTime(*sinceFlag, now)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	var until time.Time
+	if *untilFlag != "" {
+		if until, err = parseHistoryTime(*untilFlag, now); err != nil {
+			fatal(err.Error())
+		}
+	}
+
+	var changeTypes []string
+	if *types != "" {
+		changeTypes = strings.Split(*types, ",")
+		for _, changeType := range changeTypes {
+			if _, err := parseServiceChangeType(changeType); err != nil {
+				fatal("invalid change type", "err", err)
+			}
+		}
+	}
+
+	zcnConfig, err := common.setup()
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	if zcnConfig.History.File == "" {
+		fatal("no history file configured")
+	}
+
+	changes, err := readHistory(zcnConfig.History.File)
+	if err != nil {
+		fatal("failed to read history", "err", err)
+	}
+	changes = historyBetween(changes, since, until)
+
+	notifiers, err := buildNotifiers(zcnConfig)
+	if err != nil {
+		fatal("failed to create notifiers", "err", err)
+	}
+
+	selection := strings.Split(*backends, ",")
+	var selected []notifier
+	for _, n := range notifiers {
+		if selectedBackend(n.Name(), selection) {
+			selected = append(selected, n)
+		}
+	}
+
+	if len(selected) == 0 {
+		fatal("no backends matched", "backend", *backends)
+	}
+
+	if *dryRunFlag || zcnConfig.DryRun {
+		selected = dryRun(selected)
+	}
+
+	status := 0
+	sent, skipped, failed := 0, 0, 0
+	for i := range changes {
+		change := &changes[i]
+		if len(changeTypes) != 0 && !matchChangeType(changeTypes, change.ChangeType) {
+			continue
+		}
+		change.Replay = true
+
+		for _, n := range selected {
+			if allowed, reason := n.Allows(change); !allowed {
+				fmt.Printf("SKIP: %s %s: %s\n", n.Name(), change.ID, reason)
+				skipped++
+				continue
+			}
+
+			if err := n.Notify(change); err != nil {
+				fmt.Printf("FAIL: %s %s: %s\n", n.Name(), change.ID, err.Error())
+				failed++
+				status = 1
+				continue
+			}
+			sent++
+		}
+
+		if *delay > 0 {
+			time.Sleep(*delay)
+		}
+	}
+
+	for _, n := range notifiers {
+		if c, ok := n.(closer); ok {
+			c.close()
+		}
+	}
+
+	fmt.Printf("replayed %d notifications, %d filtered out, %d failed\n",
+		sent, skipped, failed)
+	return status
+}
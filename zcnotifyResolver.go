@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/hashicorp/mdns"
+)
+
+const (
+	RESOLVER_ZEROCONF string = "zeroconf"
+	RESOLVER_MDNS     string = "mdns"
+	RESOLVER_AVAHI    string = "avahi"
+	RESOLVER_BONJOUR  string = "bonjour"
+	// Use the system's mDNS daemon if one is running, otherwise zeroconf.
+	RESOLVER_AUTO string = "auto"
+)
+
+// mdnsResolver is a multicast DNS client.  Both methods return straight
+// away, sending what they find to entries and closing it once ctx is done.
+// *zeroconf.Resolver is one.
+type mdnsResolver interface {
+	Browse(ctx context.Context,
+		service string,
+		domain string,
+		entries chan<- *zeroconf.ServiceEntry) error
+	Lookup(ctx context.Context,
+		instance string,
+		service string,
+		domain string,
+		entries chan<- *zeroconf.ServiceEntry) error
+}
+
+// validResolver Returns an error if name isn't a resolver zcnotify has.
+func validResolver(name string) error {
+	switch name {
+	case RESOLVER_ZEROCONF, RESOLVER_MDNS, RESOLVER_AVAHI, RESOLVER_BONJOUR, RESOLVER_AUTO:
+		return nil
+	}
+
+	return fmt.Errorf("unknown resolver %q, expected %s, %s, %s, %s or %s",
+		name,
+		RESOLVER_AUTO,
+		RESOLVER_ZEROCONF,
+		RESOLVER_MDNS,
+		RESOLVER_AVAHI,
+		RESOLVER_BONJOUR)
+}
+
+// autoResolver is the resolver auto stands for, settled the first time it's
+// needed as asking the daemons takes a round trip to each.
+var autoResolver struct {
+	once sync.Once
+	name string
+}
+
+// selectResolver Returns name, unless it's auto in which case it's the
+// resolver of the mDNS daemon which owns port 5353, Bonjour's mDNSResponder
+// or avahi-daemon, or zeroconf if neither is running.  The daemons are only
+// looked for once, every watcher and lookup after that uses the same choice.
+func selectResolver(name string) string {
+	if name != RESOLVER_AUTO {
+		return name
+	}
+
+	autoResolver.once.Do(func() {
+		autoResolver.name = RESOLVER_ZEROCONF
+		switch {
+		case bonjourRunning():
+			autoResolver.name = RESOLVER_BONJOUR
+			break
+		case avahiRunning():
+			autoResolver.name = RESOLVER_AVAHI
+			break
+		}
+
+		slog.Info("selected resolver", "resolver", autoResolver.name)
+	})
+
+	return autoResolver.name
+}
+
+// newMDNSResolver Returns the named resolver, which uses the given IP
+// versions on intfs.
+func newMDNSResolver(name string,
+	ipver zeroconf.IPType,
+	intfs []net.Interface) (mdnsResolver, error) {
+	switch name {
+	case RESOLVER_MDNS:
+		return &hashicorpResolver{ipver: ipver, intfs: intfs}, nil
+	case RESOLVER_AVAHI:
+		return newAvahiResolver(ipver, intfs)
+	case RESOLVER_BONJOUR:
+		return newBonjourResolver(ipver, intfs)
+	case RESOLVER_AUTO:
+		return newMDNSResolver(selectResolver(name), ipver, intfs)
+	case RESOLVER_ZEROCONF, "":
+		return zeroconf.NewResolver(zeroconf.SelectIPTraffic(ipver),
+			zeroconf.SelectIfaces(intfs))
+	}
+
+	return nil, validResolver(name)
+}
+
+// mergeAddresses Adds the addresses of from which aren't in entry.
+func mergeAddresses(entry *zeroconf.ServiceEntry, from *zeroconf.ServiceEntry) {
+	for _, ip := range from.AddrIPv4 {
+		if !containsIP(entry.AddrIPv4, ip) {
+			entry.AddrIPv4 = append(entry.AddrIPv4, ip)
+		}
+	}
+
+	for _, ip := range from.AddrIPv6 {
+		if !containsIP(entry.AddrIPv6, ip) {
+			entry.AddrIPv6 = append(entry.AddrIPv6, ip)
+		}
+	}
+}
+
+// hashicorpResolver Implements mdnsResolver with github.com/hashicorp/mdns,
+// which queries one interface at a time and only reports the first IPv4 and
+// IPv6 address of each instance.
+type hashicorpResolver struct {
+	ipver zeroconf.IPType
+	intfs []net.Interface
+}
+
+// Browse Queries every interface at once until ctx is done.
+func (hr *hashicorpResolver) Browse(ctx context.Context,
+	service string,
+	domain string,
+	entries chan<- *zeroconf.ServiceEntry) error {
+	return hr.query(ctx, service, domain, "", entries)
+}
+
+// Lookup Browses for service, only sending instance on.  hashicorp/mdns
+// can't query for a single instance.
+func (hr *hashicorpResolver) Lookup(ctx context.Context,
+	instance string,
+	service string,
+	domain string,
+	entries chan<- *zeroconf.ServiceEntry) error {
+	return hr.query(ctx, service, domain, instance, entries)
+}
+
+// query Queries for service on every interface, sending each instance
+// found, or only instance if it's set, to entries.
+func (hr *hashicorpResolver) query(ctx context.Context,
+	service string,
+	domain string,
+	instance string,
+	entries chan<- *zeroconf.ServiceEntry) error {
+	timeout := time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	// hashicorp/mdns drops entries which can't be sent straight away, so
+	// they're buffered here.
+	found := make(chan *mdns.ServiceEntry, 64)
+	var wg sync.WaitGroup
+	for index := range hr.intfs {
+		wg.Add(1)
+		go func(intf *net.Interface) {
+			defer wg.Done()
+			err := mdns.QueryContext(ctx, &mdns.QueryParam{Service: service,
+				Domain:      domain,
+				Timeout:     timeout,
+				Interface:   intf,
+				Entries:     found,
+				DisableIPv4: hr.ipver&zeroconf.IPv4 == 0,
+				DisableIPv6: hr.ipver&zeroconf.IPv6 == 0,
+				Logger:      slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug)})
+			if err != nil && ctx.Err() == nil {
+				slog.Warn("mdns query failed", "interface", intf.Name, "err", err)
+			}
+		}(&hr.intfs[index])
+	}
+
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
+
+	go func() {
+		defer close(entries)
+		suffix := "." + service + "." + domain + "."
+		sent := make(map[string]bool)
+		for result := range found {
+			name := result.Name
+			if len(name) <= len(suffix) ||
+				!strings.EqualFold(name[len(name)-len(suffix):], suffix) {
+				continue
+			}
+
+			entry := zeroconf.NewServiceEntry(unescapeInstance(name[:len(name)-len(suffix)]),
+				service,
+				domain)
+			if (instance != "" && entry.Instance != instance) ||
+				sent[entry.Instance] {
+				continue
+			}
+
+			sent[entry.Instance] = true
+			entry.HostName = result.Host
+			entry.Port = result.Port
+			entry.Text = result.InfoFields
+			if result.AddrV4 != nil {
+				entry.AddrIPv4 = []net.IP{result.AddrV4}
+			}
+			if result.AddrV6 != nil {
+				entry.AddrIPv6 = []net.IP{result.AddrV6}
+			}
+
+			select {
+			case entries <- entry:
+				break
+			case <-ctx.Done():
+				break
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// browseFunc Browses service in domain, sending every instance found to
+// entries.  entries is closed once ctx is done, or when browsing fails.
+type browseFunc func(ctx context.Context,
+	service string,
+	domain string,
+	entries chan<- *zeroconf.ServiceEntry) error
+
+// mdnsBrowser Returns a browseFunc which uses the named multicast DNS
+// resolver on the given interfaces, auto is settled here rather than on
+// every browse.  Subtypes are browsed with browseSubtype.
+func mdnsBrowser(name string,
+	ipver zeroconf.IPType,
+	intfs []net.Interface) browseFunc {
+	name = selectResolver(name)
+	return func(ctx context.Context,
+		service string,
+		domain string,
+		entries chan<- *zeroconf.ServiceEntry) error {
+		resolver, err := newMDNSResolver(name, ipver, intfs)
+		if err != nil {
+			close(entries)
+			return fmt.Errorf("failed to initialize resolver: %s", err.Error())
+		}
+
+		if subtype, _ := splitSubtype(service); subtype != "" {
+			return browseSubtype(ctx, resolver, service, domain, ipver, intfs, entries)
+		}
+
+		return resolver.Browse(ctx, service, domain, entries)
+	}
+}
+
+// newBrowseFunc Returns the browseFunc for target, multicast DNS for the
+// "local" domain and unicast DNS-SD for everything else.  If sniffer is set
+// multicast DNS is listened to, and queried if it's the shared resolver.
+func newBrowseFunc(target browseTarget,
+	zcConf zeroconfConfig,
+	ipver zeroconf.IPType,
+	intfs []net.Interface,
+	sniffer *passiveSniffer) (browseFunc, error) {
+	if !target.unicast() {
+		if sniffer != nil {
+			return sniffer.browse, nil
+		}
+
+		return mdnsBrowser(zcConf.Resolver, ipver, intfs), nil
+	}
+
+	ub, err := newUnicastBrowser(zcConf.UnicastServer)
+	if err != nil {
+		return nil, err
+	}
+
+	return ub.browse, nil
+}
+
+// browseOnce Performs a single browse of service in domain, returning every
+// instance which answered within the timeout sorted by instance name.
+func browseOnce(service string,
+	domain string,
+	timeout time.Duration,
+	browse browseFunc) ([]zeroconf.ServiceEntry, error) {
+	found := make(map[string]zeroconf.ServiceEntry)
+	results := make(chan *zeroconf.ServiceEntry)
+	collected := make(chan bool)
+	go func() {
+		for entry := range results {
+			found[entry.ServiceInstanceName()] = *entry
+		}
+		collected <- true
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := browse(ctx, service, domain, results)
+	<-collected
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]zeroconf.ServiceEntry, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, found[name])
+	}
+
+	return entries, nil
+}
+
+// browseTargetsOnce Browses every target concurrently, returning the
+// instances found sorted by instance name.
+func browseTargetsOnce(zcnConfig *config,
+	timeout time.Duration,
+	ipver zeroconf.IPType,
+	intfs []net.Interface) ([]zeroconf.ServiceEntry, error) {
+	type browseResult struct {
+		entries []zeroconf.ServiceEntry
+		err     error
+	}
+
+	var sniffer *passiveSniffer
+	var err error
+	if zcnConfig.Zeroconf.Passive {
+		sniffer, err = newPassiveSniffer(ipver, intfs)
+	} else if zcnConfig.Zeroconf.SharedResolver {
+		sniffer, err = newSharedResolver(ipver,
+			intfs,
+			zcnConfig.Zeroconf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sniffer != nil {
+		defer sniffer.stop()
+	}
+
+	targets := zcnConfig.browseTargets()
+	results := make(chan browseResult, len(targets))
+	for _, target := range targets {
+		go func(target browseTarget) {
+			browse, err := newBrowseFunc(target,
+				zcnConfig.Zeroconf,
+				ipver,
+				intfs,
+				sniffer)
+			var entries []zeroconf.ServiceEntry
+			if err == nil {
+				entries, err = browseOnce(target.Service,
+					target.Domain,
+					timeout,
+					browse)
+			}
+			if err != nil {
+				err = fmt.Errorf("%s.%s: %s", target.Service, target.Domain,
+					err.Error())
+			}
+			results <- browseResult{entries: entries, err: err}
+		}(target)
+	}
+
+	var entries []zeroconf.ServiceEntry
+	for range targets {
+		result := <-results
+		if result.err != nil {
+			err = result.err
+		}
+		entries = append(entries, result.entries...)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ServiceInstanceName() < entries[j].ServiceInstanceName()
+	})
+
+	return entries, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often a backend with a digest checks whether quiet hours have ended.
+const DIGEST_CHECK_INTERVAL time.Duration = time.Minute
+
+// scheduleConfig holds a backend block's quiet hours, during which its
+// notifications are held back.
+type scheduleConfig struct {
+	// Windows such as "23:00-07:00", optionally limited to the days they
+	// start on, e.g. "Sat,Sun 00:00-24:00" or "Mon-Fri 18:00-08:00".
+	QuietHours []string
+	// Time zone of QuietHours, e.g. "Europe/Dublin", local time if empty.
+	Timezone string
+	// Send the events held back during quiet hours as a single digest once
+	// they end, rather than dropping them.
+	Digest bool
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// quietWindow is a single parsed QuietHours window, start and end are
+// minutes after midnight.  A window which ends before it starts crosses
+// midnight.
+type quietWindow struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+// schedule is the parsed form of a scheduleConfig.
+type schedule struct {
+	windows  []quietWindow
+	location *time.Location
+	digest   bool
+}
+
+// parseWeekday Returns the time.Weekday of a three letter day name.
+func parseWeekday(day string) (int, error) {
+	for i, weekday := range weekdays {
+		if strings.EqualFold(day, weekday) {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown day %q", day)
+}
+
+// parseDays Parses a list of days such as "Sat,Sun" or "Mon-Fri".
+func parseDays(spec string) ([7]bool, error) {
+	var days [7]bool
+	for _, item := range strings.Split(spec, ",") {
+		first, last, isRange := strings.Cut(item, "-")
+		start, err := parseWeekday(first)
+		if err != nil {
+			return days, err
+		}
+
+		end := start
+		if isRange {
+			if end, err = parseWeekday(last); err != nil {
+				return days, err
+			}
+		}
+
+		for day := start; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == end {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+// parseClock Returns the minutes after midnight of "HH:MM", "24:00" is the
+// end of the day.
+func parseClock(clock string) (int, error) {
+	hours, minutes, found := strings.Cut(clock, ":")
+	h, hErr := strconv.Atoi(hours)
+	m, mErr := strconv.Atoi(minutes)
+	if !found || hErr != nil || mErr != nil || h < 0 || m < 0 || m > 59 ||
+		h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", clock)
+	}
+
+	return h*60 + m, nil
+}
+
+// parseQuietWindow Parses a single QuietHours window.
+func parseQuietWindow(spec string) (quietWindow, error) {
+	window := quietWindow{days: [7]bool{true, true, true, true, true, true, true}}
+	fields := strings.Fields(spec)
+	if len(fields) == 2 {
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return window, err
+		}
+
+		window.days = days
+		fields = fields[1:]
+	}
+
+	if len(fields) != 1 {
+		return window, fmt.Errorf("expected [days] HH:MM-HH:MM")
+	}
+
+	start, end, found := strings.Cut(fields[0], "-")
+	if !found {
+		return window, fmt.Errorf("expected [days] HH:MM-HH:MM")
+	}
+
+	var err error
+	if window.start, err = parseClock(start); err != nil {
+		return window, err
+	}
+
+	if window.end, err = parseClock(end); err != nil {
+		return window, err
+	}
+
+	return window, nil
+}
+
+// newSchedule Parses a backend's quiet hours, nil is returned if it has
+// none.
+func newSchedule(conf scheduleConfig) (*schedule, error) {
+	if len(conf.QuietHours) == 0 {
+		return nil, nil
+	}
+
+	s := &schedule{location: time.Local, digest: conf.Digest}
+	if conf.Timezone != "" {
+		location, err := time.LoadLocation(conf.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("Timezone: %s", err.Error())
+		}
+
+		s.location = location
+	}
+
+	for _, spec := range conf.QuietHours {
+		window, err := parseQuietWindow(spec)
+		if err != nil {
+			return nil, fmt.Errorf("QuietHours %q: %s", spec, err.Error())
+		}
+
+		s.windows = append(s.windows, window)
+	}
+
+	return s, nil
+}
+
+// quiet Returns true if now is within the quiet hours.
+func (s *schedule) quiet(now time.Time) bool {
+	if s == nil {
+		return false
+	}
+
+	now = now.In(s.location)
+	minute := now.Hour()*60 + now.Minute()
+	today := int(now.Weekday())
+	yesterday := (today + 6) % 7
+	for _, window := range s.windows {
+		if window.start <= window.end {
+			if window.days[today] && minute >= window.start && minute < window.end {
+				return true
+			}
+		} else if (window.days[today] && minute >= window.start) ||
+			(window.days[yesterday] && minute < window.end) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// linkLocalZones Finds the interface each of the entry's IPv6 link-local
+// addresses is reachable on, keyed by address.  Every interface has the
+// fe80::/10 network so the address alone doesn't say, in order of preference
+// the zone is:
+//
+//   - intf, the interface whose network holds the device's other addresses;
+//   - the only discovery interface in intfs, if there's just one;
+//   - the interface the neighbour table, neighborCache, has the address on.
+//
+// Addresses whose interface can't be found are left out.
+func linkLocalZones(entry *zeroconf.ServiceEntry,
+	intf string,
+	intfs []net.Interface) map[string]string {
+	var linkLocal []net.IP
+	for _, ip := range entry.AddrIPv6 {
+		if ip.IsLinkLocalUnicast() {
+			linkLocal = append(linkLocal, ip)
+		}
+	}
+
+	if len(linkLocal) == 0 {
+		return nil
+	}
+
+	zones := make(map[string]string)
+	if intf == "" && len(intfs) == 1 {
+		intf = intfs[0].Name
+	}
+
+	if intf != "" {
+		for _, ip := range linkLocal {
+			zones[ip.String()] = intf
+		}
+
+		return zones
+	}
+
+	addrs := make([]string, 0, len(linkLocal))
+	for _, ip := range linkLocal {
+		addrs = append(addrs, ip.String())
+	}
+
+	for addr, n := range neighborCache.find(addrs) {
+		if n.zone != "" {
+			zones[addr] = n.zone
+		}
+	}
+
+	return zones
+}
+
+// scopedAddresses Returns the entry's addresses, link-local IPv6 addresses
+// with their zone from zones if it's known, e.g. "fe80::1%eth0".
+func scopedAddresses(entry *zeroconf.ServiceEntry, zones map[string]string) []string {
+	var addresses []string
+	for _, ip := range append(append([]net.IP(nil), entry.AddrIPv4...), entry.AddrIPv6...) {
+		address := ip.String()
+		if zone, ok := zones[address]; ok {
+			address += "%" + zone
+		}
+
+		addresses = append(addresses, address)
+	}
+
+	return addresses
+}
+
+// connectStrings Returns host:port strings for each of the entry's
+// addresses, link-local IPv6 addresses carry their zone from zones so they
+// can be used as they are, e.g. "[fe80::1%eth0]:80".  Link-local addresses
+// without a zone are left out as they'd be ambiguous.
+func connectStrings(entry *zeroconf.ServiceEntry, zones map[string]string) []string {
+	var connect []string
+	port := strconv.Itoa(entry.Port)
+	for _, address := range scopedAddresses(entry, zones) {
+		if ip := net.ParseIP(address); ip != nil && ip.IsLinkLocalUnicast() && ip.To4() == nil {
+			continue
+		}
+
+		connect = append(connect, net.JoinHostPort(address, port))
+	}
+
+	return connect
+}
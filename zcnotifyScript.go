@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/grandcat/zeroconf"
+)
+
+var scriptDroppedMetric = metrics.newCounter("zcnotify_events_dropped_total",
+	"Events recorded but not notified because a [[script]] block dropped them.")
+
+// scriptConfig is a single [[script]] block, a CEL expression which picks
+// the events the block acts on, e.g. `entry.txt["model"] == "test"`.
+type scriptConfig struct {
+	// Shown in logs and traces, the expression if not set.
+	Name string
+	// CEL expression which is true for the events to act on.
+	When string
+	// Record the events without notifying.
+	Drop bool
+	// Set the severity of the events, overriding the [[severity]] rules.
+	Severity string
+	// Labels to add to the events, each a CEL expression giving the
+	// label's value, e.g. { owner = 'entry.txt["owner"]' }.
+	Labels map[string]string
+	// Only notify these backends of the events, e.g. ["email.ops"].
+	Notify []string
+
+	condition     cel.Program
+	labelPrograms map[string]cel.Program
+	level         Severity
+}
+
+// newScriptEnv Returns the CEL environment of the [[script]] expressions:
+// the entry and previous entry of the event, with their TXT records as a
+// map, the event's most used fields, and the whole event as in the API.
+func newScriptEnv() (*cel.Env, error) {
+	entryType := cel.MapType(cel.StringType, cel.DynType)
+	return cel.NewEnv(cel.Variable("entry", entryType),
+		cel.Variable("previous", entryType),
+		cel.Variable("changeType", cel.StringType),
+		cel.Variable("severity", cel.StringType),
+		cel.Variable("site", cel.StringType),
+		cel.Variable("interface", cel.StringType),
+		cel.Variable("networks", cel.ListType(cel.StringType)),
+		cel.Variable("category", cel.StringType),
+		cel.Variable("labels", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("unknownDevice", cel.BoolType),
+		cel.Variable("event", cel.MapType(cel.StringType, cel.DynType)))
+}
+
+// compileScript Returns the program of a CEL expression which should give
+// a value of outputType.
+func compileScript(env *cel.Env, expression string, outputType *cel.Type) (cel.Program, error) {
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+
+	if !ast.OutputType().IsExactType(outputType) && !ast.OutputType().IsExactType(cel.DynType) {
+		return nil, fmt.Errorf("expression gives %s rather than %s",
+			ast.OutputType(), outputType)
+	}
+
+	return env.Program(ast)
+}
+
+// setupScripts Compiles the expressions of every [[script]] block.
+func (zcnConfig *config) setupScripts() error {
+	if len(zcnConfig.Script) == 0 {
+		return nil
+	}
+
+	env, err := newScriptEnv()
+	if err != nil {
+		return err
+	}
+
+	backends, err := zcnConfig.backendNames()
+	if err != nil {
+		return err
+	}
+
+	for i := range zcnConfig.Script {
+		script := &zcnConfig.Script[i]
+		if script.When == "" {
+			return fmt.Errorf("script %d: When is required", i+1)
+		}
+
+		if script.Name == "" {
+			script.Name = script.When
+		}
+
+		if script.condition, err = compileScript(env, script.When, cel.BoolType); err != nil {
+			return fmt.Errorf("script %q: When: %s", script.Name, err.Error())
+		}
+
+		script.labelPrograms = make(map[string]cel.Program)
+		for label, expression := range script.Labels {
+			if script.labelPrograms[label], err = compileScript(env,
+				expression,
+				cel.StringType); err != nil {
+				return fmt.Errorf("script %q: label %s: %s", script.Name, label, err.Error())
+			}
+		}
+
+		if script.Severity != "" {
+			if script.level, err = parseSeverity(script.Severity); err != nil {
+				return fmt.Errorf("script %q: %s", script.Name, err.Error())
+			}
+		}
+
+		for _, backend := range script.Notify {
+			if !backends[backend] {
+				return fmt.Errorf("script %q: unknown backend %q in Notify",
+					script.Name, backend)
+			}
+		}
+	}
+
+	return nil
+}
+
+// scriptEntry Returns the value of the entry and previous variables.
+func scriptEntry(entry *zeroconf.ServiceEntry) map[string]any {
+	if entry == nil {
+		return map[string]any{}
+	}
+
+	txt := make(map[string]string)
+	for _, record := range entry.Text {
+		key, value, _ := strings.Cut(record, "=")
+		txt[key] = value
+	}
+
+	addresses := make([]string, 0, len(entry.AddrIPv4)+len(entry.AddrIPv6))
+	for _, ip := range entryIPs(entry) {
+		addresses = append(addresses, ip.String())
+	}
+
+	return map[string]any{"instance": entry.Instance,
+		"service":   entry.Service,
+		"domain":    strings.TrimSuffix(entry.Domain, "."),
+		"hostname":  strings.TrimSuffix(entry.HostName, "."),
+		"port":      int64(entry.Port),
+		"txt":       txt,
+		"addresses": addresses}
+}
+
+// scriptVariables Returns the variables the expressions are evaluated
+// with for change.
+func scriptVariables(change *ServiceEntryChange) map[string]any {
+	var event map[string]any
+	if encoded, err := json.Marshal(change.toJSON(false)); err == nil {
+		json.Unmarshal(encoded, &event)
+	}
+
+	labels := change.Labels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+
+	networks := change.Networks
+	if networks == nil {
+		networks = []string{}
+	}
+
+	return map[string]any{"entry": scriptEntry(&change.Entry),
+		"previous":      scriptEntry(change.Previous),
+		"changeType":    change.ChangeType.String(),
+		"severity":      change.Severity.String(),
+		"site":          change.Site,
+		"interface":     change.Interface,
+		"networks":      networks,
+		"category":      change.Category,
+		"labels":        labels,
+		"unknownDevice": change.UnknownDevice,
+		"event":         event}
+}
+
+// runScripts Runs every [[script]] block whose When is true for change, in
+// order, and returns the block which dropped it, nil if none did.  An
+// expression which fails, e.g. because a TXT record is missing, is false.
+func (zcnConfig *config) runScripts(change *ServiceEntryChange) *scriptConfig {
+	if len(zcnConfig.Script) == 0 {
+		return nil
+	}
+
+	variables := scriptVariables(change)
+	for i := range zcnConfig.Script {
+		script := &zcnConfig.Script[i]
+		out, _, err := script.condition.Eval(variables)
+		if err != nil {
+			slog.Debug("script failed", changeAttrs(change), "script", script.Name, "err", err)
+			continue
+		}
+
+		if matched, ok := out.Value().(bool); !ok || !matched {
+			continue
+		}
+
+		if script.Drop {
+			return script
+		}
+
+		change.Trace.add("script", "", TRACE_ACCEPTED, "matched script "+script.Name)
+		for label, program := range script.labelPrograms {
+			out, _, err := program.Eval(variables)
+			if err != nil {
+				slog.Debug("script label failed", changeAttrs(change),
+					"script", script.Name,
+					"label", label,
+					"err", err)
+				continue
+			}
+
+			if change.Labels == nil {
+				change.Labels = make(map[string]string)
+			}
+			change.Labels[label] = fmt.Sprint(out.Value())
+		}
+
+		if script.Severity != "" {
+			change.Severity = script.level
+		}
+
+		if len(script.Notify) != 0 {
+			change.Routes = script.Notify
+		}
+
+		// Later blocks see what earlier ones did.
+		variables = scriptVariables(change)
+	}
+
+	return nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// envReference matches ${NAME} references to environment variables, other
+// uses of $ are left alone so that passwords containing it still work.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv Replaces every ${NAME} in value with the environment variable
+// NAME, referencing a variable which isn't set is an error.
+func expandEnv(value string) (string, error) {
+	var missing []string
+	expanded := envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envReference.FindStringSubmatch(ref)[1]
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+
+		return env
+	})
+
+	if len(missing) != 0 {
+		return "", fmt.Errorf("environment variable %s not set",
+			strings.Join(missing, ", "))
+	}
+
+	return expanded, nil
+}
+
+// resolveSecret Returns the value of a secret which is either given inline,
+// possibly referencing the environment, or read from file, e.g. a Docker or
+// Kubernetes secret mounted under /run/secrets.  Trailing whitespace is
+// removed from the file so that a newline at the end doesn't end up in the
+// secret.
+func resolveSecret(name string, value string, file string) (string, error) {
+	if file == "" {
+		expanded, err := expandEnv(value)
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", name, err.Error())
+		}
+
+		return expanded, nil
+	}
+
+	if value != "" {
+		return "", fmt.Errorf("%s: both a value and a file are specified", name)
+	}
+
+	file, err := expandEnv(file)
+	if err != nil {
+		return "", fmt.Errorf("%s file: %s", name, err.Error())
+	}
+
+	secret, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", name, err.Error())
+	}
+
+	return strings.TrimRight(string(secret), " \t\r\n"), nil
+}
+
+// expandSecrets Resolves environment references and secret files in the
+// backend settings of zcnConfig.
+func expandSecrets(zcnConfig *config) error {
+	for _, bt := range backendTypes {
+		if err := bt.expandSecrets(zcnConfig); err != nil {
+			return err
+		}
+	}
+
+	if err := zcnConfig.Server.resolveTokens(); err != nil {
+		return err
+	}
+
+	ackSecret, err := resolveSecret("ack secret", zcnConfig.Ack.Secret, zcnConfig.Ack.SecretFile)
+	if err != nil {
+		return err
+	}
+	zcnConfig.Ack.Secret = ackSecret
+
+	for i := range zcnConfig.Identity {
+		idConf := &zcnConfig.Identity[i]
+		prefix := fmt.Sprintf("identity %q", idConf.Name)
+		token, err := resolveSecret(prefix+" token", idConf.Token, idConf.TokenFile)
+		if err != nil {
+			return err
+		}
+		idConf.Token = token
+
+		for header, value := range idConf.Headers {
+			expanded, err := expandEnv(value)
+			if err != nil {
+				return fmt.Errorf("%s header %q: %s", prefix, header, err.Error())
+			}
+			idConf.Headers[header] = expanded
+		}
+	}
+
+	return nil
+}
+
+// expandFields Replaces the environment references in each of fields.
+func expandFields(prefix string, fields ...*string) error {
+	for _, field := range fields {
+		expanded, err := expandEnv(*field)
+		if err != nil {
+			return fmt.Errorf("%s: %s", prefix, err.Error())
+		}
+		*field = expanded
+	}
+
+	return nil
+}
+
+// expandEmailSecrets Resolves the secrets of an [email.<name>] block.
+func expandEmailSecrets(prefix string, emailConf *emailConfig) error {
+	if err := expandFields(prefix, &emailConf.From, &emailConf.To, &emailConf.Server); err != nil {
+		return err
+	}
+
+	password, err := resolveSecret(prefix+" password",
+		emailConf.Password,
+		emailConf.PasswordFile)
+	if err != nil {
+		return err
+	}
+
+	emailConf.Password = password
+	dkimKey, err := resolveSecret(prefix+" DKIM key",
+		emailConf.DkimKey,
+		emailConf.DkimKeyFile)
+	if err != nil {
+		return err
+	}
+
+	emailConf.DkimKey = dkimKey
+	emailConf.DkimKeyFile = ""
+	return nil
+}
+
+// expandAlertmanagerSecrets Resolves the secrets of an
+// [alertmanager.<name>] block.
+func expandAlertmanagerSecrets(prefix string, amConf *alertmanagerConfig) error {
+	if err := expandFields(prefix, &amConf.URL); err != nil {
+		return err
+	}
+
+	token, err := resolveSecret(prefix+" token", amConf.Token, amConf.TokenFile)
+	if err != nil {
+		return err
+	}
+
+	amConf.Token = token
+	return nil
+}
+
+// expandMqttSecrets Resolves the secrets of an [mqtt.<name>] block.
+func expandMqttSecrets(prefix string, mqttConf *mqttConfig) error {
+	if err := expandFields(prefix, &mqttConf.Broker, &mqttConf.Username); err != nil {
+		return err
+	}
+
+	password, err := resolveSecret(prefix+" password",
+		mqttConf.Password,
+		mqttConf.PasswordFile)
+	if err != nil {
+		return err
+	}
+
+	mqttConf.Password = password
+	return nil
+}
+
+// expandSnmpTrapSecrets Resolves the secrets of a [snmptrap.<name>] block.
+func expandSnmpTrapSecrets(prefix string, snmpConf *snmpTrapConfig) error {
+	if err := expandFields(prefix,
+		&snmpConf.Target,
+		&snmpConf.Community,
+		&snmpConf.User); err != nil {
+		return err
+	}
+
+	authPassword, err := resolveSecret(prefix+" auth password",
+		snmpConf.AuthPassword,
+		snmpConf.AuthPasswordFile)
+	if err != nil {
+		return err
+	}
+
+	privPassword, err := resolveSecret(prefix+" priv password",
+		snmpConf.PrivPassword,
+		snmpConf.PrivPasswordFile)
+	if err != nil {
+		return err
+	}
+
+	snmpConf.AuthPassword = authPassword
+	snmpConf.PrivPassword = privPassword
+	return nil
+}
+
+// expandForwardSecrets Resolves the secrets of a [forward.<name>] block.
+func expandForwardSecrets(prefix string, fwdConf *forwardConfig) error {
+	return expandFields(prefix, &fwdConf.URL)
+}
+
+// expandSmsSecrets Resolves the secrets of an [sms.<name>] block.
+func expandSmsSecrets(prefix string, smsConf *smsConfig) error {
+	if err := expandFields(prefix,
+		&smsConf.From,
+		&smsConf.AccountSID,
+		&smsConf.Server,
+		&smsConf.SystemID); err != nil {
+		return err
+	}
+
+	to := make([]string, 0, len(smsConf.To))
+	for _, number := range smsConf.To {
+		expanded, err := expandEnv(number)
+		if err != nil {
+			return fmt.Errorf("%s: %s", prefix, err.Error())
+		}
+		to = append(to, expanded)
+	}
+	smsConf.To = to
+
+	authToken, err := resolveSecret(prefix+" auth token",
+		smsConf.AuthToken,
+		smsConf.AuthTokenFile)
+	if err != nil {
+		return err
+	}
+
+	password, err := resolveSecret(prefix+" password",
+		smsConf.Password,
+		smsConf.PasswordFile)
+	if err != nil {
+		return err
+	}
+
+	smsConf.AuthToken = authToken
+	smsConf.Password = password
+	return nil
+}
+
+// expandChatSecrets Resolves the webhook of a [teams.<name>] or
+// [googlechat.<name>] block.
+func expandChatSecrets(prefix string, chatConf *chatConfig) error {
+	webhook, err := resolveSecret(prefix+" URL", chatConf.URL, chatConf.URLFile)
+	if err != nil {
+		return err
+	}
+
+	chatConf.URL = webhook
+	return nil
+}
+
+// expandPluginSecrets Resolves the environment references in the Env and
+// Settings of a [plugin.<name>] block.
+func expandPluginSecrets(prefix string, pluginConf *pluginConfig) error {
+	for _, values := range []map[string]string{pluginConf.Env, pluginConf.Settings} {
+		for key, value := range values {
+			expanded, err := expandEnv(value)
+			if err != nil {
+				return fmt.Errorf("%s %s: %s", prefix, key, err.Error())
+			}
+			values[key] = expanded
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	SELFTEST_SERVICE     string = "_zcnotify-test._tcp"
+	SELFTEST_PORT        int    = 9
+	SELFTEST_SCAN_PERIOD uint   = 2
+	// Number of scan periods to wait for each change before failing.
+	SELFTEST_SCAN_PERIODS uint = 5
+)
+
+// waitForChange Waits for a change of the given type to the selftest instance,
+// other changes are ignored.  Returns false if the change isn't seen within
+// the timeout.
+func waitForChange(updates *eventBus,
+	changeType ServiceChangeType,
+	instance string,
+	timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case change := <-updates.events():
+			slog.Debug("selftest saw change", changeAttrs(&change))
+			if change.ChangeType == changeType &&
+				change.Entry.Instance == instance {
+				return true
+			}
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// selftest Registers a synthetic service on the discovery interfaces and
+// verifies that the watcher reports it being added, the change to its TXT
+// record and then its removal, which confirms that multicast works on
+// this host and network.  Returns true if the test passed.
+func selftest(resolver string, ipver zeroconf.IPType, intfs []net.Interface) bool {
+	hostname, _ := os.Hostname()
+	instance := fmt.Sprintf("zcnotify-selftest-%s-%d", hostname, os.Getpid())
+	timeout := time.Duration(SELFTEST_SCAN_PERIOD*SELFTEST_SCAN_PERIODS) *
+		time.Second
+
+	done := make(chan error, 1)
+	exit := make(chan bool, 1)
+	updates := newEventBus(busConfig{Length: DEFAULT_BUS_LENGTH,
+		Overflow: BUS_OVERFLOW_DROP_OLDEST})
+	defer updates.stop()
+	go watchZCGroups(done,
+		exit,
+		nil,
+		updates,
+		SELFTEST_SERVICE,
+		DEFAULT_DOMAIN,
+		browseTiming{period: time.Duration(SELFTEST_SCAN_PERIOD) * time.Second,
+			retry: retryConfig{InitialBackoffSeconds: 1,
+				MaxBackoffSeconds: SELFTEST_SCAN_PERIOD}},
+		mdnsBrowser(resolver, ipver, intfs),
+		newResolveCache(resolver, ipver, intfs),
+		nil,
+		nil,
+		nil,
+		nil,
+		nil)
+
+	// Stop the watcher on return, browses which fail are logged and retried
+	// so they show up as changes which weren't detected.
+	defer func() {
+		exit <- true
+	}()
+
+	fmt.Printf("registering %q on %v\n", instance, interfaceNames(intfs))
+	server, err := zeroconf.Register(instance,
+		SELFTEST_SERVICE,
+		DEFAULT_DOMAIN,
+		SELFTEST_PORT,
+		[]string{"selftest=1"},
+		intfs)
+	if err != nil {
+		fmt.Println("FAIL: unable to register selftest service:", err.Error())
+		return false
+	}
+
+	passed := true
+	if waitForChange(updates, ADD, instance, timeout) {
+		fmt.Println("PASS: ADD detected")
+	} else {
+		fmt.Printf("FAIL: ADD not detected within %s\n", timeout)
+		passed = false
+	}
+
+	if passed {
+		server.SetText([]string{"selftest=2"})
+		if waitForChange(updates, TXT_CHANGED, instance, timeout) {
+			fmt.Println("PASS: TXT_CHANGED detected")
+		} else {
+			fmt.Printf("FAIL: TXT_CHANGED not detected within %s\n", timeout)
+			passed = false
+		}
+	}
+
+	server.Shutdown()
+	if passed {
+		if waitForChange(updates, REMOVE, instance, timeout) {
+			fmt.Println("PASS: REMOVE detected")
+		} else {
+			fmt.Printf("FAIL: REMOVE not detected within %s\n", timeout)
+			passed = false
+		}
+	}
+
+	return passed
+}
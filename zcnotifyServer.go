@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// apiRole is what an API client is allowed to do.
+type apiRole int
+
+const (
+	ROLE_NONE apiRole = iota
+	// List services, events and health.
+	ROLE_READ
+	// Also change the running instance, e.g. reload its config.
+	ROLE_ADMIN
+)
+
+// serverConfig is the [server] section of the config file, which secures
+// the API and metrics listeners so they can be exposed beyond localhost.
+type serverConfig struct {
+	// Serve HTTPS with this certificate and key rather than HTTP.
+	CertFile string
+	KeyFile  string
+	// Accept clients presenting a certificate signed by this CA, read-only
+	// unless the certificate's common name is in AdminCommonNames.
+	ClientCAFile     string
+	AdminCommonNames []string
+	// Accept clients presenting one of these read-only bearer tokens,
+	// TokenFile holds one per line.
+	Tokens    []string
+	TokenFile string
+	// Bearer tokens which also allow the admin endpoints.
+	AdminTokens    []string
+	AdminTokenFile string
+	// CA the command line client checks the server's certificate against,
+	// the system's CAs if not set.
+	CAFile string
+}
+
+// setupServer Checks the [server] section.
+func (zcnConfig *config) setupServer() error {
+	sc := &zcnConfig.Server
+	if (sc.CertFile == "") != (sc.KeyFile == "") {
+		return errors.New("server: CertFile and KeyFile must be given together")
+	}
+
+	if sc.ClientCAFile != "" && sc.CertFile == "" {
+		return errors.New("server: ClientCAFile needs a CertFile and KeyFile")
+	}
+
+	if _, err := sc.tlsConfig(); err != nil {
+		return fmt.Errorf("server: %s", err.Error())
+	}
+
+	if len(sc.AdminCommonNames) != 0 && sc.ClientCAFile == "" {
+		return errors.New("server: AdminCommonNames needs a ClientCAFile")
+	}
+
+	for _, token := range append(append([]string(nil), sc.Tokens...), sc.AdminTokens...) {
+		if strings.TrimSpace(token) == "" {
+			return errors.New("server: empty token")
+		}
+	}
+
+	return nil
+}
+
+// readTokens Expands environment references in tokens and adds those in
+// file, one per line.
+func readTokens(tokens []string, file string) ([]string, error) {
+	for i, token := range tokens {
+		expanded, err := expandEnv(token)
+		if err != nil {
+			return nil, err
+		}
+		tokens[i] = expanded
+	}
+
+	if file == "" {
+		return tokens, nil
+	}
+
+	file, err := expandEnv(file)
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		if token := strings.TrimSpace(line); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+
+	return tokens, nil
+}
+
+// resolveTokens Expands environment references in the tokens and adds
+// those in the token files.
+func (sc *serverConfig) resolveTokens() error {
+	var err error
+	if sc.Tokens, err = readTokens(sc.Tokens, sc.TokenFile); err != nil {
+		return fmt.Errorf("server token: %s", err.Error())
+	}
+
+	if sc.AdminTokens, err = readTokens(sc.AdminTokens, sc.AdminTokenFile); err != nil {
+		return fmt.Errorf("server admin token: %s", err.Error())
+	}
+
+	sc.TokenFile = ""
+	sc.AdminTokenFile = ""
+	return nil
+}
+
+// tlsConfig Returns the TLS settings of the listeners, nil if they serve
+// plain HTTP.  With both a ClientCAFile and tokens a client certificate is
+// optional, as the client may present a token instead.
+func (sc *serverConfig) tlsConfig() (*tls.Config, error) {
+	if sc.CertFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(sc.CertFile, sc.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("server certificate: %s", err.Error())
+	}
+
+	tlsConf := &tls.Config{Certificates: []tls.Certificate{cert},
+		MinVersion: tls.VersionTLS12}
+	if sc.ClientCAFile != "" {
+		if tlsConf.ClientCAs, err = loadCertPool(sc.ClientCAFile); err != nil {
+			return nil, err
+		}
+
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+		if sc.hasTokens() {
+			tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return tlsConf, nil
+}
+
+// hasTokens Returns true if any bearer tokens are configured.
+func (sc *serverConfig) hasTokens() bool {
+	return sc.TokenFile != "" || len(sc.Tokens) != 0 ||
+		sc.AdminTokenFile != "" || len(sc.AdminTokens) != 0
+}
+
+// authRequired Returns true if clients have to present a certificate or
+// token.  Without, anyone who can reach the listeners is an admin.
+func (sc *serverConfig) authRequired() bool {
+	return sc.ClientCAFile != "" || sc.hasTokens()
+}
+
+// presentedToken Returns true if token is one of tokens.
+func presentedToken(token string, tokens []string) bool {
+	for _, candidate := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// role Returns what the request's client certificate or token allows, the
+// greater of the two if it presented both.
+func (sc *serverConfig) role(r *http.Request) apiRole {
+	if !sc.authRequired() {
+		return ROLE_ADMIN
+	}
+
+	role := ROLE_NONE
+	if r.TLS != nil && len(r.TLS.VerifiedChains) != 0 {
+		role = ROLE_READ
+		commonName := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for _, admin := range sc.AdminCommonNames {
+			if commonName == admin {
+				return ROLE_ADMIN
+			}
+		}
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return role
+	}
+
+	if presentedToken(token, sc.AdminTokens) {
+		return ROLE_ADMIN
+	}
+
+	if presentedToken(token, sc.Tokens) {
+		return ROLE_READ
+	}
+
+	return role
+}
+
+// admin Wraps handler so that it's only served to admins.
+func (sc *serverConfig) admin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if sc.role(r) != ROLE_ADMIN {
+			http.Error(w, "admin access required", http.StatusForbidden)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// protect Wraps handler so that requests must be authenticated, except for
+// the paths in open.
+func (sc *serverConfig) protect(handler http.Handler, open ...string) http.Handler {
+	if !sc.authRequired() {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range open {
+			if r.URL.Path == path {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		if sc.role(r) == ROLE_NONE {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="zcnotify"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// serveHTTP Serves handler on the given address, or the socket named name
+// from systemd, over HTTPS if the [server] section has a certificate.
+func (sc *serverConfig) serveHTTP(name string,
+	address string,
+	handler http.Handler) error {
+	listener, err := listen(name, address)
+	if err != nil {
+		return err
+	}
+
+	// The certificates have been checked by setupServer.
+	tlsConf, _ := sc.tlsConfig()
+	slog.Info("serving "+name,
+		"listen", listener.Addr().String(),
+		"tls", tlsConf != nil,
+		"auth", sc.authRequired())
+	server := &http.Server{Handler: handler, TLSConfig: tlsConf}
+	if tlsConf != nil {
+		return server.ServeTLS(listener, "", "")
+	}
+
+	return server.Serve(listener)
+}
+
+// apiClient Makes requests to the API of a running instance, the way its
+// [server] section says.
+type apiClient struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+// newAPIClient Returns a client of the API at addr, which is either a
+// host:port or a URL.  token is presented if it's set, otherwise the first
+// admin token if role is ROLE_ADMIN or the first token if not.
+func newAPIClient(addr string, sc serverConfig, token string, role apiRole) (*apiClient, error) {
+	ac := &apiClient{base: strings.TrimSuffix(addr, "/"),
+		token:  token,
+		client: &http.Client{Timeout: DEFAULT_API_CLIENT_TIMEOUT}}
+	tokens := append(append([]string(nil), sc.Tokens...), sc.AdminTokens...)
+	if role == ROLE_ADMIN {
+		tokens = sc.AdminTokens
+	}
+
+	if ac.token == "" && len(tokens) != 0 {
+		ac.token = tokens[0]
+	}
+
+	if !strings.Contains(addr, "://") {
+		ac.base = "http://" + ac.base
+		if sc.CertFile != "" {
+			ac.base = "https://" + strings.TrimPrefix(ac.base, "http://")
+		}
+	}
+
+	if sc.CAFile != "" {
+		roots, err := loadCertPool(sc.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		ac.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	}
+
+	return ac, nil
+}
+
+// get Makes a GET request for path.
+func (ac *apiClient) get(path string) (*http.Response, error) {
+	return ac.do(http.MethodGet, path, nil)
+}
+
+// do Makes a request for path, with a JSON body if body isn't nil.
+func (ac *apiClient) do(method string, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, ac.base+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if ac.token != "" {
+		req.Header.Set("Authorization", "Bearer "+ac.token)
+	}
+
+	return ac.client.Do(req)
+}
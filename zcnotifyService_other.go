@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// serviceCommand Fails, Windows services are only available on Windows.  On
+// Linux zcnotify can run as a systemd service instead.
+func serviceCommand(name string, args []string) int {
+	fmt.Fprintf(os.Stderr, "%s: Windows services are only available on Windows\n", name)
+	return 1
+}
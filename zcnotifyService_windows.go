@@ -0,0 +1,212 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	DEFAULT_SERVICE_NAME string = "zcnotify"
+	// Time allowed for the service to stop.
+	SERVICE_STOP_TIMEOUT time.Duration = 30 * time.Second
+)
+
+// windowsService Runs zcnotify under the service control manager.
+type windowsService struct {
+	configFile string
+}
+
+// Execute Runs zcnotify until the service manager asks it to stop.
+func (ws *windowsService) Execute(args []string,
+	requests <-chan svc.ChangeRequest,
+	status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	stop := make(chan bool, 1)
+	done := make(chan int, 1)
+	go func() {
+		done <- runUntil("run", []string{"-config", ws.configFile}, stop)
+	}()
+
+	status <- svc.Status{State: svc.Running,
+		Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+				break
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				stop <- true
+				<-done
+				return false, 0
+			}
+			break
+		case code := <-done:
+			// zcnotify stopped by itself, let the service manager's
+			// recovery actions restart it.
+			return false, uint32(code)
+		}
+	}
+}
+
+// installService Registers zcnotify as an automatically started service
+// which runs with the given config file, along with the event sources of its
+// [eventlog] blocks.
+func installService(name string, configFile string) error {
+	configFile, err := filepath.Abs(configFile)
+	if err != nil {
+		return err
+	}
+
+	// The config file is checked now rather than when the service fails
+	// to start.
+	zcnConfig, err := loadConfig(configFile, "", nil)
+	if err != nil {
+		return fmt.Errorf("failed to load config file: %s", err.Error())
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", name)
+	}
+
+	s, err := m.CreateService(name, exe, mgr.Config{DisplayName: "zcnotify",
+		Description: "Sends notifications when zeroconf services join, change or leave the network.",
+		StartType:   mgr.StartAutomatic},
+		"service", "-name", name, "-config", configFile, "run")
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 10 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: time.Minute}}, 24*60*60)
+	if err != nil {
+		return fmt.Errorf("unable to set recovery actions: %s", err.Error())
+	}
+
+	for _, eventLogConf := range zcnConfig.EventLog {
+		err := eventlog.InstallAsEventCreate(eventLogConf.Source,
+			eventlog.Error|eventlog.Warning|eventlog.Info)
+		if err != nil && !strings.Contains(err.Error(), "registry key already exists") {
+			return fmt.Errorf("unable to register event source %q: %s",
+				eventLogConf.Source, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// controlService Opens the named service and applies action to it.
+func controlService(name string, action func(s *mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s: %s", name, err.Error())
+	}
+	defer s.Close()
+
+	return action(s)
+}
+
+// stopService Asks the service to stop and waits for it to do so.
+func stopService(s *mgr.Service) error {
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(SERVICE_STOP_TIMEOUT)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for the service to stop")
+		}
+
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// serviceCommand Manages the Windows service, "run" is used by the service
+// manager to start it.
+func serviceCommand(name string, args []string) int {
+	fs := newFlagSet(name, "<install|uninstall|start|stop>")
+	serviceName := fs.String("name", DEFAULT_SERVICE_NAME, "Name of the Windows service")
+	configFile := fs.String("config", DEFAULT_CONFIG_FILE, "Configuration file (TOML, YAML or JSON), for install")
+	fs.Parse(args)
+
+	var err error
+	switch fs.Arg(0) {
+	case "install":
+		if err = installService(*serviceName, *configFile); err == nil {
+			fmt.Printf("installed service %s, start it with \"%s service start\"\n",
+				*serviceName, os.Args[0])
+		}
+		break
+	case "uninstall":
+		err = controlService(*serviceName, func(s *mgr.Service) error {
+			return s.Delete()
+		})
+		break
+	case "start":
+		err = controlService(*serviceName, func(s *mgr.Service) error {
+			return s.Start()
+		})
+		break
+	case "stop":
+		err = controlService(*serviceName, stopService)
+		break
+	case "run":
+		isService, serr := svc.IsWindowsService()
+		if serr != nil || !isService {
+			fmt.Fprintf(os.Stderr, "\"service run\" is used by the service manager, use \"run\" instead\n")
+			return 2
+		}
+
+		err = svc.Run(*serviceName, &windowsService{configFile: *configFile})
+		break
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s failed: %s\n", name, fs.Arg(0), err.Error())
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/grandcat/zeroconf"
+)
+
+type Severity int
+
+const (
+	SEVERITY_INFO     Severity = iota
+	SEVERITY_WARNING           = iota
+	SEVERITY_CRITICAL          = iota
+)
+
+func (s Severity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *Severity) UnmarshalJSON(bytes []byte) error {
+	var sStr string
+	if err := json.Unmarshal(bytes, &sStr); err != nil {
+		return err
+	}
+
+	parsed, err := parseSeverity(sStr)
+	if err != nil {
+		return err
+	}
+
+	*s = parsed
+	return nil
+}
+
+// parseSeverity Converts the name of a severity, as returned by String(),
+// back into a Severity.
+func parseSeverity(sStr string) (Severity, error) {
+	switch strings.ToLower(sStr) {
+	case "info":
+		return SEVERITY_INFO, nil
+	case "warning":
+		return SEVERITY_WARNING, nil
+	case "critical":
+		return SEVERITY_CRITICAL, nil
+	default:
+		return SEVERITY_INFO, fmt.Errorf("unknown severity %q, expected info, warning or critical",
+			sStr)
+	}
+}
+
+func (s Severity) String() string {
+	var sStr string
+	switch s {
+	case SEVERITY_INFO:
+		sStr = "info"
+		break
+	case SEVERITY_WARNING:
+		sStr = "warning"
+		break
+	case SEVERITY_CRITICAL:
+		sStr = "critical"
+		break
+	default:
+		panic(fmt.Sprintf("unknown severity %d", int(s)))
+	}
+
+	return sStr
+}
+
+// eventMatch selects events by their change type, service type, instance
+// name, host name and category.  Every setting given must match, an empty
+// setting matches anything.
+type eventMatch struct {
+	ChangeTypes []string
+	Services    []string
+	// Glob patterns of instance names and host names.
+	Instances []string
+	HostNames []string
+	// Categories such as "printer", see [[category]].
+	Categories []string
+}
+
+// validate Checks the change types and patterns.
+func (em *eventMatch) validate() error {
+	for _, changeType := range em.ChangeTypes {
+		if _, err := parseServiceChangeType(changeType); err != nil {
+			return err
+		}
+	}
+
+	for _, pattern := range append(append([]string(nil), em.Instances...), em.HostNames...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("pattern %q: %s", pattern, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// matches Returns true if every setting matches change.
+func (em *eventMatch) matches(change *ServiceEntryChange) bool {
+	if len(em.ChangeTypes) != 0 && !matchChangeType(em.ChangeTypes, change.ChangeType) {
+		return false
+	}
+
+	if len(em.Categories) != 0 && !matchCategory(em.Categories, change.Category) {
+		return false
+	}
+
+	return em.matchesEntry(&change.Entry)
+}
+
+// matchesEntry Returns true if the service, instance and host name settings
+// match entry.
+func (em *eventMatch) matchesEntry(entry *zeroconf.ServiceEntry) bool {
+	if len(em.Services) != 0 {
+		filter := serviceFilter{Services: em.Services}
+		if allowed, _ := filter.allows(entry.Service); !allowed {
+			return false
+		}
+	}
+
+	if len(em.Instances) != 0 && !matchInstance(em.Instances, entry.Instance) {
+		return false
+	}
+
+	return len(em.HostNames) == 0 ||
+		matchInstance(em.HostNames, strings.TrimSuffix(entry.HostName, "."))
+}
+
+// severityRule is a single [[severity]] block.  The first rule which
+// matches an event sets its severity, events which match no rule are info.
+type severityRule struct {
+	eventMatch
+	// info, warning or critical.
+	Level string
+	// Only match devices which aren't in [knownDevices].
+	UnknownDevice bool
+
+	severity Severity
+}
+
+// setupSeverity Validates the [[severity]] rules and the MinSeverity of each
+// backend.
+func (zcnConfig *config) setupSeverity() error {
+	for i := range zcnConfig.Severity {
+		rule := &zcnConfig.Severity[i]
+		severity, err := parseSeverity(rule.Level)
+		if err != nil {
+			return fmt.Errorf("severity rule %d: %s", i+1, err.Error())
+		}
+
+		rule.severity = severity
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("severity rule %d: %s", i+1, err.Error())
+		}
+	}
+
+	for name, emailConf := range zcnConfig.Email {
+		if emailConf.MinSeverity == "" {
+			continue
+		}
+
+		if _, err := parseSeverity(emailConf.MinSeverity); err != nil {
+			return fmt.Errorf("email.%s MinSeverity: %s", name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// matches Returns true if every setting of the rule matches change.
+func (sr *severityRule) matches(change *ServiceEntryChange) bool {
+	return sr.eventMatch.matches(change) && (!sr.UnknownDevice || change.UnknownDevice)
+}
+
+// assignSeverity Sets the severity of change from the first matching rule.
+func (zcnConfig *config) assignSeverity(change *ServiceEntryChange) {
+	for i := range zcnConfig.Severity {
+		rule := &zcnConfig.Severity[i]
+		if rule.matches(change) {
+			change.Severity = rule.severity
+			change.Trace.add("severity", "", TRACE_ACCEPTED,
+				fmt.Sprintf("%s from severity rule %d", rule.severity, i+1))
+			return
+		}
+	}
+
+	change.Severity = SEVERITY_INFO
+}
+
+// minSeverity Returns the lowest severity a backend is notified of, a
+// setting which failed to parse has already been rejected by loadConfig.
+func minSeverity(setting string) Severity {
+	severity, _ := parseSeverity(setting)
+	return severity
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// Services the shared resolver queries for at once.
+	DEFAULT_MAX_CONCURRENT_BROWSES uint = 4
+	// The shared resolver sends at most one query packet this often, and
+	// starts at most one browse, so that watchers which start together
+	// don't query all at once.
+	SHARED_QUERY_INTERVAL time.Duration = 250 * time.Millisecond
+	// Queries sent for each browse, 1 then 2 seconds apart as RFC 6762
+	// section 5.2 suggests, after which the browse only listens.
+	DEFAULT_QUERY_REPEATS uint = 3
+	// The same question isn't asked again within this many seconds, RFC
+	// 6762 section 5.2 asks for at least one.
+	DEFAULT_MIN_QUERY_INTERVAL uint = 1
+	// The top bit of a question's class asks for a unicast response, the
+	// QU bit of RFC 6762 section 5.4.
+	QUESTION_UNICAST_RESPONSE uint16 = 1 << 15
+)
+
+var sharedQueriesMetric = metrics.newCounter("zcnotify_shared_queries_total",
+	"mDNS query packets sent by the shared resolver.")
+
+// errBrowseStarved is the cause of a shared browse failing because it didn't
+// get to send its queries in time, which isn't a fault of the network.
+var errBrowseStarved = errors.New("ended before its queries were sent")
+
+// sharedBrowse is a browse of the shared resolver.
+type sharedBrowse struct {
+	ctx  context.Context
+	name string
+	// Queries sent so far and when the next is due.
+	sent int
+	next time.Time
+}
+
+// browseScheduler Sends the queries of the browses of every multicast
+// watcher over the sockets of a single passiveSniffer, which hears the
+// answers.  At most a fixed number of browses query at once, the others
+// wait, and the questions due together go in a single packet.  A question
+// isn't asked again within minInterval of being asked, whichever browse
+// wants it.
+type browseScheduler struct {
+	sniffer    *passiveSniffer
+	concurrent int
+	// Set the QU bit on the questions of each browse's first query.
+	unicastResponse bool
+	repeats         int
+	minInterval     time.Duration
+	mutex           sync.Mutex
+	waiting         []*sharedBrowse
+	active          []*sharedBrowse
+	// lastAsked is when each question was last asked, by questionKey.
+	lastAsked map[string]time.Time
+	exit      chan bool
+}
+
+// newSharedResolver Starts listening for mDNS traffic on intfs, like passive
+// mode, and querying for the services the watchers browse, at most
+// MaxConcurrentBrowses at once.
+func newSharedResolver(ipver zeroconf.IPType,
+	intfs []net.Interface,
+	zcConf zeroconfConfig) (*passiveSniffer, error) {
+	ps, err := newPassiveSniffer(ipver, intfs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hosts on this machine, e.g. avahi-daemon, have to hear the queries.
+	for _, conn := range ps.conns {
+		if mdnsGroup(conn) == mdnsIPv4Group {
+			err = ipv4.NewPacketConn(conn).SetMulticastLoopback(true)
+		} else {
+			err = ipv6.NewPacketConn(conn).SetMulticastLoopback(true)
+		}
+		if err != nil {
+			slog.Debug("failed to enable multicast loopback", "err", err)
+		}
+	}
+
+	ps.scheduler = &browseScheduler{sniffer: ps,
+		concurrent:      int(zcConf.MaxConcurrentBrowses),
+		unicastResponse: zcConf.UnicastResponse,
+		repeats:         int(zcConf.QueryRepeats),
+		minInterval:     time.Duration(zcConf.MinQueryIntervalSeconds) * time.Second,
+		lastAsked:       make(map[string]time.Time),
+		exit:            make(chan bool)}
+	go ps.scheduler.run()
+	return ps, nil
+}
+
+// mdnsGroup Returns the mDNS group conn was joined to.
+func mdnsGroup(conn *net.UDPConn) *net.UDPAddr {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		return mdnsIPv6Group
+	}
+
+	return mdnsIPv4Group
+}
+
+// browse Implements browseFunc, service is queried for once the browse gets
+// its turn and the instances which answered by the time ctx is done are
+// sent to entries.  A browse which ctx ended before it sent the queries
+// there was time for, e.g. while it waited its turn, fails as what's been
+// heard may only be some of the instances.
+func (bs *browseScheduler) browse(ctx context.Context,
+	service string,
+	domain string,
+	entries chan<- *zeroconf.ServiceEntry) error {
+	defer close(entries)
+
+	started := time.Now()
+	wanted := bs.repeats
+	if deadline, ok := ctx.Deadline(); ok {
+		wanted = queriesWithin(deadline.Sub(started), bs.repeats)
+	}
+
+	browse := &sharedBrowse{ctx: ctx, name: dns.Fqdn(service + "." + domain)}
+	bs.mutex.Lock()
+	bs.waiting = append(bs.waiting, browse)
+	bs.mutex.Unlock()
+
+	<-ctx.Done()
+	bs.mutex.Lock()
+	sent := browse.sent
+	bs.mutex.Unlock()
+	if sent < wanted {
+		return &transientBrowseError{fmt.Errorf("browse of %s %w, %d of %d",
+			browse.name, errBrowseStarved, sent, wanted)}
+	}
+
+	for _, entry := range bs.sniffer.current(service, domain, started) {
+		entries <- entry
+	}
+
+	return nil
+}
+
+// queriesWithin Returns how many of a browse's repeats queries can be sent
+// within length, at least one.  The queries are 1, 2, 4... seconds apart and
+// may each be held back for a couple of SHARED_QUERY_INTERVALs.
+func queriesWithin(length time.Duration, repeats int) int {
+	queries := 1
+	offset := time.Second
+	for queries < repeats && offset+2*SHARED_QUERY_INTERVAL < length {
+		queries++
+		offset += time.Second << (queries - 1)
+	}
+
+	return queries
+}
+
+// stop Stops sending queries.
+func (bs *browseScheduler) stop() {
+	close(bs.exit)
+}
+
+// run Sends the queries which are due every SHARED_QUERY_INTERVAL, starting
+// a waiting browse if fewer than the maximum are querying.
+func (bs *browseScheduler) run() {
+	ticker := time.NewTicker(SHARED_QUERY_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			break
+		case <-bs.exit:
+			return
+		}
+
+		if questions := bs.due(time.Now()); len(questions) != 0 {
+			bs.send(questions)
+		}
+	}
+}
+
+// due Returns the questions to ask now: the services of the browses whose
+// next query is due and the records missing from the instances they've
+// found, less those asked within minInterval.
+func (bs *browseScheduler) due(now time.Time) []dns.Question {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	bs.waiting = pendingBrowses(bs.waiting, bs.repeats)
+	bs.active = pendingBrowses(bs.active, bs.repeats)
+	if len(bs.waiting) != 0 && len(bs.active) < bs.concurrent {
+		bs.active = append(bs.active, bs.waiting[0])
+		bs.waiting = bs.waiting[1:]
+	}
+
+	// Questions asked recently count as asked.
+	asked := make(map[string]bool)
+	for key, at := range bs.lastAsked {
+		if now.Sub(at) < bs.minInterval {
+			asked[key] = true
+		} else {
+			delete(bs.lastAsked, key)
+		}
+	}
+
+	var questions []dns.Question
+	for _, browse := range bs.active {
+		if now.Before(browse.next) {
+			continue
+		}
+
+		first := len(questions)
+		if key := questionKey(browse.name, dns.TypePTR); !asked[key] {
+			asked[key] = true
+			questions = append(questions, dns.Question{Name: browse.name,
+				Qtype:  dns.TypePTR,
+				Qclass: dns.ClassINET})
+		}
+
+		if browse.sent != 0 {
+			questions = append(questions, bs.sniffer.unresolved(browse.name, asked)...)
+		} else if bs.unicastResponse {
+			for i := first; i < len(questions); i++ {
+				questions[i].Qclass |= QUESTION_UNICAST_RESPONSE
+			}
+		}
+
+		browse.sent++
+		browse.next = now.Add(time.Second << (browse.sent - 1))
+	}
+
+	for _, question := range questions {
+		bs.lastAsked[questionKey(question.Name, question.Qtype)] = now
+	}
+
+	return questions
+}
+
+// pendingBrowses Returns the browses which still have queries to send, of
+// at most repeats each.
+func pendingBrowses(browses []*sharedBrowse, repeats int) []*sharedBrowse {
+	var pending []*sharedBrowse
+	for _, browse := range browses {
+		if browse.ctx.Err() == nil && browse.sent < repeats {
+			pending = append(pending, browse)
+		}
+	}
+
+	return pending
+}
+
+// send Multicasts a query with questions on every socket of the sniffer.
+func (bs *browseScheduler) send(questions []dns.Question) {
+	msg := new(dns.Msg)
+	msg.Question = questions
+	packet, err := msg.Pack()
+	if err != nil {
+		slog.Error("failed to pack mDNS query", "err", err)
+		return
+	}
+
+	sharedQueriesMetric.With().Inc()
+	for _, conn := range bs.sniffer.conns {
+		if _, err := conn.WriteToUDP(packet, mdnsGroup(conn)); err != nil {
+			slog.Debug("failed to send mDNS query",
+				"local", conn.LocalAddr(),
+				"err", err)
+		}
+	}
+}
+
+// unresolved Returns the questions for the records which haven't been heard
+// of the instances of the service type called name: the SRV and TXT records
+// of each instance and the addresses of its host.  Questions in asked are
+// left out, those returned are added to it.  The instances of a subtype are
+// named after its service type.
+func (ps *passiveSniffer) unresolved(name string, asked map[string]bool) []dns.Question {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	subtype, service, domain, ok := splitSubtypeName(name)
+	if ok {
+		name = dns.Fqdn(service + "." + domain)
+	}
+
+	var questions []dns.Question
+	ask := func(name string, qtype uint16) {
+		if key := questionKey(name, qtype); !asked[key] {
+			asked[key] = true
+			questions = append(questions, dns.Question{Name: name,
+				Qtype:  qtype,
+				Qclass: dns.ClassINET})
+		}
+	}
+
+	now := time.Now()
+	for _, si := range ps.instances {
+		if si.expires.IsZero() ||
+			!strings.EqualFold(dns.Fqdn(si.service+"."+si.domain), name) ||
+			!si.hasSubtype(subtype, now) {
+			continue
+		}
+
+		if si.hostName == "" {
+			instanceName := escapeInstance(si.instance) + "." + name
+			ask(instanceName, dns.TypeSRV)
+			ask(instanceName, dns.TypeTXT)
+			continue
+		}
+
+		if sh, ok := ps.hosts[strings.ToLower(si.hostName)]; !ok ||
+			(len(sh.addrIPv4) == 0 && len(sh.addrIPv6) == 0) {
+			ask(si.hostName, dns.TypeA)
+			ask(si.hostName, dns.TypeAAAA)
+		}
+	}
+
+	return questions
+}
+
+// questionKey Returns what tells a question apart from the others in a
+// query.
+func questionKey(name string, qtype uint16) string {
+	return strings.ToLower(name) + "/" + dns.TypeToString[qtype]
+}
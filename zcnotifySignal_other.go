@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// rescanSignal has every watcher start a new browse straight away.
+var rescanSignal os.Signal = syscall.SIGUSR1
+
+// dumpSignal has zcnotify write a snapshot of its internal state.
+var dumpSignal os.Signal = syscall.SIGUSR2
@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+)
+
+// rescanSignal is nil, Windows has no user signals so a rescan can only be
+// requested through the API.
+var rescanSignal os.Signal
+
+// dumpSignal is nil for the same reason, the state can be dumped through the
+// API.
+var dumpSignal os.Signal
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Length of a silence if none is given.
+const DEFAULT_SILENCE_DURATION string = "1h"
+
+var silencedMetric = metrics.newCounter("zcnotify_events_silenced_total",
+	"Events recorded but not notified because of a silence.")
+
+// silence Holds back the notifications of matching events until it ends,
+// they're still recorded in the history.  Empty Instance and Service match
+// everything.
+type silence struct {
+	ID string `json:"id"`
+	// Glob pattern matched against the instance name, ignoring case.
+	Instance string    `json:"instance,omitempty"`
+	Service  string    `json:"service,omitempty"`
+	Comment  string    `json:"comment,omitempty"`
+	StartsAt time.Time `json:"startsAt"`
+	EndsAt   time.Time `json:"endsAt"`
+}
+
+// silenceRequest is the body of POST /silences.
+type silenceRequest struct {
+	Instance string `json:"instance"`
+	Service  string `json:"service"`
+	Comment  string `json:"comment"`
+	// Duration such as "2h" or "1d", DEFAULT_SILENCE_DURATION if empty.
+	Duration string `json:"duration"`
+}
+
+// matches Returns true if the silence applies to change at now.
+func (s *silence) matches(change *ServiceEntryChange, now time.Time) bool {
+	if now.Before(s.StartsAt) || !now.Before(s.EndsAt) {
+		return false
+	}
+
+	if s.Service != "" && !strings.EqualFold(s.Service, change.Entry.Service) {
+		return false
+	}
+
+	return s.Instance == "" || matchInstance([]string{s.Instance}, change.Entry.Instance)
+}
+
+// description Returns what the silence matches, for traces and logs.
+func (s *silence) description() string {
+	var matches []string
+	if s.Instance != "" {
+		matches = append(matches, "instance "+s.Instance)
+	}
+
+	if s.Service != "" {
+		matches = append(matches, "service "+s.Service)
+	}
+
+	if len(matches) == 0 {
+		matches = append(matches, "everything")
+	}
+
+	return fmt.Sprintf("silence %s (%s) until %s", s.ID,
+		strings.Join(matches, ", "),
+		s.EndsAt.Format(time.RFC3339))
+}
+
+// silenceStore Keeps the silences of a running instance, they're forgotten
+// once they end or zcnotify restarts.
+type silenceStore struct {
+	mutex    sync.Mutex
+	silences map[string]*silence
+}
+
+func newSilenceStore() *silenceStore {
+	return &silenceStore{silences: make(map[string]*silence)}
+}
+
+// add Creates a silence from a request.
+func (ss *silenceStore) add(request *silenceRequest, now time.Time) (*silence, error) {
+	if request.Instance != "" {
+		if _, err := path.Match(request.Instance, ""); err != nil {
+			return nil, fmt.Errorf("invalid instance pattern %q", request.Instance)
+		}
+	}
+
+	duration := request.Duration
+	if duration == "" {
+		duration = DEFAULT_SILENCE_DURATION
+	}
+
+	length, err := parsePeriod(duration)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &silence{ID: newEventID(),
+		Instance: request.Instance,
+		Service:  request.Service,
+		Comment:  request.Comment,
+		StartsAt: now.UTC(),
+		EndsAt:   now.UTC().Add(length)}
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	ss.silences[s.ID] = s
+	return s, nil
+}
+
+// expire Ends the silence with the given ID, false if there's no such
+// active silence.
+func (ss *silenceStore) expire(id string) bool {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	_, ok := ss.silences[id]
+	delete(ss.silences, id)
+	return ok
+}
+
+// active Returns the silences which haven't ended, soonest to end first,
+// forgetting the rest.
+func (ss *silenceStore) active(now time.Time) []silence {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	active := []silence{}
+	for id, s := range ss.silences {
+		if !now.Before(s.EndsAt) {
+			delete(ss.silences, id)
+			continue
+		}
+
+		active = append(active, *s)
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].EndsAt.Before(active[j].EndsAt)
+	})
+
+	return active
+}
+
+// silenced Returns the silence which applies to change, nil if none does.
+func (ss *silenceStore) silenced(change *ServiceEntryChange) *silence {
+	if ss == nil {
+		return nil
+	}
+
+	now := time.Now()
+	for _, s := range ss.active(now) {
+		if s.matches(change, now) {
+			return &s
+		}
+	}
+
+	return nil
+}
+
+// listSilences Returns the active silences.
+func (as *apiServer) listSilences(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, as.silences.active(time.Now()))
+}
+
+// addSilence Creates a silence.
+func (as *apiServer) addSilence(w http.ResponseWriter, r *http.Request) {
+	var request silenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s, err := as.silences.add(&request, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	slog.Info("silence added", "silence", s.description(), "comment", s.Comment)
+	writeJSON(w, s)
+}
+
+// expireSilence Ends a silence early.
+func (as *apiServer) expireSilence(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !as.silences.expire(id) {
+		http.Error(w, "no such silence", http.StatusNotFound)
+		return
+	}
+
+	slog.Info("silence expired", "id", id)
+	writeJSON(w, map[string]string{"id": id, "status": "expired"})
+}
+
+// silenceCommand Lists, adds or expires the silences of a running instance.
+func silenceCommand(name string, args []string) int {
+	fs := newFlagSet(name, "")
+	common := addCommonFlags(fs)
+	addr := fs.String("api", "",
+		"Address of the instance's API, defaults to the configured API listener")
+	token := fs.String("token", "",
+		"Bearer token for the API, defaults to the first [server] admin token")
+	list := fs.Bool("list", false, "List the active silences")
+	expire := fs.String("expire", "", "End the silence with this ID")
+	instance := fs.String("instance", "",
+		"Silence instances matching this glob pattern, all if not given")
+	service := fs.String("type", "", "Silence this service type, all if not given")
+	all := fs.Bool("all", false, "Silence every event")
+	duration := fs.String("for", DEFAULT_SILENCE_DURATION,
+		"How long to silence, e.g. 30m, 2h or 1d")
+	comment := fs.String("comment", "", "Why, e.g. \"rebooting the NAS\"")
+	fs.Parse(args)
+
+	role := ROLE_ADMIN
+	if *list {
+		role = ROLE_READ
+	}
+
+	client := newCommandAPIClient(common, *addr, *token, role)
+	var resp *http.Response
+	var err error
+	if *list {
+		resp, err = client.get("/silences")
+	} else if *expire != "" {
+		resp, err = client.do(http.MethodDelete, "/silences/"+*expire, nil)
+	} else {
+		if *instance == "" && *service == "" && !*all {
+			fmt.Fprintln(os.Stderr, "give -instance and/or -type, or -all to silence every event")
+			return 2
+		}
+
+		body, _ := json.Marshal(silenceRequest{Instance: *instance,
+			Service:  *service,
+			Comment:  *comment,
+			Duration: *duration})
+		resp, err = client.do(http.MethodPost, "/silences", body)
+	}
+
+	if err != nil {
+		fatal("failed to query API", "err", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "%s: %s", resp.Status, body)
+		return 1
+	}
+
+	var silences []silence
+	if *list {
+		err = json.Unmarshal(body, &silences)
+	} else if *expire != "" {
+		fmt.Printf("expired %s\n", *expire)
+		return 0
+	} else {
+		var s silence
+		err = json.Unmarshal(body, &s)
+		silences = append(silences, s)
+	}
+
+	if err != nil {
+		fatal("invalid API response", "err", err)
+	}
+
+	writeSilences(os.Stdout, silences)
+	return 0
+}
+
+// writeSilences Writes silences as a table.
+func writeSilences(w io.Writer, silences []silence) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tINSTANCE\tSERVICE\tENDS\tCOMMENT")
+	for _, s := range silences {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", s.ID,
+			orAll(s.Instance),
+			orAll(s.Service),
+			s.EndsAt.Local().Format(time.RFC3339),
+			s.Comment)
+	}
+	tw.Flush()
+}
+
+// orAll Returns "*" for an empty matcher.
+func orAll(matcher string) string {
+	if matcher == "" {
+		return "*"
+	}
+
+	return matcher
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// siteConfig describes where this zcnotify runs, every event it finds is
+// tagged with it so that events aggregated from several sites can be told
+// apart.
+type siteConfig struct {
+	Name     string
+	Location string
+	Tags     []string
+	// MaxMind (GeoLite2 or GeoIP2) City or Country database used to
+	// locate the public addresses of services.
+	GeoipDatabase string
+}
+
+// geoLocation is where the GeoIP database places an address.
+type geoLocation struct {
+	Address     string  `json:"address"`
+	Country     string  `json:"country,omitempty"`
+	CountryCode string  `json:"countryCode,omitempty"`
+	City        string  `json:"city,omitempty"`
+	Latitude    float64 `json:"latitude,omitempty"`
+	Longitude   float64 `json:"longitude,omitempty"`
+}
+
+// geoRecord is the part of a MaxMind City or Country record which is used.
+type geoRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		IsoCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+// carrierGradeNAT is the shared address space of RFC 6598, which isn't
+// routed on the internet either.
+var _, carrierGradeNAT, _ = net.ParseCIDR("100.64.0.0/10")
+
+// publicAddress Returns true if ip is routed on the internet, i.e. it isn't
+// an RFC 1918, unique local, shared, link-local or loopback address.
+func publicAddress(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !carrierGradeNAT.Contains(ip)
+}
+
+// setupSite Checks the GeoIP database of the [site] section.
+func (zcnConfig *config) setupSite() error {
+	if zcnConfig.Site.GeoipDatabase == "" {
+		return nil
+	}
+
+	reader, err := maxminddb.Open(zcnConfig.Site.GeoipDatabase)
+	if err != nil {
+		return fmt.Errorf("site GeoipDatabase: %s", err.Error())
+	}
+
+	return reader.Close()
+}
+
+// siteTagger Adds the [site] details and the GeoIP location of public
+// addresses to changes.
+type siteTagger struct {
+	conf  siteConfig
+	geoip *maxminddb.Reader
+}
+
+// newSiteTagger Creates the site stage, opening the GeoIP database if one is
+// configured.
+func newSiteTagger(conf siteConfig) (*siteTagger, error) {
+	st := &siteTagger{conf: conf}
+	if conf.GeoipDatabase != "" {
+		reader, err := maxminddb.Open(conf.GeoipDatabase)
+		if err != nil {
+			return nil, fmt.Errorf("site GeoipDatabase: %s", err.Error())
+		}
+
+		slog.Info("loaded GeoIP database",
+			"file", conf.GeoipDatabase,
+			"type", reader.Metadata.DatabaseType)
+		st.geoip = reader
+	}
+
+	return st, nil
+}
+
+// locate Returns the location of the first of the entry's public addresses
+// the GeoIP database knows, nil if there's none.
+func (st *siteTagger) locate(change *ServiceEntryChange) *geoLocation {
+	for _, ip := range append(append([]net.IP(nil), change.Entry.AddrIPv4...),
+		change.Entry.AddrIPv6...) {
+		if !publicAddress(ip) {
+			continue
+		}
+
+		var record geoRecord
+		if err := st.geoip.Lookup(ip, &record); err != nil {
+			slog.Debug("GeoIP lookup failed", "address", ip.String(), "err", err)
+			continue
+		}
+
+		if record.Country.IsoCode == "" {
+			continue
+		}
+
+		return &geoLocation{Address: ip.String(),
+			Country:     record.Country.Names["en"],
+			CountryCode: record.Country.IsoCode,
+			City:        record.City.Names["en"],
+			Latitude:    record.Location.Latitude,
+			Longitude:   record.Location.Longitude}
+	}
+
+	return nil
+}
+
+// tag Adds the site's name, location and tags to change, unless it came from
+// another site, and the location of its public address.
+func (st *siteTagger) tag(change *ServiceEntryChange) {
+	if change.Site == "" {
+		change.Site = st.conf.Name
+		change.Location = st.conf.Location
+		change.Tags = st.conf.Tags
+	}
+
+	if st.geoip != nil {
+		change.Geo = st.locate(change)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+)
+
+// SMPP 3.4 command IDs, responses have the top bit set.
+const (
+	SMPP_GENERIC_NACK     uint32 = 0x80000000
+	SMPP_BIND_TRANSMITTER uint32 = 0x00000002
+	SMPP_SUBMIT_SM        uint32 = 0x00000004
+	SMPP_UNBIND           uint32 = 0x00000006
+	SMPP_ENQUIRE_LINK     uint32 = 0x00000015
+	SMPP_RESPONSE         uint32 = 0x80000000
+	SMPP_VERSION          byte   = 0x34
+	// UCS-2 holds 70 UTF-16 code units in the 140 octets of a single SMS,
+	// a character outside the Basic Multilingual Plane takes two.
+	SMPP_UCS2_MAX_LENGTH int = 70
+	// The GSM 03.38 default alphabet holds 160 septets, a character of its
+	// extension table takes two, the escape and its code.
+	SMPP_GSM_MAX_LENGTH int  = 160
+	SMPP_GSM_ESCAPE     byte = 0x1b
+)
+
+// The GSM 03.38 default alphabet, indexed by code.  0x1b is the escape to the
+// extension table rather than a character.
+const GSM_ALPHABET string = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞ\x1bÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+
+var (
+	gsmCodes = gsmTable()
+	// The GSM 03.38 extension table, each is sent after SMPP_GSM_ESCAPE.
+	gsmExtension = map[rune]byte{'\f': 0x0a, '^': 0x14, '{': 0x28, '}': 0x29,
+		'\\': 0x2f, '[': 0x3c, '~': 0x3d, ']': 0x3e, '|': 0x40, '€': 0x65}
+)
+
+// gsmTable Returns the codes of the characters of the GSM 03.38 default
+// alphabet.
+func gsmTable() map[rune]byte {
+	codes := make(map[rune]byte)
+	for code, r := range []rune(GSM_ALPHABET) {
+		if byte(code) != SMPP_GSM_ESCAPE {
+			codes[r] = byte(code)
+		}
+	}
+
+	return codes
+}
+
+// gsmEncode Returns text in the GSM 03.38 default alphabet, one septet per
+// octet, cut to a single SMS.  ok is false if text has a character which the
+// alphabet doesn't have.
+func gsmEncode(text string) ([]byte, bool) {
+	message := make([]byte, 0, len(text))
+	for _, r := range text {
+		var codes []byte
+		if code, ok := gsmCodes[r]; ok {
+			codes = []byte{code}
+		} else if code, ok := gsmExtension[r]; ok {
+			codes = []byte{SMPP_GSM_ESCAPE, code}
+		} else {
+			return nil, false
+		}
+
+		if len(message)+len(codes) > SMPP_GSM_MAX_LENGTH {
+			break
+		}
+		message = append(message, codes...)
+	}
+
+	return message, true
+}
+
+// ucs2Encode Returns text as UTF-16, cut to a single SMS without splitting a
+// surrogate pair.
+func ucs2Encode(text string) []byte {
+	units := utf16.Encode([]rune(text))
+	if len(units) > SMPP_UCS2_MAX_LENGTH {
+		units = units[:SMPP_UCS2_MAX_LENGTH]
+		if last := units[len(units)-1]; last >= 0xd800 && last < 0xdc00 {
+			units = units[:len(units)-1]
+		}
+	}
+
+	message := make([]byte, 0, 2*len(units))
+	for _, unit := range units {
+		message = binary.BigEndian.AppendUint16(message, unit)
+	}
+
+	return message
+}
+
+// smppSession is a connection to an SMSC bound as a transmitter, only the
+// few operations needed to submit messages are implemented.
+type smppSession struct {
+	conn     net.Conn
+	timeout  time.Duration
+	sequence uint32
+}
+
+// smppBind Connects to the SMSC at server and binds as a transmitter.
+func smppBind(server string,
+	systemID string,
+	password string,
+	systemType string,
+	timeout time.Duration) (*smppSession, error) {
+	conn, err := net.DialTimeout("tcp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	session := &smppSession{conn: conn, timeout: timeout}
+	var body bytes.Buffer
+	smppString(&body, systemID)
+	smppString(&body, password)
+	smppString(&body, systemType)
+	body.Write([]byte{SMPP_VERSION, 0, 0})
+	smppString(&body, "")
+	if err := session.request(SMPP_BIND_TRANSMITTER, body.Bytes()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("smpp bind: %s", err.Error())
+	}
+
+	return session, nil
+}
+
+// smppString Writes a null terminated string.
+func smppString(body *bytes.Buffer, s string) {
+	body.WriteString(s)
+	body.WriteByte(0)
+}
+
+// smppAddress Returns the type of number, numbering plan and digits of a
+// phone number or alphanumeric sender ID.
+func smppAddress(address string) (byte, byte, string) {
+	if strings.HasPrefix(address, "+") {
+		// International, E.164.
+		return 1, 1, address[1:]
+	}
+
+	for _, r := range address {
+		if !unicode.IsDigit(r) {
+			// Alphanumeric, unknown numbering plan.
+			return 5, 0, address
+		}
+	}
+
+	// Unknown type, E.164.
+	return 0, 1, address
+}
+
+// submit Sends text to a single phone.  Text is sent in the GSM 03.38
+// default alphabet, the SMSC's default, unless it has characters the
+// alphabet doesn't in which case it's sent as UCS-2, which fits fewer.
+func (ss *smppSession) submit(from string, to string, text string) error {
+	dataCoding := byte(0)
+	message, ok := gsmEncode(text)
+	if !ok {
+		dataCoding = 8
+		message = ucs2Encode(text)
+	}
+
+	var body bytes.Buffer
+	smppString(&body, "")
+	ton, npi, source := smppAddress(from)
+	body.Write([]byte{ton, npi})
+	smppString(&body, source)
+	ton, npi, destination := smppAddress(to)
+	body.Write([]byte{ton, npi})
+	smppString(&body, destination)
+	// esm_class, protocol_id and priority_flag.
+	body.Write([]byte{0, 0, 0})
+	// Deliver now, with the SMSC's default validity period.
+	smppString(&body, "")
+	smppString(&body, "")
+	// registered_delivery, replace_if_present_flag, data_coding,
+	// sm_default_msg_id and sm_length.
+	body.Write([]byte{0, 0, dataCoding, 0, byte(len(message))})
+	body.Write(message)
+
+	return ss.request(SMPP_SUBMIT_SM, body.Bytes())
+}
+
+// request Sends a PDU and waits for its response, answering the SMSC's
+// enquire_links meanwhile.
+func (ss *smppSession) request(command uint32, body []byte) error {
+	ss.sequence++
+	if err := ss.write(command, 0, ss.sequence, body); err != nil {
+		return err
+	}
+
+	for {
+		respCommand, status, sequence, err := ss.read()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case respCommand == SMPP_ENQUIRE_LINK:
+			if err := ss.write(SMPP_ENQUIRE_LINK|SMPP_RESPONSE, 0, sequence, nil); err != nil {
+				return err
+			}
+			continue
+		case respCommand == SMPP_GENERIC_NACK:
+			return fmt.Errorf("smpp generic_nack, status 0x%08x", status)
+		case respCommand == command|SMPP_RESPONSE && sequence == ss.sequence:
+			if status != 0 {
+				return fmt.Errorf("smpp command 0x%08x failed, status 0x%08x", command, status)
+			}
+			return nil
+		}
+	}
+}
+
+// write Sends a single PDU.
+func (ss *smppSession) write(command uint32, status uint32, sequence uint32, body []byte) error {
+	pdu := make([]byte, 16, 16+len(body))
+	binary.BigEndian.PutUint32(pdu[0:], uint32(16+len(body)))
+	binary.BigEndian.PutUint32(pdu[4:], command)
+	binary.BigEndian.PutUint32(pdu[8:], status)
+	binary.BigEndian.PutUint32(pdu[12:], sequence)
+	ss.conn.SetWriteDeadline(time.Now().Add(ss.timeout))
+	_, err := ss.conn.Write(append(pdu, body...))
+	return err
+}
+
+// read Receives a single PDU, the body is discarded as none of the
+// responses used carry anything of interest.
+func (ss *smppSession) read() (uint32, uint32, uint32, error) {
+	ss.conn.SetReadDeadline(time.Now().Add(ss.timeout))
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(ss.conn, header); err != nil {
+		return 0, 0, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:])
+	if length < 16 {
+		return 0, 0, 0, fmt.Errorf("smpp PDU length %d too short", length)
+	}
+
+	if _, err := io.CopyN(io.Discard, ss.conn, int64(length-16)); err != nil {
+		return 0, 0, 0, err
+	}
+
+	return binary.BigEndian.Uint32(header[4:]),
+		binary.BigEndian.Uint32(header[8:]),
+		binary.BigEndian.Uint32(header[12:]),
+		nil
+}
+
+// close Unbinds and disconnects, the messages have been submitted so a
+// failure to unbind is ignored.
+func (ss *smppSession) close() {
+	ss.request(SMPP_UNBIND, nil)
+	ss.conn.Close()
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	SMS_PROVIDER_TWILIO string = "twilio"
+	SMS_PROVIDER_SMPP   string = "smpp"
+	DEFAULT_TWILIO_URL  string = "https://api.twilio.com"
+	DEFAULT_SMS_TIMEOUT uint   = 10
+	// Messages are cut to a single SMS, which is 160 characters of the GSM
+	// alphabet.
+	SMS_MAX_LENGTH int = 160
+	// Events being retried for some of their phones whose other phones are
+	// remembered, beyond which they're forgotten, e.g. after giving up.
+	SMS_PENDING_MAX int = 64
+)
+
+// smsConfig describes a single [sms.<name>] block.
+type smsConfig struct {
+	serviceFilter
+	scheduleConfig
+	// Template replaces the text of the message.
+	templateConfig
+	// twilio or smpp.
+	Provider string
+	// Sender number, e.g. "+15005550006", or alphanumeric sender ID.
+	From string
+	// Numbers of the phones to send to, e.g. ["+353861234567"].
+	To []string
+	// Only send events of at least this severity, critical if not set.
+	MinSeverity string
+	// Twilio account and auth token, which may reference ${ENV_VAR}s or be
+	// read from AuthTokenFile.
+	AccountSID    string
+	AuthToken     string
+	AuthTokenFile string
+	// Base URL of the Twilio API.
+	URL string
+	// SMSC of the smpp provider, "host:port", and the account bound as a
+	// transmitter.  The password may reference ${ENV_VAR}s or be read from
+	// PasswordFile.
+	Server         string
+	SystemID       string
+	SystemType     string
+	Password       string
+	PasswordFile   string
+	TimeoutSeconds uint
+}
+
+// validSmsConfig Checks every [sms.<name>] block and fills in the defaults.
+func validSmsConfig(smsConfs map[string]smsConfig) error {
+	if len(smsConfs) == 0 {
+		return errors.New("no [sms.<name>] blocks")
+	}
+
+	for name, smsConf := range smsConfs {
+		prefix := fmt.Sprintf("sms config: %q", name)
+		if smsConf.From == "" || len(smsConf.To) == 0 {
+			return fmt.Errorf("%s From and To are required", prefix)
+		}
+
+		switch strings.ToLower(smsConf.Provider) {
+		case "", SMS_PROVIDER_TWILIO:
+			smsConf.Provider = SMS_PROVIDER_TWILIO
+			if smsConf.AccountSID == "" {
+				return fmt.Errorf("%s Twilio requires an AccountSID", prefix)
+			}
+
+			if smsConf.URL == "" {
+				smsConf.URL = DEFAULT_TWILIO_URL
+			}
+
+			parsed, err := url.Parse(smsConf.URL)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+				return fmt.Errorf("%s invalid URL %q", prefix, smsConf.URL)
+			}
+			break
+		case SMS_PROVIDER_SMPP:
+			smsConf.Provider = SMS_PROVIDER_SMPP
+			if smsConf.Server == "" || smsConf.SystemID == "" {
+				return fmt.Errorf("%s SMPP requires a Server and SystemID", prefix)
+			}
+			break
+		default:
+			return fmt.Errorf("%s unknown Provider %q, expected %s or %s",
+				prefix, smsConf.Provider, SMS_PROVIDER_TWILIO, SMS_PROVIDER_SMPP)
+		}
+
+		if smsConf.MinSeverity == "" {
+			smsConf.MinSeverity = "critical"
+		}
+
+		if _, err := parseSeverity(smsConf.MinSeverity); err != nil {
+			return fmt.Errorf("%s MinSeverity: %s", prefix, err.Error())
+		}
+
+		if smsConf.TimeoutSeconds == 0 {
+			smsConf.TimeoutSeconds = DEFAULT_SMS_TIMEOUT
+		}
+
+		if err := smsConf.setup(prefix); err != nil {
+			return err
+		}
+
+		smsConfs[name] = smsConf
+	}
+
+	return nil
+}
+
+// smsNotifier Texts the phones of a single [sms.<name>] block, through
+// Twilio or an SMSC.
+type smsNotifier struct {
+	name     string
+	conf     smsConfig
+	template *template.Template
+	client   *http.Client
+	mutex    sync.Mutex
+	// texted holds the phones each event being retried has been texted to,
+	// by the event or the first event of a digest, so that only the phones
+	// which failed are texted again.
+	texted map[*ServiceEntryChange]map[string]bool
+}
+
+// newSmsNotifier Creates a notifier for the sms block called name.
+func newSmsNotifier(name string, conf smsConfig) *smsNotifier {
+	return &smsNotifier{name: "sms." + name,
+		conf:     conf,
+		template: parseTemplate("sms."+name, conf.Template),
+		client:   &http.Client{Timeout: time.Duration(conf.TimeoutSeconds) * time.Second},
+		texted:   make(map[*ServiceEntryChange]map[string]bool)}
+}
+
+func (sn *smsNotifier) Name() string {
+	return sn.name
+}
+
+func (sn *smsNotifier) Allows(change *ServiceEntryChange) (bool, string) {
+	if change.Severity < minSeverity(sn.conf.MinSeverity) {
+		return false, "severity below MinSeverity"
+	}
+
+	return sn.conf.allowsChange(change)
+}
+
+// shorten Cuts text to a single SMS.
+func shorten(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	runes := []rune(text)
+	if len(runes) <= SMS_MAX_LENGTH {
+		return text
+	}
+
+	return string(runes[:SMS_MAX_LENGTH-3]) + "..."
+}
+
+// message Returns the text sent for a change.
+func (sn *smsNotifier) message(change *ServiceEntryChange) string {
+	text := fmt.Sprintf("%s %s %q %s %s",
+		strings.ToUpper(change.Severity.String()),
+		change.ChangeType.String(),
+		change.Entry.Instance,
+		change.Entry.Service,
+		strings.TrimSuffix(change.Entry.HostName, "."))
+	if ago := lastSeenAgo(change); ago != "" {
+		text += ", last seen " + ago + " ago"
+	}
+
+	if change.Site != "" {
+		text = change.Site + ": " + text
+	}
+
+	if change.Shadow {
+		text = "[SHADOW] " + text
+	}
+
+	return shorten(applyTemplate(sn.template, change, text))
+}
+
+// digestMessage Returns the text sent for a digest, the changes are listed
+// for as long as they fit.
+func (sn *smsNotifier) digestMessage(changes []ServiceEntryChange) string {
+	parts := make([]string, 0, len(changes))
+	for i := range changes {
+		parts = append(parts, fmt.Sprintf("%s %q",
+			changes[i].ChangeType.String(),
+			changes[i].Entry.Instance))
+	}
+
+	return shorten(fmt.Sprintf("%d changes: %s", len(changes), strings.Join(parts, ", ")))
+}
+
+// render Returns the messages as they would be sent.
+func (sn *smsNotifier) render(text string) string {
+	return "SMS via " + sn.conf.Provider + " from " + sn.conf.From + " to " +
+		strings.Join(sn.conf.To, ", ") + "\n\n" + text
+}
+
+// send Texts every phone which event hasn't been texted to yet.  An error
+// is returned if any message failed, the retry then texts only the phones
+// which failed.
+func (sn *smsNotifier) send(event *ServiceEntryChange, text string) error {
+	sn.mutex.Lock()
+	texted := sn.texted[event]
+	sn.mutex.Unlock()
+	if texted == nil {
+		texted = make(map[string]bool)
+	}
+
+	var err error
+	if sn.conf.Provider == SMS_PROVIDER_SMPP {
+		err = sn.smpp(func(session *smppSession) error {
+			return sn.textEach(texted, func(to string) error {
+				return session.submit(sn.conf.From, to, text)
+			})
+		})
+	} else {
+		err = sn.textEach(texted, func(to string) error {
+			return sn.twilio(to, text)
+		})
+	}
+
+	sn.mutex.Lock()
+	defer sn.mutex.Unlock()
+	if err == nil || event == nil {
+		delete(sn.texted, event)
+		return err
+	}
+
+	if len(sn.texted) >= SMS_PENDING_MAX {
+		sn.texted = make(map[*ServiceEntryChange]map[string]bool)
+	}
+	sn.texted[event] = texted
+
+	return err
+}
+
+// textEach Texts every phone which isn't in texted, adding those which
+// succeed.  A phone which fails doesn't stop the others being texted.
+func (sn *smsNotifier) textEach(texted map[string]bool, submit func(to string) error) error {
+	var errs []error
+	for _, to := range sn.conf.To {
+		if texted[to] {
+			continue
+		}
+
+		if err := submit(to); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", to, err.Error()))
+			continue
+		}
+		texted[to] = true
+	}
+
+	return errors.Join(errs...)
+}
+
+// twilio Sends a message through Twilio's Messages API.
+func (sn *smsNotifier) twilio(to string, text string) error {
+	form := url.Values{"From": {sn.conf.From}, "To": {to}, "Body": {text}}
+	req, err := http.NewRequest(http.MethodPost,
+		sn.twilioURL()+"/Messages.json",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(sn.conf.AccountSID, sn.conf.AuthToken)
+	resp, err := sn.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("twilio request failed: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// twilioURL Returns the URL of the Twilio account.
+func (sn *smsNotifier) twilioURL() string {
+	return strings.TrimSuffix(sn.conf.URL, "/") + "/2010-04-01/Accounts/" +
+		url.PathEscape(sn.conf.AccountSID)
+}
+
+// smpp Binds to the SMSC as a transmitter, runs send and unbinds.
+func (sn *smsNotifier) smpp(send func(session *smppSession) error) error {
+	session, err := smppBind(sn.conf.Server,
+		sn.conf.SystemID,
+		sn.conf.Password,
+		sn.conf.SystemType,
+		time.Duration(sn.conf.TimeoutSeconds)*time.Second)
+	if err != nil {
+		return err
+	}
+	defer session.close()
+
+	return send(session)
+}
+
+func (sn *smsNotifier) Render(change *ServiceEntryChange) (string, error) {
+	return sn.render(sn.message(change)), nil
+}
+
+// Notify Texts a change.
+func (sn *smsNotifier) Notify(change *ServiceEntryChange) error {
+	return sn.send(change, sn.message(change))
+}
+
+func (sn *smsNotifier) RenderDigest(changes []ServiceEntryChange) (string, error) {
+	return sn.render(sn.digestMessage(changes)), nil
+}
+
+// NotifyDigest Texts the changes held back during quiet hours as a single
+// message.
+func (sn *smsNotifier) NotifyDigest(changes []ServiceEntryChange) error {
+	var event *ServiceEntryChange
+	if len(changes) != 0 {
+		event = &changes[0]
+	}
+
+	return sn.send(event, sn.digestMessage(changes))
+}
+
+// Check Fetches the Twilio account, or binds to the SMSC, without sending
+// anything.
+func (sn *smsNotifier) Check() error {
+	if sn.conf.Provider == SMS_PROVIDER_SMPP {
+		return sn.smpp(func(*smppSession) error { return nil })
+	}
+
+	req, err := http.NewRequest(http.MethodGet, sn.twilioURL()+".json", nil)
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth(sn.conf.AccountSID, sn.conf.AuthToken)
+	resp, err := sn.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("twilio account request failed: %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Seconds an idle SMTP connection is kept open for the next email by
+// default.
+const DEFAULT_SMTP_IDLE_SECONDS uint = 30
+
+var smtpConnectionsMetric = metrics.newCounter("zcnotify_smtp_connections_total",
+	"SMTP connections opened, by backend.")
+
+// smtpSession Sends the emails of a block over a single SMTP connection,
+// which is kept open while they keep coming so that a burst of events
+// doesn't open a connection each, and closed once it has been idle for a
+// while.  A connection the server has dropped is replaced.
+type smtpSession struct {
+	backend  string
+	server   string
+	ssl      bool
+	from     string
+	password string
+	idle     time.Duration
+	mutex    sync.Mutex
+	client   *smtp.Client
+	timer    *time.Timer
+}
+
+// newSmtpSession Creates the session of the email block called backend, it
+// connects when the first email is sent.
+func newSmtpSession(backend string, conf emailConfig) *smtpSession {
+	return &smtpSession{backend: backend,
+		server:   conf.Server,
+		ssl:      conf.Ssl,
+		from:     conf.From,
+		password: conf.Password,
+		idle:     time.Duration(conf.SmtpIdleSeconds) * time.Second}
+}
+
+// connect Opens a connection to the server, upgrading it to TLS and
+// authenticating if the server supports it, the mutex is held.
+func (ss *smtpSession) connect() error {
+	host := strings.Split(ss.server, ":")[0]
+	client, err := smtp.Dial(serverAddress(ss.server, ss.ssl))
+	if err != nil {
+		return err
+	}
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			client.Close()
+			return err
+		}
+	}
+
+	if ss.password != "" {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			client.Close()
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+
+		if err := client.Auth(smtp.PlainAuth("", ss.from, ss.password, host)); err != nil {
+			client.Close()
+			return err
+		}
+	}
+
+	smtpConnectionsMetric.With("backend", ss.backend).Inc()
+	slog.Debug("connected to SMTP server", "backend", ss.backend, "server", ss.server)
+	ss.client = client
+	return nil
+}
+
+// transaction Sends a single email over the open connection.
+func (ss *smtpSession) transaction(to string, msg []byte) error {
+	if err := ss.client.Mail(ss.from); err != nil {
+		return err
+	}
+
+	if err := ss.client.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := ss.client.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+// send Sends an email to to, over the open connection if there is one.  If
+// that fails the email is sent again over a new connection, as the server
+// may have closed it.
+func (ss *smtpSession) send(to string, msg []byte) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	if ss.timer != nil {
+		ss.timer.Stop()
+	}
+
+	if ss.client != nil {
+		err := ss.client.Reset()
+		if err == nil {
+			err = ss.transaction(to, msg)
+		}
+		if err == nil {
+			ss.timer = time.AfterFunc(ss.idle, ss.close)
+			return nil
+		}
+
+		slog.Debug("reconnecting to SMTP server",
+			"backend", ss.backend,
+			"err", err)
+		ss.client.Close()
+		ss.client = nil
+	}
+
+	if err := ss.connect(); err != nil {
+		return err
+	}
+
+	if err := ss.transaction(to, msg); err != nil {
+		ss.client.Close()
+		ss.client = nil
+		return err
+	}
+
+	ss.timer = time.AfterFunc(ss.idle, ss.close)
+	return nil
+}
+
+// close Says goodbye to the server, if connected.
+func (ss *smtpSession) close() {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	if ss.timer != nil {
+		ss.timer.Stop()
+	}
+
+	if ss.client != nil {
+		if err := ss.client.Quit(); err != nil {
+			ss.client.Close()
+		}
+		ss.client = nil
+	}
+}
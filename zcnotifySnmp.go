@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+const (
+	DEFAULT_SNMP_PORT      uint16 = 162
+	DEFAULT_SNMP_COMMUNITY string = "public"
+	DEFAULT_SNMP_TIMEOUT   uint   = 5
+	// Root of the objects in ZCNOTIFY-MIB.txt, which lives under
+	// NET-SNMP-MIB's netSnmpPlaypen as zcnotify has no enterprise number.
+	DEFAULT_SNMP_ENTERPRISE_OID string = "1.3.6.1.4.1.8072.9999.9999.1"
+	// Engine ID of the traps sent with SNMPv3: the net-snmp enterprise
+	// number followed by the text "zcnotify", as described in RFC 3411.
+	DEFAULT_SNMP_ENGINE_ID string = "80001f88047a636e6f74696679"
+
+	SNMP_SYS_UPTIME_OID string = "1.3.6.1.2.1.1.3.0"
+	SNMP_TRAP_OID       string = "1.3.6.1.6.3.1.1.4.1.0"
+)
+
+// snmpStarted is when zcnotify started, traps carry the time since as
+// sysUpTime.
+var snmpStarted = time.Now()
+
+// snmpTrapConfig describes a single [snmptrap.<name>] block.
+type snmpTrapConfig struct {
+	serviceFilter
+	scheduleConfig
+	// Trap receiver, "host" or "host:port".
+	Target string
+	// "2c" or "3".
+	Version   string
+	Community string
+	// SNMPv3 user and security settings.
+	User             string
+	AuthProtocol     string
+	AuthPassword     string
+	AuthPasswordFile string
+	PrivProtocol     string
+	PrivPassword     string
+	PrivPasswordFile string
+	// Hex engine ID used for SNMPv3 traps.
+	EngineID string
+	// Root OID of the zcnotify MIB objects.
+	EnterpriseOID  string
+	TimeoutSeconds uint
+}
+
+var snmpAuthProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+	"":       gosnmp.NoAuth,
+	"md5":    gosnmp.MD5,
+	"sha":    gosnmp.SHA,
+	"sha224": gosnmp.SHA224,
+	"sha256": gosnmp.SHA256,
+	"sha384": gosnmp.SHA384,
+	"sha512": gosnmp.SHA512,
+}
+
+var snmpPrivProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+	"":        gosnmp.NoPriv,
+	"des":     gosnmp.DES,
+	"aes":     gosnmp.AES,
+	"aes192":  gosnmp.AES192,
+	"aes256":  gosnmp.AES256,
+	"aes192c": gosnmp.AES192C,
+	"aes256c": gosnmp.AES256C,
+}
+
+// validSnmpTrapConfig Checks every [snmptrap.<name>] block and fills in the
+// defaults.
+func validSnmpTrapConfig(snmpConfs map[string]snmpTrapConfig) error {
+	if len(snmpConfs) == 0 {
+		return errors.New("no [snmptrap.<name>] blocks")
+	}
+
+	for name, snmpConf := range snmpConfs {
+		prefix := fmt.Sprintf("snmptrap config: %q", name)
+		if snmpConf.Target == "" {
+			return fmt.Errorf("%s missing Target", prefix)
+		}
+
+		if _, _, err := snmpTarget(snmpConf.Target); err != nil {
+			return fmt.Errorf("%s %s", prefix, err.Error())
+		}
+
+		switch snmpConf.Version {
+		case "", "2c":
+			snmpConf.Version = "2c"
+			if snmpConf.Community == "" {
+				snmpConf.Community = DEFAULT_SNMP_COMMUNITY
+			}
+			break
+		case "3":
+			if snmpConf.User == "" {
+				return fmt.Errorf("%s SNMPv3 requires a User", prefix)
+			}
+
+			auth, ok := snmpAuthProtocols[strings.ToLower(snmpConf.AuthProtocol)]
+			if !ok {
+				return fmt.Errorf("%s unknown AuthProtocol %q", prefix, snmpConf.AuthProtocol)
+			}
+
+			priv, ok := snmpPrivProtocols[strings.ToLower(snmpConf.PrivProtocol)]
+			if !ok {
+				return fmt.Errorf("%s unknown PrivProtocol %q", prefix, snmpConf.PrivProtocol)
+			}
+
+			if priv != gosnmp.NoPriv && auth == gosnmp.NoAuth {
+				return fmt.Errorf("%s PrivProtocol requires an AuthProtocol", prefix)
+			}
+
+			if snmpConf.EngineID == "" {
+				snmpConf.EngineID = DEFAULT_SNMP_ENGINE_ID
+			} else if _, err := hex.DecodeString(snmpConf.EngineID); err != nil {
+				return fmt.Errorf("%s EngineID must be hex", prefix)
+			}
+			break
+		default:
+			return fmt.Errorf("%s unsupported Version %q, expected \"2c\" or \"3\"",
+				prefix, snmpConf.Version)
+		}
+
+		if snmpConf.EnterpriseOID == "" {
+			snmpConf.EnterpriseOID = DEFAULT_SNMP_ENTERPRISE_OID
+		}
+		snmpConf.EnterpriseOID = strings.Trim(snmpConf.EnterpriseOID, ".")
+		for _, arc := range strings.Split(snmpConf.EnterpriseOID, ".") {
+			if _, err := strconv.ParseUint(arc, 10, 32); err != nil {
+				return fmt.Errorf("%s invalid EnterpriseOID %q", prefix, snmpConf.EnterpriseOID)
+			}
+		}
+
+		if snmpConf.TimeoutSeconds == 0 {
+			snmpConf.TimeoutSeconds = DEFAULT_SNMP_TIMEOUT
+		}
+
+		snmpConfs[name] = snmpConf
+	}
+
+	return nil
+}
+
+// snmpTarget Splits a Target into host and port, the port defaults to 162.
+func snmpTarget(target string) (string, uint16, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return target, DEFAULT_SNMP_PORT, nil
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid Target port %q", port)
+	}
+
+	return host, uint16(p), nil
+}
+
+// snmpTrapNotifier Sends a trap for every event to the receiver of a single
+// [snmptrap.<name>] block.
+type snmpTrapNotifier struct {
+	name string
+	conf snmpTrapConfig
+}
+
+// newSnmpTrapNotifier Creates a notifier for the snmptrap block called name.
+func newSnmpTrapNotifier(name string, conf snmpTrapConfig) *snmpTrapNotifier {
+	return &snmpTrapNotifier{name: "snmptrap." + name, conf: conf}
+}
+
+func (sn *snmpTrapNotifier) Name() string {
+	return sn.name
+}
+
+func (sn *snmpTrapNotifier) Allows(change *ServiceEntryChange) (bool, string) {
+	return sn.conf.allowsChange(change)
+}
+
+// client Returns an SNMP session for the block's receiver.
+func (sn *snmpTrapNotifier) client() *gosnmp.GoSNMP {
+	host, port, _ := snmpTarget(sn.conf.Target)
+	client := &gosnmp.GoSNMP{Target: host,
+		Port:      port,
+		Transport: "udp",
+		Community: sn.conf.Community,
+		Version:   gosnmp.Version2c,
+		Timeout:   time.Duration(sn.conf.TimeoutSeconds) * time.Second,
+		MaxOids:   gosnmp.MaxOids}
+
+	if sn.conf.Version == "3" {
+		auth := snmpAuthProtocols[strings.ToLower(sn.conf.AuthProtocol)]
+		priv := snmpPrivProtocols[strings.ToLower(sn.conf.PrivProtocol)]
+		engineID, _ := hex.DecodeString(sn.conf.EngineID)
+
+		client.Version = gosnmp.Version3
+		client.SecurityModel = gosnmp.UserSecurityModel
+		client.MsgFlags = gosnmp.NoAuthNoPriv
+		if priv != gosnmp.NoPriv {
+			client.MsgFlags = gosnmp.AuthPriv
+		} else if auth != gosnmp.NoAuth {
+			client.MsgFlags = gosnmp.AuthNoPriv
+		}
+		client.SecurityParameters = &gosnmp.UsmSecurityParameters{
+			UserName:                 sn.conf.User,
+			AuthenticationProtocol:   auth,
+			AuthenticationPassphrase: sn.conf.AuthPassword,
+			PrivacyProtocol:          priv,
+			PrivacyPassphrase:        sn.conf.PrivPassword,
+			AuthoritativeEngineID:    string(engineID)}
+	}
+
+	return client
+}
+
+// snmpNotification Returns the number of the ZCNOTIFY-MIB notification for a
+// change type, zcnotify's own events follow those of services.
+func snmpNotification(changeType ServiceChangeType) int {
+	return int(changeType) + 1
+}
+
+// variables Returns the variable bindings of the trap for a change, as
+// defined by ZCNOTIFY-MIB.  zcnError is only sent with zcnotify's own
+// events.
+func (sn *snmpTrapNotifier) variables(change *ServiceEntryChange) []gosnmp.SnmpPDU {
+	object := func(n int, value string) gosnmp.SnmpPDU {
+		return gosnmp.SnmpPDU{Name: fmt.Sprintf("%s.1.%d", sn.conf.EnterpriseOID, n),
+			Type:  gosnmp.OctetString,
+			Value: value}
+	}
+
+	var addresses []string
+	for _, ip := range entryIPs(&change.Entry) {
+		addresses = append(addresses, ip.String())
+	}
+
+	previous := ""
+	if change.Previous != nil {
+		previous = change.Previous.Instance
+	}
+
+	variables := []gosnmp.SnmpPDU{
+		{Name: SNMP_SYS_UPTIME_OID,
+			Type:  gosnmp.TimeTicks,
+			Value: uint32(time.Since(snmpStarted) / (10 * time.Millisecond))},
+		{Name: SNMP_TRAP_OID,
+			Type: gosnmp.ObjectIdentifier,
+			Value: fmt.Sprintf("%s.0.%d", sn.conf.EnterpriseOID,
+				snmpNotification(change.ChangeType))},
+		object(1, change.ID),
+		object(2, change.ChangeType.String()),
+		object(3, change.Entry.Instance),
+		object(4, change.Entry.Service),
+		object(5, strings.TrimSuffix(change.Entry.Domain, ".")),
+		object(6, strings.TrimSuffix(change.Entry.HostName, ".")),
+		object(7, strings.Join(addresses, ",")),
+		{Name: fmt.Sprintf("%s.1.8", sn.conf.EnterpriseOID),
+			Type:  gosnmp.Integer,
+			Value: change.Entry.Port},
+		object(9, change.Severity.String()),
+		object(10, previous)}
+	if change.ChangeType.ops() {
+		variables = append(variables, object(11, change.Error))
+	}
+
+	return variables
+}
+
+// Render Returns the variable bindings of the trap for a change.
+func (sn *snmpTrapNotifier) Render(change *ServiceEntryChange) (string, error) {
+	var rendered strings.Builder
+	fmt.Fprintf(&rendered, "SNMPv%s trap to %s\n", sn.conf.Version, sn.conf.Target)
+	for _, pdu := range sn.variables(change) {
+		fmt.Fprintf(&rendered, "%s = %v\n", pdu.Name, pdu.Value)
+	}
+
+	return rendered.String(), nil
+}
+
+// send Sends a trap for every change.
+func (sn *snmpTrapNotifier) send(changes []ServiceEntryChange) error {
+	client := sn.client()
+	if err := client.Connect(); err != nil {
+		return err
+	}
+	defer client.Conn.Close()
+
+	for i := range changes {
+		trap := gosnmp.SnmpTrap{Variables: sn.variables(&changes[i])}
+		if _, err := client.SendTrap(trap); err != nil {
+			return fmt.Errorf("trap to %s failed: %s", sn.conf.Target, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Notify Sends the trap for a change.  Traps aren't acknowledged, so only
+// failures to send are reported.
+func (sn *snmpTrapNotifier) Notify(change *ServiceEntryChange) error {
+	return sn.send([]ServiceEntryChange{*change})
+}
+
+func (sn *snmpTrapNotifier) RenderDigest(changes []ServiceEntryChange) (string, error) {
+	var rendered strings.Builder
+	for i := range changes {
+		trap, _ := sn.Render(&changes[i])
+		rendered.WriteString(trap + "\n")
+	}
+
+	return rendered.String(), nil
+}
+
+// NotifyDigest Sends the traps for every change held back during quiet
+// hours, SNMP has no way to group them.
+func (sn *snmpTrapNotifier) NotifyDigest(changes []ServiceEntryChange) error {
+	return sn.send(changes)
+}
+
+// Check Resolves the receiver's address, traps aren't acknowledged so
+// whether anything is listening can't be checked.
+func (sn *snmpTrapNotifier) Check() error {
+	host, port, _ := snmpTarget(sn.conf.Target)
+	_, err := net.ResolveUDPAddr("udp",
+		net.JoinHostPort(host, strconv.Itoa(int(port))))
+	return err
+}
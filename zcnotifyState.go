@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	// Version of the state file layout written by this build, bump it
+	// whenever stateFile changes and add the step from the previous version
+	// to stateMigrations.  Version 2 added the presence history.
+	STATE_SCHEMA_VERSION int = 2
+	stateFileMode            = 0600
+
+	STATE_NEWER_REFUSE   string = "refuse"
+	STATE_NEWER_READONLY string = "readonly"
+
+	// Changes are saved together, at most this often, rather than the
+	// state file being rewritten for each one.
+	STATE_SAVE_INTERVAL = 5 * time.Second
+)
+
+// stateConfig controls where the known services are persisted between
+// runs, and what to do with a state file written by a newer zcnotify.
+type stateConfig struct {
+	File          string
+	OnNewerSchema string
+	// Days of presence history kept for availability reports.
+	PresenceDays uint
+	// Most services whose presence history is kept, those gone longest are
+	// forgotten first, 0 for no limit.
+	PresenceMaxServices uint
+}
+
+// stateFile is the on-disk layout of the state store.
+type stateFile struct {
+	SchemaVersion int                `json:"schemaVersion"`
+	WrittenBy     string             `json:"writtenBy"`
+	SavedAt       time.Time          `json:"savedAt"`
+	Services      []serviceEntryJSON `json:"services"`
+	Presence      []servicePresence  `json:"presence,omitempty"`
+}
+
+// stateMigrations Upgrade a state file from the schema version they're
+// indexed by to the next one.
+var stateMigrations = map[int]func(state *stateFile){
+	// The presence history starts with the upgrade.
+	1: func(state *stateFile) {
+		state.Presence = nil
+	},
+}
+
+// upgradeState Migrates a state file written by an older zcnotify to this
+// version's schema.
+func upgradeState(state *stateFile) error {
+	for state.SchemaVersion < STATE_SCHEMA_VERSION {
+		migration, ok := stateMigrations[state.SchemaVersion]
+		if !ok {
+			return fmt.Errorf("no migration from state schema version %d",
+				state.SchemaVersion)
+		}
+
+		migration(state)
+		state.SchemaVersion++
+	}
+
+	return nil
+}
+
+// stateStore Persists the services known to the registry so that a restart
+// doesn't report every service as newly added.  A read-only store loads
+// state but never writes it.
+type stateStore struct {
+	mutex    sync.Mutex
+	path     string
+	readOnly bool
+	// changed is signalled by saveLater, stopping asks run to save any
+	// changes left and stop, closing the channel it carries once it has.
+	changed  chan struct{}
+	stopping chan chan bool
+}
+
+// readStateFile Reads and decodes the state file, nil is returned if it
+// doesn't exist.
+func readStateFile(path string) (*stateFile, []byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	var state stateFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, nil, fmt.Errorf("state file %q is corrupt: %s",
+			path, err.Error())
+	}
+
+	return &state, data, nil
+}
+
+// openStateStore Loads the state file and returns the services and presence
+// history it holds.  If the file was written by a newer zcnotify it is only used if
+// OnNewerSchema is "readonly" (in which case it is never written) or if
+// migrate is set, which rewrites it in this version's schema after keeping a
+// backup.  A file written by an older zcnotify is upgraded, keeping a backup
+// for going back to it.
+func openStateStore(conf stateConfig, migrate bool) (*stateStore,
+	[]zeroconf.ServiceEntry,
+	[]servicePresence,
+	error) {
+	ss := &stateStore{path: conf.File,
+		changed:  make(chan struct{}, 1),
+		stopping: make(chan chan bool)}
+	if conf.File == "" {
+		return ss, nil, nil, nil
+	}
+
+	state, data, err := readStateFile(conf.File)
+	if err != nil {
+		return nil, nil, nil, err
+	} else if state == nil {
+		return ss, nil, nil, nil
+	}
+
+	if state.SchemaVersion > STATE_SCHEMA_VERSION {
+		switch {
+		case migrate:
+			backup := conf.File + ".bak"
+			if err := os.WriteFile(backup, data, stateFileMode); err != nil {
+				return nil, nil, nil, err
+			}
+			slog.Warn("migrating state file to an older schema, data unknown to this version is dropped",
+				"file", conf.File,
+				"backup", backup,
+				"from", state.SchemaVersion,
+				"to", STATE_SCHEMA_VERSION)
+		case strings.ToLower(conf.OnNewerSchema) == STATE_NEWER_READONLY:
+			slog.Warn("state file was written by a newer zcnotify, it will not be updated",
+				"file", conf.File,
+				"schemaVersion", state.SchemaVersion,
+				"writtenBy", state.WrittenBy)
+			ss.readOnly = true
+		default:
+			return nil, nil, nil, fmt.Errorf("state file %q has schema version %d (written by zcnotify %s) but this is zcnotify %s which understands version %d; "+
+				"upgrade zcnotify, set [state] OnNewerSchema = \"readonly\" or run with -migrate to rewrite it",
+				conf.File,
+				state.SchemaVersion,
+				state.WrittenBy,
+				version,
+				STATE_SCHEMA_VERSION)
+		}
+	}
+
+	if state.SchemaVersion < STATE_SCHEMA_VERSION {
+		from := state.SchemaVersion
+		if err := upgradeState(state); err != nil {
+			return nil, nil, nil, fmt.Errorf("state file %q: %s", conf.File, err.Error())
+		}
+
+		backup := conf.File + ".bak"
+		if err := os.WriteFile(backup, data, stateFileMode); err != nil {
+			return nil, nil, nil, err
+		}
+		slog.Info("upgraded state file from an older schema",
+			"file", conf.File,
+			"backup", backup,
+			"from", from,
+			"to", STATE_SCHEMA_VERSION)
+		migrate = true
+	}
+
+	entries := make([]zeroconf.ServiceEntry, 0, len(state.Services))
+	for i := range state.Services {
+		entries = append(entries, state.Services[i].serviceEntry())
+	}
+
+	slog.Info("loaded state", "file", conf.File, "services", len(entries))
+	if migrate && !ss.readOnly {
+		if err := ss.save(entries, state.Presence); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return ss, entries, state.Presence, nil
+}
+
+// save Atomically replaces the state file with the given services and
+// presence history.
+func (ss *stateStore) save(entries []zeroconf.ServiceEntry,
+	presence []servicePresence) error {
+	if ss == nil || ss.path == "" || ss.readOnly {
+		return nil
+	}
+
+	state := stateFile{SchemaVersion: STATE_SCHEMA_VERSION,
+		WrittenBy: version,
+		SavedAt:   time.Now().UTC(),
+		Services:  make([]serviceEntryJSON, 0, len(entries)),
+		Presence:  presence}
+	for i := range entries {
+		state.Services = append(state.Services, newServiceEntryJSON(&entries[i]))
+	}
+
+	data, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	tmp := ss.path + ".tmp"
+	if err := os.WriteFile(tmp, data, stateFileMode); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, ss.path)
+}
+
+// saveLater Has run save the state once the changes which follow have been
+// made, without waiting for it.
+func (ss *stateStore) saveLater() {
+	if ss == nil || ss.path == "" || ss.readOnly {
+		return
+	}
+
+	select {
+	case ss.changed <- struct{}{}:
+		break
+	default:
+		// A save is already pending.
+		break
+	}
+}
+
+// run Saves the state taken by snapshot after saveLater is called, at most
+// every STATE_SAVE_INTERVAL, until stop is called.
+func (ss *stateStore) run(snapshot func() ([]zeroconf.ServiceEntry, []servicePresence)) {
+	save := func() {
+		entries, presence := snapshot()
+		if err := ss.save(entries, presence); err != nil {
+			slog.Error("failed to save state", "err", err)
+		}
+	}
+
+	for {
+		select {
+		case <-ss.changed:
+			break
+		case done := <-ss.stopping:
+			select {
+			case <-ss.changed:
+				save()
+				break
+			default:
+				break
+			}
+			close(done)
+			return
+		}
+
+		select {
+		case <-time.After(STATE_SAVE_INTERVAL):
+			save()
+			break
+		case done := <-ss.stopping:
+			save()
+			close(done)
+			return
+		}
+	}
+}
+
+// stop Saves the changes not yet saved and stops run.
+func (ss *stateStore) stop() {
+	done := make(chan bool)
+	ss.stopping <- done
+	<-done
+}
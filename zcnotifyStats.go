@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the pipeline's counters are sampled for its throughput...
+	STATS_SAMPLE_INTERVAL time.Duration = 10 * time.Second
+	// ...which is averaged over this many samples, a minute.
+	STATS_SAMPLES int = 6
+)
+
+var pipelineEventsMetric = metrics.newCounter("zcnotify_pipeline_events_total",
+	"Changes processed by the pipeline.")
+
+// pipelineSample is a reading of the pipeline's counters.
+type pipelineSample struct {
+	at            time.Time
+	published     int64
+	processed     int64
+	notifications int64
+}
+
+// readPipelineSample Returns the pipeline's counters as they are now.
+func readPipelineSample(now time.Time) pipelineSample {
+	return pipelineSample{at: now,
+		published:     busPublishedMetric.total(""),
+		processed:     pipelineEventsMetric.total(""),
+		notifications: notificationsMetric.total(`result="sent"`)}
+}
+
+// memoryStats is the Go runtime's memory use.
+type memoryStats struct {
+	HeapAllocBytes  uint64  `json:"heapAllocBytes"`
+	HeapInuseBytes  uint64  `json:"heapInuseBytes"`
+	HeapObjects     uint64  `json:"heapObjects"`
+	StackInuseBytes uint64  `json:"stackInuseBytes"`
+	SysBytes        uint64  `json:"sysBytes"`
+	TotalAllocBytes uint64  `json:"totalAllocBytes"`
+	NumGC           uint32  `json:"numGC"`
+	GCPauseTotalMs  float64 `json:"gcPauseTotalMs"`
+	GCCPUFraction   float64 `json:"gcCpuFraction"`
+}
+
+// pipelineStats is the throughput of the event pipeline, totals since start
+// up and rates per second over the last minute.
+type pipelineStats struct {
+	Published          int64   `json:"published"`
+	Processed          int64   `json:"processed"`
+	NotificationsSent  int64   `json:"notificationsSent"`
+	BusLength          int64   `json:"busLength"`
+	PublishedPerSecond float64 `json:"publishedPerSecond"`
+	ProcessedPerSecond float64 `json:"processedPerSecond"`
+	SentPerSecond      float64 `json:"notificationsSentPerSecond"`
+	RateWindowSeconds  float64 `json:"rateWindowSeconds"`
+}
+
+// runtimeStats is the body of /debug/stats.
+type runtimeStats struct {
+	Time          time.Time     `json:"time"`
+	UptimeSeconds int64         `json:"uptimeSeconds"`
+	GoVersion     string        `json:"goVersion"`
+	GOOS          string        `json:"goos"`
+	GOARCH        string        `json:"goarch"`
+	NumCPU        int           `json:"numCpu"`
+	GOMAXPROCS    int           `json:"gomaxprocs"`
+	Goroutines    int           `json:"goroutines"`
+	Memory        memoryStats   `json:"memory"`
+	Pipeline      pipelineStats `json:"pipeline"`
+}
+
+// statsSampler Samples the pipeline's counters so that its throughput can
+// be reported as a rate.
+type statsSampler struct {
+	mutex   sync.Mutex
+	started time.Time
+	samples []pipelineSample
+}
+
+func newStatsSampler() *statsSampler {
+	now := time.Now().UTC()
+	return &statsSampler{started: now,
+		samples: []pipelineSample{readPipelineSample(now)}}
+}
+
+// run Samples the counters every STATS_SAMPLE_INTERVAL until the process
+// exits.
+func (ss *statsSampler) run() {
+	ticker := time.NewTicker(STATS_SAMPLE_INTERVAL)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		sample := readPipelineSample(now.UTC())
+		ss.mutex.Lock()
+		ss.samples = append(ss.samples, sample)
+		if len(ss.samples) > STATS_SAMPLES+1 {
+			ss.samples = ss.samples[len(ss.samples)-STATS_SAMPLES-1:]
+		}
+		ss.mutex.Unlock()
+	}
+}
+
+// stats Returns the runtime's and the pipeline's statistics as they are now.
+func (ss *statsSampler) stats() runtimeStats {
+	now := time.Now().UTC()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	current := readPipelineSample(now)
+
+	ss.mutex.Lock()
+	oldest := ss.samples[0]
+	ss.mutex.Unlock()
+
+	stats := runtimeStats{Time: now,
+		UptimeSeconds: int64(now.Sub(ss.started).Seconds()),
+		GoVersion:     runtime.Version(),
+		GOOS:          runtime.GOOS,
+		GOARCH:        runtime.GOARCH,
+		NumCPU:        runtime.NumCPU(),
+		GOMAXPROCS:    runtime.GOMAXPROCS(0),
+		Goroutines:    runtime.NumGoroutine(),
+		Memory: memoryStats{HeapAllocBytes: mem.HeapAlloc,
+			HeapInuseBytes:  mem.HeapInuse,
+			HeapObjects:     mem.HeapObjects,
+			StackInuseBytes: mem.StackInuse,
+			SysBytes:        mem.Sys,
+			TotalAllocBytes: mem.TotalAlloc,
+			NumGC:           mem.NumGC,
+			GCPauseTotalMs:  float64(mem.PauseTotalNs) / float64(time.Millisecond),
+			GCCPUFraction:   mem.GCCPUFraction},
+		Pipeline: pipelineStats{Published: current.published,
+			Processed:         current.processed,
+			NotificationsSent: current.notifications,
+			BusLength:         busLengthMetric.total("")}}
+
+	if window := now.Sub(oldest.at).Seconds(); window > 0 {
+		stats.Pipeline.RateWindowSeconds = window
+		stats.Pipeline.PublishedPerSecond = float64(current.published-oldest.published) / window
+		stats.Pipeline.ProcessedPerSecond = float64(current.processed-oldest.processed) / window
+		stats.Pipeline.SentPerSecond = float64(current.notifications-oldest.notifications) / window
+	}
+
+	return stats
+}
+
+// stats Serves the runtime and pipeline statistics.
+func (as *apiServer) stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, as.sampler.stats())
+}
+
+// handleDiagnostics Adds the pprof handlers and /debug/stats to mux, all
+// for admins only.
+func (as *apiServer) handleDiagnostics(mux *http.ServeMux) {
+	mux.HandleFunc("GET /debug/stats", as.server.admin(as.stats))
+	mux.HandleFunc("GET /debug/pprof/", as.server.admin(pprof.Index))
+	mux.HandleFunc("GET /debug/pprof/cmdline", as.server.admin(pprof.Cmdline))
+	mux.HandleFunc("GET /debug/pprof/profile", as.server.admin(pprof.Profile))
+	mux.HandleFunc("GET /debug/pprof/symbol", as.server.admin(pprof.Symbol))
+	mux.HandleFunc("POST /debug/pprof/symbol", as.server.admin(pprof.Symbol))
+	mux.HandleFunc("GET /debug/pprof/trace", as.server.admin(pprof.Trace))
+}
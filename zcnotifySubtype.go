@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// browseSubtype Browses the service type of a subtype with resolver, and
+// sends on the instances which answer a query for the subtype by the time
+// ctx is done, as entries of the subtype.  The resolvers can't browse
+// subtypes themselves, so the subtype is asked for separately.
+func browseSubtype(ctx context.Context,
+	resolver mdnsResolver,
+	service string,
+	domain string,
+	ipver zeroconf.IPType,
+	intfs []net.Interface,
+	entries chan<- *zeroconf.ServiceEntry) error {
+	subtype, serviceType := splitSubtype(service)
+	found := make(chan *zeroconf.ServiceEntry)
+	if err := resolver.Browse(ctx, serviceType, domain, found); err != nil {
+		close(entries)
+		return err
+	}
+
+	members := make(chan map[string]bool, 1)
+	go func() {
+		members <- subtypeMembers(ctx, subtype, serviceType, domain, ipver, intfs)
+	}()
+
+	go func() {
+		defer close(entries)
+		var all []*zeroconf.ServiceEntry
+		for entry := range found {
+			all = append(all, entry)
+		}
+
+		member := <-members
+		for _, entry := range all {
+			if !member[strings.ToLower(entry.Instance)] {
+				continue
+			}
+
+			entry.Service = service
+			entries <- entry
+		}
+	}()
+
+	return nil
+}
+
+// subtypeMembers Returns the instances, by name in lower case, which have
+// answered a query for subtype of service in domain by the time ctx is done.
+// The query is a one-shot query (RFC 6762 section 5.1) sent from a socket
+// of its own on each of intfs, which responders answer straight back to.
+func subtypeMembers(ctx context.Context,
+	subtype string,
+	service string,
+	domain string,
+	ipver zeroconf.IPType,
+	intfs []net.Interface) map[string]bool {
+	name := dns.Fqdn(subtype + "._sub." + service + "." + domain)
+	suffix := "." + dns.Fqdn(service+"."+domain)
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypePTR)
+	packet, err := msg.Pack()
+	if err != nil {
+		slog.Error("failed to pack subtype query", "subtype", name, "err", err)
+		return nil
+	}
+
+	var conns []*net.UDPConn
+	if ipver&zeroconf.IPv4 != 0 {
+		if conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero}); err != nil {
+			slog.Warn("failed to open subtype query socket", "err", err)
+		} else {
+			pc := ipv4.NewPacketConn(conn)
+			for i := range intfs {
+				if err := pc.SetMulticastInterface(&intfs[i]); err == nil {
+					_, err = pc.WriteTo(packet, nil, mdnsIPv4Group)
+				}
+				if err != nil {
+					slog.Debug("failed to send subtype query",
+						"interface", intfs[i].Name,
+						"err", err)
+				}
+			}
+			conns = append(conns, conn)
+		}
+	}
+
+	if ipver&zeroconf.IPv6 != 0 {
+		if conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified}); err != nil {
+			slog.Warn("failed to open subtype query socket", "err", err)
+		} else {
+			pc := ipv6.NewPacketConn(conn)
+			for i := range intfs {
+				if err := pc.SetMulticastInterface(&intfs[i]); err == nil {
+					_, err = pc.WriteTo(packet, nil, mdnsIPv6Group)
+				}
+				if err != nil {
+					slog.Debug("failed to send subtype query",
+						"interface", intfs[i].Name,
+						"err", err)
+				}
+			}
+			conns = append(conns, conn)
+		}
+	}
+
+	var mutex sync.Mutex
+	members := make(map[string]bool)
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn *net.UDPConn) {
+			defer wg.Done()
+			buf := make([]byte, 65536)
+			for {
+				n, _, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+
+				resp := new(dns.Msg)
+				if err := resp.Unpack(buf[:n]); err != nil || resp.Id != msg.Id {
+					continue
+				}
+
+				mutex.Lock()
+				for _, rr := range append(resp.Answer, resp.Extra...) {
+					ptr, ok := rr.(*dns.PTR)
+					if !ok || ptr.Hdr.Ttl == 0 ||
+						!strings.EqualFold(ptr.Hdr.Name, name) ||
+						len(ptr.Ptr) <= len(suffix) ||
+						!strings.EqualFold(ptr.Ptr[len(ptr.Ptr)-len(suffix):], suffix) {
+						continue
+					}
+
+					members[strings.ToLower(unescapeInstance(ptr.Ptr[:len(ptr.Ptr)-len(suffix)]))] = true
+				}
+				mutex.Unlock()
+			}
+		}(conn)
+	}
+
+	<-ctx.Done()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	wg.Wait()
+
+	return members
+}
@@ -0,0 +1,55 @@
+//go:build linux
+
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+var (
+	activatedOnce      sync.Once
+	activatedListeners map[string][]net.Listener
+)
+
+// sdNotify Tells systemd about a change of state, e.g. "READY=1", when
+// running as a Type=notify service.  Outside systemd it does nothing.
+func sdNotify(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		slog.Debug("failed to notify systemd", "state", state, "err", err)
+	}
+}
+
+// sdWatchdogInterval Returns how often systemd expects to hear that zcnotify
+// is alive, 0 if WatchdogSec isn't set.
+func sdWatchdogInterval() time.Duration {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		slog.Warn("invalid systemd watchdog settings", "err", err)
+		return 0
+	}
+
+	return interval
+}
+
+// activatedListener Returns the socket passed by systemd socket activation
+// with FileDescriptorName=name, or nil if there isn't one.
+func activatedListener(name string) net.Listener {
+	activatedOnce.Do(func() {
+		var err error
+		if activatedListeners, err = activation.ListenersWithNames(); err != nil {
+			slog.Warn("failed to use systemd sockets", "err", err)
+		}
+	})
+
+	if listeners := activatedListeners[name]; len(listeners) != 0 {
+		return listeners[0]
+	}
+
+	return nil
+}
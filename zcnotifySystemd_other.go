@@ -0,0 +1,24 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// sdNotify Does nothing, there's no systemd on this platform.
+func sdNotify(state string) {
+}
+
+// sdWatchdogInterval Returns 0, there's no systemd watchdog on this
+// platform.
+func sdWatchdogInterval() time.Duration {
+	return 0
+}
+
+// activatedListener Returns nil, there's no socket activation on this
+// platform.
+func activatedListener(name string) net.Listener {
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// templateConfig is embedded in backend blocks whose message can be replaced
+// by a Go template.
+type templateConfig struct {
+	// Template replaces the backend's message, it's given a templateEvent.
+	Template string
+	// TemplateFile reads the template from a file instead.
+	TemplateFile string
+}
+
+// fieldChange is a single difference between the previous and current
+// entry of an event.
+type fieldChange struct {
+	Field    string
+	Previous string
+	Current  string
+}
+
+// templateEvent is given to message templates, it's the event along with
+// what changed and the entry's addresses as strings.
+type templateEvent struct {
+	*ServiceEntryChange
+	Diff      []fieldChange
+	Addresses []string
+}
+
+// templateFuncs are the helper functions available to message templates.
+var templateFuncs = template.FuncMap{
+	"join":     templateJoin,
+	"upper":    strings.ToUpper,
+	"lower":    strings.ToLower,
+	"trimDot":  func(s string) string { return strings.TrimSuffix(s, ".") },
+	"humanize": humanizeDuration,
+	"since":    func(t time.Time) time.Duration { return time.Since(t) },
+	"json": func(v any) (string, error) {
+		encoded, err := json.Marshal(v)
+		return string(encoded), err
+	},
+}
+
+// templateJoin Joins the elements of any slice, e.g. the entry's TXT
+// records or addresses, with sep.
+func templateJoin(sep string, list any) (string, error) {
+	value := reflect.ValueOf(list)
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return "", fmt.Errorf("join: %T isn't a list", list)
+	}
+
+	items := make([]string, 0, value.Len())
+	for i := 0; i < value.Len(); i++ {
+		items = append(items, fmt.Sprint(value.Index(i).Interface()))
+	}
+
+	return strings.Join(items, sep), nil
+}
+
+// humanizeDuration Returns a duration rounded to its two largest units,
+// e.g. "3d 4h" or "5m 10s".
+func humanizeDuration(d time.Duration) string {
+	if d < 0 {
+		d = -d
+	}
+
+	if d < time.Second {
+		return "0s"
+	}
+
+	units := []struct {
+		suffix string
+		size   time.Duration
+	}{{"d", 24 * time.Hour}, {"h", time.Hour}, {"m", time.Minute}, {"s", time.Second}}
+	var parts []string
+	for _, unit := range units {
+		if d >= unit.size {
+			parts = append(parts, fmt.Sprintf("%d%s", d/unit.size, unit.suffix))
+			d %= unit.size
+		}
+
+		if len(parts) == 2 {
+			break
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// loadTemplate Returns the template text given in config, reading it from
+// file if one is given, and checks that it parses.
+func loadTemplate(name string, text string, file string) (string, error) {
+	if file != "" {
+		if text != "" {
+			return "", fmt.Errorf("%s: only one of the template and template file may be given",
+				name)
+		}
+
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", name, err.Error())
+		}
+
+		text = string(contents)
+	}
+
+	if text != "" {
+		// Parse errors already name the template.
+		if _, err := template.New(name).Funcs(templateFuncs).Parse(text); err != nil {
+			return "", err
+		}
+	}
+
+	return text, nil
+}
+
+// setup Reads the template file, if any, into Template and checks that the
+// template parses.
+func (tc *templateConfig) setup(name string) error {
+	text, err := loadTemplate(name+" template", tc.Template, tc.TemplateFile)
+	if err != nil {
+		return err
+	}
+
+	tc.Template = text
+	tc.TemplateFile = ""
+	return nil
+}
+
+// parseTemplate Returns the parsed template, or nil if text is empty.  The
+// template has already been checked by loadTemplate.
+func parseTemplate(name string, text string) *template.Template {
+	if text == "" {
+		return nil
+	}
+
+	tmpl, _ := template.New(name).Funcs(templateFuncs).Parse(text)
+	return tmpl
+}
+
+// newTemplateEvent Returns the context given to templates for a change.
+func newTemplateEvent(change *ServiceEntryChange) templateEvent {
+	event := templateEvent{ServiceEntryChange: change}
+	for _, ip := range entryIPs(&change.Entry) {
+		event.Addresses = append(event.Addresses, ip.String())
+	}
+
+	if change.Previous != nil {
+		event.Diff = entryDiff(change.Previous, &change.Entry)
+	}
+
+	return event
+}
+
+// executeTemplate Renders a change with tmpl.
+func executeTemplate(tmpl *template.Template, change *ServiceEntryChange) (string, error) {
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, newTemplateEvent(change)); err != nil {
+		return "", fmt.Errorf("template error: %s", err.Error())
+	}
+
+	return rendered.String(), nil
+}
+
+// applyTemplate Returns message rendered with tmpl, or message itself if
+// there's no template.  If the template fails the default message is sent
+// rather than nothing.
+func applyTemplate(tmpl *template.Template,
+	change *ServiceEntryChange,
+	message string) string {
+	if tmpl == nil {
+		return message
+	}
+
+	rendered, err := executeTemplate(tmpl, change)
+	if err != nil {
+		slog.Warn("using the default message",
+			changeAttrs(change),
+			"template", tmpl.Name(),
+			"err", err)
+		return message
+	}
+
+	return rendered
+}
+
+// entryDiff Returns the fields which differ between previous and current,
+// TXT records are compared key by key.
+func entryDiff(previous *zeroconf.ServiceEntry,
+	current *zeroconf.ServiceEntry) []fieldChange {
+	var diff []fieldChange
+	add := func(field string, a string, b string) {
+		if a != b {
+			diff = append(diff, fieldChange{Field: field, Previous: a, Current: b})
+		}
+	}
+
+	joinIPs := func(entry *zeroconf.ServiceEntry, v6 bool) string {
+		ips := entry.AddrIPv4
+		if v6 {
+			ips = entry.AddrIPv6
+		}
+
+		var addresses []string
+		for _, ip := range ips {
+			addresses = append(addresses, ip.String())
+		}
+		sort.Strings(addresses)
+		return strings.Join(addresses, ", ")
+	}
+
+	add("instance", previous.Instance, current.Instance)
+	add("hostname", previous.HostName, current.HostName)
+	add("port", strconv.Itoa(previous.Port), strconv.Itoa(current.Port))
+	add("ipv4", joinIPs(previous, false), joinIPs(current, false))
+	add("ipv6", joinIPs(previous, true), joinIPs(current, true))
+
+	txt := func(entry *zeroconf.ServiceEntry) map[string]string {
+		records := make(map[string]string)
+		for _, record := range entry.Text {
+			key, value, _ := strings.Cut(record, "=")
+			records[key] = value
+		}
+		return records
+	}
+
+	previousTXT := txt(previous)
+	currentTXT := txt(current)
+	var keys []string
+	for key := range previousTXT {
+		keys = append(keys, key)
+	}
+	for key := range currentTXT {
+		if _, ok := previousTXT[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		add("txt:"+key, previousTXT[key], currentTXT[key])
+	}
+
+	return diff
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	// How often the textfile is rewritten by default.
+	DEFAULT_TEXTFILE_SECONDS uint = 60
+	// node_exporter only reads files with the .prom extension.
+	TEXTFILE_NAME string = "zcnotify.prom"
+)
+
+// setupTextfile Checks the directory the metrics textfile is written to and
+// fills in the default interval.
+func (zcnConfig *config) setupTextfile() error {
+	if zcnConfig.Metrics.TextfileDir == "" {
+		return nil
+	}
+
+	info, err := os.Stat(zcnConfig.Metrics.TextfileDir)
+	if err != nil {
+		return fmt.Errorf("metrics: TextfileDir: %s", err.Error())
+	} else if !info.IsDir() {
+		return fmt.Errorf("metrics: TextfileDir %q isn't a directory",
+			zcnConfig.Metrics.TextfileDir)
+	}
+
+	if zcnConfig.Metrics.TextfileSeconds == 0 {
+		zcnConfig.Metrics.TextfileSeconds = DEFAULT_TEXTFILE_SECONDS
+	}
+
+	return nil
+}
+
+// writeServicePresence Writes a zcnotify_service_present sample for each of
+// the services present on the network.
+func writeServicePresence(w io.Writer, entries []zeroconf.ServiceEntry) error {
+	_, err := fmt.Fprintf(w, "# HELP zcnotify_service_present %s\n# TYPE zcnotify_service_present %s\n",
+		"Services present on the network, by instance.",
+		gaugeMetric)
+	for i := range entries {
+		if err != nil {
+			break
+		}
+
+		_, err = fmt.Fprintf(w, "zcnotify_service_present{instance=%q,service=%q,domain=%q} 1\n",
+			entries[i].Instance,
+			entries[i].Service,
+			entries[i].Domain)
+	}
+
+	return err
+}
+
+// writeTextfile Atomically replaces the textfile in dir with every metric
+// and the services in the registry, node_exporter may read it at any time.
+func writeTextfile(dir string, registry *serviceRegistry) error {
+	var text bytes.Buffer
+	if err := metrics.writeText(&text); err != nil {
+		return err
+	}
+
+	if err := writeServicePresence(&text, registry.snapshot()); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, TEXTFILE_NAME)
+	// The collector skips files which don't end in .prom.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, text.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// runTextfile Rewrites the metrics textfile for node_exporter's textfile
+// collector every TextfileSeconds, for hosts where the metrics listener
+// can't be opened.
+func runTextfile(conf metricsConfig, registry *serviceRegistry) {
+	ticker := time.NewTicker(time.Duration(conf.TextfileSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		if err := writeTextfile(conf.TextfileDir, registry); err != nil {
+			slog.Error("failed to write metrics textfile",
+				"dir", conf.TextfileDir,
+				"err", err)
+		}
+
+		<-ticker.C
+	}
+}
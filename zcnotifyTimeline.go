@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// presenceInterval is a time during which a service instance was on the
+// network, according to the history.  Disappeared is nil while it still is.
+type presenceInterval struct {
+	Service     string     `json:"service"`
+	Domain      string     `json:"domain"`
+	Appeared    time.Time  `json:"appeared"`
+	Disappeared *time.Time `json:"disappeared,omitempty"`
+	// Seconds the service was present, until now if it still is.
+	DurationSeconds int64 `json:"durationSeconds"`
+}
+
+// presenceTimeline Returns when the services of instance appeared and
+// disappeared, oldest first, from the changes recorded in the history.  A
+// change other than a removal means the service was present, so one already
+// present when the history begins starts at its first change.  Like the
+// presence history, services are assumed to have stayed present while
+// zcnotify wasn't running.
+func presenceTimeline(changes []ServiceEntryChange,
+	instance string,
+	now time.Time) []presenceInterval {
+	var timeline []presenceInterval
+	open := make(map[string]int)
+	appear := func(service string, domain string, at time.Time) {
+		if _, ok := open[service+"."+domain]; ok {
+			return
+		}
+
+		open[service+"."+domain] = len(timeline)
+		timeline = append(timeline, presenceInterval{Service: service,
+			Domain:   domain,
+			Appeared: at})
+	}
+	disappear := func(service string, domain string, at time.Time) {
+		i, ok := open[service+"."+domain]
+		if !ok {
+			return
+		}
+
+		delete(open, service+"."+domain)
+		disappeared := at
+		timeline[i].Disappeared = &disappeared
+	}
+
+	for i := range changes {
+		change := &changes[i]
+		if change.ChangeType.ops() {
+			continue
+		}
+
+		entry := &change.Entry
+		switch {
+		case change.ChangeType == RENAMED:
+			if change.Previous != nil && strings.EqualFold(change.Previous.Instance, instance) {
+				disappear(change.Previous.Service, change.Previous.Domain, change.Timestamp)
+			}
+			if strings.EqualFold(entry.Instance, instance) {
+				appear(entry.Service, entry.Domain, change.Timestamp)
+			}
+			break
+		case !strings.EqualFold(entry.Instance, instance):
+			break
+		case change.ChangeType == REMOVE:
+			disappear(entry.Service, entry.Domain, change.Timestamp)
+			break
+		case change.ChangeType == MISSING:
+			break
+		default:
+			appear(entry.Service, entry.Domain, change.Timestamp)
+			break
+		}
+	}
+
+	for i := range timeline {
+		end := now
+		if timeline[i].Disappeared != nil {
+			end = *timeline[i].Disappeared
+		}
+		timeline[i].DurationSeconds = int64(end.Sub(timeline[i].Appeared).Seconds())
+	}
+
+	return timeline
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_TRACE_HISTORY uint = 100
+
+	TRACE_ACCEPTED   string = "accepted"
+	TRACE_SUPPRESSED string = "suppressed"
+	TRACE_DELIVERED  string = "delivered"
+	TRACE_FAILED     string = "failed"
+)
+
+// traceConfig enables recording of why each event was, or wasn't, notified.
+type traceConfig struct {
+	Enabled bool
+	// Number of recent event traces kept for the API.
+	History uint
+}
+
+// traceStep is a single decision taken while processing an event.
+type traceStep struct {
+	Time     time.Time `json:"time"`
+	Stage    string    `json:"stage"`
+	Backend  string    `json:"backend,omitempty"`
+	Decision string    `json:"decision"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// decisionTrace Records every decision taken for one event: which filters
+// matched, which backends were selected and why notifications were
+// suppressed.  It is shared by every copy of the event so delivery outcomes
+// from the backend queues end up in the same trace.  A nil trace records
+// nothing.
+type decisionTrace struct {
+	mutex sync.Mutex
+	steps []traceStep
+}
+
+// add Records a decision.
+func (dt *decisionTrace) add(stage string, backend string, decision string, reason string) {
+	if dt == nil {
+		return
+	}
+
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+
+	dt.steps = append(dt.steps, traceStep{Time: time.Now().UTC(),
+		Stage:    stage,
+		Backend:  backend,
+		Decision: decision,
+		Reason:   reason})
+}
+
+func (dt *decisionTrace) MarshalJSON() ([]byte, error) {
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+
+	if dt.steps == nil {
+		return []byte("[]"), nil
+	}
+
+	return json.Marshal(dt.steps)
+}
+
+// tracedEvent is an event summary along with its decision trace.
+type tracedEvent struct {
+	ID         string            `json:"id"`
+	ChangeType ServiceChangeType `json:"changeType"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Instance   string            `json:"instance"`
+	Service    string            `json:"service"`
+	Trace      *decisionTrace    `json:"trace"`
+}
+
+// traceStore Keeps the traces of the most recent events.
+type traceStore struct {
+	mutex  sync.Mutex
+	size   int
+	events []tracedEvent
+}
+
+func newTraceStore(size uint) *traceStore {
+	return &traceStore{size: int(size)}
+}
+
+// start Attaches a new trace to change and remembers it, if tracing is
+// disabled (a nil store) the change is left without a trace.
+func (ts *traceStore) start(change *ServiceEntryChange) {
+	if ts == nil {
+		return
+	}
+
+	change.Trace = &decisionTrace{}
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	ts.events = append(ts.events, tracedEvent{ID: change.ID,
+		ChangeType: change.ChangeType,
+		Timestamp:  change.Timestamp,
+		Instance:   change.Entry.Instance,
+		Service:    change.Entry.Service,
+		Trace:      change.Trace})
+	if len(ts.events) > ts.size {
+		ts.events = ts.events[len(ts.events)-ts.size:]
+	}
+}
+
+// recent Returns the remembered traces, newest first.
+func (ts *traceStore) recent() []tracedEvent {
+	events := []tracedEvent{}
+	if ts == nil {
+		return events
+	}
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	for i := len(ts.events) - 1; i >= 0; i-- {
+		events = append(events, ts.events[i])
+	}
+
+	return events
+}
+
+// find Returns the trace of the event with the given ID.
+func (ts *traceStore) find(id string) (tracedEvent, bool) {
+	if ts == nil {
+		return tracedEvent{}, false
+	}
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	for _, event := range ts.events {
+		if event.ID == id {
+			return event, true
+		}
+	}
+
+	return tracedEvent{}, false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// deviceTracker Recognizes the same device across instance name changes, so
+// that a rename is reported as RENAMED rather than an unrelated REMOVE and
+// ADD.  Devices are the same if they have the same host name, share an
+// address or, when the neighbour table is used, have the same MAC address.
+type deviceTracker struct {
+	neighbors bool
+}
+
+// newDeviceTracker Creates a tracker, MAC addresses are only compared if the
+// [enrich] stage reads the neighbour table.
+func newDeviceTracker(conf enrichConfig) *deviceTracker {
+	return &deviceTracker{neighbors: conf.Neighbors}
+}
+
+// entryIPs Returns every address of entry.
+func entryIPs(entry *zeroconf.ServiceEntry) []net.IP {
+	return append(append([]net.IP(nil), entry.AddrIPv4...), entry.AddrIPv6...)
+}
+
+// entryMAC Returns the MAC address of the first of the entry's addresses in
+// the neighbour table, or "".
+func entryMAC(entry *zeroconf.ServiceEntry, table map[string]neighbor) string {
+	for _, ip := range entryIPs(entry) {
+		if n, ok := table[ip.String()]; ok && n.mac != nil {
+			return n.mac.String()
+		}
+	}
+
+	return ""
+}
+
+// sameDevice Returns true if a and b describe the same device.
+func sameDevice(a *zeroconf.ServiceEntry,
+	b *zeroconf.ServiceEntry,
+	table map[string]neighbor) bool {
+	if a.HostName != "" && strings.EqualFold(a.HostName, b.HostName) {
+		return true
+	}
+
+	for _, aIP := range entryIPs(a) {
+		for _, bIP := range entryIPs(b) {
+			if aIP.Equal(bIP) {
+				return true
+			}
+		}
+	}
+
+	aMAC := entryMAC(a, table)
+	return aMAC != "" && aMAC == entryMAC(b, table)
+}
+
+// pairRenames Matches removed entries with added entries of the same device,
+// returning the index of the removed entry for each renamed added entry.
+func (dt *deviceTracker) pairRenames(removed []zeroconf.ServiceEntry,
+	added []zeroconf.ServiceEntry) map[int]int {
+	renames := make(map[int]int)
+	if len(removed) == 0 || len(added) == 0 {
+		return renames
+	}
+
+	var table map[string]neighbor
+	if dt != nil && dt.neighbors {
+		var addrs []string
+		for _, entries := range [][]zeroconf.ServiceEntry{removed, added} {
+			for i := range entries {
+				for _, ip := range entryIPs(&entries[i]) {
+					addrs = append(addrs, ip.String())
+				}
+			}
+		}
+		table = neighborCache.find(addrs)
+	}
+
+	paired := make(map[int]bool)
+	for a := range added {
+		for r := range removed {
+			if !paired[r] && sameDevice(&removed[r], &added[a], table) {
+				paired[r] = true
+				renames[a] = r
+				break
+			}
+		}
+	}
+
+	return renames
+}
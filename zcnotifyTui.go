@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/grandcat/zeroconf"
+	"github.com/rivo/tview"
+)
+
+// Number of lines kept in the terminal UI's event log.
+const TUI_LOG_LINES int = 500
+
+// tuiColumns are the columns of the terminal UI's service table, which can
+// be sorted by any of them.
+var tuiColumns = []string{"INSTANCE",
+	"SERVICE",
+	"HOST",
+	"ADDRESS",
+	"PORT",
+	"INTERFACE",
+	"LAST CHANGE",
+	"CHANGED"}
+
+// liveService is a row of the terminal UI's service table.
+type liveService struct {
+	entry      zeroconf.ServiceEntry
+	intf       string
+	changeType ServiceChangeType
+	changed    time.Time
+}
+
+// cells Returns the row's values, in the order of tuiColumns.
+func (ls *liveService) cells() []string {
+	address := ""
+	if len(ls.entry.AddrIPv4) != 0 {
+		address = ls.entry.AddrIPv4[0].String()
+	} else if len(ls.entry.AddrIPv6) != 0 {
+		address = ls.entry.AddrIPv6[0].String()
+	}
+
+	return []string{ls.entry.Instance,
+		ls.entry.Service,
+		ls.entry.HostName,
+		address,
+		strconv.Itoa(ls.entry.Port),
+		ls.intf,
+		ls.changeType.String(),
+		ls.changed.Local().Format(time.TimeOnly)}
+}
+
+// liveLine is a line of the terminal UI's event log, a change or a log
+// message.
+type liveLine struct {
+	change *ServiceEntryChange
+	text   string
+}
+
+// liveView is the state of the terminal UI: the services present, the recent
+// changes and how they're sorted and filtered.
+type liveView struct {
+	services map[string]*liveService
+	lines    []liveLine
+	// Index into tuiColumns of the column the table is sorted by.
+	sortColumn int
+	descending bool
+	// Only show the services and changes of this change type and
+	// interface, all if empty.
+	changeType string
+	intf       string
+}
+
+func newLiveView() *liveView {
+	return &liveView{services: make(map[string]*liveService)}
+}
+
+// apply Updates the services with a change and adds it to the log.
+func (lv *liveView) apply(change *ServiceEntryChange) {
+	switch change.ChangeType {
+	case REMOVE:
+		delete(lv.services, change.Entry.ServiceInstanceName())
+		break
+	default:
+		if change.ChangeType == RENAMED && change.Previous != nil {
+			delete(lv.services, change.Previous.ServiceInstanceName())
+		}
+		lv.services[change.Entry.ServiceInstanceName()] = &liveService{entry: change.Entry,
+			intf:       change.Interface,
+			changeType: change.ChangeType,
+			changed:    change.Timestamp}
+		break
+	}
+
+	lv.add(liveLine{change: change})
+}
+
+// add Appends a line to the log, dropping the oldest once it's full.
+func (lv *liveView) add(line liveLine) {
+	lv.lines = append(lv.lines, line)
+	if len(lv.lines) > TUI_LOG_LINES {
+		lv.lines = lv.lines[len(lv.lines)-TUI_LOG_LINES:]
+	}
+}
+
+// shows Returns true if a change of changeType on intf passes the filters.
+func (lv *liveView) shows(changeType ServiceChangeType, intf string) bool {
+	return (lv.changeType == "" || changeType.String() == lv.changeType) &&
+		(lv.intf == "" || intf == lv.intf)
+}
+
+// rows Returns the services which pass the filters, sorted.
+func (lv *liveView) rows() [][]string {
+	var rows [][]string
+	for _, ls := range lv.services {
+		if lv.shows(ls.changeType, ls.intf) {
+			rows = append(rows, ls.cells())
+		}
+	}
+
+	column := lv.sortColumn
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i][column], rows[j][column]
+		if tuiColumns[column] == "PORT" {
+			a, b = fmt.Sprintf("%05s", a), fmt.Sprintf("%05s", b)
+		}
+		if a == b {
+			return rows[i][0] < rows[j][0]
+		}
+		return (a < b) != lv.descending
+	})
+	return rows
+}
+
+// log Returns the text of the log lines which pass the filters.
+func (lv *liveView) log() string {
+	var text strings.Builder
+	for _, line := range lv.lines {
+		if line.change == nil {
+			text.WriteString(line.text)
+			continue
+		}
+
+		if lv.shows(line.change.ChangeType, line.change.Interface) {
+			fmt.Fprintf(&text, "%s  %-15s  %s.%s  %s\n",
+				line.change.Timestamp.Local().Format(time.TimeOnly),
+				line.change.ChangeType.String(),
+				line.change.Entry.Instance,
+				line.change.Entry.Service,
+				line.change.Interface)
+		}
+	}
+	return text.String()
+}
+
+// choices Returns the change types, or interfaces, of the changes in the
+// log, sorted, to cycle the filters through.
+func (lv *liveView) choices(intf bool) []string {
+	seen := make(map[string]bool)
+	for _, line := range lv.lines {
+		if line.change == nil {
+			continue
+		}
+
+		if intf {
+			seen[line.change.Interface] = true
+		} else {
+			seen[line.change.ChangeType.String()] = true
+		}
+	}
+	delete(seen, "")
+
+	var choices []string
+	for choice := range seen {
+		choices = append(choices, choice)
+	}
+	sort.Strings(choices)
+	return choices
+}
+
+// nextChoice Returns the choice after current, "" for all after the last.
+func nextChoice(choices []string, current string) string {
+	if current == "" {
+		if len(choices) == 0 {
+			return ""
+		}
+		return choices[0]
+	}
+
+	for i, choice := range choices {
+		if choice == current && i+1 < len(choices) {
+			return choices[i+1]
+		}
+	}
+	return ""
+}
+
+// status Returns the status line: the sort order, filters and key bindings.
+func (lv *liveView) status() string {
+	order := "ascending"
+	if lv.descending {
+		order = "descending"
+	}
+
+	all := func(filter string) string {
+		if filter == "" {
+			return "all"
+		}
+		return filter
+	}
+
+	return fmt.Sprintf(" %d services, sorted by %s %s, type: %s, interface: %s  |  s: sort  r: reverse  t: type  i: interface  c: clear  tab: focus  q: quit",
+		len(lv.services),
+		strings.ToLower(tuiColumns[lv.sortColumn]),
+		order,
+		all(lv.changeType),
+		all(lv.intf))
+}
+
+// tuiLogWriter Adds the log messages written while the terminal UI runs to
+// its event log, rather than to the terminal it's drawn on.
+type tuiLogWriter struct {
+	app  *tview.Application
+	view *liveView
+	draw func()
+}
+
+func (tw *tuiLogWriter) Write(p []byte) (int, error) {
+	text := string(p)
+	tw.app.QueueUpdateDraw(func() {
+		tw.view.add(liveLine{text: text})
+		tw.draw()
+	})
+	return len(p), nil
+}
+
+// runTUI Shows the changes published to updates in a terminal UI, a table of
+// the services present above a log of their changes, until it's quit.
+func runTUI(updates *eventBus, intfs []net.Interface) error {
+	app := tview.NewApplication()
+	lv := newLiveView()
+
+	table := tview.NewTable().
+		SetFixed(1, 0).
+		SetSelectable(true, false)
+	table.SetBorder(true).SetTitle(" services ")
+	events := tview.NewTextView().SetScrollable(true)
+	events.SetBorder(true).SetTitle(" events ")
+	status := tview.NewTextView()
+
+	draw := func() {
+		table.Clear()
+		for i, column := range tuiColumns {
+			if i == lv.sortColumn {
+				if lv.descending {
+					column += " v"
+				} else {
+					column += " ^"
+				}
+			}
+			table.SetCell(0, i, tview.NewTableCell(column).
+				SetTextColor(tcell.ColorYellow).
+				SetSelectable(false))
+		}
+
+		for r, row := range lv.rows() {
+			for c, value := range row {
+				table.SetCell(r+1, c, tview.NewTableCell(tview.Escape(value)).
+					SetExpansion(1))
+			}
+		}
+
+		events.SetText(tview.Escape(lv.log()))
+		events.ScrollToEnd()
+		status.SetText(lv.status())
+	}
+	draw()
+
+	layout := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(table, 0, 2, true).
+		AddItem(events, 0, 1, false).
+		AddItem(status, 1, 0, false)
+
+	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyTab:
+			if table.HasFocus() {
+				app.SetFocus(events)
+			} else {
+				app.SetFocus(table)
+			}
+			return nil
+		case tcell.KeyEscape:
+			app.Stop()
+			return nil
+		}
+
+		switch event.Rune() {
+		case 'q':
+			app.Stop()
+			return nil
+		case 's':
+			lv.sortColumn = (lv.sortColumn + 1) % len(tuiColumns)
+			break
+		case 'r':
+			lv.descending = !lv.descending
+			break
+		case 't':
+			lv.changeType = nextChoice(lv.choices(false), lv.changeType)
+			break
+		case 'i':
+			lv.intf = nextChoice(lv.choices(true), lv.intf)
+			break
+		case 'c':
+			lv.changeType = ""
+			lv.intf = ""
+			break
+		default:
+			return event
+		}
+
+		draw()
+		return nil
+	})
+
+	level := slog.LevelInfo
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		level = slog.LevelDebug
+	}
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&tuiLogWriter{app: app, view: lv, draw: draw},
+		&slog.HandlerOptions{Level: level})))
+	defer slog.SetDefault(logger)
+
+	quit := make(chan bool)
+	defer close(quit)
+	go func() {
+		for {
+			select {
+			case change := <-updates.events():
+				tagInterface(&change, intfs)
+				app.QueueUpdateDraw(func() {
+					lv.apply(&change)
+					draw()
+				})
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return app.SetRoot(layout, true).Run()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
+)
+
+const (
+	DEFAULT_RESOLV_CONF string = "/etc/resolv.conf"
+	dnsPort             string = "53"
+)
+
+// transientBrowseError is returned by browsers when a browse failed in a way
+// which may succeed later, e.g. the DNS server didn't answer.  The watcher
+// logs it and tries again next period rather than exiting.
+type transientBrowseError struct {
+	err error
+}
+
+func (tbe *transientBrowseError) Error() string {
+	return tbe.err.Error()
+}
+
+func (tbe *transientBrowseError) Unwrap() error {
+	return tbe.err
+}
+
+// unicastBrowser Browses wide-area DNS-SD domains (RFC 6763) by sending PTR,
+// SRV, TXT and address queries to a DNS server.
+type unicastBrowser struct {
+	server string
+	client *dns.Client
+}
+
+// newUnicastBrowser Creates a browser which queries server, or the system
+// nameserver if server is empty.
+func newUnicastBrowser(server string) (*unicastBrowser, error) {
+	if server == "" {
+		resolvConf, err := dns.ClientConfigFromFile(DEFAULT_RESOLV_CONF)
+		if err != nil {
+			return nil, fmt.Errorf("no unicast DNS server configured and %s unusable: %s",
+				DEFAULT_RESOLV_CONF, err.Error())
+		}
+
+		if len(resolvConf.Servers) == 0 {
+			return nil, fmt.Errorf("no unicast DNS server configured or in %s",
+				DEFAULT_RESOLV_CONF)
+		}
+
+		server = net.JoinHostPort(resolvConf.Servers[0], resolvConf.Port)
+	} else if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, dnsPort)
+	}
+
+	return &unicastBrowser{server: server, client: new(dns.Client)}, nil
+}
+
+// query Sends a single query, retrying over TCP if the answer was truncated.
+// A name which doesn't exist isn't an error, no records are returned.
+func (ub *unicastBrowser) query(ctx context.Context,
+	name string,
+	qtype uint16) ([]dns.RR, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+
+	resp, _, err := ub.client.ExchangeContext(ctx, msg, ub.server)
+	if err == nil && resp.Truncated {
+		tcpClient := &dns.Client{Net: "tcp"}
+		resp, _, err = tcpClient.ExchangeContext(ctx, msg, ub.server)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %s", name, dns.TypeToString[qtype],
+			err.Error())
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+		return resp.Answer, nil
+	case dns.RcodeNameError:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%s %s: %s", name, dns.TypeToString[qtype],
+			dns.RcodeToString[resp.Rcode])
+	}
+}
+
+// unescapeInstance Converts an instance label from DNS presentation format,
+// in which spaces and dots are escaped, to its plain form.
+func unescapeInstance(label string) string {
+	var sb strings.Builder
+	for i := 0; i < len(label); i++ {
+		if label[i] != '\\' || i+1 >= len(label) {
+			sb.WriteByte(label[i])
+			continue
+		}
+
+		if i+3 < len(label) {
+			if code, err := strconv.Atoi(label[i+1 : i+4]); err == nil && code < 256 {
+				sb.WriteByte(byte(code))
+				i += 3
+				continue
+			}
+		}
+
+		sb.WriteByte(label[i+1])
+		i++
+	}
+
+	return sb.String()
+}
+
+// escapeInstance Converts an instance name to a label in DNS presentation
+// format, the reverse of unescapeInstance.
+func escapeInstance(instance string) string {
+	var sb strings.Builder
+	for i := 0; i < len(instance); i++ {
+		switch c := instance[i]; {
+		case c == '.' || c == '\\' || c == ' ':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+			break
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&sb, "\\%03d", c)
+			break
+		default:
+			sb.WriteByte(c)
+			break
+		}
+	}
+
+	return sb.String()
+}
+
+// resolveInstance Completes the entry of a single instance from its SRV, TXT
+// and address records.
+func (ub *unicastBrowser) resolveInstance(ctx context.Context,
+	name string,
+	entry *zeroconf.ServiceEntry) error {
+	srvs, err := ub.query(ctx, name, dns.TypeSRV)
+	if err != nil {
+		return err
+	}
+
+	for _, rr := range srvs {
+		if srv, ok := rr.(*dns.SRV); ok {
+			entry.HostName = srv.Target
+			entry.Port = int(srv.Port)
+			break
+		}
+	}
+
+	txts, err := ub.query(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return err
+	}
+
+	for _, rr := range txts {
+		if txt, ok := rr.(*dns.TXT); ok {
+			entry.Text = append(entry.Text, txt.Txt...)
+		}
+	}
+
+	if entry.HostName == "" {
+		return nil
+	}
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		addrs, err := ub.query(ctx, entry.HostName, qtype)
+		if err != nil {
+			return err
+		}
+
+		for _, rr := range addrs {
+			switch addr := rr.(type) {
+			case *dns.A:
+				entry.AddrIPv4 = append(entry.AddrIPv4, addr.A)
+				break
+			case *dns.AAAA:
+				entry.AddrIPv6 = append(entry.AddrIPv6, addr.AAAA)
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// browse Implements browseFunc, the domain is queried once and the entries
+// channel closed when every instance has been resolved.  Record TTLs aren't
+// copied into the entries, a caching server counts them down which would
+// look like every instance changing on every browse.
+func (ub *unicastBrowser) browse(ctx context.Context,
+	service string,
+	domain string,
+	entries chan<- *zeroconf.ServiceEntry) error {
+	defer close(entries)
+
+	// A subtype's PTR records point at instances of its service type.
+	_, serviceType := splitSubtype(service)
+	suffix := "." + dns.Fqdn(serviceType+"."+domain)
+	ptrs, err := ub.query(ctx, service+"."+domain, dns.TypePTR)
+	if err != nil {
+		return &transientBrowseError{err}
+	}
+
+	for _, rr := range ptrs {
+		ptr, ok := rr.(*dns.PTR)
+		if !ok || len(ptr.Ptr) <= len(suffix) ||
+			!strings.EqualFold(ptr.Ptr[len(ptr.Ptr)-len(suffix):], suffix) {
+			continue
+		}
+
+		instance := unescapeInstance(ptr.Ptr[:len(ptr.Ptr)-len(suffix)])
+		entry := zeroconf.NewServiceEntry(instance, service, domain)
+		if err := ub.resolveInstance(ctx, ptr.Ptr, entry); err != nil {
+			return &transientBrowseError{err}
+		}
+
+		select {
+		case entries <- entry:
+			break
+		case <-ctx.Done():
+			return &transientBrowseError{ctx.Err()}
+		}
+	}
+
+	return nil
+}
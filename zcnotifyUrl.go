@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultUrlSchemes are the URL schemes of well-known service types.
+var defaultUrlSchemes = map[string]string{
+	"_http._tcp":       "http",
+	"_https._tcp":      "https",
+	"_webdav._tcp":     "http",
+	"_webdavs._tcp":    "https",
+	"_ipp._tcp":        "ipp",
+	"_ipps._tcp":       "ipps",
+	"_ssh._tcp":        "ssh",
+	"_sftp-ssh._tcp":   "sftp",
+	"_ftp._tcp":        "ftp",
+	"_smb._tcp":        "smb",
+	"_afpovertcp._tcp": "afp",
+	"_nfs._tcp":        "nfs",
+	"_rfb._tcp":        "vnc",
+	"_rdp._tcp":        "rdp",
+	"_telnet._tcp":     "telnet",
+}
+
+// validUrlScheme matches URL schemes (RFC 3986).
+var validUrlScheme = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]*$`)
+
+// urlsConfig controls the links to services added to events.
+type urlsConfig struct {
+	// Schemes adds to or replaces the built-in schemes of service types,
+	// e.g. "_octoprint._tcp" = "http", an empty scheme removes one.
+	Schemes map[string]string
+	// Link to the service's first address rather than its host name, for
+	// readers who can't resolve .local names.
+	UseAddress bool
+
+	// byService is the scheme of each service type, built-in and
+	// configured.
+	byService map[string]string
+}
+
+// setupUrls Checks the [urls] section and merges its schemes with the
+// built-in ones.
+func (zcnConfig *config) setupUrls() error {
+	uc := &zcnConfig.Urls
+	uc.byService = make(map[string]string, len(defaultUrlSchemes))
+	for service, scheme := range defaultUrlSchemes {
+		uc.byService[service] = scheme
+	}
+
+	for service, scheme := range uc.Schemes {
+		if err := validService(service); err != nil {
+			return fmt.Errorf("urls: %s", err.Error())
+		}
+
+		if scheme == "" {
+			delete(uc.byService, strings.ToLower(service))
+			continue
+		}
+
+		if !validUrlScheme.MatchString(scheme) {
+			return fmt.Errorf("urls: invalid scheme %q for %s", scheme, service)
+		}
+		uc.byService[strings.ToLower(service)] = strings.ToLower(scheme)
+	}
+
+	return nil
+}
+
+// url Returns the link to the service of change, empty if its type has no
+// scheme or it has gone.  The path is taken from the "path" TXT record
+// (RFC 6763), or "rp" for printers.
+func (uc *urlsConfig) url(change *ServiceEntryChange) string {
+	if change.ChangeType == REMOVE || change.ChangeType == MISSING {
+		return ""
+	}
+
+	// Subtypes have the scheme of their service type unless they have
+	// their own.
+	scheme := uc.byService[strings.ToLower(change.Entry.Service)]
+	if _, serviceType := splitSubtype(change.Entry.Service); scheme == "" {
+		scheme = uc.byService[strings.ToLower(serviceType)]
+	}
+	if scheme == "" {
+		return ""
+	}
+
+	link := url.URL{Scheme: scheme}
+	if uc.UseAddress {
+		if len(change.Connect) == 0 {
+			return ""
+		}
+		link.Host = change.Connect[0]
+	} else {
+		host := strings.TrimSuffix(change.Entry.HostName, ".")
+		if host == "" {
+			return ""
+		}
+		link.Host = net.JoinHostPort(host, strconv.Itoa(change.Entry.Port))
+	}
+
+	resourcePath := txtValue(&change.Entry, "path")
+	if resourcePath == "" && strings.HasPrefix(scheme, "ipp") {
+		resourcePath = txtValue(&change.Entry, "rp")
+	}
+
+	if resourcePath != "" {
+		link.Path = "/" + strings.TrimPrefix(resourcePath, "/")
+	} else if scheme == "http" || scheme == "https" {
+		link.Path = "/"
+	}
+
+	return link.String()
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// watchConfig describes a single [[watch]] block, a service type with its own
+// domains, scan period, instance filters and notification routes.  If no
+// blocks are configured the [zeroconf] service is watched.
+type watchConfig struct {
+	Service string
+	// Domains and ScanPeriodSeconds default to the global settings.
+	Domains           []string
+	ScanPeriodSeconds uint
+	// Glob patterns of the instance names to notify about, and to ignore.
+	Instances        []string
+	ExcludeInstances []string
+	// Backends which are notified, e.g. "email.pdmorrow", all if empty.
+	Notify []string
+}
+
+// browseTarget is a single service type browsed in a single domain, a
+// watcher is run for every target.
+type browseTarget struct {
+	Service           string
+	Domain            string
+	ScanPeriodSeconds uint
+}
+
+// unicast Returns true if the target is browsed with unicast DNS-SD rather
+// than multicast DNS.
+func (bt *browseTarget) unicast() bool {
+	return bt.Domain != DEFAULT_DOMAIN
+}
+
+// matches Returns true if entry was found by browsing the target.
+func (bt *browseTarget) matches(entry *zeroconf.ServiceEntry) bool {
+	return strings.EqualFold(entry.Service, bt.Service) &&
+		strings.EqualFold(strings.Trim(entry.Domain, "."), bt.Domain)
+}
+
+// validService Checks that service is a DNS-SD service type such as
+// "_workstation._tcp", or a subtype of one such as
+// "_printer._sub._http._tcp".
+func validService(service string) error {
+	subtype, serviceType := splitSubtype(service)
+	if !strings.HasPrefix(serviceType, "_") ||
+		!(strings.HasSuffix(serviceType, "._tcp") || strings.HasSuffix(serviceType, "._udp")) ||
+		strings.Count(serviceType, ".") != 1 {
+		return fmt.Errorf("invalid service type %q, expected _name._tcp, _name._udp or _subtype._sub._name._tcp",
+			service)
+	}
+
+	if strings.Contains(strings.ToLower(service), "._sub.") &&
+		(subtype == "" || strings.Contains(subtype, ".")) {
+		return fmt.Errorf("invalid subtype %q, expected _subtype._sub._name._tcp",
+			service)
+	}
+
+	return nil
+}
+
+// splitSubtype Splits a subtype such as "_printer._sub._http._tcp" into the
+// subtype and the service type it belongs to.  The subtype of a plain
+// service type is empty.
+func splitSubtype(service string) (string, string) {
+	if i := strings.Index(strings.ToLower(service), "._sub."); i != -1 {
+		return service[:i], service[i+len("._sub."):]
+	}
+
+	return "", service
+}
+
+// setupWatches Fills in the defaults of every [[watch]] block and validates
+// them, the [zeroconf] service is watched if there are no blocks.
+func (zcnConfig *config) setupWatches() error {
+	if len(zcnConfig.Watch) == 0 {
+		zcnConfig.Watch = []watchConfig{{Service: zcnConfig.Zeroconf.Service}}
+	}
+
+	backends, err := zcnConfig.backendNames()
+	if err != nil {
+		return err
+	}
+
+	for i := range zcnConfig.Watch {
+		watch := &zcnConfig.Watch[i]
+		if err := validService(watch.Service); err != nil {
+			return err
+		}
+
+		if len(watch.Domains) == 0 {
+			watch.Domains = zcnConfig.Zeroconf.Domains
+		} else if watch.Domains, err = normalizeDomains(watch.Domains); err != nil {
+			return fmt.Errorf("watch %s: %s", watch.Service, err.Error())
+		}
+
+		if watch.ScanPeriodSeconds == 0 {
+			watch.ScanPeriodSeconds = zcnConfig.ScanPeriodSeconds
+		}
+
+		for _, pattern := range append(watch.Instances, watch.ExcludeInstances...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("watch %s: instance pattern %q: %s",
+					watch.Service, pattern, err.Error())
+			}
+		}
+
+		for _, backend := range watch.Notify {
+			if !backends[backend] {
+				return fmt.Errorf("watch %s: unknown backend %q in Notify",
+					watch.Service, backend)
+			}
+		}
+	}
+
+	return nil
+}
+
+// browseTargets Returns every service/domain pair which should be browsed.
+// A pair watched by more than one block, e.g. by two profiles, is browsed
+// once with the shortest of their scan periods.
+func (zcnConfig *config) browseTargets() []browseTarget {
+	var targets []browseTarget
+	seen := make(map[string]int)
+	for _, watch := range zcnConfig.Watch {
+		for _, domain := range watch.Domains {
+			key := strings.ToLower(watch.Service) + "/" + domain
+			if i, ok := seen[key]; ok {
+				targets[i].ScanPeriodSeconds = min(targets[i].ScanPeriodSeconds,
+					watch.ScanPeriodSeconds)
+				continue
+			}
+
+			seen[key] = len(targets)
+			targets = append(targets, browseTarget{Service: watch.Service,
+				Domain:            domain,
+				ScanPeriodSeconds: watch.ScanPeriodSeconds})
+		}
+	}
+
+	return targets
+}
+
+// watchesFor Returns the [[watch]] blocks which found entry.
+func (zcnConfig *config) watchesFor(entry *zeroconf.ServiceEntry) []*watchConfig {
+	var watches []*watchConfig
+	for i := range zcnConfig.Watch {
+		watch := &zcnConfig.Watch[i]
+		for _, domain := range watch.Domains {
+			target := browseTarget{Service: watch.Service, Domain: domain}
+			if target.matches(entry) {
+				watches = append(watches, watch)
+				break
+			}
+		}
+	}
+
+	return watches
+}
+
+// matchInstance Returns true if instance matches any of the glob patterns,
+// ignoring case.
+func matchInstance(patterns []string, instance string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToLower(pattern),
+			strings.ToLower(instance)); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allows Returns true if the change should be delivered to backend, which
+// belongs to profile if it's one of a profile's, along with the reason for
+// the decision.
+func (wc *watchConfig) allows(change *ServiceEntryChange,
+	backend string,
+	profile string) (bool, string) {
+	if len(wc.Instances) != 0 && !matchInstance(wc.Instances, change.Entry.Instance) {
+		return false, "instance not in watch Instances"
+	}
+
+	if matchInstance(wc.ExcludeInstances, change.Entry.Instance) {
+		return false, "instance in watch ExcludeInstances"
+	}
+
+	if len(wc.Notify) == 0 {
+		if profile != "" {
+			return false, "backend belongs to profile " + profile
+		}
+		return true, "watch notifies every backend"
+	}
+
+	for _, name := range wc.Notify {
+		if name == backend {
+			return true, "backend in watch Notify"
+		}
+	}
+
+	return false, "backend not in watch Notify"
+}